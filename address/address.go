@@ -0,0 +1,384 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+// Package address derives human-readable addresses from public keys and
+// scripts and encodes them for a network.
+//
+// Two encodings are supported.  Base58Check addresses start with the version
+// byte of the network from the chain parameters and end with a four byte
+// checksum.  Bech32 addresses start with the human-readable part of the
+// network and carry a version and a program; version 0 programs use the
+// Bech32 checksum and later versions use Bech32m.  Decoding an address
+// requires the parameters of the expected network and rejects addresses of
+// any other network.
+package address
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/blockchainservice/address/base58"
+	"github.com/blockchainservice/address/bech32"
+	"github.com/blockchainservice/chaincfg"
+	"github.com/blockchainservice/crypto"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// Hash160Size is the size of the hash of a public key or script that
+// pay-to-pubkey-hash and pay-to-script-hash addresses commit to.
+const Hash160Size = ripemd160.Size
+
+var (
+	// ErrChecksumMismatch describes an error where decoding failed due
+	// to a bad checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrUnknownAddressType describes an error where an address can not
+	// decoded as a specific address type due to the string encoding
+	// begining with an identifier byte unknown to any standard or
+	// registered (via chaincfg.Register) network.
+	ErrUnknownAddressType = errors.New("unknown address type")
+
+	// ErrWrongNetwork describes an error where an address is well formed
+	// but belongs to a network other than the expected one.
+	ErrWrongNetwork = errors.New("address is for the wrong network")
+)
+
+// Hash160 calculates the hash ripemd160(sha256(b)).
+func Hash160(b []byte) []byte {
+	sha := sha256.Sum256(b)
+	h := ripemd160.New()
+	h.Write(sha[:])
+	return h.Sum(nil)
+}
+
+// Address is an interface type for any type of destination a transaction
+// output may spend to.
+type Address interface {
+	// String returns the string encoding of the address.  It is the same
+	// as EncodeAddress.
+	String() string
+
+	// EncodeAddress returns the string encoding of the address.
+	EncodeAddress() string
+
+	// ScriptAddress returns the raw bytes of the address to be used when
+	// inserting the address into a txout's script.
+	ScriptAddress() []byte
+
+	// IsForNet returns whether or not the address is associated with the
+	// passed network.
+	IsForNet(*chaincfg.Params) bool
+}
+
+// DecodeAddress decodes the string encoding of an address and returns the
+// Address if addr is a valid encoding for a known address type of the passed
+// network.  Addresses of other networks are rejected with ErrWrongNetwork.
+func DecodeAddress(addr string, params *chaincfg.Params) (Address, error) {
+	// Bech32 encoded addresses start with the human-readable part of
+	// their network, which never contains the separator character.
+	if sep := strings.LastIndexByte(addr, '1'); sep > 0 {
+		hrp := strings.ToLower(addr[:sep])
+		if hrp == params.Bech32HRP {
+			return decodeBech32(addr, params)
+		}
+		if chaincfg.IsBech32HRP(hrp) {
+			return nil, ErrWrongNetwork
+		}
+	}
+
+	decoded, netID, err := base58.CheckDecode(addr)
+	if err != nil {
+		if err == base58.ErrChecksum {
+			return nil, ErrChecksumMismatch
+		}
+		return nil, errors.New("decoded address is of unknown format")
+	}
+	if len(decoded) != Hash160Size {
+		return nil, errors.New("decoded address is of unknown size")
+	}
+
+	switch netID {
+	case params.PubKeyHashAddrID:
+		return newAddressPubKeyHash(decoded, netID)
+	case params.ScriptHashAddrID:
+		return newAddressScriptHash(decoded, netID)
+	}
+	if chaincfg.IsPubKeyHashAddrID(netID) || chaincfg.IsScriptHashAddrID(netID) {
+		return nil, ErrWrongNetwork
+	}
+	return nil, ErrUnknownAddressType
+}
+
+// AddressPubKeyHash is an Address for a pay-to-pubkey-hash transaction.  The
+// hash commits to the type prefixed public key, so the address also fixes the
+// signature scheme of the key.
+type AddressPubKeyHash struct {
+	hash  [Hash160Size]byte
+	netID byte
+}
+
+// NewAddressPubKeyHash returns a new AddressPubKeyHash.  pkHash must be 20
+// bytes.
+func NewAddressPubKeyHash(pkHash []byte, params *chaincfg.Params) (*AddressPubKeyHash, error) {
+	return newAddressPubKeyHash(pkHash, params.PubKeyHashAddrID)
+}
+
+// NewAddressPubKeyHashFromPubKey returns the AddressPubKeyHash of the passed
+// public key.
+func NewAddressPubKeyHashFromPubKey(pubKey crypto.PublicKey, params *chaincfg.Params) *AddressPubKeyHash {
+	addr, _ := newAddressPubKeyHash(PubKeyHash(pubKey), params.PubKeyHashAddrID)
+	return addr
+}
+
+// PubKeyHash returns the hash a pay-to-pubkey-hash address of the public key
+// commits to.
+func PubKeyHash(pubKey crypto.PublicKey) []byte {
+	return Hash160(crypto.EncodePublicKey(pubKey))
+}
+
+// newAddressPubKeyHash is the internal API to create a pubkey hash address
+// with a known leading identifier byte for a network, rather than looking
+// it up through its parameters.
+func newAddressPubKeyHash(pkHash []byte, netID byte) (*AddressPubKeyHash, error) {
+	// Check for a valid pubkey hash length.
+	if len(pkHash) != Hash160Size {
+		return nil, errors.New("pkHash must be 20 bytes")
+	}
+
+	addr := &AddressPubKeyHash{netID: netID}
+	copy(addr.hash[:], pkHash)
+	return addr, nil
+}
+
+// EncodeAddress returns the string encoding of a pay-to-pubkey-hash
+// address.  Part of the Address interface.
+func (a *AddressPubKeyHash) EncodeAddress() string {
+	return base58.CheckEncode(a.hash[:], a.netID)
+}
+
+// ScriptAddress returns the bytes to be included in a txout script to pay
+// to a pubkey hash.  Part of the Address interface.
+func (a *AddressPubKeyHash) ScriptAddress() []byte {
+	return a.hash[:]
+}
+
+// IsForNet returns whether or not the pay-to-pubkey-hash address is associated
+// with the passed network.
+func (a *AddressPubKeyHash) IsForNet(params *chaincfg.Params) bool {
+	return a.netID == params.PubKeyHashAddrID
+}
+
+// String returns a human-readable string for the pay-to-pubkey-hash address.
+// This is equivalent to calling EncodeAddress, but is provided so the type can
+// be used as a fmt.Stringer.
+func (a *AddressPubKeyHash) String() string {
+	return a.EncodeAddress()
+}
+
+// Hash160 returns the underlying array of the pubkey hash.  This can be useful
+// when an array is more appropiate than a slice (for example, when used as map
+// keys).
+func (a *AddressPubKeyHash) Hash160() *[Hash160Size]byte {
+	return &a.hash
+}
+
+// AddressScriptHash is an Address for a pay-to-script-hash transaction.
+type AddressScriptHash struct {
+	hash  [Hash160Size]byte
+	netID byte
+}
+
+// NewAddressScriptHash returns a new AddressScriptHash for the passed script.
+func NewAddressScriptHash(serializedScript []byte, params *chaincfg.Params) *AddressScriptHash {
+	addr, _ := newAddressScriptHash(Hash160(serializedScript),
+		params.ScriptHashAddrID)
+	return addr
+}
+
+// NewAddressScriptHashFromHash returns a new AddressScriptHash.  scriptHash
+// must be 20 bytes.
+func NewAddressScriptHashFromHash(scriptHash []byte, params *chaincfg.Params) (*AddressScriptHash, error) {
+	return newAddressScriptHash(scriptHash, params.ScriptHashAddrID)
+}
+
+// newAddressScriptHash is the internal API to create a script hash address
+// with a known leading identifier byte for a network, rather than looking
+// it up through its parameters.
+func newAddressScriptHash(scriptHash []byte, netID byte) (*AddressScriptHash, error) {
+	// Check for a valid script hash length.
+	if len(scriptHash) != Hash160Size {
+		return nil, errors.New("scriptHash must be 20 bytes")
+	}
+
+	addr := &AddressScriptHash{netID: netID}
+	copy(addr.hash[:], scriptHash)
+	return addr, nil
+}
+
+// EncodeAddress returns the string encoding of a pay-to-script-hash
+// address.  Part of the Address interface.
+func (a *AddressScriptHash) EncodeAddress() string {
+	return base58.CheckEncode(a.hash[:], a.netID)
+}
+
+// ScriptAddress returns the bytes to be included in a txout script to pay
+// to a script hash.  Part of the Address interface.
+func (a *AddressScriptHash) ScriptAddress() []byte {
+	return a.hash[:]
+}
+
+// IsForNet returns whether or not the pay-to-script-hash address is associated
+// with the passed network.
+func (a *AddressScriptHash) IsForNet(params *chaincfg.Params) bool {
+	return a.netID == params.ScriptHashAddrID
+}
+
+// String returns a human-readable string for the pay-to-script-hash address.
+// This is equivalent to calling EncodeAddress, but is provided so the type can
+// be used as a fmt.Stringer.
+func (a *AddressScriptHash) String() string {
+	return a.EncodeAddress()
+}
+
+// Hash160 returns the underlying array of the script hash.  This can be useful
+// when an array is more appropiate than a slice (for example, when used as map
+// keys).
+func (a *AddressScriptHash) Hash160() *[Hash160Size]byte {
+	return &a.hash
+}
+
+// AddressBech32 is a Bech32 encoded address made of a version and a program.
+// Version 0 programs are either the 20 byte hash of a public key or the 32
+// byte sha256 of a script, later versions are reserved for future address
+// types and only have their length checked.
+type AddressBech32 struct {
+	hrp     string
+	version byte
+	program []byte
+}
+
+// NewAddressBech32PubKeyHash returns the version 0 Bech32 address of the
+// passed public key.
+func NewAddressBech32PubKeyHash(pubKey crypto.PublicKey, params *chaincfg.Params) *AddressBech32 {
+	addr, _ := NewAddressBech32(0, PubKeyHash(pubKey), params)
+	return addr
+}
+
+// NewAddressBech32ScriptHash returns the version 0 Bech32 address of the
+// passed script.
+func NewAddressBech32ScriptHash(serializedScript []byte, params *chaincfg.Params) *AddressBech32 {
+	hash := sha256.Sum256(serializedScript)
+	addr, _ := NewAddressBech32(0, hash[:], params)
+	return addr
+}
+
+// NewAddressBech32 returns a new AddressBech32 for the given version and
+// program.
+func NewAddressBech32(version byte, program []byte, params *chaincfg.Params) (*AddressBech32, error) {
+	if err := checkProgram(version, program); err != nil {
+		return nil, err
+	}
+	return &AddressBech32{
+		hrp:     params.Bech32HRP,
+		version: version,
+		program: append([]byte{}, program...),
+	}, nil
+}
+
+// checkProgram returns an error when the program length is not valid for the
+// version.
+func checkProgram(version byte, program []byte) error {
+	if version > 16 {
+		return fmt.Errorf("invalid address version %d", version)
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return fmt.Errorf("invalid address program length %d",
+			len(program))
+	}
+	if version == 0 && len(program) != Hash160Size && len(program) != 32 {
+		return fmt.Errorf("invalid version 0 address program length %d",
+			len(program))
+	}
+	return nil
+}
+
+// decodeBech32 decodes a Bech32 address whose human-readable part is the one
+// of the passed network.
+func decodeBech32(addr string, params *chaincfg.Params) (*AddressBech32, error) {
+	hrp, data, encoding, err := bech32.Decode(addr)
+	if err != nil {
+		return nil, err
+	}
+	if hrp != params.Bech32HRP {
+		return nil, ErrWrongNetwork
+	}
+	if len(data) < 1 {
+		return nil, errors.New("no address version")
+	}
+
+	// Version 0 addresses must use Bech32 and later versions Bech32m, the
+	// other combinations are rejected so mistyped addresses are caught.
+	version := data[0]
+	if (version == 0) != (encoding == bech32.Version0) {
+		return nil, fmt.Errorf("invalid checksum variant for address "+
+			"version %d", version)
+	}
+
+	program, err := bech32.ConvertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProgram(version, program); err != nil {
+		return nil, err
+	}
+	return &AddressBech32{hrp: hrp, version: version, program: program}, nil
+}
+
+// EncodeAddress returns the Bech32 string encoding of the address.  Part of
+// the Address interface.
+func (a *AddressBech32) EncodeAddress() string {
+	converted, err := bech32.ConvertBits(a.program, 8, 5, true)
+	if err != nil {
+		return ""
+	}
+	data := append([]byte{a.version}, converted...)
+
+	var str string
+	if a.version == 0 {
+		str, err = bech32.Encode(a.hrp, data)
+	} else {
+		str, err = bech32.EncodeM(a.hrp, data)
+	}
+	if err != nil {
+		return ""
+	}
+	return str
+}
+
+// ScriptAddress returns the program of the address.  Part of the Address
+// interface.
+func (a *AddressBech32) ScriptAddress() []byte {
+	return append([]byte{}, a.program...)
+}
+
+// IsForNet returns whether or not the address is associated with the passed
+// network.
+func (a *AddressBech32) IsForNet(params *chaincfg.Params) bool {
+	return a.hrp == params.Bech32HRP
+}
+
+// String returns a human-readable string for the address.  This is
+// equivalent to calling EncodeAddress, but is provided so the type can be
+// used as a fmt.Stringer.
+func (a *AddressBech32) String() string {
+	return a.EncodeAddress()
+}
+
+// Version returns the version of the address.
+func (a *AddressBech32) Version() byte {
+	return a.version
+}
@@ -0,0 +1,234 @@
+package address_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/blockchainservice/address"
+	"github.com/blockchainservice/chaincfg"
+	"github.com/blockchainservice/crypto"
+)
+
+// bip173MainNet and bip173TestNet are networks using the human-readable parts
+// and address version bytes of the bitcoin main and test networks so the
+// BIP173 and BIP350 test vectors can be decoded.
+var (
+	bip173MainNet = chaincfg.Params{
+		Name:             "bip173-main",
+		Net:              0xfeedbeef,
+		Bech32HRP:        "bc",
+		PubKeyHashAddrID: 0x00,
+		ScriptHashAddrID: 0x05,
+	}
+	bip173TestNet = chaincfg.Params{
+		Name:             "bip173-test",
+		Net:              0xfeedbef0,
+		Bech32HRP:        "tb",
+		PubKeyHashAddrID: 0x6f,
+		ScriptHashAddrID: 0xc4,
+	}
+)
+
+func init() {
+	for _, params := range []*chaincfg.Params{&bip173MainNet, &bip173TestNet} {
+		if err := chaincfg.Register(params); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// decodeHex decodes the passed hex string and panics on failure.  It is only
+// used with hard-coded values.
+func decodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic("invalid hex in source file: " + s)
+	}
+	return b
+}
+
+// TestBech32Addresses ensures the valid addresses of the BIP350 test vectors
+// decode to their version and program and encode back, and the invalid ones
+// are rejected.
+func TestBech32Addresses(t *testing.T) {
+	valid := []struct {
+		addr   string
+		params *chaincfg.Params
+		script string // witness output script of the address
+	}{
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", &bip173MainNet,
+			"0014751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", &bip173TestNet,
+			"00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262"},
+		{"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y", &bip173MainNet,
+			"5128751e76e8199196d454941c45d1b3a323f1433bd6751e76e8199196d454941c45d1b3a323f1433bd6"},
+		{"BC1SW50QGDZ25J", &bip173MainNet, "6002751e"},
+		{"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs", &bip173MainNet,
+			"5210751e76e8199196d454941c45d1b3a323"},
+		{"tb1qqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesrxh6hy", &bip173TestNet,
+			"0020000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c", &bip173TestNet,
+			"5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", &bip173MainNet,
+			"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"},
+	}
+	for _, test := range valid {
+		addr, err := address.DecodeAddress(test.addr, test.params)
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		bech32Addr, ok := addr.(*address.AddressBech32)
+		if !ok {
+			t.Errorf("%s: decoded as %T", test.addr, addr)
+			continue
+		}
+
+		// The script starts with the version opcode, OP_0 or OP_1 to
+		// OP_16, followed by the push of the program.
+		script := decodeHex(test.script)
+		version := script[0]
+		if version != 0 {
+			version -= 0x50
+		}
+		if bech32Addr.Version() != version {
+			t.Errorf("%s: version %d, want %d", test.addr,
+				bech32Addr.Version(), version)
+		}
+		if !bytes.Equal(addr.ScriptAddress(), script[2:]) {
+			t.Errorf("%s: program %x, want %x", test.addr,
+				addr.ScriptAddress(), script[2:])
+		}
+		if !addr.IsForNet(test.params) {
+			t.Errorf("%s: not for network %s", test.addr,
+				test.params.Name)
+		}
+		if got := addr.EncodeAddress(); got != strings.ToLower(test.addr) {
+			t.Errorf("%s: encoded as %s", test.addr, got)
+		}
+	}
+
+	invalid := []struct {
+		addr   string
+		reason string
+	}{
+		{"tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut", "unknown human-readable part"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", "Bech32 checksum of a version 1 address"},
+		{"tb1z0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqglt7rf", "Bech32 checksum of a version 2 address"},
+		{"BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL", "Bech32 checksum of a version 16 address"},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh", "Bech32m checksum of a version 0 address"},
+		{"tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq24jc47", "Bech32m checksum of a version 0 address"},
+		{"bc1p38j9r5y49hruaue7wxjce0updqjuyyx0kh56v8s25huc6995vvpql3jow4", "invalid data character"},
+		{"BC130XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ7ZWS8R", "invalid version"},
+		{"bc1pw5dgrnzv", "program of 1 byte"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v8n0nx0muaewav253zgeav", "program of 41 bytes"},
+		{"BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P", "version 0 program of 16 bytes"},
+		{"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47Zagq", "mixed case"},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v07qwwzcrf", "more than 4 padding bits"},
+		{"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vpggkg4j", "non-zero padding"},
+		{"bc1gmk9yu", "empty data"},
+	}
+	for _, test := range invalid {
+		params := &bip173MainNet
+		if strings.HasPrefix(strings.ToLower(test.addr), "tb") {
+			params = &bip173TestNet
+		}
+		if addr, err := address.DecodeAddress(test.addr, params); err == nil {
+			t.Errorf("%s: %s decoded as %v", test.addr, test.reason, addr)
+		}
+	}
+}
+
+// TestAddressWrongNetwork ensures the addresses of every type encoded for a
+// network decode on that network alone and are rejected with ErrWrongNetwork
+// on the others.
+func TestAddressWrongNetwork(t *testing.T) {
+	privKey, err := crypto.ParsePrivateKey(crypto.KeyTypeSecp256k1, decodeHex(
+		"0000000000000000000000000000000000000000000000000000000000000001"))
+	if err != nil {
+		t.Fatalf("ParsePrivateKey: %v", err)
+	}
+	pubKey := privKey.PubKey()
+	script := []byte{0x51}
+
+	networks := []*chaincfg.Params{
+		&chaincfg.MainNetParams,
+		&chaincfg.TestNetParams,
+		&chaincfg.RegressionNetParams,
+		&chaincfg.SimNetParams,
+	}
+	for _, params := range networks {
+		addrs := []address.Address{
+			address.NewAddressPubKeyHashFromPubKey(pubKey, params),
+			address.NewAddressScriptHash(script, params),
+			address.NewAddressBech32PubKeyHash(pubKey, params),
+			address.NewAddressBech32ScriptHash(script, params),
+		}
+		for _, addr := range addrs {
+			encoded := addr.EncodeAddress()
+			for _, other := range networks {
+				decoded, err := address.DecodeAddress(encoded, other)
+				if other == params {
+					if err != nil {
+						t.Errorf("%s on %s: %v", encoded,
+							other.Name, err)
+					} else if decoded.EncodeAddress() != encoded ||
+						!bytes.Equal(decoded.ScriptAddress(),
+							addr.ScriptAddress()) {
+
+						t.Errorf("%s on %s: decoded as %v",
+							encoded, other.Name, decoded)
+					}
+					continue
+				}
+				if err != address.ErrWrongNetwork {
+					t.Errorf("%s of %s on %s: got error %v, want "+
+						"%v", encoded, params.Name, other.Name,
+						err, address.ErrWrongNetwork)
+				}
+			}
+		}
+	}
+}
+
+// TestBase58Addresses ensures Base58Check addresses decode to their hash and
+// are rejected when a character is modified.
+func TestBase58Addresses(t *testing.T) {
+	tests := []struct {
+		addr   string
+		hash   string
+		script bool
+	}{
+		{"1MirQ9bwyQcGVJPwKUgapu5ouK2E2Ey4gX",
+			"e34cce70c86373273efcc54ce7d2a491bb4a0e84", false},
+		{"3QJmV3qfvL9SuYo34YihAf3sRCW3qSinyC",
+			"f815b036d9bbbce5e9f2a00abd1bf3dc91e95510", true},
+	}
+	for _, test := range tests {
+		addr, err := address.DecodeAddress(test.addr, &bip173MainNet)
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		_, isScript := addr.(*address.AddressScriptHash)
+		if isScript != test.script {
+			t.Errorf("%s: decoded as %T", test.addr, addr)
+		}
+		if hash := decodeHex(test.hash); !bytes.Equal(addr.ScriptAddress(), hash) {
+			t.Errorf("%s: hash %x, want %x", test.addr,
+				addr.ScriptAddress(), hash)
+		}
+		if got := addr.EncodeAddress(); got != test.addr {
+			t.Errorf("%s: encoded as %s", test.addr, got)
+		}
+
+		modified := "2" + test.addr[1:]
+		_, err = address.DecodeAddress(modified, &bip173MainNet)
+		if err != address.ErrChecksumMismatch {
+			t.Errorf("%s: got error %v, want %v", modified, err,
+				address.ErrChecksumMismatch)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+// Package base58 implements the base58 encoding used for human-readable
+// addresses, along with the Base58Check variant that appends a checksum.
+package base58
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// alphabet is the modified base58 alphabet which omits the characters that
+// are easily confused with one another: 0, O, I and l.
+const alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// alphabetIdx0 is the character that encodes a leading zero byte.
+const alphabetIdx0 = '1'
+
+// b58 maps each ASCII character to its value in the alphabet, or 255 when
+// the character is not part of it.
+var b58 = func() [256]byte {
+	var table [256]byte
+	for i := range table {
+		table[i] = 255
+	}
+	for i := 0; i < len(alphabet); i++ {
+		table[alphabet[i]] = byte(i)
+	}
+	return table
+}()
+
+// Encode encodes a byte slice to a modified base58 string.
+func Encode(b []byte) string {
+	// Each leading zero byte is encoded as a single leading '1'.
+	zeros := 0
+	for zeros < len(b) && b[zeros] == 0 {
+		zeros++
+	}
+
+	// Convert the remaining bytes from base256 to base58.  log(256) /
+	// log(58) is approximately 1.37, so the result is at most 138% of the
+	// input size.
+	size := (len(b)-zeros)*138/100 + 1
+	buf := make([]byte, size)
+	high := size - 1
+	for _, c := range b[zeros:] {
+		carry := uint32(c)
+		j := size - 1
+		for ; j > high || carry != 0; j-- {
+			carry += 256 * uint32(buf[j])
+			buf[j] = byte(carry % 58)
+			carry /= 58
+		}
+		high = j
+	}
+
+	// Skip the leading zeroes of the base58 number.
+	start := 0
+	for start < size && buf[start] == 0 {
+		start++
+	}
+
+	result := make([]byte, zeros+size-start)
+	for i := 0; i < zeros; i++ {
+		result[i] = alphabetIdx0
+	}
+	for i, v := range buf[start:] {
+		result[zeros+i] = alphabet[v]
+	}
+	return string(result)
+}
+
+// Decode decodes a modified base58 string to a byte slice.  An empty slice is
+// returned when the string holds characters outside of the alphabet.
+func Decode(s string) []byte {
+	zeros := 0
+	for zeros < len(s) && s[zeros] == alphabetIdx0 {
+		zeros++
+	}
+
+	// Convert the remaining characters from base58 to base256.  log(58) /
+	// log(256) is approximately 0.733, so the result is at most 74% of the
+	// input size.
+	size := (len(s)-zeros)*733/1000 + 1
+	buf := make([]byte, size)
+	high := size - 1
+	for i := zeros; i < len(s); i++ {
+		carry := uint32(b58[s[i]])
+		if carry == 255 {
+			return []byte("")
+		}
+		j := size - 1
+		for ; j > high || carry != 0; j-- {
+			carry += 58 * uint32(buf[j])
+			buf[j] = byte(carry)
+			carry >>= 8
+		}
+		high = j
+	}
+
+	start := 0
+	for start < size && buf[start] == 0 {
+		start++
+	}
+
+	result := make([]byte, zeros+size-start)
+	copy(result[zeros:], buf[start:])
+	return result
+}
+
+// ErrChecksum indicates that the checksum of a check-encoded string does not
+// verify against the checksum.
+var ErrChecksum = errors.New("checksum error")
+
+// ErrInvalidFormat indicates that the check-encoded string has an invalid
+// format.
+var ErrInvalidFormat = errors.New("invalid format: version and/or checksum bytes missing")
+
+// checksum returns the first four bytes of the double sha256 of input.
+func checksum(input []byte) (cksum [4]byte) {
+	h := sha256.Sum256(input)
+	h2 := sha256.Sum256(h[:])
+	copy(cksum[:], h2[:4])
+	return
+}
+
+// CheckEncode prepends a version byte and appends a four byte checksum.
+func CheckEncode(input []byte, version byte) string {
+	b := make([]byte, 0, 1+len(input)+4)
+	b = append(b, version)
+	b = append(b, input...)
+	cksum := checksum(b)
+	b = append(b, cksum[:]...)
+	return Encode(b)
+}
+
+// CheckDecode decodes a string that was encoded with CheckEncode and verifies
+// the checksum.
+func CheckDecode(input string) (result []byte, version byte, err error) {
+	decoded := Decode(input)
+	if len(decoded) < 5 {
+		return nil, 0, ErrInvalidFormat
+	}
+	version = decoded[0]
+	var cksum [4]byte
+	copy(cksum[:], decoded[len(decoded)-4:])
+	if checksum(decoded[:len(decoded)-4]) != cksum {
+		return nil, 0, ErrChecksum
+	}
+	payload := decoded[1 : len(decoded)-4]
+	result = append(result, payload...)
+	return
+}
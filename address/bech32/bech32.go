@@ -0,0 +1,226 @@
+// Copyright (c) 2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+// Package bech32 implements the Bech32 encoding of BIP173 and its Bech32m
+// variant of BIP350.  Both encode 5-bit groups behind a human-readable part
+// and protect them with a BCH checksum; they only differ in the constant the
+// checksum is xored with.
+package bech32
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// charset is the set of characters used in the data section of bech32
+// strings.  Its index in the string is the 5-bit value of the character.
+const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// gen holds the generator polynomial coefficients of the checksum.
+var gen = [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+// MaxLength is the maximum length of a bech32 string.
+const MaxLength = 90
+
+// checksumLength is the number of 5-bit groups of the checksum.
+const checksumLength = 6
+
+// Version identifies the checksum constant of a bech32 string.
+type Version uint8
+
+// These constants define the bech32 variants.
+const (
+	// Version0 is the original Bech32 checksum of BIP173.
+	Version0 Version = iota
+
+	// VersionM is the Bech32m checksum of BIP350.
+	VersionM
+)
+
+// checksumConstants maps each variant to the constant its checksum is xored
+// with.
+var checksumConstants = map[Version]uint32{
+	Version0: 1,
+	VersionM: 0x2bc830a3,
+}
+
+// ErrMixedCase is returned when a string mixes upper and lower case
+// characters.
+var ErrMixedCase = errors.New("string not all lowercase or all uppercase")
+
+// polymod computes the BCH checksum over the expanded human-readable part
+// and the data values.
+func polymod(values []byte) uint32 {
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// hrpExpand expands the human-readable part into the values fed to polymod.
+func hrpExpand(hrp string) []byte {
+	v := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]>>5)
+	}
+	v = append(v, 0)
+	for i := 0; i < len(hrp); i++ {
+		v = append(v, hrp[i]&31)
+	}
+	return v
+}
+
+// createChecksum returns the checksum of hrp and data for the variant.
+func createChecksum(hrp string, data []byte, version Version) []byte {
+	values := append(hrpExpand(hrp), data...)
+	values = append(values, make([]byte, checksumLength)...)
+	mod := polymod(values) ^ checksumConstants[version]
+	res := make([]byte, checksumLength)
+	for i := range res {
+		res[i] = byte((mod >> uint(5*(5-i))) & 31)
+	}
+	return res
+}
+
+// verifyChecksum returns the variant whose checksum matches hrp and data.
+func verifyChecksum(hrp string, data []byte) (Version, bool) {
+	mod := polymod(append(hrpExpand(hrp), data...))
+	for version, constant := range checksumConstants {
+		if mod == constant {
+			return version, true
+		}
+	}
+	return 0, false
+}
+
+// encode encodes 5-bit groups with the checksum of the given variant.
+func encode(hrp string, data []byte, version Version) (string, error) {
+	if len(hrp)+1+len(data)+checksumLength > MaxLength {
+		return "", fmt.Errorf("bech32 string exceeds %d characters",
+			MaxLength)
+	}
+	if len(hrp) == 0 {
+		return "", errors.New("empty human-readable part")
+	}
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", fmt.Errorf("invalid character in "+
+				"human-readable part: %q", hrp[i])
+		}
+	}
+	if strings.ToLower(hrp) != hrp && strings.ToUpper(hrp) != hrp {
+		return "", ErrMixedCase
+	}
+	hrp = strings.ToLower(hrp)
+
+	var sb strings.Builder
+	sb.Grow(len(hrp) + 1 + len(data) + checksumLength)
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, b := range append(data, createChecksum(hrp, data, version)...) {
+		if b >= 32 {
+			return "", fmt.Errorf("invalid data byte: %v", b)
+		}
+		sb.WriteByte(charset[b])
+	}
+	return sb.String(), nil
+}
+
+// Encode encodes the human-readable part and the 5-bit groups of data into
+// a Bech32 string.
+func Encode(hrp string, data []byte) (string, error) {
+	return encode(hrp, data, Version0)
+}
+
+// EncodeM encodes the human-readable part and the 5-bit groups of data into
+// a Bech32m string.
+func EncodeM(hrp string, data []byte) (string, error) {
+	return encode(hrp, data, VersionM)
+}
+
+// Decode decodes a Bech32 or Bech32m string into its lowercase
+// human-readable part and 5-bit groups of data, and reports which checksum
+// variant it was encoded with.
+func Decode(s string) (string, []byte, Version, error) {
+	if len(s) > MaxLength {
+		return "", nil, 0, fmt.Errorf("bech32 string exceeds %d "+
+			"characters", MaxLength)
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, 0, ErrMixedCase
+	}
+	s = strings.ToLower(s)
+
+	// The separator is the last '1' of the string since the
+	// human-readable part may contain it as well.
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+checksumLength+1 > len(s) {
+		return "", nil, 0, errors.New("invalid separator position")
+	}
+	hrp := s[:sep]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, 0, fmt.Errorf("invalid character in "+
+				"human-readable part: %q", hrp[i])
+		}
+	}
+
+	data := make([]byte, 0, len(s)-sep-1)
+	for i := sep + 1; i < len(s); i++ {
+		idx := strings.IndexByte(charset, s[i])
+		if idx < 0 {
+			return "", nil, 0, fmt.Errorf("invalid character in data "+
+				"part: %q", s[i])
+		}
+		data = append(data, byte(idx))
+	}
+
+	version, ok := verifyChecksum(hrp, data)
+	if !ok {
+		return "", nil, 0, errors.New("invalid checksum")
+	}
+	return hrp, data[:len(data)-checksumLength], version, nil
+}
+
+// ConvertBits regroups a slice of fromBits-bit groups into toBits-bit groups.
+// When pad is true the last group is padded with zero bits, otherwise
+// leftover bits must be zero padding of less than fromBits bits.
+func ConvertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	if fromBits < 1 || fromBits > 8 || toBits < 1 || toBits > 8 {
+		return nil, errors.New("only bit groups between 1 and 8 allowed")
+	}
+
+	var acc uint32
+	var bits uint
+	maxv := uint32(1)<<toBits - 1
+	regrouped := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	for _, b := range data {
+		if uint32(b)>>fromBits != 0 {
+			return nil, fmt.Errorf("invalid data range: %v", b)
+		}
+		acc = acc<<fromBits | uint32(b)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			regrouped = append(regrouped, byte(acc>>bits&maxv))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			regrouped = append(regrouped, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return regrouped, nil
+}
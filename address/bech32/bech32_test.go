@@ -0,0 +1,129 @@
+package bech32
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestBech32 ensures the valid and invalid strings of the BIP173 and BIP350
+// test vectors are decoded with the right checksum variant or rejected.
+func TestBech32(t *testing.T) {
+	tests := []struct {
+		str     string
+		version Version
+		valid   bool
+	}{
+		// Valid Bech32 strings of BIP173.
+		{"A12UEL5L", Version0, true},
+		{"a12uel5l", Version0, true},
+		{"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs", Version0, true},
+		{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", Version0, true},
+		{"11" + strings.Repeat("q", 82) + "c8247j", Version0, true},
+		{"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w", Version0, true},
+		{"?1ezyfcl", Version0, true},
+
+		// Valid Bech32m strings of BIP350.
+		{"A1LQFN3A", VersionM, true},
+		{"a1lqfn3a", VersionM, true},
+		{"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6", VersionM, true},
+		{"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx", VersionM, true},
+		{"11" + strings.Repeat("l", 82) + "ludsr8", VersionM, true},
+		{"split1checkupstagehandshakeupstreamerranterredcaperredlc445v", VersionM, true},
+		{"?1v759aa", VersionM, true},
+
+		// Invalid strings of BIP173 and BIP350.
+		{"\x201nwldj5", 0, false},   // hrp character out of range
+		{"\x7f1axkwrx", 0, false},   // hrp character out of range
+		{"\x801eym55h", 0, false},   // hrp character out of range
+		{"pzry9x0s0muk", 0, false},  // no separator
+		{"1pzry9x0s0muk", 0, false}, // empty hrp
+		{"x1b4n0q5v", 0, false},     // invalid data character
+		{"li1dgmt3", 0, false},      // too short checksum
+		{"de1lg7wt\xff", 0, false},  // invalid checksum character
+		{"A1G7SGD8", 0, false},      // checksum of an uppercase hrp
+		{"10a06t8", 0, false},       // empty hrp
+		{"1qzzfhee", 0, false},      // empty hrp
+		{"a12UEL5L", 0, false},      // mixed case
+		{"an84characterslonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1569pvx", 0, false}, // too long
+		{"M1VUXWEZ", 0, false},      // checksum of an uppercase hrp
+		{"qyrz8wqd2c9m", 0, false},  // no separator
+		{"1qyrz8wqd2c9m", 0, false}, // empty hrp
+		{"y1b0jsk6g", 0, false},     // invalid data character
+		{"lt1igcx5c0", 0, false},    // invalid data character
+		{"in1muywd", 0, false},      // too short checksum
+		{"mm1crxm3i", 0, false},     // invalid checksum character
+		{"au1s5cgom", 0, false},     // invalid checksum character
+		{"16plkw9", 0, false},       // empty hrp
+		{"1p2gdwpf", 0, false},      // empty hrp
+	}
+
+	for _, test := range tests {
+		hrp, data, version, err := Decode(test.str)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: decoded as %s %x", test.str, hrp, data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.str, err)
+			continue
+		}
+		if version != test.version {
+			t.Errorf("%q: checksum variant %d, want %d", test.str,
+				version, test.version)
+		}
+
+		// The string encodes back to its lowercase form.
+		var encoded string
+		if version == Version0 {
+			encoded, err = Encode(hrp, data)
+		} else {
+			encoded, err = EncodeM(hrp, data)
+		}
+		if err != nil {
+			t.Errorf("%q: encode: %v", test.str, err)
+		} else if want := strings.ToLower(test.str); encoded != want {
+			t.Errorf("%q: encoded as %q", test.str, encoded)
+		}
+
+		// Flipping a character of the data breaks the checksum.
+		flipped := []byte(strings.ToLower(test.str))
+		i := strings.LastIndexByte(test.str, '1') + 1
+		flipped[i] = charset[(strings.IndexByte(charset, flipped[i])+1)%32]
+		if _, _, _, err := Decode(string(flipped)); err == nil {
+			t.Errorf("%q: decoded with a modified character", test.str)
+		}
+	}
+}
+
+// TestConvertBits ensures bit groups are regrouped and invalid padding is
+// rejected.
+func TestConvertBits(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		from, to uint
+		pad      bool
+		want     []byte
+		wantErr  bool
+	}{
+		{"8 to 5 padded", []byte{0xff}, 8, 5, true, []byte{31, 28}, false},
+		{"5 to 8", []byte{31, 28}, 5, 8, false, []byte{0xff}, false},
+		{"non-zero padding", []byte{31, 29}, 5, 8, false, nil, true},
+		{"too much padding", []byte{31, 28, 0}, 5, 8, false, nil, true},
+		{"value out of range", []byte{32}, 5, 8, false, nil, true},
+		{"invalid group size", []byte{1}, 0, 8, false, nil, true},
+	}
+	for _, test := range tests {
+		got, err := ConvertBits(test.data, test.from, test.to, test.pad)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err,
+				test.wantErr)
+			continue
+		}
+		if string(got) != string(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -1 +1,161 @@
+// Package chain keeps the block chain of the node.  It validates the headers
+// and blocks downloaded from the peers before connecting them to the tip of
+// the main chain.
 package chain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blockchainservice/chaincfg"
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/common/merkle"
+)
+
+// maxTimeOffset is how far in the future the timestamp of a block may be.
+const maxTimeOffset = 2 * time.Hour
+
+var (
+	// ErrNoTransactions is returned for a block without transactions.
+	ErrNoTransactions = errors.New("block does not contain any transactions")
+
+	// ErrBadMerkleRoot is returned for a block whose header does not
+	// commit to its transactions.
+	ErrBadMerkleRoot = errors.New("block merkle root does not match its " +
+		"transactions")
+)
+
+// BlockChain is the main chain of the node held in memory.  It starts at the
+// genesis block of the network and only grows at its tip, there is no fork
+// handling.  On proof of work networks the difficulty does not retarget, every
+// block keeps the bits of the genesis block.  It is safe for concurrent use.
+type BlockChain struct {
+	params *chaincfg.Params
+
+	mtx    sync.RWMutex
+	blocks []*common.Block
+	index  map[common.Hash]uint64
+}
+
+// New returns a chain holding the genesis block of the network described by
+// params.  Block hashes are computed with the process wide algorithm, so it
+// fails unless that is the algorithm of the network and the genesis block
+// hashes to the genesis hash of params.
+func New(params *chaincfg.Params) (*BlockChain, error) {
+	if algo := common.ChainHashAlgorithm(); algo != params.HashAlgorithm {
+		return nil, fmt.Errorf("chain hash algorithm %v is not %v, the "+
+			"one of %s", algo, params.HashAlgorithm, params.Name)
+	}
+	if hash := params.GenesisBlock.BlockHash(); hash != *params.GenesisHash {
+		return nil, fmt.Errorf("genesis block of %s hashes to %v, not %v",
+			params.Name, hash, params.GenesisHash)
+	}
+	return &BlockChain{
+		params: params,
+		blocks: []*common.Block{params.GenesisBlock},
+		index:  map[common.Hash]uint64{*params.GenesisHash: 0},
+	}, nil
+}
+
+// BestHeight returns the height of the tip of the main chain.
+func (c *BlockChain) BestHeight() uint64 {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return uint64(len(c.blocks) - 1)
+}
+
+// HeaderByHeight returns the header of the block of the main chain at height,
+// nil when the chain is not that high.
+func (c *BlockChain) HeaderByHeight(height uint64) *common.BlockHeader {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if height >= uint64(len(c.blocks)) {
+		return nil
+	}
+	return &c.blocks[height].Header
+}
+
+// MainChainHeight returns the height of the block with the given hash and
+// whether it is part of the main chain.
+func (c *BlockChain) MainChainHeight(hash *common.Hash) (uint64, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	height, ok := c.index[*hash]
+	return height, ok
+}
+
+// Block returns the block of the main chain with the given hash, nil when it
+// is unknown.
+func (c *BlockChain) Block(hash *common.Hash) *common.Block {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	height, ok := c.index[*hash]
+	if !ok {
+		return nil
+	}
+	return c.blocks[height]
+}
+
+// CheckHeader validates header as the successor of prev: it has to follow
+// prev, must not be older than prev nor too far in the future and, on proof
+// of work networks, keep the bits of prev and satisfy them.
+func (c *BlockChain) CheckHeader(header, prev *common.BlockHeader) error {
+	if header.Height != prev.Height+1 {
+		return fmt.Errorf("block height %d does not follow height %d",
+			header.Height, prev.Height)
+	}
+	if prevHash := prev.BlockHash(); header.PrevBlock != prevHash {
+		return fmt.Errorf("previous block %v is not %v",
+			header.PrevBlock, prevHash)
+	}
+	if header.Timestamp.Before(prev.Timestamp) {
+		return fmt.Errorf("block timestamp of %v is before the one of "+
+			"the previous block %v", header.Timestamp, prev.Timestamp)
+	}
+	if maxTime := time.Now().Add(maxTimeOffset); header.Timestamp.After(maxTime) {
+		return fmt.Errorf("block timestamp of %v is too far in the "+
+			"future", header.Timestamp)
+	}
+
+	if c.params.Consensus != chaincfg.ConsensusPoW {
+		return nil
+	}
+	if header.Bits != prev.Bits {
+		return fmt.Errorf("block difficulty of %08x is not the expected "+
+			"value of %08x", header.Bits, prev.Bits)
+	}
+	return CheckProofOfWork(header, c.params.PowLimit)
+}
+
+// ProcessBlock validates block and connects it to the tip of the main chain.
+func (c *BlockChain) ProcessBlock(block *common.Block) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	tip := &c.blocks[len(c.blocks)-1].Header
+	if err := c.CheckHeader(&block.Header, tip); err != nil {
+		return err
+	}
+	if len(block.Transactions) == 0 {
+		return ErrNoTransactions
+	}
+	// Merkle proofs could pass them off as inner nodes.
+	for _, tx := range block.Transactions {
+		if tx.SerializeSize() == 2*common.HashSize {
+			return merkle.ErrTxSize64
+		}
+	}
+	root, err := merkle.BlockMerkleRoot(block)
+	if err != nil {
+		return err
+	}
+	if root != block.Header.MerkleRoot {
+		return ErrBadMerkleRoot
+	}
+
+	c.index[block.BlockHash()] = block.Header.Height
+	c.blocks = append(c.blocks, block)
+	return nil
+}
@@ -0,0 +1,193 @@
+package chain
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blockchainservice/chaincfg"
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/common/merkle"
+)
+
+// solveBlock builds the successor of prev holding a coinbase paying value and
+// searches a nonce satisfying its bits.
+func solveBlock(t *testing.T, prev *common.BlockHeader, value int64) *common.Block {
+	t.Helper()
+	tx := &common.Tx{
+		Version: 1,
+		TxIn: []*common.TxIn{{
+			PreviousOutPoint: common.OutPoint{Index: common.MaxPrevOutIndex},
+			Sequence:         common.MaxTxInSequenceNum,
+		}},
+		TxOut: []*common.TxOut{{Value: value}},
+	}
+	prevHash := prev.BlockHash()
+	block := common.NewBlock(common.NewBlockHeader(1, &prevHash,
+		&common.Hash{}, prev.Height+1, prev.Bits, 0))
+	block.Header.Timestamp = prev.Timestamp.Add(time.Minute)
+	block.AddTransaction(tx)
+	root, err := merkle.BlockMerkleRoot(block)
+	if err != nil {
+		t.Fatalf("BlockMerkleRoot: %v", err)
+	}
+	block.Header.MerkleRoot = root
+	for CheckProofOfWork(&block.Header,
+		chaincfg.RegressionNetParams.PowLimit) != nil {
+
+		block.Header.Nonce++
+	}
+	return block
+}
+
+// TestProcessBlock ensures the chain connects valid blocks at its tip and
+// rejects the ones breaking a rule.
+func TestProcessBlock(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	genesis := &params.GenesisBlock.Header
+
+	tests := []struct {
+		name   string
+		modify func(b *common.Block)
+		err    string
+	}{{
+		name:   "valid",
+		modify: func(b *common.Block) {},
+	}, {
+		name:   "wrong height",
+		modify: func(b *common.Block) { b.Header.Height = 2 },
+		err:    "does not follow",
+	}, {
+		name:   "unknown parent",
+		modify: func(b *common.Block) { b.Header.PrevBlock[0] ^= 1 },
+		err:    "previous block",
+	}, {
+		name: "older than parent",
+		modify: func(b *common.Block) {
+			b.Header.Timestamp = genesis.Timestamp.Add(-time.Second)
+		},
+		err: "before the one of the previous block",
+	}, {
+		name: "in the future",
+		modify: func(b *common.Block) {
+			b.Header.Timestamp = time.Now().Add(3 * time.Hour)
+		},
+		err: "too far in the future",
+	}, {
+		name:   "changed difficulty",
+		modify: func(b *common.Block) { b.Header.Bits = 0x1d00ffff },
+		err:    "not the expected value",
+	}, {
+		name:   "no transactions",
+		modify: func(b *common.Block) { b.ClearTransactions() },
+		err:    ErrNoTransactions.Error(),
+	}, {
+		name: "64 byte transaction",
+		modify: func(b *common.Block) {
+			b.Transactions[0].TxIn[0].SignatureScript = []byte{1, 2, 3}
+		},
+		err: merkle.ErrTxSize64.Error(),
+	}, {
+		name:   "bad merkle root",
+		modify: func(b *common.Block) { b.Transactions[0].TxOut[0].Value++ },
+		err:    ErrBadMerkleRoot.Error(),
+	}}
+
+	for _, test := range tests {
+		c, err := New(params)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		block := solveBlock(t, genesis, 50)
+		test.modify(block)
+		// Solve the modified header again so only the broken rule
+		// fails.
+		for block.Header.Bits == genesis.Bits &&
+			CheckProofOfWork(&block.Header, params.PowLimit) != nil {
+
+			block.Header.Nonce++
+		}
+
+		err = c.ProcessBlock(block)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+				continue
+			}
+			hash := block.BlockHash()
+			if c.BestHeight() != 1 || c.Block(&hash) != block {
+				t.Errorf("%s: block not connected", test.name)
+			}
+			if height, ok := c.MainChainHeight(&hash); !ok || height != 1 {
+				t.Errorf("%s: main chain height %d, %v", test.name,
+					height, ok)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err,
+				test.err)
+		}
+		if c.BestHeight() != 0 {
+			t.Errorf("%s: rejected block connected", test.name)
+		}
+	}
+}
+
+// TestCheckProofOfWork ensures headers whose hash is above their target or
+// whose target is above the limit of the network are rejected.
+func TestCheckProofOfWork(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	block := solveBlock(t, &params.GenesisBlock.Header, 50)
+	if err := CheckProofOfWork(&block.Header, params.PowLimit); err != nil {
+		t.Fatalf("solved block: %v", err)
+	}
+
+	// The hardest target only a hash of zero satisfies.
+	header := block.Header
+	header.Bits = 0x01010000
+	if err := CheckProofOfWork(&header, params.PowLimit); err == nil ||
+		!strings.Contains(err.Error(), "higher than expected") {
+
+		t.Errorf("hash above target: got %v", err)
+	}
+
+	header = block.Header
+	if err := CheckProofOfWork(&header,
+		chaincfg.MainNetParams.PowLimit); err == nil ||
+		!strings.Contains(err.Error(), "higher than max") {
+
+		t.Errorf("target above limit: got %v", err)
+	}
+
+	header.Bits = 0
+	if err := CheckProofOfWork(&header, params.PowLimit); err == nil ||
+		!strings.Contains(err.Error(), "too low") {
+
+		t.Errorf("zero target: got %v", err)
+	}
+}
+
+// TestNewGenesisMismatch ensures a chain is not created when the genesis block
+// does not hash to the genesis hash of the network.
+func TestNewGenesisMismatch(t *testing.T) {
+	params := chaincfg.RegressionNetParams
+	wrongHash := *params.GenesisHash
+	wrongHash[0] ^= 1
+	params.GenesisHash = &wrongHash
+	if _, err := New(&params); err == nil ||
+		!strings.Contains(err.Error(), "hashes to") {
+
+		t.Errorf("wrong genesis hash: got %v", err)
+	}
+
+	defer common.UseHashAlgorithm(common.ChainHashAlgorithm())
+	if err := common.UseHashAlgorithm(common.Blake2b); err != nil {
+		t.Fatalf("UseHashAlgorithm: %v", err)
+	}
+	if _, err := New(&chaincfg.RegressionNetParams); err == nil ||
+		!strings.Contains(err.Error(), "chain hash algorithm") {
+
+		t.Errorf("wrong hash algorithm: got %v", err)
+	}
+}
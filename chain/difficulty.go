@@ -0,0 +1,97 @@
+// Copyright (c) 2013-2017 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package chain
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/blockchainservice/common"
+)
+
+// HashToBig converts a common.Hash into a big.Int that can be used to perform
+// math comparisons.
+func HashToBig(hash *common.Hash) *big.Int {
+	// A Hash is in little-endian, but the big package wants the bytes in
+	// big-endian, so reverse them.
+	buf := *hash
+	blen := len(buf)
+	for i := 0; i < blen/2; i++ {
+		buf[i], buf[blen-1-i] = buf[blen-1-i], buf[i]
+	}
+
+	return new(big.Int).SetBytes(buf[:])
+}
+
+// CompactToBig converts a compact representation of a whole number N to an
+// unsigned 32-bit number.  The representation is similar to IEEE754 floating
+// point numbers.
+//
+// Like IEEE754 floating point, there are three basic components: the sign,
+// the exponent, and the mantissa.  The most significant 8 bits represent the
+// unsigned base 256 exponent, bit 23 (the 24th bit) represents the sign bit
+// and the least significant 23 bits represent the mantissa:
+//
+//	-------------------------------------------------
+//	|   Exponent     |    Sign    |    Mantissa     |
+//	-------------------------------------------------
+//	| 8 bits [31-24] | 1 bit [23] | 23 bits [22-00] |
+//	-------------------------------------------------
+//
+// The formula to calculate N is:
+//
+//	N = (-1^sign) * mantissa * 256^(exponent-3)
+//
+// This compact form is only used to encode unsigned 256-bit numbers which
+// represent difficulty targets, thus there really is not a need for a sign
+// bit, but it is implemented here to stay consistent with bitcoind.
+func CompactToBig(compact uint32) *big.Int {
+	// Extract the mantissa, sign bit, and exponent.
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	// Since the base for the exponent is 256, the exponent can be treated
+	// as the number of bytes to represent the full 256-bit number.  So,
+	// treat the exponent as the number of bytes and shift the mantissa
+	// right or left accordingly.  This is equivalent to:
+	// N = mantissa * 256^(exponent-3)
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	// Make it negative if the sign bit is set.
+	if isNegative {
+		bn = bn.Neg(bn)
+	}
+
+	return bn
+}
+
+// CheckProofOfWork ensures the hash of the header is no higher than the
+// target its difficulty bits claim and that the target is within powLimit.
+func CheckProofOfWork(header *common.BlockHeader, powLimit *big.Int) error {
+	target := CompactToBig(header.Bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("block target difficulty of %064x is too low",
+			target)
+	}
+	if target.Cmp(powLimit) > 0 {
+		return fmt.Errorf("block target difficulty of %064x is higher "+
+			"than max of %064x", target, powLimit)
+	}
+
+	hash := header.BlockHash()
+	if HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("block hash of %064x is higher than expected "+
+			"max of %064x", HashToBig(&hash), target)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2014-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package chaincfg
+
+import (
+	"time"
+
+	"github.com/blockchainservice/common"
+)
+
+// genesisCoinbaseTx is the coinbase transaction for the genesis blocks for
+// all of the networks.
+var genesisCoinbaseTx = common.Tx{
+	Version: 1,
+	TxIn: []*common.TxIn{
+		{
+			PreviousOutPoint: common.OutPoint{
+				Hash:  common.Hash{},
+				Index: common.MaxPrevOutIndex,
+			},
+			Sequence: common.MaxTxInSequenceNum,
+		},
+	},
+	TxOut: []*common.TxOut{
+		{
+			Value: 0x12a05f200,
+		},
+	},
+	LockTime: 0,
+	Payload:  []byte("blockchainservice: pow/pos + pbft, 18 Jul 2018"),
+}
+
+// genesisMerkleRoot is the hash of the first transaction in the genesis block
+// for all of the networks.
+var genesisMerkleRoot = newHashFromStr("a3d14d7dbb44c63ffdcfd8bed1bd6a85da4cf8d6aeb8fc2b2ca014cf099a653c")
+
+// genesisBlock defines the genesis block of the block chain which serves as
+// the public transaction ledger for the main network.
+var genesisBlock = common.Block{
+	Header: common.BlockHeader{
+		Version:    1,
+		PrevBlock:  common.Hash{},
+		MerkleRoot: *genesisMerkleRoot,
+		Timestamp:  time.Unix(1531872000, 0), // 2018-07-18 00:00:00 +0000 UTC
+		Height:     0,
+		Bits:       0x1d00ffff,
+		Nonce:      4332543513,
+	},
+	Transactions: []*common.Tx{&genesisCoinbaseTx},
+}
+
+// genesisHash is the hash of the first block in the block chain for the main
+// network (genesis block).
+var genesisHash = newHashFromStr("00000000593d8841affdefe23e7818b5b2b16e5650afaedcb810933fbbc1f181")
+
+// testNetGenesisBlock defines the genesis block of the block chain which
+// serves as the public transaction ledger for the test network.
+var testNetGenesisBlock = common.Block{
+	Header: common.BlockHeader{
+		Version:    1,
+		PrevBlock:  common.Hash{},
+		MerkleRoot: *genesisMerkleRoot,
+		Timestamp:  time.Unix(1531958400, 0), // 2018-07-19 00:00:00 +0000 UTC
+		Height:     0,
+		Bits:       0x1d00ffff,
+		Nonce:      292340934,
+	},
+	Transactions: []*common.Tx{&genesisCoinbaseTx},
+}
+
+// testNetGenesisHash is the hash of the first block in the block chain for
+// the test network.
+var testNetGenesisHash = newHashFromStr("00000000162edc006470bc93d812219f3be3cd23e15e827ba977331cf0cf4aef")
+
+// regTestGenesisBlock defines the genesis block of the block chain which
+// serves as the public transaction ledger for the regression test network.
+var regTestGenesisBlock = common.Block{
+	Header: common.BlockHeader{
+		Version:    1,
+		PrevBlock:  common.Hash{},
+		MerkleRoot: *genesisMerkleRoot,
+		Timestamp:  time.Unix(1296688602, 0), // 2011-02-02 23:16:42 +0000 UTC
+		Height:     0,
+		Bits:       0x207fffff,
+		Nonce:      1,
+	},
+	Transactions: []*common.Tx{&genesisCoinbaseTx},
+}
+
+// regTestGenesisHash is the hash of the first block in the block chain for
+// the regression test network.
+var regTestGenesisHash = newHashFromStr("1e105795ad24d4e4d653bed7db7a3a15296519b87821c8e11666cbdcd0ff3c6c")
+
+// simNetGenesisBlock defines the genesis block of the block chain which
+// serves as the public transaction ledger for the simulation test network.
+var simNetGenesisBlock = common.Block{
+	Header: common.BlockHeader{
+		Version:    1,
+		PrevBlock:  common.Hash{},
+		MerkleRoot: *genesisMerkleRoot,
+		Timestamp:  time.Unix(1401292357, 0), // 2014-05-28 15:52:37 +0000 UTC
+		Height:     0,
+		Bits:       0x207fffff,
+		Nonce:      0,
+	},
+	Transactions: []*common.Tx{&genesisCoinbaseTx},
+}
+
+// simNetGenesisHash is the hash of the first block in the block chain for the
+// simulation test network.
+var simNetGenesisHash = newHashFromStr("1ea9cf157643173db17f3ef7982497938d607512a5d5657637263b86e7db01a3")
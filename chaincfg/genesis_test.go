@@ -0,0 +1,53 @@
+package chaincfg_test
+
+import (
+	"testing"
+
+	"github.com/blockchainservice/chain"
+	"github.com/blockchainservice/chaincfg"
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/common/merkle"
+)
+
+// TestGenesisBlocks ensures the genesis block of every network commits to
+// its transactions, hashes to the genesis hash of the network and satisfies
+// its own proof of work.
+func TestGenesisBlocks(t *testing.T) {
+	defer common.UseHashAlgorithm(common.ChainHashAlgorithm())
+
+	for _, params := range []*chaincfg.Params{
+		&chaincfg.MainNetParams,
+		&chaincfg.TestNetParams,
+		&chaincfg.RegressionNetParams,
+		&chaincfg.SimNetParams,
+	} {
+		if err := common.UseHashAlgorithm(params.HashAlgorithm); err != nil {
+			t.Errorf("%s: %v", params.Name, err)
+			continue
+		}
+		block := params.GenesisBlock
+
+		root, err := merkle.BlockMerkleRoot(block)
+		if err != nil {
+			t.Errorf("%s: %v", params.Name, err)
+		} else if root != block.Header.MerkleRoot {
+			t.Errorf("%s: merkle root %v, want %v", params.Name,
+				block.Header.MerkleRoot, root)
+		}
+
+		if hash := block.BlockHash(); hash != *params.GenesisHash {
+			t.Errorf("%s: genesis hash %v, block hashes to %v",
+				params.Name, params.GenesisHash, hash)
+		}
+
+		// Proof of stake networks carry the bits of their limit too.
+		if block.Header.Bits != params.PowLimitBits {
+			t.Errorf("%s: genesis bits %08x, want %08x", params.Name,
+				block.Header.Bits, params.PowLimitBits)
+		}
+		err = chain.CheckProofOfWork(&block.Header, params.PowLimit)
+		if err != nil {
+			t.Errorf("%s: %v", params.Name, err)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright (c) 2014-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+// Package chaincfg defines the parameters of the networks the service can
+// join.  Each network is isolated from the others by its magic bytes, chain ID
+// and genesis block, so a regression test chain can run in CI next to the
+// production nodes on the same host.
+package chaincfg
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/blockchainservice/common"
+)
+
+var (
+	// bigOne is 1 represented as a big.Int.  It is defined here to avoid
+	// the overhead of creating it multiple times.
+	bigOne = big.NewInt(1)
+
+	// mainPowLimit is the highest proof of work value a block can have for
+	// the main network.  It is the value 2^224 - 1.
+	mainPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 224), bigOne)
+
+	// regressionPowLimit is the highest proof of work value a block can
+	// have for the regression test network.  It is the value 2^255 - 1.
+	regressionPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 255), bigOne)
+
+	// testNetPowLimit is the highest proof of work value a block can have
+	// for the test network.  It is the value 2^224 - 1.
+	testNetPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 224), bigOne)
+
+	// simNetPowLimit is the highest proof of work value a block can have
+	// for the simulation test network.  It is the value 2^255 - 1.
+	simNetPowLimit = new(big.Int).Sub(new(big.Int).Lsh(bigOne, 255), bigOne)
+)
+
+// ConsensusType identifies the engine that reaches global consensus on the
+// chain.
+type ConsensusType uint8
+
+// These constants define the supported global consensus engines.
+const (
+	// ConsensusPoW selects proof of work.
+	ConsensusPoW ConsensusType = iota
+
+	// ConsensusPoS selects proof of stake.
+	ConsensusPoS
+)
+
+// Map of ConsensusType values back to their names for pretty printing.
+var consensusTypeStrings = map[ConsensusType]string{
+	ConsensusPoW: "pow",
+	ConsensusPoS: "pos",
+}
+
+// String returns the ConsensusType as a human-readable name.
+func (t ConsensusType) String() string {
+	if s, ok := consensusTypeStrings[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown ConsensusType (%d)", uint8(t))
+}
+
+// Checkpoint identifies a known good point in the block chain.  Using
+// checkpoints allows a few optimizations for old blocks during initial
+// download and also prevents forks from old blocks.
+type Checkpoint struct {
+	Height uint64
+	Hash   *common.Hash
+}
+
+// Params defines a network by its parameters.  These parameters may be
+// used by applications to differentiate networks as well as addresses
+// and keys for one network from those intended for use on another network.
+type Params struct {
+	// Name defines a human-readable identifier for the network.
+	Name string
+
+	// Net defines the magic bytes used to identify the network on the
+	// wire.
+	Net uint32
+
+	// ChainID identifies the chain in the handshake and is mixed into
+	// signatures so they cannot be replayed on another network.
+	ChainID uint32
+
+	// DefaultPort defines the default peer-to-peer port for the network.
+	DefaultPort string
+
+	// RPCPort defines the default JSON-RPC port for the network.
+	RPCPort string
+
+	// GenesisBlock defines the first block of the chain.
+	GenesisBlock *common.Block
+
+	// GenesisHash is the starting block hash.  It must be the hash of
+	// GenesisBlock under HashAlgorithm.
+	GenesisHash *common.Hash
+
+	// HashAlgorithm is the algorithm used to compute block and transaction
+	// hashes on the network.
+	HashAlgorithm common.HashAlgorithm
+
+	// Consensus is the engine that reaches global consensus on the chain.
+	Consensus ConsensusType
+
+	// PBFT enables pbft rounds among the validators to finalize blocks
+	// locally before the global consensus engine settles them.
+	PBFT bool
+
+	// PBFTRoundTimeout is the time a pbft round may take before the
+	// validators move on to the next proposer.
+	PBFTRoundTimeout time.Duration
+
+	// PowLimit defines the highest allowed proof of work value for a block
+	// as a uint256.
+	PowLimit *big.Int
+
+	// PowLimitBits defines the highest allowed proof of work value for a
+	// block in compact form.
+	PowLimitBits uint32
+
+	// MinStake is the smallest amount that has to be staked for a
+	// validator to propose proof of stake blocks.
+	MinStake int64
+
+	// StakeMinAge is the time staked outputs have to mature before they
+	// can be used to propose proof of stake blocks.
+	StakeMinAge time.Duration
+
+	// TargetTimePerBlock is the desired amount of time to generate each
+	// block.
+	TargetTimePerBlock time.Duration
+
+	// Checkpoints ordered from oldest to newest.
+	Checkpoints []Checkpoint
+
+	// Human-readable part for Bech32 encoded addresses.
+	Bech32HRP string
+
+	// Address encoding magics
+	PubKeyHashAddrID byte // First byte of a pay-to-pubkey-hash address
+	ScriptHashAddrID byte // First byte of a pay-to-script-hash address
+}
+
+// MainNetParams defines the network parameters for the main network.
+var MainNetParams = Params{
+	Name:        "mainnet",
+	Net:         0xe1d9c3b5,
+	ChainID:     1,
+	DefaultPort: "9090",
+	RPCPort:     "8080",
+
+	// Chain parameters
+	GenesisBlock:       &genesisBlock,
+	GenesisHash:        genesisHash,
+	HashAlgorithm:      common.SHA256D,
+	Consensus:          ConsensusPoW,
+	PBFT:               true,
+	PBFTRoundTimeout:   time.Second * 10,
+	PowLimit:           mainPowLimit,
+	PowLimitBits:       0x1d00ffff,
+	MinStake:           0,
+	StakeMinAge:        0,
+	TargetTimePerBlock: time.Minute,
+
+	// Checkpoints ordered from oldest to newest.
+	Checkpoints: nil,
+
+	// Human-readable part for Bech32 encoded addresses.
+	Bech32HRP: "bcs",
+
+	// Address encoding magics
+	PubKeyHashAddrID: 0x19,
+	ScriptHashAddrID: 0x1c,
+}
+
+// TestNetParams defines the network parameters for the test network.
+var TestNetParams = Params{
+	Name:        "testnet",
+	Net:         0xe2dac4b6,
+	ChainID:     2,
+	DefaultPort: "19090",
+	RPCPort:     "18080",
+
+	// Chain parameters
+	GenesisBlock:       &testNetGenesisBlock,
+	GenesisHash:        testNetGenesisHash,
+	HashAlgorithm:      common.SHA256D,
+	Consensus:          ConsensusPoW,
+	PBFT:               true,
+	PBFTRoundTimeout:   time.Second * 10,
+	PowLimit:           testNetPowLimit,
+	PowLimitBits:       0x1d00ffff,
+	MinStake:           0,
+	StakeMinAge:        0,
+	TargetTimePerBlock: time.Minute,
+
+	// Checkpoints ordered from oldest to newest.
+	Checkpoints: nil,
+
+	// Human-readable part for Bech32 encoded addresses.
+	Bech32HRP: "tbcs",
+
+	// Address encoding magics
+	PubKeyHashAddrID: 0x6f,
+	ScriptHashAddrID: 0xc4,
+}
+
+// RegressionNetParams defines the network parameters for the regression test
+// network.  Not to be confused with the test network, this network is
+// sometimes simply called "regtest".  Its trivial proof of work makes it the
+// network to use for isolated chains in CI.
+var RegressionNetParams = Params{
+	Name:        "regtest",
+	Net:         0xe3dbc5b7,
+	ChainID:     3,
+	DefaultPort: "29090",
+	RPCPort:     "28080",
+
+	// Chain parameters
+	GenesisBlock:       &regTestGenesisBlock,
+	GenesisHash:        regTestGenesisHash,
+	HashAlgorithm:      common.SHA256D,
+	Consensus:          ConsensusPoW,
+	PBFT:               false,
+	PBFTRoundTimeout:   time.Second,
+	PowLimit:           regressionPowLimit,
+	PowLimitBits:       0x207fffff,
+	MinStake:           0,
+	StakeMinAge:        0,
+	TargetTimePerBlock: time.Second,
+
+	// Checkpoints ordered from oldest to newest.
+	Checkpoints: nil,
+
+	// Human-readable part for Bech32 encoded addresses.
+	Bech32HRP: "bcsrt",
+
+	// Address encoding magics
+	PubKeyHashAddrID: 0x70,
+	ScriptHashAddrID: 0xc5,
+}
+
+// SimNetParams defines the network parameters for the simulation test
+// network.  This network is similar to the normal test network except it is
+// intended for private use within a group of individuals doing simulation
+// testing of the proof of stake engine.
+var SimNetParams = Params{
+	Name:        "simnet",
+	Net:         0xe4dcc6b8,
+	ChainID:     4,
+	DefaultPort: "39090",
+	RPCPort:     "38080",
+
+	// Chain parameters
+	GenesisBlock:       &simNetGenesisBlock,
+	GenesisHash:        simNetGenesisHash,
+	HashAlgorithm:      common.SHA256D,
+	Consensus:          ConsensusPoS,
+	PBFT:               true,
+	PBFTRoundTimeout:   time.Second * 2,
+	PowLimit:           simNetPowLimit,
+	PowLimitBits:       0x207fffff,
+	MinStake:           1000,
+	StakeMinAge:        time.Minute,
+	TargetTimePerBlock: time.Second * 10,
+
+	// Checkpoints ordered from oldest to newest.
+	Checkpoints: nil,
+
+	// Human-readable part for Bech32 encoded addresses.
+	Bech32HRP: "sbcs",
+
+	// Address encoding magics
+	PubKeyHashAddrID: 0x3f,
+	ScriptHashAddrID: 0x7b,
+}
+
+var (
+	// ErrDuplicateNet describes an error where the parameters for a
+	// network could not be set due to the network already being a
+	// registered network.
+	ErrDuplicateNet = errors.New("duplicate network")
+
+	// ErrUnknownNet describes an error where the parameters for a network
+	// were requested by a name which is not registered.
+	ErrUnknownNet = errors.New("unknown network")
+)
+
+var (
+	registeredNets    = make(map[uint32]struct{})
+	netsByName        = make(map[string]*Params)
+	pubKeyHashAddrIDs = make(map[byte]struct{})
+	scriptHashAddrIDs = make(map[byte]struct{})
+	bech32HRPs        = make(map[string]struct{})
+)
+
+// Register registers the network parameters for a network.  This may error
+// with ErrDuplicateNet if the network is already registered (either due to a
+// previous Register call, or the network being one of the default networks).
+//
+// Network parameters should be registered into this package by a main package
+// as early as possible.  Then, library packages may lookup networks or network
+// parameters based on inputs and work regardless of the network being standard
+// or not.
+func Register(params *Params) error {
+	if _, ok := registeredNets[params.Net]; ok {
+		return ErrDuplicateNet
+	}
+	if _, ok := netsByName[params.Name]; ok {
+		return ErrDuplicateNet
+	}
+	registeredNets[params.Net] = struct{}{}
+	netsByName[params.Name] = params
+	pubKeyHashAddrIDs[params.PubKeyHashAddrID] = struct{}{}
+	scriptHashAddrIDs[params.ScriptHashAddrID] = struct{}{}
+	bech32HRPs[strings.ToLower(params.Bech32HRP)] = struct{}{}
+	return nil
+}
+
+// mustRegister performs the same function as Register except it panics if
+// there is an error.  This should only be called from package init
+// functions.
+func mustRegister(params *Params) {
+	if err := Register(params); err != nil {
+		panic("failed to register network: " + err.Error())
+	}
+}
+
+// ParamsForName returns the registered network parameters with the given
+// name.  ErrUnknownNet is returned when no such network is registered.
+func ParamsForName(name string) (*Params, error) {
+	params, ok := netsByName[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrUnknownNet
+	}
+	return params, nil
+}
+
+// IsPubKeyHashAddrID returns whether the id is an identifier known to prefix a
+// pay-to-pubkey-hash address on any default or registered network.  This is
+// used when decoding an address string into a specific address type.
+func IsPubKeyHashAddrID(id byte) bool {
+	_, ok := pubKeyHashAddrIDs[id]
+	return ok
+}
+
+// IsScriptHashAddrID returns whether the id is an identifier known to prefix a
+// pay-to-script-hash address on any default or registered network.  This is
+// used when decoding an address string into a specific address type.
+func IsScriptHashAddrID(id byte) bool {
+	_, ok := scriptHashAddrIDs[id]
+	return ok
+}
+
+// IsBech32HRP returns whether the hrp is the human-readable part of Bech32
+// addresses on any default or registered network.  The check is not
+// case-sensitive.
+func IsBech32HRP(hrp string) bool {
+	_, ok := bech32HRPs[strings.ToLower(hrp)]
+	return ok
+}
+
+// newHashFromStr converts the passed big-endian hex string into a
+// common.Hash.  It only differs from the one available in common in that
+// it panics on an error since it will only (and must only) be called with
+// hard-coded, and therefore known good, hashes.
+func newHashFromStr(hexStr string) *common.Hash {
+	hash, err := common.NewHashFromStr(hexStr)
+	if err != nil {
+		// Library code does not panic as a rule, but this can only
+		// fail on a typo in the hard-coded hashes, which panics on
+		// init of the package and is caught by any of its tests.
+		panic(err)
+	}
+	return hash
+}
+
+func init() {
+	// Register all default networks when the package is initialized.
+	mustRegister(&MainNetParams)
+	mustRegister(&TestNetParams)
+	mustRegister(&RegressionNetParams)
+	mustRegister(&SimNetParams)
+}
@@ -7,6 +7,10 @@ import (
 
 	"github.com/blockchainservice/common"
 	"github.com/blockchainservice/jsonrpc"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/p2p/blocksync"
+	"github.com/blockchainservice/p2p/pex"
+	"github.com/blockchainservice/p2p/relay"
 	"github.com/jrick/logrotate/rotator"
 )
 
@@ -24,18 +28,30 @@ var (
 	logRotator *rotator.Rotator
 	// add modules log
 	jsonRPCLog = backendLog.Logger("JSONRPC")
+	p2pLog     = backendLog.Logger("P2P")
+	syncLog    = backendLog.Logger("SYNC")
+	pexLog     = backendLog.Logger("PEX")
+	relayLog   = backendLog.Logger("RELAY")
 )
 
 // Initialize package-global logger variables.
 func init() {
 	// add modules log
 	jsonrpc.UseLogger(jsonRPCLog)
+	p2p.UseLogger(p2pLog)
+	blocksync.UseLogger(syncLog)
+	pex.UseLogger(pexLog)
+	relay.UseLogger(relayLog)
 }
 
 // subsystemLoggers maps each subsystem identifier to its associated logger.
 // add modules log
 var subsystemLoggers = map[string]common.Logger{
 	"JSONRPC": jsonRPCLog,
+	"P2P":     p2pLog,
+	"SYNC":    syncLog,
+	"PEX":     pexLog,
+	"RELAY":   relayLog,
 }
 
 // initLogRotator initializes the logging rotater to write logs to logFile and
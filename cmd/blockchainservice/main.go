@@ -1,28 +1,131 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
-	"time"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/blockchainservice/chain"
 	"github.com/blockchainservice/jsonrpc"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/p2p/blocksync"
+	"github.com/blockchainservice/p2p/pex"
+	"github.com/blockchainservice/p2p/relay"
 )
 
 func main() {
+	testNet := flag.Bool("testnet", false, "Use the test network")
+	regressionTest := flag.Bool("regtest", false, "Use the regression test network")
+	simNet := flag.Bool("simnet", false, "Use the simulation test network")
+	dataDir := flag.String("datadir", "./data", "Directory to store the node key and the known peers")
+	listen := flag.String("listen", "", "Address to listen on for peers (default: all interfaces on the port of the network)")
+	natSpec := flag.String("nat", "", "Port mapping mechanism (none|any|upnp|pmp|pmp:<IP>|extip:<IP>)")
+	peers := flag.String("peers", "", "Comma separated addresses of peers to connect to")
+	seeds := flag.String("seeds", "", "Comma separated addresses of seed nodes to ask for peer addresses")
+	seedMode := flag.Bool("seed", false, "Run as a seed node crawling the network and handing out peer addresses")
+	flag.Parse()
+
 	initLogRotator("./json_rpc.log")
 	setLogLevels("debug")
+	if err := selectNetParams(*testNet, *regressionTest, *simNet); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	jsonRPCLog.Infof("Active network: %s", activeNetParams.Name)
+
+	netDir := filepath.Join(*dataDir, activeNetParams.Name)
+	if err := os.MkdirAll(netDir, 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create data directory: %v\n", err)
+		os.Exit(1)
+	}
+	nodeKey, err := p2p.LoadOrGenNodeKey(filepath.Join(netDir, "node_key.json"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load node key: %v\n", err)
+		os.Exit(1)
+	}
+	if *listen == "" {
+		*listen = net.JoinHostPort("", activeNetParams.DefaultPort)
+	}
+	p2pConfig := p2p.Config{
+		ListenAddr:  *listen,
+		NAT:         *natSpec,
+		ChainParams: activeNetParams,
+		NodeKey:     nodeKey,
+		Peers:       splitList(*peers),
+		DataDir:     netDir,
+	}
+	manage, err := p2p.NewManage(p2pConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create p2p manager: %v\n", err)
+		os.Exit(1)
+	}
+	blockChain, err := chain.New(activeNetParams)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load block chain: %v\n", err)
+		os.Exit(1)
+	}
+	syncManager := blocksync.NewSyncManager(blockChain)
+	if err := manage.AddReactor(blocksync.ReactorName, syncManager); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to register sync manager: %v\n", err)
+		os.Exit(1)
+	}
+	relayReactor := relay.NewReactor(&chainStore{blockChain}, relay.Config{})
+	if err := manage.AddReactor(relay.ReactorName, relayReactor); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to register relay: %v\n", err)
+		os.Exit(1)
+	}
+	pexReactor, err := pex.NewReactor(pex.Config{
+		SeedMode: *seedMode,
+		Seeds:    splitList(*seeds),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid seeds: %v\n", err)
+		os.Exit(1)
+	}
+	if err := manage.AddReactor(pex.ReactorName, pexReactor); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to register peer exchange: %v\n", err)
+		os.Exit(1)
+	}
+	manage.Start()
+	syncManager.Start()
+	pexReactor.Start()
+	p2pLog.Infof("Node %s listening on %s", nodeKey.ID(), *listen)
+
 	// test jsonrpc
 	listeners := make([]net.Listener, 0, 1)
-	listener, err := net.Listen("tcp", ":8080")
+	listener, err := net.Listen("tcp", net.JoinHostPort("", activeNetParams.RPCPort))
 	if err != nil {
 		fmt.Println(err)
 	}
 	listeners = append(listeners, listener)
 
 	jsonRPC := jsonrpc.NewRPCServer(listeners)
+	jsonRPC.P2P = manage
+	jsonRPC.Sync = syncManager
 	jsonRPCLog.Info("json rpc server start ......")
 	jsonRPC.Start()
-	for {
-		time.Sleep(time.Second * 2)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	<-interrupt
+	jsonRPCLog.Info("Received signal, shutting down...")
+	pexReactor.Stop()
+	syncManager.Stop()
+	manage.Stop()
+}
+
+// splitList returns the non-empty elements of the comma separated list s.
+func splitList(s string) []string {
+	var list []string
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
 	}
+	return list
 }
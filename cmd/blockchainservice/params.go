@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/blockchainservice/chaincfg"
+	"github.com/blockchainservice/common"
+)
+
+// activeNetParams is a pointer to the parameters specific to the currently
+// active network.
+var activeNetParams = &chaincfg.MainNetParams
+
+// selectNetParams sets activeNetParams from the network flags passed on the
+// command line.  At most one of them may be set, the main network is used
+// when none is.
+func selectNetParams(testNet, regressionTest, simNet bool) error {
+	numNets := 0
+	if testNet {
+		numNets++
+		activeNetParams = &chaincfg.TestNetParams
+	}
+	if regressionTest {
+		numNets++
+		activeNetParams = &chaincfg.RegressionNetParams
+	}
+	if simNet {
+		numNets++
+		activeNetParams = &chaincfg.SimNetParams
+	}
+	if numNets > 1 {
+		return errors.New("the testnet, regtest, and simnet params " +
+			"can't be used together -- choose one of the three")
+	}
+
+	// Every block and transaction hash of the chain is computed with the
+	// algorithm of the network.
+	return common.UseHashAlgorithm(activeNetParams.HashAlgorithm)
+}
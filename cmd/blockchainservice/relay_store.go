@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/blockchainservice/chain"
+	"github.com/blockchainservice/common"
+)
+
+// chainStore is the relay store of the node.  It serves and accepts the
+// blocks of the chain.  There is no memory pool, so transactions are neither
+// requested nor served.
+type chainStore struct {
+	chain *chain.BlockChain
+}
+
+func (s *chainStore) HaveBlock(hash *common.Hash) bool {
+	_, ok := s.chain.MainChainHeight(hash)
+	return ok
+}
+
+func (s *chainStore) HaveTx(hash *common.Hash) bool {
+	return true
+}
+
+func (s *chainStore) Block(hash *common.Hash) *common.Block {
+	return s.chain.Block(hash)
+}
+
+func (s *chainStore) Tx(hash *common.Hash) *common.Tx {
+	return nil
+}
+
+// ProcessBlock connects a block extending the tip of the chain.  The other
+// blocks are left to the sync manager, which downloads the missing ones.
+func (s *chainStore) ProcessBlock(block *common.Block) (bool, error) {
+	tip := s.chain.HeaderByHeight(s.chain.BestHeight())
+	if block.Header.PrevBlock != tip.BlockHash() {
+		return false, nil
+	}
+	if err := s.chain.ProcessBlock(block); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *chainStore) ProcessTx(tx *common.Tx) (bool, error) {
+	return false, nil
+}
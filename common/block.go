@@ -1 +1,142 @@
 package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// defaultTransactionAlloc is the default size used for the backing array
+// for transactions.  The transaction array will dynamically grow as needed, but
+// this figure is intended to provide enough space for the number of
+// transactions in the vast majority of blocks without needing to grow the
+// backing array multiple times.
+const defaultTransactionAlloc = 2048
+
+// MaxBlockPayload is the maximum bytes a serialized block can be.
+const MaxBlockPayload = 4000000
+
+// maxTxPerBlock is the maximum number of transactions that could
+// possibly fit into a block.
+const maxTxPerBlock = (MaxBlockPayload / minTxPayload) + 1
+
+// minTxPayload is the minimum payload size for a transaction.  Version 4
+// bytes + Varint number of transaction inputs 1 byte + Varint number of
+// transaction outputs 1 byte + LockTime 4 bytes + Varint payload length 1
+// byte + min input payload + min output payload.
+const minTxPayload = 11 + minTxInPayload + minTxOutPayload
+
+// Block defines a block of the chain: a header and the list of
+// transactions it commits to.
+type Block struct {
+	Header       BlockHeader
+	Transactions []*Tx
+}
+
+// AddTransaction adds a transaction to the block.
+func (b *Block) AddTransaction(tx *Tx) {
+	b.Transactions = append(b.Transactions, tx)
+}
+
+// ClearTransactions removes all transactions from the block.
+func (b *Block) ClearTransactions() {
+	b.Transactions = make([]*Tx, 0, defaultTransactionAlloc)
+}
+
+// BlockHash computes the block identifier hash for this block.
+func (b *Block) BlockHash() Hash {
+	return b.Header.BlockHash()
+}
+
+// TxHashes returns a slice of hashes of all of transactions in this block.
+func (b *Block) TxHashes() []Hash {
+	hashList := make([]Hash, 0, len(b.Transactions))
+	for _, tx := range b.Transactions {
+		hashList = append(hashList, tx.TxHash())
+	}
+	return hashList
+}
+
+// Deserialize decodes a block from r into the receiver using the canonical
+// encoding used for both storage and the wire.
+func (b *Block) Deserialize(r io.Reader) error {
+	if err := b.Header.Deserialize(r); err != nil {
+		return err
+	}
+
+	txCount, err := ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+
+	// Prevent more transactions than could possibly fit into a block.
+	// It would be possible to cause memory exhaustion and panics without
+	// a sane upper bound on this count.
+	if txCount > maxTxPerBlock {
+		return fmt.Errorf("Block.Deserialize: too many transactions to "+
+			"fit into a block [count %d, max %d]", txCount, maxTxPerBlock)
+	}
+
+	b.Transactions = make([]*Tx, 0, txCount)
+	for i := uint64(0); i < txCount; i++ {
+		tx := Tx{}
+		if err := tx.Deserialize(r); err != nil {
+			return err
+		}
+		b.Transactions = append(b.Transactions, &tx)
+	}
+
+	return nil
+}
+
+// Serialize encodes the block to w using the canonical encoding used for both
+// storage and the wire.
+func (b *Block) Serialize(w io.Writer) error {
+	if err := b.Header.Serialize(w); err != nil {
+		return err
+	}
+
+	if err := WriteVarInt(w, uint64(len(b.Transactions))); err != nil {
+		return err
+	}
+
+	for _, tx := range b.Transactions {
+		if err := tx.Serialize(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SerializeSize returns the number of bytes it would take to serialize the
+// block.
+func (b *Block) SerializeSize() int {
+	// Block header bytes + Serialized varint size for the number of
+	// transactions.
+	n := b.Header.SerializeSize() +
+		VarIntSerializeSize(uint64(len(b.Transactions)))
+
+	for _, tx := range b.Transactions {
+		n += tx.SerializeSize()
+	}
+
+	return n
+}
+
+// Bytes returns the serialized block.
+func (b *Block) Bytes() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, b.SerializeSize()))
+	if err := b.Serialize(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewBlock returns a new block using the provided block header.
+func NewBlock(blockHeader *BlockHeader) *Block {
+	return &Block{
+		Header:       *blockHeader,
+		Transactions: make([]*Tx, 0, defaultTransactionAlloc),
+	}
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 )
 
@@ -15,8 +16,9 @@ const MaxHashStringSize = HashSize * 2
 // string that has too many characters.
 var ErrHashStrSize = fmt.Errorf("max hash string length is %v bytes", MaxHashStringSize)
 
-// Hash is used in several of the bitcoin messages and common structures.  It
-// typically represents the double sha256 of data.
+// Hash is used in several of the messages and common structures.  It
+// typically represents the double sha256 of data, or its digest under the
+// hash algorithm selected by the chain parameters.
 type Hash [HashSize]byte
 
 // String returns the Hash as the hexadecimal string of the byte-reversed
@@ -28,6 +30,37 @@ func (hash Hash) String() string {
 	return hex.EncodeToString(hash[:])
 }
 
+// MarshalText returns the Hash as the hexadecimal string of the byte-reversed
+// hash.  This satisfies the encoding.TextMarshaler interface.
+func (hash Hash) MarshalText() ([]byte, error) {
+	return []byte(hash.String()), nil
+}
+
+// UnmarshalText sets the Hash from the hexadecimal string of a byte-reversed
+// hash as produced by MarshalText.  This satisfies the
+// encoding.TextUnmarshaler interface.
+func (hash *Hash) UnmarshalText(text []byte) error {
+	return Decode(hash, string(text))
+}
+
+// MarshalJSON returns the Hash as a JSON string holding the hexadecimal
+// string of the byte-reversed hash.  This satisfies the json.Marshaler
+// interface.
+func (hash Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hash.String())
+}
+
+// UnmarshalJSON sets the Hash from a JSON string holding the hexadecimal
+// string of a byte-reversed hash.  This satisfies the json.Unmarshaler
+// interface.
+func (hash *Hash) UnmarshalJSON(input []byte) error {
+	var s string
+	if err := json.Unmarshal(input, &s); err != nil {
+		return err
+	}
+	return Decode(hash, s)
+}
+
 // CloneBytes returns a copy of the bytes which represent the hash as a byte
 // slice.
 //
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// HashB calculates hash(b) and returns the resulting bytes.
+func HashB(b []byte) []byte {
+	hash := sha256.Sum256(b)
+	return hash[:]
+}
+
+// HashH calculates hash(b) and returns the resulting bytes as a Hash.
+func HashH(b []byte) Hash {
+	return Hash(sha256.Sum256(b))
+}
+
+// DoubleHashB calculates hash(hash(b)) and returns the resulting bytes.
+func DoubleHashB(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// DoubleHashH calculates hash(hash(b)) and returns the resulting bytes as a
+// Hash.
+func DoubleHashH(b []byte) Hash {
+	first := sha256.Sum256(b)
+	return Hash(sha256.Sum256(first[:]))
+}
+
+// HashAlgorithm identifies the function used to compute block and transaction
+// identifiers.  Every node of a chain must agree on it, so it is selected by
+// the chain parameters rather than configured per node.
+type HashAlgorithm uint8
+
+// These constants define the supported hash algorithms.
+const (
+	// SHA256D is the double sha256 used by bitcoin.  It is the default.
+	SHA256D HashAlgorithm = iota
+
+	// Blake2b is the 256-bit variant of BLAKE2b.
+	Blake2b
+
+	// Keccak256 is the original Keccak-256 as used by ethereum, which
+	// differs from the standardized SHA3-256 in its padding.
+	Keccak256
+
+	// numHashAlgorithms is the number of supported hash algorithms.
+	numHashAlgorithms
+)
+
+// Map of HashAlgorithm values back to their names for pretty printing.
+var hashAlgorithmStrings = map[HashAlgorithm]string{
+	SHA256D:   "sha256d",
+	Blake2b:   "blake2b",
+	Keccak256: "keccak256",
+}
+
+// String returns the HashAlgorithm as a human-readable name.
+func (a HashAlgorithm) String() string {
+	if s, ok := hashAlgorithmStrings[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown HashAlgorithm (%d)", uint8(a))
+}
+
+// HashAlgorithmFromString returns the hash algorithm with the given name.
+// The name is not case-sensitive.
+func HashAlgorithmFromString(s string) (HashAlgorithm, error) {
+	s = strings.ToLower(s)
+	for algo, name := range hashAlgorithmStrings {
+		if name == s {
+			return algo, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash algorithm %q", s)
+}
+
+// Sum calculates the hash of b using the algorithm.  It panics when called on
+// an unknown algorithm since that indicates a programming error.
+func (a HashAlgorithm) Sum(b []byte) Hash {
+	switch a {
+	case SHA256D:
+		return DoubleHashH(b)
+
+	case Blake2b:
+		return Hash(blake2b.Sum256(b))
+
+	case Keccak256:
+		var hash Hash
+		h := sha3.NewLegacyKeccak256()
+		h.Write(b)
+		h.Sum(hash[:0])
+		return hash
+	}
+
+	panic(fmt.Sprintf("hash algorithm %v is not supported", a))
+}
+
+// chainHashAlgorithm holds the HashAlgorithm used by ChainHashH.  It is stored
+// atomically since it is set once at startup and read from every subsystem.
+var chainHashAlgorithm uint32
+
+// UseHashAlgorithm sets the algorithm used to compute block and transaction
+// hashes.  It is meant to be called once at startup with the value from the
+// active chain parameters, before any hash is computed.
+func UseHashAlgorithm(algo HashAlgorithm) error {
+	if algo >= numHashAlgorithms {
+		return fmt.Errorf("hash algorithm %v is not supported", algo)
+	}
+	atomic.StoreUint32(&chainHashAlgorithm, uint32(algo))
+	return nil
+}
+
+// ChainHashAlgorithm returns the algorithm used to compute block and
+// transaction hashes.
+func ChainHashAlgorithm() HashAlgorithm {
+	return HashAlgorithm(atomic.LoadUint32(&chainHashAlgorithm))
+}
+
+// ChainHashH calculates the hash of b using the algorithm selected by
+// UseHashAlgorithm.
+func ChainHashH(b []byte) Hash {
+	return ChainHashAlgorithm().Sum(b)
+}
@@ -1 +1,116 @@
 package common
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// MaxConsensusDataLen is the maximum number of bytes of engine specific data a
+// block header may carry.
+const MaxConsensusDataLen = 4096
+
+// blockHeaderFixedLen is the number of bytes of a serialized block header
+// excluding the variable length consensus data.
+// Version 4 bytes + PrevBlock 32 bytes + MerkleRoot 32 bytes + Timestamp 8
+// bytes + Height 8 bytes + Bits 4 bytes + Nonce 8 bytes.
+const blockHeaderFixedLen = 96
+
+// MaxBlockHeaderPayload is the maximum number of bytes a block header can be.
+const MaxBlockHeaderPayload = blockHeaderFixedLen + MaxVarIntPayload +
+	MaxConsensusDataLen
+
+// BlockHeader defines information about a block and is used in block and
+// headers messages.
+type BlockHeader struct {
+	// Version of the block.  This is not the same as the protocol version.
+	Version int32
+
+	// Hash of the previous block header in the block chain.
+	PrevBlock Hash
+
+	// Merkle tree reference to hash of all transactions for the block.
+	MerkleRoot Hash
+
+	// Time the block was created.  This is, unfortunately, encoded as an
+	// int64 on the wire and therefore is limited to second precision.
+	Timestamp time.Time
+
+	// Height of the block in the chain, the genesis block is at height 0.
+	Height uint64
+
+	// Difficulty target for the block when the chain runs proof of work.
+	Bits uint32
+
+	// Nonce used to generate the block when the chain runs proof of work.
+	Nonce uint64
+
+	// ConsensusData holds engine specific data, for example the stake
+	// kernel of a proof of stake block or the proposer signature of a
+	// pbft round.  It is covered by the block hash.
+	ConsensusData []byte
+}
+
+// BlockHash computes the block identifier hash for the given block header.
+func (h *BlockHeader) BlockHash() Hash {
+	// Encode the header and hash it with the algorithm of the active
+	// chain.  Ignore the error returns since there is no way the encode
+	// could fail except being out of memory which would cause a run-time
+	// panic.
+	buf := bytes.NewBuffer(make([]byte, 0, h.SerializeSize()))
+	_ = h.Serialize(buf)
+
+	return ChainHashH(buf.Bytes())
+}
+
+// Deserialize decodes a block header from r into the receiver using the
+// canonical encoding used for both storage and the wire.
+func (h *BlockHeader) Deserialize(r io.Reader) error {
+	err := readElements(r, &h.Version, &h.PrevBlock, &h.MerkleRoot,
+		&h.Timestamp, &h.Height, &h.Bits, &h.Nonce)
+	if err != nil {
+		return err
+	}
+
+	h.ConsensusData, err = ReadVarBytes(r, MaxConsensusDataLen,
+		"block header consensus data")
+	return err
+}
+
+// Serialize encodes the receiver to w using the canonical encoding used for
+// both storage and the wire.
+func (h *BlockHeader) Serialize(w io.Writer) error {
+	err := writeElements(w, h.Version, &h.PrevBlock, &h.MerkleRoot,
+		h.Timestamp, h.Height, h.Bits, h.Nonce)
+	if err != nil {
+		return err
+	}
+
+	return WriteVarBytes(w, h.ConsensusData)
+}
+
+// SerializeSize returns the number of bytes it would take to serialize the
+// block header.
+func (h *BlockHeader) SerializeSize() int {
+	n := len(h.ConsensusData)
+	return blockHeaderFixedLen + VarIntSerializeSize(uint64(n)) + n
+}
+
+// NewBlockHeader returns a new BlockHeader using the provided version,
+// previous block hash, merkle root hash, height, difficulty bits, and nonce
+// used to generate the block with defaults for the remaining fields.
+func NewBlockHeader(version int32, prevHash, merkleRootHash *Hash,
+	height uint64, bits uint32, nonce uint64) *BlockHeader {
+
+	// Limit the timestamp to one second precision since the protocol
+	// doesn't support better.
+	return &BlockHeader{
+		Version:    version,
+		PrevBlock:  *prevHash,
+		MerkleRoot: *merkleRootHash,
+		Timestamp:  time.Unix(time.Now().Unix(), 0),
+		Height:     height,
+		Bits:       bits,
+		Nonce:      nonce,
+	}
+}
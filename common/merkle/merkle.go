@@ -0,0 +1,316 @@
+// Package merkle builds merkle trees over transaction hashes and produces and
+// verifies compact inclusion proofs against their roots.
+//
+// Trees are built the way bitcoin builds them: an odd node at the end of a
+// level is paired with itself.  That makes the lists [a b c] and [a b c c]
+// produce the same root (CVE-2012-2459), so a tree in which two distinct
+// positions at the same level pair up identical hashes is reported as mutated
+// and must be rejected by the caller.  Proofs carry the leaf index and the
+// number of leaves so the verifier knows where the duplication happens and
+// never accepts a prover supplied copy of a node as its own sibling.
+//
+// Leaves and inner nodes are hashed alike, an inner node being the hash of the
+// 64 bytes of its children.  A proof could thus pass an inner node off as a
+// leaf, or a 64 byte transaction as an inner node.  The verifier takes the
+// number of leaves from a source it trusts rather than from the proof, which
+// fixes the depth of the leaves, and 64 byte transactions are rejected.
+package merkle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/blockchainservice/common"
+)
+
+// MaxProofDepth is the maximum number of siblings a proof can contain.  It
+// covers trees with up to 2^32 leaves, far more than fit in a block.
+const MaxProofDepth = 32
+
+var (
+	// ErrNoLeaves is returned when a tree or proof is requested for an
+	// empty list of hashes.
+	ErrNoLeaves = errors.New("merkle tree has no leaves")
+
+	// ErrMutated is returned when the list of hashes contains a duplicated
+	// subtree which would make its root ambiguous.
+	ErrMutated = errors.New("merkle tree is mutated by duplicate hashes")
+
+	// ErrTxSize64 is returned for a transaction of 64 bytes, whose
+	// serialization can be mistaken for the children of an inner node.
+	ErrTxSize64 = errors.New("transaction of 64 bytes could be taken " +
+		"for an inner merkle node")
+)
+
+// HashMerkleBranches takes two hashes, treated as the left and right tree
+// nodes, and returns the hash of their concatenation using the hash
+// algorithm of the active chain.  This is a helper function used to aid in
+// the generation of a merkle tree.
+func HashMerkleBranches(left *common.Hash, right *common.Hash) common.Hash {
+	// Concatenate the left and right nodes.
+	var h [common.HashSize * 2]byte
+	copy(h[:common.HashSize], left[:])
+	copy(h[common.HashSize:], right[:])
+
+	return common.ChainHashH(h[:])
+}
+
+// nextLevel computes the parents of the given level of the tree.  The
+// returned flag is true when two distinct nodes that are paired together are
+// identical, which is how duplicated subtrees show up.
+func nextLevel(level []common.Hash) ([]common.Hash, bool) {
+	mutated := false
+	parents := make([]common.Hash, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		// When there is no right child the parent is generated by
+		// hashing the concatenation of the left child with itself.
+		if i+1 == len(level) {
+			parents = append(parents, HashMerkleBranches(&level[i], &level[i]))
+			continue
+		}
+		if level[i] == level[i+1] {
+			mutated = true
+		}
+		parents = append(parents, HashMerkleBranches(&level[i], &level[i+1]))
+	}
+	return parents, mutated
+}
+
+// CalcMerkleRoot returns the merkle root of the passed leaf hashes along with
+// whether or not the tree is mutated.  A mutated tree has the same root as a
+// shorter list of hashes and must not be accepted as valid.  The root of an
+// empty list is the zero hash.
+func CalcMerkleRoot(leaves []common.Hash) (common.Hash, bool) {
+	if len(leaves) == 0 {
+		return common.Hash{}, false
+	}
+
+	level := leaves
+	mutated := false
+	for len(level) > 1 {
+		var m bool
+		level, m = nextLevel(level)
+		mutated = mutated || m
+	}
+	return level[0], mutated
+}
+
+// BuildMerkleTreeStore creates a merkle tree from the passed leaf hashes,
+// stores it using a linear array, and returns the array along with whether or
+// not the tree is mutated.  The leaves come first, followed by each level up
+// to the root which is the final element.
+//
+// A merkle tree is a tree in which every non-leaf node is the hash of its
+// children nodes.  A diagram depicting how this works for four leaves
+// follows:
+//
+//	       root = h1234 = h(h12 + h34)
+//	      /                           \
+//	h12 = h(h1 + h2)            h34 = h(h3 + h4)
+//	 /            \              /            \
+//	h1            h2            h3            h4
+//
+// The above stored as a linear array is as follows:
+//
+//	[h1 h2 h3 h4 h12 h34 root]
+func BuildMerkleTreeStore(leaves []common.Hash) ([]common.Hash, bool) {
+	if len(leaves) == 0 {
+		return nil, false
+	}
+
+	store := append(make([]common.Hash, 0, 2*len(leaves)), leaves...)
+	level := leaves
+	mutated := false
+	for len(level) > 1 {
+		var m bool
+		level, m = nextLevel(level)
+		mutated = mutated || m
+		store = append(store, level...)
+	}
+	return store, mutated
+}
+
+// BlockMerkleRoot returns the merkle root of the transactions in the block.
+// ErrMutated is returned when the transaction list contains duplicates that
+// make the root ambiguous.
+func BlockMerkleRoot(block *common.Block) (common.Hash, error) {
+	root, mutated := CalcMerkleRoot(block.TxHashes())
+	if mutated {
+		return common.Hash{}, ErrMutated
+	}
+	return root, nil
+}
+
+// Proof is a merkle inclusion proof for a single leaf.  Siblings lists the
+// hashes needed to recompute the root from the leaf, ordered from the leaf
+// level upwards.  Levels at which the node on the path is an odd last node
+// are skipped since the node is paired with itself.
+type Proof struct {
+	LeafIndex uint32
+	NumLeaves uint32
+	Siblings  []common.Hash
+}
+
+// NewProof returns an inclusion proof for the leaf at the given index of the
+// passed leaf hashes.  ErrMutated is returned for trees whose root is
+// ambiguous since proofs against them are meaningless.
+func NewProof(leaves []common.Hash, index int) (*Proof, error) {
+	if len(leaves) == 0 {
+		return nil, ErrNoLeaves
+	}
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf index %d out of range [0, %d)",
+			index, len(leaves))
+	}
+
+	proof := &Proof{
+		LeafIndex: uint32(index),
+		NumLeaves: uint32(len(leaves)),
+	}
+	level := leaves
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, level[sibling])
+		}
+
+		var mutated bool
+		level, mutated = nextLevel(level)
+		if mutated {
+			return nil, ErrMutated
+		}
+		index >>= 1
+	}
+	return proof, nil
+}
+
+// Root recomputes the merkle root implied by the proof for the given leaf.
+func (p *Proof) Root(leaf common.Hash) (common.Hash, error) {
+	if p.NumLeaves == 0 {
+		return common.Hash{}, ErrNoLeaves
+	}
+	if p.LeafIndex >= p.NumLeaves {
+		return common.Hash{}, fmt.Errorf("leaf index %d out of range [0, %d)",
+			p.LeafIndex, p.NumLeaves)
+	}
+
+	node := leaf
+	index, width := p.LeafIndex, p.NumLeaves
+	used := 0
+	for width > 1 {
+		if index^1 >= width {
+			// The node is the odd last one of its level and is paired
+			// with itself, no sibling is consumed.
+			node = HashMerkleBranches(&node, &node)
+		} else {
+			if used == len(p.Siblings) {
+				return common.Hash{}, errors.New("merkle proof is " +
+					"missing siblings")
+			}
+			sibling := p.Siblings[used]
+			used++
+
+			// Two identical distinct nodes only appear in mutated
+			// trees, which never have valid proofs.
+			if sibling == node {
+				return common.Hash{}, ErrMutated
+			}
+			if index&1 == 0 {
+				node = HashMerkleBranches(&node, &sibling)
+			} else {
+				node = HashMerkleBranches(&sibling, &node)
+			}
+		}
+		index >>= 1
+		width = (width + 1) >> 1
+	}
+	if used != len(p.Siblings) {
+		return common.Hash{}, fmt.Errorf("merkle proof has %d unused "+
+			"siblings", len(p.Siblings)-used)
+	}
+	return node, nil
+}
+
+// Verify returns nil when the proof shows that leaf is included in the tree
+// with the given root and number of leaves.  numLeaves must come from a
+// source the verifier trusts, such as the block, and not from the proof.
+func (p *Proof) Verify(leaf, root common.Hash, numLeaves uint32) error {
+	if p.NumLeaves != numLeaves {
+		return fmt.Errorf("merkle proof is for %d leaves, expected %d",
+			p.NumLeaves, numLeaves)
+	}
+	calculated, err := p.Root(leaf)
+	if err != nil {
+		return err
+	}
+	if calculated != root {
+		return fmt.Errorf("merkle proof leads to root %v, expected %v",
+			calculated, root)
+	}
+	return nil
+}
+
+// VerifyTx returns nil when the proof shows that tx is included in the tree
+// with the given root and number of leaves.  Transactions of 64 bytes are
+// rejected with ErrTxSize64.
+func (p *Proof) VerifyTx(tx *common.Tx, root common.Hash, numLeaves uint32) error {
+	if tx.SerializeSize() == 2*common.HashSize {
+		return ErrTxSize64
+	}
+	return p.Verify(tx.TxHash(), root, numLeaves)
+}
+
+// Serialize encodes the proof to w.
+func (p *Proof) Serialize(w io.Writer) error {
+	if err := common.WriteVarInt(w, uint64(p.LeafIndex)); err != nil {
+		return err
+	}
+	if err := common.WriteVarInt(w, uint64(p.NumLeaves)); err != nil {
+		return err
+	}
+	if err := common.WriteVarInt(w, uint64(len(p.Siblings))); err != nil {
+		return err
+	}
+	for i := range p.Siblings {
+		if _, err := w.Write(p.Siblings[i][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deserialize decodes a proof from r into the receiver.
+func (p *Proof) Deserialize(r io.Reader) error {
+	index, err := common.ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+	numLeaves, err := common.ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+	if numLeaves == 0 || numLeaves > 1<<MaxProofDepth-1 || index >= numLeaves {
+		return fmt.Errorf("invalid merkle proof leaf index %d of %d",
+			index, numLeaves)
+	}
+
+	count, err := common.ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+	if count > uint64(bits.Len64(numLeaves-1)) {
+		return fmt.Errorf("merkle proof has too many siblings [count %d, "+
+			"max %d]", count, bits.Len64(numLeaves-1))
+	}
+
+	p.LeafIndex = uint32(index)
+	p.NumLeaves = uint32(numLeaves)
+	p.Siblings = make([]common.Hash, count)
+	for i := range p.Siblings {
+		if _, err := io.ReadFull(r, p.Siblings[i][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package merkle
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/blockchainservice/common"
+)
+
+// makeLeaves returns n distinct leaf hashes.
+func makeLeaves(n int) []common.Hash {
+	leaves := make([]common.Hash, n)
+	for i := range leaves {
+		leaves[i] = common.DoubleHashH([]byte{byte(i), byte(i >> 8)})
+	}
+	return leaves
+}
+
+// TestMutatedTree ensures a list of hashes whose last one is duplicated, as
+// in CVE-2012-2459, has the root of the list without the duplicate and is
+// reported as mutated.
+func TestMutatedTree(t *testing.T) {
+	leaves := makeLeaves(3)
+	a, b, c := leaves[0], leaves[1], leaves[2]
+
+	root, mutated := CalcMerkleRoot([]common.Hash{a, b, c})
+	if mutated {
+		t.Error("[a b c] reported as mutated")
+	}
+	dupRoot, mutated := CalcMerkleRoot([]common.Hash{a, b, c, c})
+	if !mutated {
+		t.Error("[a b c c] not reported as mutated")
+	}
+	if dupRoot != root {
+		t.Errorf("[a b c c] has root %v, want the one of [a b c] %v",
+			dupRoot, root)
+	}
+	store, mutated := BuildMerkleTreeStore([]common.Hash{a, b, c, c})
+	if !mutated || store[len(store)-1] != root {
+		t.Errorf("tree store of [a b c c]: mutated %v, root %v", mutated,
+			store[len(store)-1])
+	}
+	if _, err := NewProof([]common.Hash{a, b, c, c}, 2); err != ErrMutated {
+		t.Errorf("proof in [a b c c]: got %v, want %v", err, ErrMutated)
+	}
+
+	// The duplicate of the last one of six hashes shows up one level up.
+	leaves = makeLeaves(6)
+	if _, mutated := CalcMerkleRoot(leaves); mutated {
+		t.Error("6 leaves reported as mutated")
+	}
+	leaves = append(leaves, leaves[4:]...)
+	if _, mutated := CalcMerkleRoot(leaves); !mutated {
+		t.Error("6 leaves with the last two duplicated not reported as " +
+			"mutated")
+	}
+}
+
+// TestProofRoundTrip ensures the proof of every leaf of trees of 1 to 33
+// leaves verifies against the root once serialized and deserialized, and
+// fails for another leaf, root or number of leaves.
+func TestProofRoundTrip(t *testing.T) {
+	for n := 1; n <= 33; n++ {
+		leaves := makeLeaves(n)
+		root, _ := CalcMerkleRoot(leaves)
+		for i := range leaves {
+			proof, err := NewProof(leaves, i)
+			if err != nil {
+				t.Fatalf("%d/%d: NewProof: %v", i, n, err)
+			}
+
+			var buf bytes.Buffer
+			if err := proof.Serialize(&buf); err != nil {
+				t.Fatalf("%d/%d: Serialize: %v", i, n, err)
+			}
+			var decoded Proof
+			if err := decoded.Deserialize(&buf); err != nil {
+				t.Fatalf("%d/%d: Deserialize: %v", i, n, err)
+			}
+			// Proofs without siblings decode to an empty list.
+			want := *proof
+			if want.Siblings == nil {
+				want.Siblings = []common.Hash{}
+			}
+			if !reflect.DeepEqual(decoded, want) {
+				t.Errorf("%d/%d: decoded %+v, want %+v", i, n,
+					decoded, want)
+			}
+
+			if err := decoded.Verify(leaves[i], root, uint32(n)); err != nil {
+				t.Errorf("%d/%d: Verify: %v", i, n, err)
+			}
+			other := leaves[(i+1)%n]
+			if n > 1 && decoded.Verify(other, root, uint32(n)) == nil {
+				t.Errorf("%d/%d: proof verifies another leaf", i, n)
+			}
+			badRoot := root
+			badRoot[0] ^= 1
+			if decoded.Verify(leaves[i], badRoot, uint32(n)) == nil {
+				t.Errorf("%d/%d: proof verifies another root", i, n)
+			}
+			if decoded.Verify(leaves[i], root, uint32(n+1)) == nil {
+				t.Errorf("%d/%d: proof verifies with %d leaves", i, n,
+					n+1)
+			}
+		}
+	}
+}
+
+// TestProofInnerNode ensures an inner node cannot be proven as a leaf of the
+// tree, the number of leaves given by the verifier fixing their depth.
+func TestProofInnerNode(t *testing.T) {
+	leaves := makeLeaves(8)
+	root, _ := CalcMerkleRoot(leaves)
+
+	// The parents of the leaves form a tree of four leaves with the same
+	// root.
+	parents, _ := nextLevel(leaves)
+	proof, err := NewProof(parents, 1)
+	if err != nil {
+		t.Fatalf("NewProof: %v", err)
+	}
+	if err := proof.Verify(parents[1], root, 4); err != nil {
+		t.Fatalf("proof of the parent level: %v", err)
+	}
+	if err := proof.Verify(parents[1], root, 8); err == nil {
+		t.Error("inner node proven as a leaf of 8")
+	}
+
+	// Claiming the missing levels by lying about the number of leaves does
+	// not help either.
+	proof.NumLeaves = 8
+	if err := proof.Verify(parents[1], root, 8); err == nil {
+		t.Error("inner node proven with a forged number of leaves")
+	}
+}
+
+// TestVerifyTx ensures transactions are verified by hash and those of 64
+// bytes are rejected.
+func TestVerifyTx(t *testing.T) {
+	tx := &common.Tx{
+		Version: 1,
+		TxIn: []*common.TxIn{{
+			PreviousOutPoint: common.OutPoint{Index: common.MaxPrevOutIndex},
+			Sequence:         common.MaxTxInSequenceNum,
+		}},
+		TxOut: []*common.TxOut{{Value: 1}},
+	}
+	leaves := append(makeLeaves(2), tx.TxHash())
+	root, _ := CalcMerkleRoot(leaves)
+	proof, err := NewProof(leaves, 2)
+	if err != nil {
+		t.Fatalf("NewProof: %v", err)
+	}
+	if err := proof.VerifyTx(tx, root, 3); err != nil {
+		t.Errorf("VerifyTx: %v", err)
+	}
+
+	tx.TxIn[0].SignatureScript = make([]byte, 64-tx.SerializeSize())
+	if tx.SerializeSize() != 64 {
+		t.Fatalf("transaction of %d bytes, want 64", tx.SerializeSize())
+	}
+	leaves[2] = tx.TxHash()
+	root, _ = CalcMerkleRoot(leaves)
+	if proof, err = NewProof(leaves, 2); err != nil {
+		t.Fatalf("NewProof: %v", err)
+	}
+	if err := proof.VerifyTx(tx, root, 3); err != ErrTxSize64 {
+		t.Errorf("VerifyTx of 64 bytes: got %v, want %v", err,
+			ErrTxSize64)
+	}
+}
+
+// TestProofDeserializeErrors ensures malformed proofs are rejected.
+func TestProofDeserializeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{name: "empty", buf: nil},
+		{name: "no leaves", buf: []byte{0, 0, 0}},
+		{name: "index out of range", buf: []byte{2, 2, 1}},
+		{name: "too many siblings", buf: []byte{0, 4, 3}},
+		{name: "missing siblings", buf: []byte{0, 4, 2, 0}},
+		{name: "too many leaves", buf: []byte{0, 0xff, 0, 0, 0, 0, 1, 0,
+			0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		var proof Proof
+		if err := proof.Deserialize(bytes.NewReader(test.buf)); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxVarIntPayload is the maximum payload size for a variable length integer.
+const MaxVarIntPayload = 9
+
+// littleEndian is a convenience variable since binary.LittleEndian is quite
+// long.
+var littleEndian = binary.LittleEndian
+
+// readElement reads the next sequence of bytes from r using little endian
+// depending on the concrete type of element pointed to.
+func readElement(r io.Reader, element interface{}) error {
+	var scratch [8]byte
+
+	switch e := element.(type) {
+	case *int32:
+		if _, err := io.ReadFull(r, scratch[:4]); err != nil {
+			return err
+		}
+		*e = int32(littleEndian.Uint32(scratch[:4]))
+		return nil
+
+	case *uint32:
+		if _, err := io.ReadFull(r, scratch[:4]); err != nil {
+			return err
+		}
+		*e = littleEndian.Uint32(scratch[:4])
+		return nil
+
+	case *int64:
+		if _, err := io.ReadFull(r, scratch[:8]); err != nil {
+			return err
+		}
+		*e = int64(littleEndian.Uint64(scratch[:8]))
+		return nil
+
+	case *uint64:
+		if _, err := io.ReadFull(r, scratch[:8]); err != nil {
+			return err
+		}
+		*e = littleEndian.Uint64(scratch[:8])
+		return nil
+
+	// Unix timestamp encoded as an int64 number of seconds.
+	case *time.Time:
+		var sec int64
+		if err := readElement(r, &sec); err != nil {
+			return err
+		}
+		*e = time.Unix(sec, 0)
+		return nil
+
+	case *Hash:
+		_, err := io.ReadFull(r, e[:])
+		return err
+	}
+
+	return fmt.Errorf("readElement: unsupported type %T", element)
+}
+
+// readElements reads multiple items from r.  It is equivalent to multiple
+// calls to readElement.
+func readElements(r io.Reader, elements ...interface{}) error {
+	for _, element := range elements {
+		if err := readElement(r, element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeElement writes the little endian representation of element to w.
+func writeElement(w io.Writer, element interface{}) error {
+	var scratch [8]byte
+
+	switch e := element.(type) {
+	case int32:
+		littleEndian.PutUint32(scratch[:4], uint32(e))
+		_, err := w.Write(scratch[:4])
+		return err
+
+	case uint32:
+		littleEndian.PutUint32(scratch[:4], e)
+		_, err := w.Write(scratch[:4])
+		return err
+
+	case int64:
+		littleEndian.PutUint64(scratch[:8], uint64(e))
+		_, err := w.Write(scratch[:8])
+		return err
+
+	case uint64:
+		littleEndian.PutUint64(scratch[:8], e)
+		_, err := w.Write(scratch[:8])
+		return err
+
+	// Unix timestamp encoded as an int64 number of seconds.
+	case time.Time:
+		return writeElement(w, e.Unix())
+
+	case *Hash:
+		_, err := w.Write(e[:])
+		return err
+
+	case Hash:
+		_, err := w.Write(e[:])
+		return err
+	}
+
+	return fmt.Errorf("writeElement: unsupported type %T", element)
+}
+
+// writeElements writes multiple items to w.  It is equivalent to multiple
+// calls to writeElement.
+func writeElements(w io.Writer, elements ...interface{}) error {
+	for _, element := range elements {
+		if err := writeElement(w, element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadVarInt reads a variable length integer from r and returns it as a
+// uint64.  Non-canonical encodings, where a value is encoded with more bytes
+// than necessary, are rejected so every value has exactly one encoding.
+func ReadVarInt(r io.Reader) (uint64, error) {
+	var discriminant [1]byte
+	if _, err := io.ReadFull(r, discriminant[:]); err != nil {
+		return 0, err
+	}
+
+	var rv, min uint64
+	var scratch [8]byte
+	switch discriminant[0] {
+	case 0xff:
+		if _, err := io.ReadFull(r, scratch[:8]); err != nil {
+			return 0, err
+		}
+		rv = littleEndian.Uint64(scratch[:8])
+		min = 0x100000000
+
+	case 0xfe:
+		if _, err := io.ReadFull(r, scratch[:4]); err != nil {
+			return 0, err
+		}
+		rv = uint64(littleEndian.Uint32(scratch[:4]))
+		min = 0x10000
+
+	case 0xfd:
+		if _, err := io.ReadFull(r, scratch[:2]); err != nil {
+			return 0, err
+		}
+		rv = uint64(littleEndian.Uint16(scratch[:2]))
+		min = 0xfd
+
+	default:
+		return uint64(discriminant[0]), nil
+	}
+
+	if rv < min {
+		return 0, fmt.Errorf("ReadVarInt: non-canonical varint %x - "+
+			"discriminant %x must encode a value greater than %x",
+			rv, discriminant[0], min)
+	}
+	return rv, nil
+}
+
+// WriteVarInt serializes val to w using a variable number of bytes depending
+// on its value.
+func WriteVarInt(w io.Writer, val uint64) error {
+	var buf [MaxVarIntPayload]byte
+	switch {
+	case val < 0xfd:
+		buf[0] = uint8(val)
+		_, err := w.Write(buf[:1])
+		return err
+
+	case val <= 0xffff:
+		buf[0] = 0xfd
+		littleEndian.PutUint16(buf[1:3], uint16(val))
+		_, err := w.Write(buf[:3])
+		return err
+
+	case val <= 0xffffffff:
+		buf[0] = 0xfe
+		littleEndian.PutUint32(buf[1:5], uint32(val))
+		_, err := w.Write(buf[:5])
+		return err
+	}
+
+	buf[0] = 0xff
+	littleEndian.PutUint64(buf[1:9], val)
+	_, err := w.Write(buf[:9])
+	return err
+}
+
+// VarIntSerializeSize returns the number of bytes it would take to serialize
+// val as a variable length integer.
+func VarIntSerializeSize(val uint64) int {
+	switch {
+	case val < 0xfd:
+		return 1
+	case val <= 0xffff:
+		return 3
+	case val <= 0xffffffff:
+		return 5
+	}
+	return 9
+}
+
+// ReadVarBytes reads a variable length byte array.  A byte array is encoded
+// as a varInt containing the length of the array followed by the bytes
+// themselves.  An error is returned if the length is greater than the
+// passed maxAllowed parameter which helps protect against memory exhaustion
+// attacks and forced panics through malformed messages.  The fieldName
+// parameter is only used for the error message so it provides more context in
+// the error.
+func ReadVarBytes(r io.Reader, maxAllowed uint32, fieldName string) ([]byte, error) {
+	count, err := ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prevent byte array larger than the max message size.  It would
+	// be possible to cause memory exhaustion and panics without a sane
+	// upper bound on this count.
+	if count > uint64(maxAllowed) {
+		return nil, fmt.Errorf("%s is larger than the max allowed size "+
+			"[count %d, max %d]", fieldName, count, maxAllowed)
+	}
+
+	b := make([]byte, count)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WriteVarBytes serializes a variable length byte array to w as a varInt
+// containing the number of bytes, followed by the bytes themselves.
+func WriteVarBytes(w io.Writer, bytes []byte) error {
+	if err := WriteVarInt(w, uint64(len(bytes))); err != nil {
+		return err
+	}
+	_, err := w.Write(bytes)
+	return err
+}
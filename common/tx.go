@@ -1 +1,355 @@
 package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// TxVersion is the current latest supported transaction version.
+	TxVersion = 1
+
+	// MaxTxInSequenceNum is the maximum sequence number the sequence field
+	// of a transaction input can be.
+	MaxTxInSequenceNum uint32 = 0xffffffff
+
+	// MaxPrevOutIndex is the maximum index the index field of a previous
+	// outpoint can be.
+	MaxPrevOutIndex uint32 = 0xffffffff
+
+	// MaxTxPayload is the maximum number of bytes a serialized transaction
+	// can be.
+	MaxTxPayload = 1024 * 1024
+
+	// MaxScriptSize is the maximum number of bytes a signature script or
+	// public key script can be.
+	MaxScriptSize = 10000
+
+	// minTxInPayload is the minimum payload size for a transaction input.
+	// PreviousOutPoint.Hash + PreviousOutPoint.Index 4 bytes + Varint for
+	// SignatureScript length 1 byte + Sequence 4 bytes.
+	minTxInPayload = 9 + HashSize
+
+	// minTxOutPayload is the minimum payload size for a transaction output.
+	// Value 8 bytes + Varint for PkScript length 1 byte.
+	minTxOutPayload = 9
+
+	// maxTxInPerTx and maxTxOutPerTx are the maximum number of inputs and
+	// outputs that could possibly fit into a transaction.
+	maxTxInPerTx  = MaxTxPayload / minTxInPayload
+	maxTxOutPerTx = MaxTxPayload / minTxOutPayload
+)
+
+// OutPoint defines a data type that is used to track previous transaction
+// outputs.
+type OutPoint struct {
+	Hash  Hash
+	Index uint32
+}
+
+// NewOutPoint returns a new transaction outpoint point with the provided
+// hash and index.
+func NewOutPoint(hash *Hash, index uint32) *OutPoint {
+	return &OutPoint{
+		Hash:  *hash,
+		Index: index,
+	}
+}
+
+// String returns the OutPoint in the human-readable form "hash:index".
+func (o OutPoint) String() string {
+	return o.Hash.String() + ":" + strconv.FormatUint(uint64(o.Index), 10)
+}
+
+// TxIn defines a transaction input.
+type TxIn struct {
+	PreviousOutPoint OutPoint
+	SignatureScript  []byte
+	Sequence         uint32
+}
+
+// SerializeSize returns the number of bytes it would take to serialize the
+// the transaction input.
+func (t *TxIn) SerializeSize() int {
+	// Outpoint Hash 32 bytes + Outpoint Index 4 bytes + Sequence 4 bytes +
+	// serialized varint size for the length of SignatureScript +
+	// SignatureScript bytes.
+	return 40 + VarIntSerializeSize(uint64(len(t.SignatureScript))) +
+		len(t.SignatureScript)
+}
+
+// NewTxIn returns a new transaction input with the provided previous outpoint
+// and signature script with a default sequence of MaxTxInSequenceNum.
+func NewTxIn(prevOut *OutPoint, signatureScript []byte) *TxIn {
+	return &TxIn{
+		PreviousOutPoint: *prevOut,
+		SignatureScript:  signatureScript,
+		Sequence:         MaxTxInSequenceNum,
+	}
+}
+
+// TxOut defines a transaction output.
+type TxOut struct {
+	Value    int64
+	PkScript []byte
+}
+
+// SerializeSize returns the number of bytes it would take to serialize the
+// the transaction output.
+func (t *TxOut) SerializeSize() int {
+	// Value 8 bytes + serialized varint size for the length of PkScript +
+	// PkScript bytes.
+	return 8 + VarIntSerializeSize(uint64(len(t.PkScript))) + len(t.PkScript)
+}
+
+// NewTxOut returns a new transaction output with the provided
+// transaction value and public key script.
+func NewTxOut(value int64, pkScript []byte) *TxOut {
+	return &TxOut{
+		Value:    value,
+		PkScript: pkScript,
+	}
+}
+
+// Tx is used to deliver transaction information.  A transaction spends the
+// outputs referenced by its inputs and creates new outputs, and may carry an
+// application defined payload.
+//
+// Use the AddTxIn and AddTxOut functions to build up the list of transaction
+// inputs and outputs.
+type Tx struct {
+	Version  int32
+	TxIn     []*TxIn
+	TxOut    []*TxOut
+	LockTime uint32
+	Payload  []byte
+}
+
+// AddTxIn adds a transaction input to the transaction.
+func (tx *Tx) AddTxIn(ti *TxIn) {
+	tx.TxIn = append(tx.TxIn, ti)
+}
+
+// AddTxOut adds a transaction output to the transaction.
+func (tx *Tx) AddTxOut(to *TxOut) {
+	tx.TxOut = append(tx.TxOut, to)
+}
+
+// TxHash generates the Hash for the transaction.
+func (tx *Tx) TxHash() Hash {
+	// Encode the transaction and hash the result with the algorithm of the
+	// active chain.
+	// Ignore the error returns since the only way the encode could fail
+	// is being out of memory or due to nil pointers, both of which would
+	// cause a run-time panic.
+	buf := bytes.NewBuffer(make([]byte, 0, tx.SerializeSize()))
+	_ = tx.Serialize(buf)
+
+	return ChainHashH(buf.Bytes())
+}
+
+// IsCoinBase determines whether or not the transaction is a coinbase.  A
+// coinbase is a special transaction created by miners or block proposers that
+// has no inputs.  This is represented by exactly one input whose previous
+// outpoint has a zero hash and the maximum index.
+func (tx *Tx) IsCoinBase() bool {
+	if len(tx.TxIn) != 1 {
+		return false
+	}
+
+	prevOut := &tx.TxIn[0].PreviousOutPoint
+	return prevOut.Index == MaxPrevOutIndex && prevOut.Hash == (Hash{})
+}
+
+// Copy creates a deep copy of a transaction so that the original does not get
+// modified when the copy is manipulated.
+func (tx *Tx) Copy() *Tx {
+	newTx := Tx{
+		Version:  tx.Version,
+		TxIn:     make([]*TxIn, 0, len(tx.TxIn)),
+		TxOut:    make([]*TxOut, 0, len(tx.TxOut)),
+		LockTime: tx.LockTime,
+	}
+	if tx.Payload != nil {
+		newTx.Payload = append([]byte{}, tx.Payload...)
+	}
+
+	for _, oldTxIn := range tx.TxIn {
+		var newScript []byte
+		if oldTxIn.SignatureScript != nil {
+			newScript = append([]byte{}, oldTxIn.SignatureScript...)
+		}
+		newTx.TxIn = append(newTx.TxIn, &TxIn{
+			PreviousOutPoint: oldTxIn.PreviousOutPoint,
+			SignatureScript:  newScript,
+			Sequence:         oldTxIn.Sequence,
+		})
+	}
+
+	for _, oldTxOut := range tx.TxOut {
+		var newScript []byte
+		if oldTxOut.PkScript != nil {
+			newScript = append([]byte{}, oldTxOut.PkScript...)
+		}
+		newTx.TxOut = append(newTx.TxOut, &TxOut{
+			Value:    oldTxOut.Value,
+			PkScript: newScript,
+		})
+	}
+
+	return &newTx
+}
+
+// Deserialize decodes a transaction from r into the receiver using the
+// canonical encoding used for both storage and the wire.
+func (tx *Tx) Deserialize(r io.Reader) error {
+	if err := readElement(r, &tx.Version); err != nil {
+		return err
+	}
+
+	count, err := ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+
+	// Prevent more input transactions than could possibly fit into a
+	// message.  It would be possible to cause memory exhaustion and panics
+	// without a sane upper bound on this count.
+	if count > uint64(maxTxInPerTx) {
+		return fmt.Errorf("Tx.Deserialize: too many input transactions "+
+			"to fit into max message size [count %d, max %d]", count,
+			maxTxInPerTx)
+	}
+
+	tx.TxIn = make([]*TxIn, count)
+	for i := uint64(0); i < count; i++ {
+		ti := new(TxIn)
+		err := readElements(r, &ti.PreviousOutPoint.Hash,
+			&ti.PreviousOutPoint.Index)
+		if err != nil {
+			return err
+		}
+		ti.SignatureScript, err = ReadVarBytes(r, MaxScriptSize,
+			"transaction input signature script")
+		if err != nil {
+			return err
+		}
+		if err := readElement(r, &ti.Sequence); err != nil {
+			return err
+		}
+		tx.TxIn[i] = ti
+	}
+
+	count, err = ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+
+	// Prevent more output transactions than could possibly fit into a
+	// message.  It would be possible to cause memory exhaustion and panics
+	// without a sane upper bound on this count.
+	if count > uint64(maxTxOutPerTx) {
+		return fmt.Errorf("Tx.Deserialize: too many output transactions "+
+			"to fit into max message size [count %d, max %d]", count,
+			maxTxOutPerTx)
+	}
+
+	tx.TxOut = make([]*TxOut, count)
+	for i := uint64(0); i < count; i++ {
+		to := new(TxOut)
+		if err := readElement(r, &to.Value); err != nil {
+			return err
+		}
+		to.PkScript, err = ReadVarBytes(r, MaxScriptSize,
+			"transaction output public key script")
+		if err != nil {
+			return err
+		}
+		tx.TxOut[i] = to
+	}
+
+	if err := readElement(r, &tx.LockTime); err != nil {
+		return err
+	}
+
+	tx.Payload, err = ReadVarBytes(r, MaxTxPayload, "transaction payload")
+	return err
+}
+
+// Serialize encodes the transaction to w using the canonical encoding used
+// for both storage and the wire.
+func (tx *Tx) Serialize(w io.Writer) error {
+	if err := writeElement(w, tx.Version); err != nil {
+		return err
+	}
+
+	if err := WriteVarInt(w, uint64(len(tx.TxIn))); err != nil {
+		return err
+	}
+	for _, ti := range tx.TxIn {
+		err := writeElements(w, &ti.PreviousOutPoint.Hash,
+			ti.PreviousOutPoint.Index)
+		if err != nil {
+			return err
+		}
+		if err := WriteVarBytes(w, ti.SignatureScript); err != nil {
+			return err
+		}
+		if err := writeElement(w, ti.Sequence); err != nil {
+			return err
+		}
+	}
+
+	if err := WriteVarInt(w, uint64(len(tx.TxOut))); err != nil {
+		return err
+	}
+	for _, to := range tx.TxOut {
+		if err := writeElement(w, to.Value); err != nil {
+			return err
+		}
+		if err := WriteVarBytes(w, to.PkScript); err != nil {
+			return err
+		}
+	}
+
+	if err := writeElement(w, tx.LockTime); err != nil {
+		return err
+	}
+
+	return WriteVarBytes(w, tx.Payload)
+}
+
+// SerializeSize returns the number of bytes it would take to serialize the
+// the transaction.
+func (tx *Tx) SerializeSize() int {
+	// Version 4 bytes + LockTime 4 bytes + Serialized varint size for the
+	// number of transaction inputs and outputs + Serialized varint size and
+	// bytes of the payload.
+	n := 8 + VarIntSerializeSize(uint64(len(tx.TxIn))) +
+		VarIntSerializeSize(uint64(len(tx.TxOut))) +
+		VarIntSerializeSize(uint64(len(tx.Payload))) + len(tx.Payload)
+
+	for _, txIn := range tx.TxIn {
+		n += txIn.SerializeSize()
+	}
+
+	for _, txOut := range tx.TxOut {
+		n += txOut.SerializeSize()
+	}
+
+	return n
+}
+
+// NewTx returns a new transaction using the provided version.  There are no
+// transaction inputs or outputs.  Also, the lock time is set to zero to
+// indicate the transaction is valid immediately as opposed to some time in
+// future.
+func NewTx(version int32) *Tx {
+	return &Tx{
+		Version: version,
+		TxIn:    make([]*TxIn, 0, 1),
+		TxOut:   make([]*TxOut, 0, 1),
+	}
+}
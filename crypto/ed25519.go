@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+)
+
+// Ed25519PrivateKey is an Ed25519 private key.
+type Ed25519PrivateKey struct {
+	key ed25519.PrivateKey
+}
+
+// Ensure Ed25519PrivateKey implements the PrivateKey interface.
+var _ PrivateKey = (*Ed25519PrivateKey)(nil)
+
+func generateEd25519() (*Ed25519PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Ed25519PrivateKey{key: key}, nil
+}
+
+func parseEd25519PrivateKey(b []byte) (*Ed25519PrivateKey, error) {
+	if len(b) != ed25519.SeedSize {
+		return nil, errors.New("malformed ed25519 private key")
+	}
+	return &Ed25519PrivateKey{key: ed25519.NewKeyFromSeed(b)}, nil
+}
+
+// Type returns KeyTypeEd25519.
+func (k *Ed25519PrivateKey) Type() KeyType {
+	return KeyTypeEd25519
+}
+
+// PubKey returns the public key corresponding to the private key.
+func (k *Ed25519PrivateKey) PubKey() PublicKey {
+	return &Ed25519PublicKey{key: k.key.Public().(ed25519.PublicKey)}
+}
+
+// Sign returns the 64-byte signature of hash.  Ed25519 signatures are
+// deterministic by construction.
+func (k *Ed25519PrivateKey) Sign(hash []byte) ([]byte, error) {
+	return ed25519.Sign(k.key, hash), nil
+}
+
+// Serialize returns the 32-byte seed the key is derived from.
+func (k *Ed25519PrivateKey) Serialize() []byte {
+	return append([]byte{}, k.key.Seed()...)
+}
+
+// Ed25519PublicKey is an Ed25519 public key.
+type Ed25519PublicKey struct {
+	key ed25519.PublicKey
+}
+
+// Ensure Ed25519PublicKey implements the PublicKey interface.
+var _ PublicKey = (*Ed25519PublicKey)(nil)
+
+func parseEd25519PublicKey(b []byte) (*Ed25519PublicKey, error) {
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed ed25519 public key")
+	}
+	return &Ed25519PublicKey{key: append(ed25519.PublicKey{}, b...)}, nil
+}
+
+// Type returns KeyTypeEd25519.
+func (k *Ed25519PublicKey) Type() KeyType {
+	return KeyTypeEd25519
+}
+
+// Serialize returns the 32 raw bytes of the public key.
+func (k *Ed25519PublicKey) Serialize() []byte {
+	return append([]byte{}, k.key...)
+}
+
+// Verify returns whether sig is a valid signature of hash.
+func (k *Ed25519PublicKey) Verify(hash, sig []byte) bool {
+	if len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(k.key, hash, sig)
+}
+
+// IsEqual returns whether other is the same Ed25519 public key.
+func (k *Ed25519PublicKey) IsEqual(other PublicKey) bool {
+	if other == nil || other.Type() != KeyTypeEd25519 {
+		return false
+	}
+	return bytes.Equal(k.key, other.Serialize())
+}
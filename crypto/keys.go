@@ -0,0 +1,142 @@
+// Package crypto provides the private and public keys used to authenticate
+// transactions, consensus votes and nodes.  Two signature schemes are
+// supported: ECDSA over secp256k1 with deterministic RFC6979 nonces and
+// Ed25519.
+package crypto
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KeyType identifies the signature scheme of a key.
+type KeyType uint8
+
+// These constants define the supported signature schemes.
+const (
+	// KeyTypeSecp256k1 is ECDSA over the secp256k1 curve.  Signatures use
+	// RFC6979 deterministic nonces and are DER encoded with a low S value.
+	KeyTypeSecp256k1 KeyType = iota
+
+	// KeyTypeEd25519 is the Ed25519 signature scheme of RFC8032.
+	KeyTypeEd25519
+)
+
+// Map of KeyType values back to their names for pretty printing.
+var keyTypeStrings = map[KeyType]string{
+	KeyTypeSecp256k1: "secp256k1",
+	KeyTypeEd25519:   "ed25519",
+}
+
+// String returns the KeyType as a human-readable name.
+func (t KeyType) String() string {
+	if s, ok := keyTypeStrings[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown KeyType (%d)", uint8(t))
+}
+
+// ErrUnknownKeyType is returned when a key of an unsupported type is
+// requested or decoded.
+var ErrUnknownKeyType = errors.New("unknown key type")
+
+// PublicKey is a public key of one of the supported signature schemes.
+type PublicKey interface {
+	// Type returns the signature scheme of the key.
+	Type() KeyType
+
+	// Serialize returns the key in its canonical encoding, which is the
+	// compressed point for secp256k1 and the 32 raw bytes for Ed25519.
+	Serialize() []byte
+
+	// Verify returns whether sig is a valid signature of hash by the key.
+	Verify(hash, sig []byte) bool
+
+	// IsEqual returns whether the key is the same as other.
+	IsEqual(other PublicKey) bool
+}
+
+// PrivateKey is a private key of one of the supported signature schemes.
+type PrivateKey interface {
+	// Type returns the signature scheme of the key.
+	Type() KeyType
+
+	// PubKey returns the public key corresponding to the private key.
+	PubKey() PublicKey
+
+	// Sign signs hash with the key.  Signing is deterministic: the same
+	// key and hash always produce the same signature.
+	Sign(hash []byte) ([]byte, error)
+
+	// Serialize returns the 32 byte secret of the key.
+	Serialize() []byte
+}
+
+// GeneratePrivateKey returns a new random private key of the given type.
+func GeneratePrivateKey(keyType KeyType) (PrivateKey, error) {
+	switch keyType {
+	case KeyTypeSecp256k1:
+		return generateSecp256k1()
+	case KeyTypeEd25519:
+		return generateEd25519()
+	}
+	return nil, ErrUnknownKeyType
+}
+
+// ParsePrivateKey parses a private key of the given type from its serialized
+// secret.
+func ParsePrivateKey(keyType KeyType, b []byte) (PrivateKey, error) {
+	switch keyType {
+	case KeyTypeSecp256k1:
+		return parseSecp256k1PrivateKey(b)
+	case KeyTypeEd25519:
+		return parseEd25519PrivateKey(b)
+	}
+	return nil, ErrUnknownKeyType
+}
+
+// ParsePublicKey parses a public key of the given type from its canonical
+// encoding.
+func ParsePublicKey(keyType KeyType, b []byte) (PublicKey, error) {
+	switch keyType {
+	case KeyTypeSecp256k1:
+		return parseSecp256k1PublicKey(b)
+	case KeyTypeEd25519:
+		return parseEd25519PublicKey(b)
+	}
+	return nil, ErrUnknownKeyType
+}
+
+// EncodePublicKey returns the key prefixed by its type so it can be decoded
+// without knowing the signature scheme in advance.
+func EncodePublicKey(key PublicKey) []byte {
+	serialized := key.Serialize()
+	b := make([]byte, 0, 1+len(serialized))
+	b = append(b, byte(key.Type()))
+	return append(b, serialized...)
+}
+
+// DecodePublicKey parses a public key encoded with EncodePublicKey.
+func DecodePublicKey(b []byte) (PublicKey, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty public key")
+	}
+	return ParsePublicKey(KeyType(b[0]), b[1:])
+}
+
+// EncodePrivateKey returns the key prefixed by its type so it can be decoded
+// without knowing the signature scheme in advance.
+func EncodePrivateKey(key PrivateKey) []byte {
+	serialized := key.Serialize()
+	b := make([]byte, 0, 1+len(serialized))
+	b = append(b, byte(key.Type()))
+	return append(b, serialized...)
+}
+
+// DecodePrivateKey parses a private key encoded with EncodePrivateKey.
+func DecodePrivateKey(b []byte) (PrivateKey, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty private key")
+	}
+	return ParsePrivateKey(KeyType(b[0]), b[1:])
+}
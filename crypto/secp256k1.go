@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// Secp256k1PrivKeyLen is the length of a serialized secp256k1 private key.
+const Secp256k1PrivKeyLen = btcec.PrivKeyBytesLen
+
+// Secp256k1PubKeyLen is the length of a compressed secp256k1 public key.
+const Secp256k1PubKeyLen = btcec.PubKeyBytesLenCompressed
+
+// secp256k1HalfOrder is half the order of the secp256k1 curve, the largest
+// S value of a canonical signature.
+var secp256k1HalfOrder = new(big.Int).Rsh(btcec.S256().N, 1)
+
+// Secp256k1PrivateKey is a secp256k1 private key.
+type Secp256k1PrivateKey struct {
+	key *btcec.PrivateKey
+}
+
+// Ensure Secp256k1PrivateKey implements the PrivateKey interface.
+var _ PrivateKey = (*Secp256k1PrivateKey)(nil)
+
+func generateSecp256k1() (*Secp256k1PrivateKey, error) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	return &Secp256k1PrivateKey{key: key}, nil
+}
+
+func parseSecp256k1PrivateKey(b []byte) (*Secp256k1PrivateKey, error) {
+	if len(b) != Secp256k1PrivKeyLen {
+		return nil, errors.New("malformed secp256k1 private key")
+	}
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), b)
+	if key.D.Sign() == 0 || key.D.Cmp(btcec.S256().N) >= 0 {
+		return nil, errors.New("secp256k1 private key out of range")
+	}
+	return &Secp256k1PrivateKey{key: key}, nil
+}
+
+// Type returns KeyTypeSecp256k1.
+func (k *Secp256k1PrivateKey) Type() KeyType {
+	return KeyTypeSecp256k1
+}
+
+// PubKey returns the public key corresponding to the private key.
+func (k *Secp256k1PrivateKey) PubKey() PublicKey {
+	return &Secp256k1PublicKey{key: k.key.PubKey()}
+}
+
+// Sign returns the DER encoded signature of hash.  The nonce is derived per
+// RFC6979 and the signature is normalized to a low S value.
+func (k *Secp256k1PrivateKey) Sign(hash []byte) ([]byte, error) {
+	sig, err := k.key.Sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+// Serialize returns the private key as a 256-bit big-endian number padded to
+// 32 bytes.
+func (k *Secp256k1PrivateKey) Serialize() []byte {
+	return k.key.Serialize()
+}
+
+// Secp256k1PublicKey is a secp256k1 public key.
+type Secp256k1PublicKey struct {
+	key *btcec.PublicKey
+}
+
+// Ensure Secp256k1PublicKey implements the PublicKey interface.
+var _ PublicKey = (*Secp256k1PublicKey)(nil)
+
+func parseSecp256k1PublicKey(b []byte) (*Secp256k1PublicKey, error) {
+	// Only the compressed encoding is accepted so every key has a single
+	// canonical encoding.
+	if len(b) != Secp256k1PubKeyLen {
+		return nil, errors.New("malformed secp256k1 public key")
+	}
+	key, err := btcec.ParsePubKey(b, btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	return &Secp256k1PublicKey{key: key}, nil
+}
+
+// Type returns KeyTypeSecp256k1.
+func (k *Secp256k1PublicKey) Type() KeyType {
+	return KeyTypeSecp256k1
+}
+
+// Serialize returns the public key in the 33-byte compressed format.
+func (k *Secp256k1PublicKey) Serialize() []byte {
+	return k.key.SerializeCompressed()
+}
+
+// Verify returns whether sig is a valid strict DER encoded signature of hash
+// with a low S value.  High S values and bytes trailing the DER encoding are
+// rejected so signatures are not malleable.
+func (k *Secp256k1PublicKey) Verify(hash, sig []byte) bool {
+	signature, err := btcec.ParseDERSignature(sig, btcec.S256())
+	if err != nil {
+		return false
+	}
+	if signature.S.Cmp(secp256k1HalfOrder) > 0 {
+		return false
+	}
+	// The parser ignores the bytes following the length of the encoding.
+	if len(sig) != int(sig[1])+2 {
+		return false
+	}
+	return signature.Verify(hash, k.key)
+}
+
+// IsEqual returns whether other is the same secp256k1 public key.
+func (k *Secp256k1PublicKey) IsEqual(other PublicKey) bool {
+	if other == nil || other.Type() != KeyTypeSecp256k1 {
+		return false
+	}
+	return bytes.Equal(k.Serialize(), other.Serialize())
+}
@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// decodeHex decodes the passed hex string and panics on failure.  It is only
+// used with hard-coded values.
+func decodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic("invalid hex in source file: " + s)
+	}
+	return b
+}
+
+// derSignature returns the strict DER encoding of the signature (r, s),
+// without normalizing s.
+func derSignature(r, s *big.Int) []byte {
+	encodeInt := func(n *big.Int) []byte {
+		b := n.Bytes()
+		if b[0]&0x80 != 0 {
+			b = append([]byte{0x00}, b...)
+		}
+		return append([]byte{0x02, byte(len(b))}, b...)
+	}
+	body := append(encodeInt(r), encodeInt(s)...)
+	return append([]byte{0x30, byte(len(body))}, body...)
+}
+
+// TestSecp256k1RFC6979 ensures signatures use the RFC6979 deterministic nonce
+// and a low S value by checking them against known vectors.
+func TestSecp256k1RFC6979(t *testing.T) {
+	// Test vectors matching Trezor and CoreBitcoin implementations.
+	tests := []struct {
+		key       string
+		msg       string
+		signature string
+	}{
+		{
+			"cca9fbcc1b41e5a95d369eaa6ddcff73b61a4efaa279cfc6567e8daa39cbaf50",
+			"sample",
+			"3045022100af340daf02cc15c8d5d08d7735dfe6b98a474ed373bdb5fbecf7571be52b384202205009fb27f37034a9b24b707b7c6b79ca23ddef9e25f7282e8a797efe53a8f124",
+		},
+		{
+			// The raw S value of this signature is above the half
+			// order and must be normalized.
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"Satoshi Nakamoto",
+			"3045022100934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d802202442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5",
+		},
+		{
+			"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364140",
+			"Satoshi Nakamoto",
+			"3045022100fd567d121db66e382991534ada77a6bd3106f0a1098c231e47993447cd6af2d002206b39cd0eb1bc8603e159ef5c20a5c8ad685a45b06ce9bebed3f153d10d93bed5",
+		},
+		{
+			"f8b8af8ce3c7cca5e300d33939540c10d45ce001b8f252bfbc57ba0342904181",
+			"Alan Turing",
+			"304402207063ae83e7f62bbb171798131b4a0564b956930092b33b07b395615d9ec7e15c022058dfcc1e00a35e1572f366ffe34ba0fc47db1e7189759b9fb233c5b05ab388ea",
+		},
+	}
+
+	for i, test := range tests {
+		privKey, err := ParsePrivateKey(KeyTypeSecp256k1, decodeHex(test.key))
+		if err != nil {
+			t.Errorf("#%d: ParsePrivateKey: %v", i, err)
+			continue
+		}
+		hash := sha256.Sum256([]byte(test.msg))
+		sig, err := privKey.Sign(hash[:])
+		if err != nil {
+			t.Errorf("#%d: Sign: %v", i, err)
+			continue
+		}
+		if want := decodeHex(test.signature); !bytes.Equal(sig, want) {
+			t.Errorf("#%d: signature %x, want %x", i, sig, want)
+			continue
+		}
+		if !privKey.PubKey().Verify(hash[:], sig) {
+			t.Errorf("#%d: signature does not verify", i)
+		}
+	}
+}
+
+// TestSecp256k1HighS ensures a signature is rejected once its S value is
+// replaced by the high S value of the same signature.
+func TestSecp256k1HighS(t *testing.T) {
+	privKey, err := ParsePrivateKey(KeyTypeSecp256k1, decodeHex(
+		"cca9fbcc1b41e5a95d369eaa6ddcff73b61a4efaa279cfc6567e8daa39cbaf50"))
+	if err != nil {
+		t.Fatalf("ParsePrivateKey: %v", err)
+	}
+	pubKey := privKey.PubKey()
+	hash := sha256.Sum256([]byte("sample"))
+	sig, err := privKey.Sign(hash[:])
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	parsed, err := btcec.ParseDERSignature(sig, btcec.S256())
+	if err != nil {
+		t.Fatalf("ParseDERSignature: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		sig   []byte
+		valid bool
+	}{
+		{"low S", derSignature(parsed.R, parsed.S), true},
+		{"high S", derSignature(parsed.R,
+			new(big.Int).Sub(btcec.S256().N, parsed.S)), false},
+		{"not DER", append(sig, 0x00), false},
+	}
+	for _, test := range tests {
+		if valid := pubKey.Verify(hash[:], test.sig); valid != test.valid {
+			t.Errorf("%s: Verify returned %v, want %v", test.name, valid,
+				test.valid)
+		}
+	}
+}
+
+// TestSecp256k1PubKeyEncoding ensures only the compressed encoding of a public
+// key is accepted.
+func TestSecp256k1PubKeyEncoding(t *testing.T) {
+	privKey, err := ParsePrivateKey(KeyTypeSecp256k1, decodeHex(
+		"0000000000000000000000000000000000000000000000000000000000000001"))
+	if err != nil {
+		t.Fatalf("ParsePrivateKey: %v", err)
+	}
+	pubKey := privKey.PubKey().(*Secp256k1PublicKey)
+
+	tests := []struct {
+		name    string
+		key     []byte
+		wantErr bool
+	}{
+		{"compressed", pubKey.key.SerializeCompressed(), false},
+		{"uncompressed", pubKey.key.SerializeUncompressed(), true},
+		{"hybrid", pubKey.key.SerializeHybrid(), true},
+		{"truncated", pubKey.key.SerializeCompressed()[:32], true},
+	}
+	for _, test := range tests {
+		parsed, err := ParsePublicKey(KeyTypeSecp256k1, test.key)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err,
+				test.wantErr)
+			continue
+		}
+		if err == nil && !parsed.IsEqual(pubKey) {
+			t.Errorf("%s: parsed key %x, want %x", test.name,
+				parsed.Serialize(), pubKey.Serialize())
+		}
+	}
+}
+
+// TestPrivateKeyRange ensures secp256k1 private keys outside the range of the
+// curve order are rejected.
+func TestPrivateKeyRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"zero", "0000000000000000000000000000000000000000000000000000000000000000", true},
+		{"one", "0000000000000000000000000000000000000000000000000000000000000001", false},
+		{"order minus one", "fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364140", false},
+		{"order", "fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", true},
+		{"short", "01", true},
+	}
+	for _, test := range tests {
+		_, err := ParsePrivateKey(KeyTypeSecp256k1, decodeHex(test.key))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err,
+				test.wantErr)
+		}
+	}
+}
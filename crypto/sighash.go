@@ -0,0 +1,239 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/blockchainservice/common"
+)
+
+// SigHashType represents hash type bits at the end of a signature.
+type SigHashType uint32
+
+// Hash type bits from the end of a signature.
+const (
+	SigHashAll          SigHashType = 0x1
+	SigHashNone         SigHashType = 0x2
+	SigHashSingle       SigHashType = 0x3
+	SigHashAnyOneCanPay SigHashType = 0x80
+
+	// sigHashMask defines the number of bits of the hash type which is used
+	// to identify which outputs are signed.
+	sigHashMask = 0x1f
+)
+
+// maxSignatureLen is the maximum length of a serialized signature of any of
+// the supported schemes.  DER encoded secp256k1 signatures are at most 72
+// bytes and Ed25519 signatures are 64 bytes.
+const maxSignatureLen = 72
+
+// maxEncodedPubKeyLen is the maximum length of a public key encoded with
+// EncodePublicKey.
+const maxEncodedPubKeyLen = 1 + Secp256k1PubKeyLen
+
+var (
+	// ErrInvalidSigHashType is returned when a signature commits to an
+	// unknown hash type.
+	ErrInvalidSigHashType = errors.New("invalid signature hash type")
+
+	// ErrInvalidIndex is returned when the input to sign or verify is out
+	// of range.
+	ErrInvalidIndex = errors.New("transaction input index out of range")
+
+	// ErrSignatureMismatch is returned when a signature script does not
+	// hold a valid signature of the transaction.
+	ErrSignatureMismatch = errors.New("signature does not match transaction")
+)
+
+// isValid returns whether the hash type is one of the defined types with or
+// without the anyone can pay flag.
+func (hashType SigHashType) isValid() bool {
+	switch hashType &^ SigHashAnyOneCanPay {
+	case SigHashAll, SigHashNone, SigHashSingle:
+		return true
+	}
+	return false
+}
+
+// CalcSignatureHash computes the signature hash for the specified input of
+// the target transaction observing the desired signature hash type.  The
+// subScript is the public key script of the output being spent, and the chain
+// ID of the network is committed to so a signature cannot be replayed on
+// another network.
+//
+// The hash is calculated over a copy of the transaction in which every
+// signature script is emptied except the one of the signed input, which is
+// replaced by subScript.  SigHashNone and SigHashSingle then drop the outputs
+// that are not signed, and SigHashAnyOneCanPay drops the other inputs.
+func CalcSignatureHash(tx *common.Tx, idx int, subScript []byte,
+	hashType SigHashType, chainID uint32) (common.Hash, error) {
+
+	if !hashType.isValid() {
+		return common.Hash{}, ErrInvalidSigHashType
+	}
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return common.Hash{}, ErrInvalidIndex
+	}
+
+	// Unlike bitcoin, SigHashSingle without a corresponding output is an
+	// error rather than a signature of the constant one.
+	if hashType&sigHashMask == SigHashSingle && idx >= len(tx.TxOut) {
+		return common.Hash{}, fmt.Errorf("SigHashSingle input %d has no "+
+			"corresponding output", idx)
+	}
+
+	txCopy := tx.Copy()
+	for i := range txCopy.TxIn {
+		if i == idx {
+			txCopy.TxIn[idx].SignatureScript = subScript
+		} else {
+			txCopy.TxIn[i].SignatureScript = nil
+		}
+	}
+
+	switch hashType & sigHashMask {
+	case SigHashNone:
+		txCopy.TxOut = txCopy.TxOut[0:0] // Empty slice.
+		for i := range txCopy.TxIn {
+			if i != idx {
+				txCopy.TxIn[i].Sequence = 0
+			}
+		}
+
+	case SigHashSingle:
+		// Resize output array to up to and including requested index.
+		txCopy.TxOut = txCopy.TxOut[:idx+1]
+
+		// All but current output get zeroed out.
+		for i := 0; i < idx; i++ {
+			txCopy.TxOut[i].Value = -1
+			txCopy.TxOut[i].PkScript = nil
+		}
+
+		// Sequence on all other inputs is 0, too.
+		for i := range txCopy.TxIn {
+			if i != idx {
+				txCopy.TxIn[i].Sequence = 0
+			}
+		}
+	}
+
+	if hashType&SigHashAnyOneCanPay != 0 {
+		txCopy.TxIn = txCopy.TxIn[idx : idx+1]
+	}
+
+	// The final hash is the hash of both the serialized modified
+	// transaction and the hash type and chain ID encoded as uint32s.
+	var buf bytes.Buffer
+	buf.Grow(txCopy.SerializeSize() + 8)
+	if err := txCopy.Serialize(&buf); err != nil {
+		return common.Hash{}, err
+	}
+	var scratch [8]byte
+	binary.LittleEndian.PutUint32(scratch[:4], uint32(hashType))
+	binary.LittleEndian.PutUint32(scratch[4:], chainID)
+	buf.Write(scratch[:])
+
+	return common.ChainHashH(buf.Bytes()), nil
+}
+
+// SignatureScript returns a signature script that spends the output with the
+// given public key script from the specified input of tx.  The script holds
+// the signature with the hash type appended, followed by the type prefixed
+// public key of privKey.
+func SignatureScript(tx *common.Tx, idx int, subScript []byte,
+	hashType SigHashType, chainID uint32, privKey PrivateKey) ([]byte, error) {
+
+	hash, err := CalcSignatureHash(tx, idx, subScript, hashType, chainID)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := privKey.Sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	sig = append(sig, byte(hashType))
+	pubKey := EncodePublicKey(privKey.PubKey())
+
+	var buf bytes.Buffer
+	buf.Grow(2 + len(sig) + len(pubKey))
+	if err := common.WriteVarBytes(&buf, sig); err != nil {
+		return nil, err
+	}
+	if err := common.WriteVarBytes(&buf, pubKey); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SignTxInput signs the specified input of tx with privKey and sets its
+// signature script.
+func SignTxInput(tx *common.Tx, idx int, subScript []byte,
+	hashType SigHashType, chainID uint32, privKey PrivateKey) error {
+
+	script, err := SignatureScript(tx, idx, subScript, hashType, chainID,
+		privKey)
+	if err != nil {
+		return err
+	}
+	tx.TxIn[idx].SignatureScript = script
+	return nil
+}
+
+// ParseSignatureScript splits a signature script created by SignatureScript
+// into the signature, its hash type and the public key.
+func ParseSignatureScript(script []byte) ([]byte, SigHashType, PublicKey, error) {
+	r := bytes.NewReader(script)
+	sig, err := common.ReadVarBytes(r, maxSignatureLen+1, "signature")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	encodedPubKey, err := common.ReadVarBytes(r, maxEncodedPubKeyLen,
+		"public key")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if r.Len() != 0 {
+		return nil, 0, nil, fmt.Errorf("signature script has %d trailing "+
+			"bytes", r.Len())
+	}
+	if len(sig) == 0 {
+		return nil, 0, nil, errors.New("empty signature")
+	}
+
+	hashType := SigHashType(sig[len(sig)-1])
+	if !hashType.isValid() {
+		return nil, 0, nil, ErrInvalidSigHashType
+	}
+	pubKey, err := DecodePublicKey(encodedPubKey)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return sig[:len(sig)-1], hashType, pubKey, nil
+}
+
+// VerifyTxInput checks that the signature script of the specified input of tx
+// holds a valid signature for spending the output with the given public key
+// script.  The public key that signed the input is returned so the caller can
+// check that it is the one the output is locked to.
+func VerifyTxInput(tx *common.Tx, idx int, subScript []byte,
+	chainID uint32) (PublicKey, error) {
+
+	if idx < 0 || idx >= len(tx.TxIn) {
+		return nil, ErrInvalidIndex
+	}
+	sig, hashType, pubKey, err := ParseSignatureScript(tx.TxIn[idx].SignatureScript)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := CalcSignatureHash(tx, idx, subScript, hashType, chainID)
+	if err != nil {
+		return nil, err
+	}
+	if !pubKey.Verify(hash[:], sig) {
+		return nil, ErrSignatureMismatch
+	}
+	return pubKey, nil
+}
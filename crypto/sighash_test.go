@@ -0,0 +1,140 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/blockchainservice/common"
+)
+
+// testTx returns a transaction spending two outputs to two outputs.
+func testTx() *common.Tx {
+	return &common.Tx{
+		Version: 1,
+		TxIn: []*common.TxIn{
+			{
+				PreviousOutPoint: common.OutPoint{Hash: common.Hash{1}},
+				Sequence:         common.MaxTxInSequenceNum,
+			},
+			{
+				PreviousOutPoint: common.OutPoint{Hash: common.Hash{2}},
+				Sequence:         common.MaxTxInSequenceNum,
+			},
+		},
+		TxOut: []*common.TxOut{
+			{Value: 1, PkScript: []byte{1}},
+			{Value: 2, PkScript: []byte{2}},
+		},
+	}
+}
+
+// TestSignatureHashChainID ensures the signature hash commits to the chain ID
+// so a signed input does not verify on another network.
+func TestSignatureHashChainID(t *testing.T) {
+	const chainID = 1
+	subScript := []byte{0xac}
+	tx := testTx()
+
+	hash, err := CalcSignatureHash(tx, 0, subScript, SigHashAll, chainID)
+	if err != nil {
+		t.Fatalf("CalcSignatureHash: %v", err)
+	}
+	other, err := CalcSignatureHash(tx, 0, subScript, SigHashAll, chainID+1)
+	if err != nil {
+		t.Fatalf("CalcSignatureHash: %v", err)
+	}
+	if hash == other {
+		t.Fatal("signature hash does not commit to the chain ID")
+	}
+
+	for _, keyType := range []KeyType{KeyTypeSecp256k1, KeyTypeEd25519} {
+		privKey, err := GeneratePrivateKey(keyType)
+		if err != nil {
+			t.Fatalf("%v: GeneratePrivateKey: %v", keyType, err)
+		}
+		tx := testTx()
+		err = SignTxInput(tx, 0, subScript, SigHashAll, chainID, privKey)
+		if err != nil {
+			t.Errorf("%v: SignTxInput: %v", keyType, err)
+			continue
+		}
+
+		pubKey, err := VerifyTxInput(tx, 0, subScript, chainID)
+		if err != nil {
+			t.Errorf("%v: VerifyTxInput: %v", keyType, err)
+		} else if !pubKey.IsEqual(privKey.PubKey()) {
+			t.Errorf("%v: input signed by %x, want %x", keyType,
+				pubKey.Serialize(), privKey.PubKey().Serialize())
+		}
+
+		_, err = VerifyTxInput(tx, 0, subScript, chainID+1)
+		if err != ErrSignatureMismatch {
+			t.Errorf("%v: verified on another chain: got error %v, "+
+				"want %v", keyType, err, ErrSignatureMismatch)
+		}
+	}
+}
+
+// TestSignatureHashTypes ensures every hash type commits to the parts of the
+// transaction it signs and only to them.
+func TestSignatureHashTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		hashType SigHashType
+		modify   func(tx *common.Tx)
+		changed  bool
+	}{
+		{"all, other output", SigHashAll,
+			func(tx *common.Tx) { tx.TxOut[1].Value++ }, true},
+		{"all, other input", SigHashAll,
+			func(tx *common.Tx) { tx.TxIn[1].Sequence = 0 }, true},
+		{"none, outputs", SigHashNone,
+			func(tx *common.Tx) { tx.TxOut[0].Value++ }, false},
+		{"none, other input sequence", SigHashNone,
+			func(tx *common.Tx) { tx.TxIn[1].Sequence = 0 }, false},
+		{"single, own output", SigHashSingle,
+			func(tx *common.Tx) { tx.TxOut[0].Value++ }, true},
+		{"single, other output", SigHashSingle,
+			func(tx *common.Tx) { tx.TxOut[1].Value++ }, false},
+		{"anyonecanpay, other input", SigHashAll | SigHashAnyOneCanPay,
+			func(tx *common.Tx) { tx.TxIn[1].PreviousOutPoint.Index++ }, false},
+		{"anyonecanpay, own input", SigHashAll | SigHashAnyOneCanPay,
+			func(tx *common.Tx) { tx.TxIn[0].PreviousOutPoint.Index++ }, true},
+		{"signature scripts", SigHashAll,
+			func(tx *common.Tx) { tx.TxIn[1].SignatureScript = []byte{1} }, false},
+	}
+
+	subScript := []byte{0xac}
+	for _, test := range tests {
+		hash, err := CalcSignatureHash(testTx(), 0, subScript, test.hashType, 1)
+		if err != nil {
+			t.Errorf("%s: CalcSignatureHash: %v", test.name, err)
+			continue
+		}
+		tx := testTx()
+		test.modify(tx)
+		modified, err := CalcSignatureHash(tx, 0, subScript, test.hashType, 1)
+		if err != nil {
+			t.Errorf("%s: CalcSignatureHash: %v", test.name, err)
+			continue
+		}
+		if changed := hash != modified; changed != test.changed {
+			t.Errorf("%s: hash changed %v, want %v", test.name, changed,
+				test.changed)
+		}
+	}
+
+	// Invalid hash types and indexes are rejected.
+	tx := testTx()
+	if _, err := CalcSignatureHash(tx, 0, subScript, 0x4, 1); err != ErrInvalidSigHashType {
+		t.Errorf("unknown hash type: got error %v, want %v", err,
+			ErrInvalidSigHashType)
+	}
+	if _, err := CalcSignatureHash(tx, 2, subScript, SigHashAll, 1); err != ErrInvalidIndex {
+		t.Errorf("index out of range: got error %v, want %v", err,
+			ErrInvalidIndex)
+	}
+	tx.TxOut = tx.TxOut[:1]
+	if _, err := CalcSignatureHash(tx, 1, subScript, SigHashSingle, 1); err == nil {
+		t.Error("SigHashSingle without a corresponding output accepted")
+	}
+}
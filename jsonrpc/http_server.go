@@ -12,6 +12,8 @@ import (
 	"time"
 
 	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/p2p/blocksync"
 )
 
 // todo Reading and writing separation
@@ -39,6 +41,27 @@ var (
 		Code:    common.ErrRPCNoWallet,
 		Message: "This implementation does not implement wallet commands",
 	}
+
+	// ErrRPCNoP2P is an error returned to RPC clients when the provided
+	// command needs the peer to peer service, which is not running.
+	ErrRPCNoP2P = &common.RPCError{
+		Code:    common.ErrRPCClientNotConnected,
+		Message: "Peer to peer service is not running",
+	}
+
+	// ErrRPCNoSync is an error returned to RPC clients when the provided
+	// command needs the download of the chain, which is not running.
+	ErrRPCNoSync = &common.RPCError{
+		Code:    common.ErrRPCMisc,
+		Message: "Chain download is not running",
+	}
+
+	// ErrRPCInInitialDownload is an error returned to RPC clients when the
+	// provided command needs the chain, which is still being downloaded.
+	ErrRPCInInitialDownload = &common.RPCError{
+		Code:    common.ErrRPCClientInInitialDownload,
+		Message: "Client in initial download",
+	}
 )
 
 type parsedRPCCmd struct {
@@ -109,9 +132,44 @@ func handleAskWallet(s *RPCServer, cmd interface{}, closeChan <-chan struct{}) (
 	return nil, ErrRPCNoWallet
 }
 
+// P2PNode is the view of the peer to peer service the RPC server reports on.
+// It is implemented by *p2p.Manage.
+type P2PNode interface {
+	// ExternalAddr returns the address the node is reachable at from the
+	// internet, nil when it is unknown.
+	ExternalAddr() *net.TCPAddr
+
+	// ConnectedCount returns the number of connected peers.
+	ConnectedCount() int
+
+	// PeerStats returns the state and the traffic of the connected peers.
+	PeerStats() []p2p.PeerStats
+}
+
+// ChainSync is the view of the download of the chain the RPC server checks
+// before answering commands that depend on the chain.  It is implemented by
+// *blocksync.SyncManager.
+type ChainSync interface {
+	// IsInitialDownload returns whether the node is still catching up to
+	// the network.
+	IsInitialDownload() bool
+
+	// Progress returns the state of the download of the chain.
+	Progress() blocksync.Progress
+}
+
 // RPCServer struct
 type RPCServer struct {
-	Listeners   []net.Listener
+	Listeners []net.Listener
+
+	// P2P is the peer to peer service of the node, nil when it does not
+	// run.
+	P2P P2PNode
+
+	// Sync is the download of the chain, nil when the node does not
+	// download it.
+	Sync ChainSync
+
 	wg          sync.WaitGroup
 	statusLines map[int]string
 	statusLock  sync.RWMutex
@@ -169,7 +227,7 @@ func (s *RPCServer) jsonRPCRead(w http.ResponseWriter, r *http.Request, isAdmin
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		errMsg := "webserver doesn't support hijacking"
-		log.Warnf(errMsg)
+		log.Warn(errMsg)
 		errCode := http.StatusInternalServerError
 		http.Error(w, strconv.Itoa(errCode)+" "+errMsg, errCode)
 		return
@@ -271,6 +329,11 @@ func (s *RPCServer) standardCmdResult(cmd *parsedRPCCmd, closeChan <-chan struct
 	}
 	return nil, common.ErrRPCMethodNotFound
 handled:
+	if s.Sync != nil && s.Sync.IsInitialDownload() {
+		if _, ok := rpcAvailableDuringSync[cmd.method]; !ok {
+			return nil, ErrRPCInInitialDownload
+		}
+	}
 
 	return handler(s, cmd.cmd, closeChan)
 }
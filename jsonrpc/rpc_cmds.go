@@ -13,6 +13,15 @@ type Data struct {
 	Content string `json:"content"`
 }
 
+// GetNetworkInfo defines the getnetworkinfo JSON-RPC command.
+type GetNetworkInfo struct{}
+
+// GetPeerInfo defines the getpeerinfo JSON-RPC command.
+type GetPeerInfo struct{}
+
+// GetSyncInfo defines the getsyncinfo JSON-RPC command.
+type GetSyncInfo struct{}
+
 type GetData struct {
 	Data  []Data
 	Arr   map[string]int64 `jsonrpcusage:"{\"a\":1,...}"`
@@ -27,4 +36,7 @@ func init() {
 	common.MustRegisterCmd("hello_world", (*HelloWorld)(nil), flags)
 	common.MustRegisterCmd("echo", (*Echo)(nil), flags)
 	common.MustRegisterCmd("get_data", (*GetData)(nil), flags)
+	common.MustRegisterCmd("getnetworkinfo", (*GetNetworkInfo)(nil), flags)
+	common.MustRegisterCmd("getpeerinfo", (*GetPeerInfo)(nil), flags)
+	common.MustRegisterCmd("getsyncinfo", (*GetSyncInfo)(nil), flags)
 }
@@ -2,6 +2,9 @@ package jsonrpc
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/blockchainservice/wire"
 )
 
 type commandHandler func(*RPCServer, interface{}, <-chan struct{}) (interface{}, error)
@@ -13,15 +16,27 @@ var rpcHandlers = map[string]commandHandler{
 	"hello_world": helloWorld,
 	"echo":        echo,
 	"get_data":    getData,
+
+	"getnetworkinfo": handleGetNetworkInfo,
+	"getpeerinfo":    handleGetPeerInfo,
+	"getsyncinfo":    handleGetSyncInfo,
 }
 
 var rpcAskWallet = map[string]struct{}{
 	"listtransactions": {},
 }
 
+// rpcAvailableDuringSync lists the network and status commands, which do not
+// depend on the chain and are therefore answered during the initial block
+// download.  Every other command fails with ErrRPCInInitialDownload then.
+var rpcAvailableDuringSync = map[string]struct{}{
+	"getnetworkinfo": {},
+	"getpeerinfo":    {},
+	"getsyncinfo":    {},
+}
+
 var rpcUnimplemented = map[string]struct{}{
 	"getmempoolentry": {},
-	"getnetworkinfo":  {},
 	"getwork":         {},
 }
 
@@ -52,3 +67,92 @@ func getData(s *RPCServer, cmd interface{}, closeChan <-chan struct{}) (interfac
 
 	return "ok", nil
 }
+
+// handleGetNetworkInfo implements the getnetworkinfo command.
+func handleGetNetworkInfo(s *RPCServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.P2P == nil {
+		return nil, ErrRPCNoP2P
+	}
+
+	reply := &GetNetworkInfoResult{
+		SubVersion:      wire.DefaultUserAgent,
+		ProtocolVersion: wire.ProtocolVersion,
+		Connections:     s.P2P.ConnectedCount(),
+		LocalAddresses:  []LocalAddressesResult{},
+	}
+	if addr := s.P2P.ExternalAddr(); addr != nil {
+		reply.LocalAddresses = append(reply.LocalAddresses,
+			LocalAddressesResult{
+				Address: addr.IP.String(),
+				Port:    uint16(addr.Port),
+			})
+	}
+	return reply, nil
+}
+
+// handleGetPeerInfo implements the getpeerinfo command.
+func handleGetPeerInfo(s *RPCServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.P2P == nil {
+		return nil, ErrRPCNoP2P
+	}
+
+	peers := s.P2P.PeerStats()
+	infos := make([]*GetPeerInfoResult, 0, len(peers))
+	for _, p := range peers {
+		info := &GetPeerInfoResult{
+			ID:             p.ID,
+			Services:       fmt.Sprintf("%08d", uint64(p.Services)),
+			Inbound:        p.Inbound,
+			Persistent:     p.Persistent,
+			SubVer:         p.UserAgent,
+			StartingHeight: p.BestHeight,
+			BanScore:       p.BanScore,
+			ConnTime:       time.Now().Add(-p.Conn.Duration).Unix(),
+			PingTime:       float64(p.Conn.PingTime.Nanoseconds()) / 1000,
+			BytesSent:      p.Conn.BytesSent,
+			BytesRecv:      p.Conn.BytesRecv,
+			SendRate:       p.Conn.SendRate,
+			RecvRate:       p.Conn.RecvRate,
+			SendQueueBytes: p.Conn.SendQueueBytes,
+			Channels:       make([]GetPeerInfoChannelResult, 0, len(p.Conn.Channels)),
+		}
+		if p.Addr != nil {
+			info.Addr = p.Addr.String()
+		}
+		if !p.LastBlock.IsZero() {
+			info.LastBlock = p.LastBlock.Unix()
+		}
+		if !p.LastTx.IsZero() {
+			info.LastTx = p.LastTx.Unix()
+		}
+		for _, ch := range p.Conn.Channels {
+			info.Channels = append(info.Channels, GetPeerInfoChannelResult{
+				ID:            ch.ID,
+				BytesSent:     ch.BytesSent,
+				BytesRecv:     ch.BytesRecv,
+				MsgsSent:      ch.MsgsSent,
+				MsgsRecv:      ch.MsgsRecv,
+				SendQueueSize: ch.SendQueueSize,
+			})
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// handleGetSyncInfo implements the getsyncinfo command.
+func handleGetSyncInfo(s *RPCServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.Sync == nil {
+		return nil, ErrRPCNoSync
+	}
+
+	progress := s.Sync.Progress()
+	return &GetSyncInfoResult{
+		InitialBlockDownload: progress.InitialDownload,
+		SyncPeer:             progress.SyncPeer,
+		Headers:              progress.HeaderHeight,
+		Blocks:               progress.BlockHeight,
+		PeerHeight:           progress.PeerHeight,
+		BlocksInFlight:       progress.BlocksInFlight,
+	}, nil
+}
@@ -0,0 +1,93 @@
+package jsonrpc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/p2p/blocksync"
+)
+
+// fakeSync is a ChainSync reporting a fixed progress.
+type fakeSync struct {
+	progress blocksync.Progress
+}
+
+func (s *fakeSync) IsInitialDownload() bool {
+	return s.progress.InitialDownload
+}
+
+func (s *fakeSync) Progress() blocksync.Progress {
+	return s.progress
+}
+
+// runCmd runs the command method with params on s.
+func runCmd(t *testing.T, s *RPCServer, method string, params ...interface{}) (interface{}, error) {
+	t.Helper()
+	request, err := common.NewRequest(1, method, params)
+	if err != nil {
+		t.Fatalf("%s: NewRequest: %v", method, err)
+	}
+	parsedCmd := parseCmd(request)
+	if parsedCmd.err != nil {
+		t.Fatalf("%s: parseCmd: %v", method, parsedCmd.err)
+	}
+	return s.standardCmdResult(parsedCmd, nil)
+}
+
+// TestInitialDownloadCommands ensures only the network and status commands
+// are answered during the initial block download.
+func TestInitialDownloadCommands(t *testing.T) {
+	sync := &fakeSync{progress: blocksync.Progress{
+		InitialDownload: true,
+		SyncPeer:        "peer",
+		HeaderHeight:    120,
+		BlockHeight:     80,
+		PeerHeight:      120,
+		BlocksInFlight:  16,
+	}}
+	s := &RPCServer{Sync: sync}
+
+	for method := range rpcHandlers {
+		var params []interface{}
+		switch method {
+		case "echo":
+			params = []interface{}{"hi"}
+		case "get_data":
+			params = []interface{}{[]Data{}, map[string]int64{}, 1}
+		}
+		_, err := runCmd(t, s, method, params...)
+		_, available := rpcAvailableDuringSync[method]
+		if gotErr := err == ErrRPCInInitialDownload; gotErr == available {
+			t.Errorf("%s: got error %v during the download", method,
+				err)
+		}
+	}
+
+	result, err := runCmd(t, s, "getsyncinfo")
+	if err != nil {
+		t.Fatalf("getsyncinfo: %v", err)
+	}
+	want := &GetSyncInfoResult{
+		InitialBlockDownload: true,
+		SyncPeer:             "peer",
+		Headers:              120,
+		Blocks:               80,
+		PeerHeight:           120,
+		BlocksInFlight:       16,
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("getsyncinfo: got %+v, want %+v", result, want)
+	}
+
+	// Once the chain caught up every command is answered.
+	sync.progress = blocksync.Progress{HeaderHeight: 120, BlockHeight: 120}
+	if result, err := runCmd(t, s, "echo", "hi"); err != nil || result != "hi" {
+		t.Errorf("echo after the download: got %v, %v", result, err)
+	}
+
+	if _, err := runCmd(t, &RPCServer{}, "getsyncinfo"); err != ErrRPCNoSync {
+		t.Errorf("getsyncinfo without sync: got %v, want %v", err,
+			ErrRPCNoSync)
+	}
+}
@@ -0,0 +1,60 @@
+package jsonrpc
+
+// LocalAddressesResult models the localaddresses data from the getnetworkinfo
+// command.
+type LocalAddressesResult struct {
+	Address string `json:"address"`
+	Port    uint16 `json:"port"`
+}
+
+// GetNetworkInfoResult models the data returned from the getnetworkinfo
+// command.
+type GetNetworkInfoResult struct {
+	SubVersion      string                 `json:"subversion"`
+	ProtocolVersion uint32                 `json:"protocolversion"`
+	Connections     int                    `json:"connections"`
+	LocalAddresses  []LocalAddressesResult `json:"localaddresses"`
+}
+
+// GetPeerInfoChannelResult models the traffic of a channel of a peer from the
+// getpeerinfo command.
+type GetPeerInfoChannelResult struct {
+	ID            byte  `json:"id"`
+	BytesSent     int64 `json:"bytessent"`
+	BytesRecv     int64 `json:"bytesrecv"`
+	MsgsSent      int64 `json:"msgssent"`
+	MsgsRecv      int64 `json:"msgsrecv"`
+	SendQueueSize int   `json:"sendqueuesize"`
+}
+
+// GetPeerInfoResult models the data returned from the getpeerinfo command.
+type GetPeerInfoResult struct {
+	ID             string                     `json:"id"`
+	Addr           string                     `json:"addr"`
+	Services       string                     `json:"services"`
+	Inbound        bool                       `json:"inbound"`
+	Persistent     bool                       `json:"persistent"`
+	SubVer         string                     `json:"subver"`
+	StartingHeight uint64                     `json:"startingheight"`
+	BanScore       uint32                     `json:"banscore"`
+	ConnTime       int64                      `json:"conntime"`
+	PingTime       float64                    `json:"pingtime"`
+	LastBlock      int64                      `json:"lastblock"`
+	LastTx         int64                      `json:"lasttx"`
+	BytesSent      int64                      `json:"bytessent"`
+	BytesRecv      int64                      `json:"bytesrecv"`
+	SendRate       int64                      `json:"sendrate"`
+	RecvRate       int64                      `json:"recvrate"`
+	SendQueueBytes int64                      `json:"sendqueuebytes"`
+	Channels       []GetPeerInfoChannelResult `json:"channels"`
+}
+
+// GetSyncInfoResult models the data returned from the getsyncinfo command.
+type GetSyncInfoResult struct {
+	InitialBlockDownload bool   `json:"initialblockdownload"`
+	SyncPeer             string `json:"syncpeer,omitempty"`
+	Headers              uint64 `json:"headers"`
+	Blocks               uint64 `json:"blocks"`
+	PeerHeight           uint64 `json:"peerheight"`
+	BlocksInFlight       int    `json:"blocksinflight"`
+}
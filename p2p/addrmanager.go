@@ -0,0 +1,879 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Copyright (c) 2015-2018 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package p2p
+
+import (
+	"container/list"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blockchainservice/common"
+)
+
+// AddrManager provides a concurrency safe address manager for caching
+// potential peers on the network.
+type AddrManager struct {
+	mtx       sync.Mutex
+	peersFile string
+	strict    bool
+	rand      *rand.Rand
+	key       [32]byte
+	addrIndex map[string]*KnownAddress // address key to ka for all addrs.
+	addrNew   [newBucketCount]map[string]*KnownAddress
+	addrTried [triedBucketCount]*list.List
+	started   int32
+	shutdown  int32
+	wg        sync.WaitGroup
+	quit      chan struct{}
+	nTried    int
+	nNew      int
+}
+
+type serializedKnownAddress struct {
+	Addr        string
+	Src         string
+	Attempts    int
+	Successes   int
+	TimeStamp   int64
+	LastAttempt int64
+	LastSuccess int64
+	// no refcount or tried, that is available from context.
+}
+
+type serializedAddrManager struct {
+	Version      int
+	Key          [32]byte
+	Addresses    []*serializedKnownAddress
+	NewBuckets   [newBucketCount][]string // string is NetAddressKey
+	TriedBuckets [triedBucketCount][]string
+}
+
+const (
+	// needAddressThreshold is the number of addresses under which the
+	// address manager will claim to need more addresses.
+	needAddressThreshold = 1000
+
+	// dumpAddressInterval is the interval used to dump the address
+	// cache to disk for future use.
+	dumpAddressInterval = time.Minute * 10
+
+	// triedBucketSize is the maximum number of addresses in each
+	// tried address bucket.
+	triedBucketSize = 256
+
+	// triedBucketCount is the number of buckets we split tried
+	// addresses over.
+	triedBucketCount = 64
+
+	// newBucketSize is the maximum number of addresses in each new address
+	// bucket.
+	newBucketSize = 64
+
+	// newBucketCount is the number of buckets that we spread new addresses
+	// over.
+	newBucketCount = 1024
+
+	// triedBucketsPerGroup is the number of tried buckets over which an
+	// address group will be spread.
+	triedBucketsPerGroup = 8
+
+	// newBucketsPerGroup is the number of new buckets over which an
+	// source address group will be spread.
+	newBucketsPerGroup = 64
+
+	// newBucketsPerAddress is the number of buckets a frequently seen new
+	// address may end up in.
+	newBucketsPerAddress = 8
+
+	// numMissingDays is the number of days before which we assume an
+	// address has vanished if we have not seen it announced in that long.
+	numMissingDays = 30
+
+	// numRetries is the number of tried without a single success before
+	// we assume an address is bad.
+	numRetries = 3
+
+	// maxFailures is the maximum number of failures we will accept without
+	// a success before considering an address bad.
+	maxFailures = 10
+
+	// minBadDays is the number of days since the last success before we
+	// will consider evicting an address.
+	minBadDays = 7
+
+	// getAddrMax is the most addresses that we will send in response
+	// to a getAddr (in practise the most addresses we will return from a
+	// call to AddressCache()).
+	getAddrMax = 2500
+
+	// getAddrPercent is the percentage of total addresses known that we
+	// will share with a call to AddressCache.
+	getAddrPercent = 23
+
+	// serialisationVersion is the current version of the on-disk format.
+	serialisationVersion = 1
+
+	// peersFilename is the name of the file the addresses are saved to in
+	// the data directory.
+	peersFilename = "peers.json"
+)
+
+// NewAddrManager returns a new address manager.  The addresses are saved to
+// the data directory dataDir, an empty one keeps them in memory only.  A
+// strict address manager only accepts addresses routable over the public
+// internet.  Use Start to begin processing asynchronous address updates.
+func NewAddrManager(dataDir string, strict bool) *AddrManager {
+	am := AddrManager{
+		strict: strict,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		quit:   make(chan struct{}),
+	}
+	if dataDir != "" {
+		am.peersFile = filepath.Join(dataDir, peersFilename)
+	}
+	am.reset()
+	return &am
+}
+
+// NetAddressKey returns the key of an address in the address manager, its
+// "host:port".
+func NetAddressKey(na *NetAddress) string {
+	return na.DialString()
+}
+
+// updateAddress is a helper function to either update an address already
+// known to the address manager, or to add the address if not already known.
+// The address was last heard of at lastSeen.
+func (a *AddrManager) updateAddress(netAddr, srcAddr *NetAddress,
+	lastSeen time.Time) {
+
+	// Filter out non-routable addresses.  Note that non-routable also
+	// includes invalid and local addresses.
+	if !IsValid(netAddr) || (a.strict && !IsRoutable(netAddr)) {
+		return
+	}
+
+	addr := NetAddressKey(netAddr)
+	ka := a.find(netAddr)
+	if ka != nil {
+		// Update the last seen time.  The node ID of an address only
+		// gets filled in by gossip, anyone can claim one.  It is
+		// replaced once the node proved it in a handshake, see Good.
+		if lastSeen.After(ka.lastseen) {
+			ka.lastseen = lastSeen
+		}
+		if netAddr.ID != "" && ka.na.ID == "" && !ka.tried {
+			ka.na = netAddr
+		}
+
+		// If already in tried, we have nothing to do here.
+		if ka.tried {
+			return
+		}
+
+		// Already at our max?
+		if ka.refs == newBucketsPerAddress {
+			return
+		}
+
+		// The more entries we have, the less likely we are to add more.
+		// likelihood is 2N.
+		factor := int32(2 * ka.refs)
+		if a.rand.Int31n(factor) != 0 {
+			return
+		}
+	} else {
+		ka = &KnownAddress{na: netAddr, srcAddr: srcAddr,
+			lastseen: lastSeen}
+		a.addrIndex[addr] = ka
+		a.nNew++
+	}
+
+	bucket := a.getNewBucket(netAddr, srcAddr)
+
+	// Already exists?
+	if _, ok := a.addrNew[bucket][addr]; ok {
+		return
+	}
+
+	// Enforce max addresses.
+	if len(a.addrNew[bucket]) > newBucketSize {
+		log.Tracef("new bucket is full, expiring old")
+		a.expireNew(bucket)
+	}
+
+	// Add to new bucket.
+	ka.refs++
+	a.addrNew[bucket][addr] = ka
+
+	log.Tracef("Added new address %s for a total of %d addresses", addr,
+		a.nTried+a.nNew)
+}
+
+// expireNew makes space in the new buckets by expiring the really bad entries.
+// If no bad entries are available we look at a few and remove the oldest.
+func (a *AddrManager) expireNew(bucket int) {
+	// First see if there are any entries that are so bad we can just throw
+	// them away.  Otherwise we throw away the oldest entry in the cache.
+	// We keep track of oldest in the initial traversal and use that
+	// information instead.
+	var oldest *KnownAddress
+	for k, v := range a.addrNew[bucket] {
+		if v.isBad() {
+			log.Tracef("expiring bad address %v", k)
+			delete(a.addrNew[bucket], k)
+			v.refs--
+			if v.refs == 0 {
+				a.nNew--
+				delete(a.addrIndex, k)
+			}
+			continue
+		}
+		if oldest == nil {
+			oldest = v
+		} else if !v.lastseen.After(oldest.lastseen) {
+			oldest = v
+		}
+	}
+
+	if oldest != nil {
+		key := NetAddressKey(oldest.na)
+		log.Tracef("expiring oldest address %v", key)
+
+		delete(a.addrNew[bucket], key)
+		oldest.refs--
+		if oldest.refs == 0 {
+			a.nNew--
+			delete(a.addrIndex, key)
+		}
+	}
+}
+
+// pickTried selects an address from the tried bucket to be evicted.
+// We just choose the eldest.
+func (a *AddrManager) pickTried(bucket int) *list.Element {
+	var oldest *KnownAddress
+	var oldestElem *list.Element
+	for e := a.addrTried[bucket].Front(); e != nil; e = e.Next() {
+		ka := e.Value.(*KnownAddress)
+		if oldest == nil || oldest.lastseen.After(ka.lastseen) {
+			oldestElem = e
+			oldest = ka
+		}
+
+	}
+	return oldestElem
+}
+
+func (a *AddrManager) getNewBucket(netAddr, srcAddr *NetAddress) int {
+	// doublesha256(key + sourcegroup + int64(doublesha256(key + group
+	// + sourcegroup))%bucket_per_source_group) % num_new_buckets
+
+	data1 := []byte{}
+	data1 = append(data1, a.key[:]...)
+	data1 = append(data1, []byte(GroupKey(netAddr))...)
+	data1 = append(data1, []byte(GroupKey(srcAddr))...)
+	hash1 := common.DoubleHashB(data1)
+	hash64 := binary.LittleEndian.Uint64(hash1)
+	hash64 %= newBucketsPerGroup
+	var hashbuf [8]byte
+	binary.LittleEndian.PutUint64(hashbuf[:], hash64)
+	data2 := []byte{}
+	data2 = append(data2, a.key[:]...)
+	data2 = append(data2, GroupKey(srcAddr)...)
+	data2 = append(data2, hashbuf[:]...)
+
+	hash2 := common.DoubleHashB(data2)
+	return int(binary.LittleEndian.Uint64(hash2) % newBucketCount)
+}
+
+func (a *AddrManager) getTriedBucket(netAddr *NetAddress) int {
+	// doublesha256(key + group + truncate_to_64bits(doublesha256(key)) %
+	// buckets_per_group) % num_buckets
+	data1 := []byte{}
+	data1 = append(data1, a.key[:]...)
+	data1 = append(data1, []byte(NetAddressKey(netAddr))...)
+	hash1 := common.DoubleHashB(data1)
+	hash64 := binary.LittleEndian.Uint64(hash1)
+	hash64 %= triedBucketsPerGroup
+	var hashbuf [8]byte
+	binary.LittleEndian.PutUint64(hashbuf[:], hash64)
+	data2 := []byte{}
+	data2 = append(data2, a.key[:]...)
+	data2 = append(data2, GroupKey(netAddr)...)
+	data2 = append(data2, hashbuf[:]...)
+
+	hash2 := common.DoubleHashB(data2)
+	return int(binary.LittleEndian.Uint64(hash2) % triedBucketCount)
+}
+
+// addressHandler is the main handler for the address manager.  It must be run
+// as a goroutine.
+func (a *AddrManager) addressHandler() {
+	dumpAddressTicker := time.NewTicker(dumpAddressInterval)
+	defer dumpAddressTicker.Stop()
+out:
+	for {
+		select {
+		case <-dumpAddressTicker.C:
+			a.savePeers()
+
+		case <-a.quit:
+			break out
+		}
+	}
+	a.savePeers()
+	a.wg.Done()
+	log.Trace("Address handler done")
+}
+
+// savePeers saves all the known addresses to a file so they can be read back
+// in at next run.
+func (a *AddrManager) savePeers() {
+	if a.peersFile == "" {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	// First we make a serialisable datastructure so we can encode it to
+	// json.
+	sam := new(serializedAddrManager)
+	sam.Version = serialisationVersion
+	copy(sam.Key[:], a.key[:])
+
+	sam.Addresses = make([]*serializedKnownAddress, len(a.addrIndex))
+	i := 0
+	for k, v := range a.addrIndex {
+		ska := new(serializedKnownAddress)
+		ska.Addr = k
+		if v.na.ID != "" {
+			ska.Addr = v.na.ID + "@" + k
+		}
+		ska.TimeStamp = v.lastseen.Unix()
+		ska.Src = NetAddressKey(v.srcAddr)
+		if v.srcAddr.ID != "" {
+			ska.Src = v.srcAddr.ID + "@" + ska.Src
+		}
+		ska.Attempts = v.attempts
+		ska.Successes = v.successes
+		ska.LastAttempt = v.lastattempt.Unix()
+		ska.LastSuccess = v.lastsuccess.Unix()
+		// Tried and refs are implicit in the rest of the structure
+		// and will be worked out from context on unserialisation.
+		sam.Addresses[i] = ska
+		i++
+	}
+	for i := range a.addrNew {
+		sam.NewBuckets[i] = make([]string, len(a.addrNew[i]))
+		j := 0
+		for k := range a.addrNew[i] {
+			sam.NewBuckets[i][j] = k
+			j++
+		}
+	}
+	for i := range a.addrTried {
+		sam.TriedBuckets[i] = make([]string, a.addrTried[i].Len())
+		j := 0
+		for e := a.addrTried[i].Front(); e != nil; e = e.Next() {
+			ka := e.Value.(*KnownAddress)
+			sam.TriedBuckets[i][j] = NetAddressKey(ka.na)
+			j++
+		}
+	}
+
+	// Write to a temporary file first so an interrupted save does not
+	// lose the addresses saved before.
+	tmpFile := a.peersFile + ".tmp"
+	w, err := os.Create(tmpFile)
+	if err != nil {
+		log.Errorf("Error opening file %s: %v", tmpFile, err)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&sam); err != nil {
+		w.Close()
+		log.Errorf("Failed to encode file %s: %v", tmpFile, err)
+		return
+	}
+	if err := w.Close(); err != nil {
+		log.Errorf("Error closing file %s: %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, a.peersFile); err != nil {
+		log.Errorf("Error writing file %s: %v", a.peersFile, err)
+	}
+}
+
+// loadPeers loads the known address from the saved file.  If empty, missing,
+// or malformed file, just don't load anything and start fresh
+func (a *AddrManager) loadPeers() {
+	if a.peersFile == "" {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	err := a.deserializePeers(a.peersFile)
+	if err != nil {
+		log.Errorf("Failed to parse file %s: %v", a.peersFile, err)
+		// if it is invalid we nuke the old one unconditionally.
+		err = os.Remove(a.peersFile)
+		if err != nil {
+			log.Warnf("Failed to remove corrupt peers file %s: %v",
+				a.peersFile, err)
+		}
+		a.reset()
+		return
+	}
+	log.Infof("Loaded %d addresses from file '%s'", a.numAddresses(),
+		a.peersFile)
+}
+
+func (a *AddrManager) deserializePeers(filePath string) error {
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	r, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("%s error opening file: %v", filePath, err)
+	}
+	defer r.Close()
+
+	var sam serializedAddrManager
+	dec := json.NewDecoder(r)
+	err = dec.Decode(&sam)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", filePath, err)
+	}
+
+	if sam.Version != serialisationVersion {
+		return fmt.Errorf("unknown version %v in serialized "+
+			"addrmanager", sam.Version)
+	}
+	copy(a.key[:], sam.Key[:])
+
+	for _, v := range sam.Addresses {
+		ka := new(KnownAddress)
+		ka.na, err = NewNetAddressString(v.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize netaddress "+
+				"%s: %v", v.Addr, err)
+		}
+		ka.srcAddr, err = NewNetAddressString(v.Src)
+		if err != nil {
+			return fmt.Errorf("failed to deserialize netaddress "+
+				"%s: %v", v.Src, err)
+		}
+		ka.attempts = v.Attempts
+		ka.successes = v.Successes
+		ka.lastseen = time.Unix(v.TimeStamp, 0)
+		ka.lastattempt = time.Unix(v.LastAttempt, 0)
+		ka.lastsuccess = time.Unix(v.LastSuccess, 0)
+		a.addrIndex[NetAddressKey(ka.na)] = ka
+	}
+
+	for i := range sam.NewBuckets {
+		for _, val := range sam.NewBuckets[i] {
+			ka, ok := a.addrIndex[val]
+			if !ok {
+				return fmt.Errorf("newbucket contains %s but "+
+					"none in address list", val)
+			}
+
+			if ka.refs == 0 {
+				a.nNew++
+			}
+			ka.refs++
+			a.addrNew[i][val] = ka
+		}
+	}
+	for i := range sam.TriedBuckets {
+		for _, val := range sam.TriedBuckets[i] {
+			ka, ok := a.addrIndex[val]
+			if !ok {
+				return fmt.Errorf("Newbucket contains %s but "+
+					"none in address list", val)
+			}
+
+			ka.tried = true
+			a.nTried++
+			a.addrTried[i].PushBack(ka)
+		}
+	}
+
+	// Sanity checking.
+	for k, v := range a.addrIndex {
+		if v.refs == 0 && !v.tried {
+			return fmt.Errorf("address %s after serialisation "+
+				"with no references", k)
+		}
+
+		if v.refs > 0 && v.tried {
+			return fmt.Errorf("address %s after serialisation "+
+				"which is both new and tried!", k)
+		}
+	}
+
+	return nil
+}
+
+// Start begins the core address handler which manages a pool of known
+// addresses, timeouts, and interval based writes.
+func (a *AddrManager) Start() {
+	// Already started?
+	if atomic.AddInt32(&a.started, 1) != 1 {
+		return
+	}
+
+	log.Trace("Starting address manager")
+
+	// Load peers we already know about from file.
+	a.loadPeers()
+
+	// Start the address ticker to save addresses periodically.
+	a.wg.Add(1)
+	go a.addressHandler()
+}
+
+// Stop gracefully shuts down the address manager by stopping the main handler.
+func (a *AddrManager) Stop() error {
+	if atomic.AddInt32(&a.shutdown, 1) != 1 {
+		log.Warnf("Address manager is already in the process of " +
+			"shutting down")
+		return nil
+	}
+
+	log.Infof("Address manager shutting down")
+	close(a.quit)
+	a.wg.Wait()
+	return nil
+}
+
+// AddAddresses adds new addresses to the address manager.  It enforces a max
+// number of addresses and silently ignores duplicate addresses.  It is
+// safe for concurrent access.
+func (a *AddrManager) AddAddresses(addrs []*NetAddress, srcAddr *NetAddress) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	now := time.Now()
+	for _, na := range addrs {
+		a.updateAddress(na, srcAddr, now)
+	}
+}
+
+// AddAddress adds a new address to the address manager.  It enforces a max
+// number of addresses and silently ignores duplicate addresses.  It is
+// safe for concurrent access.
+func (a *AddrManager) AddAddress(addr, srcAddr *NetAddress) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.updateAddress(addr, srcAddr, time.Now())
+}
+
+// AddAddressSeen adds an address last heard of at lastSeen, as relayed by
+// srcAddr, to the address manager.  An address already known keeps the most
+// recent of both times.  It is safe for concurrent access.
+func (a *AddrManager) AddAddressSeen(addr, srcAddr *NetAddress,
+	lastSeen time.Time) {
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.updateAddress(addr, srcAddr, lastSeen)
+}
+
+// LastSeen returns the last time the address was heard of, the zero time when
+// it is unknown.
+func (a *AddrManager) LastSeen(addr *NetAddress) time.Time {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	ka := a.find(addr)
+	if ka == nil {
+		return time.Time{}
+	}
+	return ka.lastseen
+}
+
+// numAddresses returns the number of addresses known to the address manager.
+func (a *AddrManager) numAddresses() int {
+	return a.nTried + a.nNew
+}
+
+// NumAddresses returns the number of addresses known to the address manager.
+func (a *AddrManager) NumAddresses() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	return a.numAddresses()
+}
+
+// NeedMoreAddresses returns whether or not the address manager needs more
+// addresses.
+func (a *AddrManager) NeedMoreAddresses() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	return a.numAddresses() < needAddressThreshold
+}
+
+// AddressCache returns the current address cache.  It must be treated as
+// read-only (but since it is a copy now, this is not as dangerous).
+func (a *AddrManager) AddressCache() []*NetAddress {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	addrIndexLen := len(a.addrIndex)
+	if addrIndexLen == 0 {
+		return nil
+	}
+
+	allAddr := make([]*NetAddress, 0, addrIndexLen)
+	// Iteration order is undefined here, but we randomise it anyway.
+	for _, v := range a.addrIndex {
+		allAddr = append(allAddr, v.na)
+	}
+
+	numAddresses := addrIndexLen * getAddrPercent / 100
+	if numAddresses > getAddrMax {
+		numAddresses = getAddrMax
+	}
+
+	// Fisher-Yates shuffle the array.  We only need to do the first
+	// `numAddresses' since we are throwing the rest.
+	for i := 0; i < numAddresses; i++ {
+		// pick a number between current index and the end
+		j := a.rand.Intn(addrIndexLen-i) + i
+		allAddr[i], allAddr[j] = allAddr[j], allAddr[i]
+	}
+
+	// slice off the limit we are willing to share.
+	return allAddr[0:numAddresses]
+}
+
+// reset resets the address manager by reinitialising the random source
+// and allocating fresh empty bucket storage.
+func (a *AddrManager) reset() {
+
+	a.addrIndex = make(map[string]*KnownAddress)
+
+	// fill key with bytes from a good random source.
+	io.ReadFull(crand.Reader, a.key[:])
+	for i := range a.addrNew {
+		a.addrNew[i] = make(map[string]*KnownAddress)
+	}
+	for i := range a.addrTried {
+		a.addrTried[i] = list.New()
+	}
+	a.nNew = 0
+	a.nTried = 0
+}
+
+// GetAddress returns a single address that should be routable.  It picks a
+// random one from the possible addresses with preference given to ones that
+// have not been used recently and should not pick 'close' addresses
+// consecutively.  The returned entry is a copy, the address manager keeps
+// updating its own.
+func (a *AddrManager) GetAddress() *KnownAddress {
+	// Protect concurrent access.
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.numAddresses() == 0 {
+		return nil
+	}
+
+	// Use a 50% chance for choosing between tried and new table entries.
+	if a.nTried > 0 && (a.nNew == 0 || a.rand.Intn(2) == 0) {
+		// Tried entry.
+		large := 1 << 30
+		factor := 1.0
+		for {
+			// pick a random bucket.
+			bucket := a.rand.Intn(len(a.addrTried))
+			if a.addrTried[bucket].Len() == 0 {
+				continue
+			}
+
+			// Pick a random entry in the list
+			e := a.addrTried[bucket].Front()
+			for i :=
+				a.rand.Int63n(int64(a.addrTried[bucket].Len())); i > 0; i-- {
+				e = e.Next()
+			}
+			ka := e.Value.(*KnownAddress)
+			randval := a.rand.Intn(large)
+			if float64(randval) < (factor * ka.chance() * float64(large)) {
+				log.Tracef("Selected %v from tried bucket",
+					NetAddressKey(ka.na))
+				kaCopy := *ka
+				return &kaCopy
+			}
+			factor *= 1.2
+		}
+	} else {
+		// new node.
+		large := 1 << 30
+		factor := 1.0
+		for {
+			// Pick a random bucket.
+			bucket := a.rand.Intn(len(a.addrNew))
+			if len(a.addrNew[bucket]) == 0 {
+				continue
+			}
+			// Then, a random entry in it.
+			var ka *KnownAddress
+			nth := a.rand.Intn(len(a.addrNew[bucket]))
+			for _, value := range a.addrNew[bucket] {
+				if nth == 0 {
+					ka = value
+				}
+				nth--
+			}
+			randval := a.rand.Intn(large)
+			if float64(randval) < (factor * ka.chance() * float64(large)) {
+				log.Tracef("Selected %v from new bucket",
+					NetAddressKey(ka.na))
+				kaCopy := *ka
+				return &kaCopy
+			}
+			factor *= 1.2
+		}
+	}
+}
+
+func (a *AddrManager) find(addr *NetAddress) *KnownAddress {
+	return a.addrIndex[NetAddressKey(addr)]
+}
+
+// Attempt increases the given address' attempt counter and updates
+// the last attempt time.
+func (a *AddrManager) Attempt(addr *NetAddress) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	// find address.
+	// Surely address will be in tried by now?
+	ka := a.find(addr)
+	if ka == nil {
+		return
+	}
+	// set last tried time to now
+	ka.attempts++
+	ka.lastattempt = time.Now()
+}
+
+// Good marks the given address as good.  To be called after a successful
+// connection and version exchange, with the node ID the peer proved in the
+// handshake, which replaces the one known for the address.  If the address is
+// unknown to the address manager it will be ignored.
+func (a *AddrManager) Good(addr *NetAddress) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	ka := a.find(addr)
+	if ka == nil {
+		return
+	}
+	if addr.ID != "" && addr.ID != ka.na.ID {
+		// The address may have been handed out, update a copy.
+		na := *ka.na
+		na.ID = addr.ID
+		ka.na = &na
+	}
+
+	// ka.lastseen is not updated here to avoid leaking information
+	// about currently connected peers.
+	now := time.Now()
+	ka.lastsuccess = now
+	ka.lastattempt = now
+	ka.attempts = 0
+	ka.successes++
+
+	// move to tried set, optionally evicting other addresses if needed.
+	if ka.tried {
+		return
+	}
+
+	// ok, need to move it to tried.
+
+	// remove from all new buckets.
+	// record one of the buckets in question and call it the `first'
+	addrKey := NetAddressKey(addr)
+	oldBucket := -1
+	for i := range a.addrNew {
+		// we check for existence so we can record the first one
+		if _, ok := a.addrNew[i][addrKey]; ok {
+			delete(a.addrNew[i], addrKey)
+			ka.refs--
+			if oldBucket == -1 {
+				oldBucket = i
+			}
+		}
+	}
+	a.nNew--
+
+	if oldBucket == -1 {
+		// What? wasn't in a bucket after all.... Panic?
+		return
+	}
+
+	bucket := a.getTriedBucket(ka.na)
+
+	// Room in this tried bucket?
+	if a.addrTried[bucket].Len() < triedBucketSize {
+		ka.tried = true
+		a.addrTried[bucket].PushBack(ka)
+		a.nTried++
+		return
+	}
+
+	// No room, we have to evict something else.
+	entry := a.pickTried(bucket)
+	rmka := entry.Value.(*KnownAddress)
+
+	// First bucket it would have been put in.
+	newBucket := a.getNewBucket(rmka.na, rmka.srcAddr)
+
+	// If no room in the original bucket, we put it in a bucket we just
+	// freed up a space in.
+	if len(a.addrNew[newBucket]) >= newBucketSize {
+		newBucket = oldBucket
+	}
+
+	// replace with ka in list.
+	ka.tried = true
+	entry.Value = ka
+
+	rmka.tried = false
+	rmka.refs++
+
+	// We don't touch a.nTried here since the number of tried stays the same
+	// but we decremented new above, raise it again since we're putting
+	// something back.
+	a.nNew++
+
+	rmkey := NetAddressKey(rmka.na)
+	log.Tracef("Replacing %s with %s in tried", rmkey, addrKey)
+
+	// We made sure there is space here just above.
+	a.addrNew[newBucket][rmkey] = rmka
+}
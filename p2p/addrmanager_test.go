@@ -0,0 +1,49 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+)
+
+// TestAddrManagerNodeID ensures gossip only fills in a missing node ID of an
+// address while a successful connection replaces it.
+func TestAddrManagerNodeID(t *testing.T) {
+	const (
+		gossipID = "1111111111111111111111111111111111111111"
+		otherID  = "2222222222222222222222222222222222222222"
+		peerID   = "3333333333333333333333333333333333333333"
+	)
+	ip := net.IPv4(8, 8, 8, 8)
+	src := NewNetAddressIPPort("", net.IPv4(9, 9, 9, 9), 18444)
+	a := NewAddrManager("", true)
+
+	tests := []struct {
+		name string
+		add  string // node ID of the address gossiped, if any
+		good string // node ID of the peer connected to, if any
+		want string
+	}{
+		{name: "new without ID", add: "", want: ""},
+		{name: "ID gossiped", add: gossipID, want: gossipID},
+		{name: "other ID gossiped", add: otherID, want: gossipID},
+		{name: "connected", good: peerID, want: peerID},
+		{name: "ID of tried gossiped", add: gossipID, want: peerID},
+	}
+
+	for _, test := range tests {
+		addr := NewNetAddressIPPort(test.add, ip, 18444)
+		if test.good != "" {
+			a.Good(NewNetAddressIPPort(test.good, ip, 18444))
+		} else {
+			a.AddAddress(addr, src)
+		}
+		ka := a.GetAddress()
+		if ka == nil {
+			t.Fatalf("%s: address not known", test.name)
+		}
+		if got := ka.NetAddress().ID; got != test.want {
+			t.Errorf("%s: node ID %q, want %q", test.name, got,
+				test.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// banListFilename is the name of the file the ban list is saved to in
+	// the data directory.
+	banListFilename = "banlist.json"
+
+	// maxBans is the maximum number of bans held.  The bans expiring first
+	// make room for the new ones.
+	maxBans = 10000
+
+	// banListSaveDelay is how long the changes of the ban list are batched
+	// before it is saved.
+	banListSaveDelay = 5 * time.Second
+)
+
+// banList holds the hosts that are banned and the time their ban expires.
+// IPv6 hosts are banned by /64 prefix, the size of the network usually
+// handed to a single host.  It is saved to the data directory shortly after
+// changes so bans survive restarts.
+type banList struct {
+	mtx       sync.Mutex
+	file      string
+	bans      map[string]time.Time
+	dirty     bool        // there are changes to save
+	saveTimer *time.Timer // pending save, nil when there is none
+
+	// fileMtx serializes the writes of the file, which happen without
+	// holding mtx.
+	fileMtx sync.Mutex
+}
+
+// newBanList returns a ban list saved to the data directory dataDir, an
+// empty one keeps it in memory only.  The bans saved by a previous run are
+// loaded.
+func newBanList(dataDir string) *banList {
+	b := &banList{bans: make(map[string]time.Time)}
+	if dataDir == "" {
+		return b
+	}
+	b.file = filepath.Join(dataDir, banListFilename)
+
+	r, err := os.Open(b.file)
+	if os.IsNotExist(err) {
+		return b
+	}
+	if err != nil {
+		log.Errorf("Error opening file %s: %v", b.file, err)
+		return b
+	}
+	defer r.Close()
+
+	var bans map[string]time.Time
+	if err := json.NewDecoder(r).Decode(&bans); err != nil {
+		log.Errorf("Failed to parse file %s: %v", b.file, err)
+		return b
+	}
+	now := time.Now()
+	for host, until := range bans {
+		key := banKey(host)
+		if until.After(now) && until.After(b.bans[key]) {
+			b.bans[key] = until
+		}
+	}
+	log.Infof("Loaded %d bans from file '%s'", len(b.bans), b.file)
+	return b
+}
+
+// banKey returns the key host is banned under: the /64 prefix of an IPv6
+// address, the host itself otherwise.
+func banKey(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	prefix := net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)),
+		Mask: net.CIDRMask(64, 128)}
+	return prefix.String()
+}
+
+// ban bans host until the given time.  When the list is full, the ban
+// expiring first is dropped.
+func (b *banList) ban(host string, until time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	key := banKey(host)
+	if _, ok := b.bans[key]; !ok && len(b.bans) >= maxBans {
+		b.evict()
+	}
+	b.bans[key] = until
+	b.scheduleSave()
+}
+
+// evict removes the expired bans, or the one expiring first when there are
+// none.  The caller must hold b.mtx.
+func (b *banList) evict() {
+	now := time.Now()
+	var first string
+	var firstUntil time.Time
+	for key, until := range b.bans {
+		if !until.After(now) {
+			delete(b.bans, key)
+			continue
+		}
+		if first == "" || until.Before(firstUntil) {
+			first, firstUntil = key, until
+		}
+	}
+	if len(b.bans) >= maxBans {
+		log.Debugf("Ban list full, dropping the ban of %s", first)
+		delete(b.bans, first)
+	}
+}
+
+// unban lifts the ban of host.  It returns false when the host was not
+// banned.
+func (b *banList) unban(host string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	key := banKey(host)
+	if _, ok := b.bans[key]; !ok {
+		return false
+	}
+	delete(b.bans, key)
+	b.scheduleSave()
+	return true
+}
+
+// isBanned returns whether host is banned.  An expired ban is removed.
+func (b *banList) isBanned(host string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	key := banKey(host)
+	until, ok := b.bans[key]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	log.Infof("Ban of host %s expired", key)
+	delete(b.bans, key)
+	b.scheduleSave()
+	return false
+}
+
+// banned returns the banned hosts and the expiry of their bans.
+func (b *banList) banned() map[string]time.Time {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	bans := make(map[string]time.Time, len(b.bans))
+	for host, until := range b.bans {
+		if until.After(now) {
+			bans[host] = until
+		}
+	}
+	return bans
+}
+
+// scheduleSave saves the ban list after banListSaveDelay unless a save is
+// pending already.  The caller must hold b.mtx.
+func (b *banList) scheduleSave() {
+	if b.file == "" {
+		return
+	}
+	b.dirty = true
+	if b.saveTimer == nil {
+		b.saveTimer = time.AfterFunc(banListSaveDelay, b.save)
+	}
+}
+
+// flush saves the pending changes of the ban list right away.
+func (b *banList) flush() {
+	b.mtx.Lock()
+	if b.saveTimer != nil {
+		b.saveTimer.Stop()
+	}
+	b.mtx.Unlock()
+	b.save()
+}
+
+// save writes the ban list to its file when it changed since the last save.
+func (b *banList) save() {
+	b.fileMtx.Lock()
+	defer b.fileMtx.Unlock()
+
+	b.mtx.Lock()
+	b.saveTimer = nil
+	if !b.dirty {
+		b.mtx.Unlock()
+		return
+	}
+	b.dirty = false
+	bans := make(map[string]time.Time, len(b.bans))
+	for key, until := range b.bans {
+		bans[key] = until
+	}
+	b.mtx.Unlock()
+
+	tmpFile := b.file + ".tmp"
+	w, err := os.Create(tmpFile)
+	if err != nil {
+		log.Errorf("Error opening file %s: %v", tmpFile, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(bans); err != nil {
+		w.Close()
+		log.Errorf("Failed to encode file %s: %v", tmpFile, err)
+		return
+	}
+	if err := w.Close(); err != nil {
+		log.Errorf("Error closing file %s: %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, b.file); err != nil {
+		log.Errorf("Error writing file %s: %v", b.file, err)
+	}
+}
+
+// hostOf returns the host of a network address, which the key of the ban
+// list is derived from.
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// parseWhitelists parses the allowlisted networks given as CIDRs or single
+// IP addresses.
+func parseWhitelists(whitelists []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(whitelists))
+	for _, addr := range whitelists {
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("the whitelist value of '%s' "+
+					"is invalid", addr)
+			}
+			var bits int
+			if ip.To4() == nil {
+				// IPv6
+				bits = 128
+			} else {
+				bits = 32
+			}
+			ipnet = &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			}
+		}
+		ipNets = append(ipNets, ipnet)
+	}
+	return ipNets, nil
+}
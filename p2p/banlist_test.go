@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBanListIPv6Prefix ensures IPv6 hosts are banned by /64 prefix while
+// IPv4 hosts are banned alone.
+func TestBanListIPv6Prefix(t *testing.T) {
+	b := newBanList("")
+	until := time.Now().Add(time.Hour)
+	b.ban("2001:db8::1", until)
+	b.ban("192.0.2.1", until)
+
+	tests := []struct {
+		host   string
+		banned bool
+	}{
+		{"2001:db8::1", true},
+		{"2001:db8::ffff:1", true},
+		{"2001:db8:0:0:1234:5678:9abc:def0", true},
+		{"2001:db8:0:1::1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+	}
+	for _, test := range tests {
+		if got := b.isBanned(test.host); got != test.banned {
+			t.Errorf("%s: banned %v, want %v", test.host, got,
+				test.banned)
+		}
+	}
+	if bans := b.banned(); len(bans) != 2 {
+		t.Errorf("%d bans, want 2: %v", len(bans), bans)
+	}
+
+	if !b.unban("2001:db8::2") || b.isBanned("2001:db8::1") {
+		t.Error("unbanning another host of the prefix did not lift the ban")
+	}
+}
+
+// TestBanListCap ensures the ban list holds at most maxBans bans, dropping
+// the expired ones first and then the ones expiring first.
+func TestBanListCap(t *testing.T) {
+	b := newBanList("")
+	now := time.Now()
+	for i := 0; i < maxBans; i++ {
+		host := fmt.Sprintf("10.%d.%d.1", i>>8, i&0xff)
+		b.ban(host, now.Add(time.Hour+time.Duration(i)*time.Second))
+	}
+
+	b.ban("192.0.2.1", now.Add(2*time.Hour))
+	if n := len(b.banned()); n != maxBans {
+		t.Errorf("%d bans, want %d", n, maxBans)
+	}
+	if b.isBanned("10.0.0.1") {
+		t.Error("ban expiring first not dropped")
+	}
+	if !b.isBanned("10.0.1.1") || !b.isBanned("192.0.2.1") {
+		t.Error("ban dropped instead of the one expiring first")
+	}
+
+	// Expired bans are dropped before any other.
+	b.bans["10.0.2.1"] = now.Add(-time.Second)
+	b.bans["10.0.3.1"] = now.Add(-time.Second)
+	b.ban("192.0.2.2", now.Add(2*time.Hour))
+	if n := len(b.bans); n != maxBans-1 {
+		t.Errorf("%d bans after dropping the expired ones, want %d", n,
+			maxBans-1)
+	}
+	if !b.isBanned("10.0.4.1") {
+		t.Error("ban dropped while expired ones were left")
+	}
+}
+
+// TestBanListSave ensures the changes of the ban list are saved together
+// after a delay or when flushed, and loaded by the next ban list.
+func TestBanListSave(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, banListFilename)
+	b := newBanList(dir)
+	until := time.Now().Add(time.Hour)
+	b.ban("192.0.2.1", until)
+	b.ban("2001:db8::1", until)
+	b.ban("192.0.2.2", until)
+	b.unban("192.0.2.2")
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("ban list saved before the save delay: %v", err)
+	}
+
+	b.flush()
+	loaded := newBanList(dir)
+	if !loaded.isBanned("192.0.2.1") || !loaded.isBanned("2001:db8::2") ||
+		loaded.isBanned("192.0.2.2") {
+
+		t.Errorf("unexpected bans loaded: %v", loaded.banned())
+	}
+
+	// A ban is saved on its own after the delay.
+	b.ban("192.0.2.3", until)
+	deadline := time.Now().Add(banListSaveDelay + 5*time.Second)
+	for !newBanList(dir).isBanned("192.0.2.3") {
+		if time.Now().After(deadline) {
+			t.Fatal("ban not saved after the save delay")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -1,7 +1,70 @@
 package p2p
 
+import (
+	"github.com/blockchainservice/p2p/conn"
+)
+
+// Reactor is the business logic of a node.  Each reactor owns the channels
+// it declares, receives the messages peers send on them and is told about
+// the peers the node connects to and disconnects from.
 type Reactor interface {
+	// SetManage allows setting the Manage the reactor is registered with.
+	SetManage(*Manage)
+
 	// GetChannels returns the list of channel descriptors.
-	//GetChannels() []*conn.ChannelDescriptor
-	Receive(chID byte, conn PeerConn, msgBytes []byte)
+	GetChannels() []*conn.ChannelDescriptor
+
+	// InitPeer is called by the Manage before the peer is started.  Use it
+	// to initialize data for the peer (e.g. peer state).
+	InitPeer(peer *PeerConn)
+
+	// AddPeer is called by the Manage after the peer successfully started,
+	// before the Manage lists it in Peers.  Use it to start
+	// goroutines communicating with the peer.  The peer may already have
+	// stopped, RemovePeer then follows.
+	AddPeer(peer *PeerConn)
+
+	// RemovePeer is called by the Manage when the peer is stopped (due to
+	// error or other reason).  It is only called after AddPeer.
+	RemovePeer(peer *PeerConn, reason interface{})
+
+	// Receive is called when msgBytes is received from peer on channel
+	// chID.  It runs on the receive routine of the peer connection, so it
+	// must not block.  msgBytes belongs to the reactor and may be retained.
+	Receive(chID byte, peer *PeerConn, msgBytes []byte)
+}
+
+// BaseReactor provides no-op implementations of the Reactor interface so
+// reactors only need to implement the methods they care about.  It is meant
+// to be embedded.
+type BaseReactor struct {
+	Name   string
+	Manage *Manage
 }
+
+// NewBaseReactor returns a BaseReactor with the given name.
+func NewBaseReactor(name string) *BaseReactor {
+	return &BaseReactor{
+		Name: name,
+	}
+}
+
+// SetManage records the Manage the reactor is registered with.
+func (br *BaseReactor) SetManage(m *Manage) {
+	br.Manage = m
+}
+
+// GetChannels declares no channels.
+func (*BaseReactor) GetChannels() []*conn.ChannelDescriptor { return nil }
+
+// InitPeer does nothing.
+func (*BaseReactor) InitPeer(peer *PeerConn) {}
+
+// AddPeer does nothing.
+func (*BaseReactor) AddPeer(peer *PeerConn) {}
+
+// RemovePeer does nothing.
+func (*BaseReactor) RemovePeer(peer *PeerConn, reason interface{}) {}
+
+// Receive ignores the message.
+func (*BaseReactor) Receive(chID byte, peer *PeerConn, msgBytes []byte) {}
@@ -0,0 +1,234 @@
+package blocksync
+
+import (
+	"time"
+
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/wire"
+)
+
+// windowLimit returns the highest block that may be requested: the end of the
+// download window or the best header, whichever is lower.
+func (m *SyncManager) windowLimit() uint64 {
+	limit := m.chain.BestHeight() + blockDownloadWindow
+	if tip := m.headerTipHeight(); tip < limit {
+		limit = tip
+	}
+	return limit
+}
+
+// needsBlock returns whether the block at height is neither requested nor
+// received.
+func (m *SyncManager) needsBlock(height uint64) bool {
+	if _, ok := m.requests[height]; ok {
+		return false
+	}
+	_, ok := m.blocks[height]
+	return !ok
+}
+
+// fetchBlocks spreads the blocks of the window that are not requested yet
+// over the peers having them.  Each peer gets the lowest blocks still needed,
+// up to the maximum number of blocks in flight per peer, so the blocks are
+// requested in contiguous ranges.
+func (m *SyncManager) fetchBlocks() {
+	if len(m.headers) == 0 {
+		return
+	}
+	now := time.Now()
+	tip := m.chain.BestHeight()
+	limit := m.windowLimit()
+	for _, ps := range m.peers {
+		if now.Before(ps.stalledUntil) {
+			continue
+		}
+
+		var heights []uint64
+		msg := wire.NewMsgGetData()
+		for height := tip + 1; height <= limit && height <= ps.height &&
+			len(ps.inFlight)+len(heights) < maxBlocksInFlightPerPeer; height++ {
+
+			if !m.needsBlock(height) {
+				continue
+			}
+			node := m.headerByHeight(height)
+			msg.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &node.hash))
+			heights = append(heights, height)
+			m.requests[height] = &blockRequest{peer: ps, time: now}
+		}
+		if len(heights) == 0 {
+			continue
+		}
+
+		if !m.send(ps.peer, SyncChannel, msg) {
+			for _, height := range heights {
+				delete(m.requests, height)
+			}
+			continue
+		}
+		for _, height := range heights {
+			ps.inFlight[height] = struct{}{}
+		}
+		log.Tracef("Requested %d blocks from height %d from peer %s",
+			len(heights), heights[0], ps.peer)
+	}
+}
+
+// handleBlock stores a block delivered by a peer until its parent is
+// connected.
+func (m *SyncManager) handleBlock(ps *peerSync, block *common.Block) {
+	hash := block.BlockHash()
+	height, ok := m.headerIndex[hash]
+	if !ok {
+		// Either the block was connected meanwhile or it is not
+		// part of the header chain and was never requested.
+		if _, ok := m.chain.MainChainHeight(&hash); !ok {
+			m.Manage.AddBanScore(ps.peer, 0, badSyncBanScore,
+				"unrequested block "+hash.String())
+		}
+		return
+	}
+
+	// A block requested from another peer after this one stalled is
+	// still welcome.
+	if req, ok := m.requests[height]; ok {
+		delete(m.requests, height)
+		delete(req.peer.inFlight, height)
+	}
+	delete(ps.inFlight, height)
+	if _, ok := m.blocks[height]; ok {
+		return
+	}
+	m.blocks[height] = &receivedBlock{block: block, peer: ps.peer}
+	m.connectBlocks()
+}
+
+// connectBlocks connects the received blocks following the tip of the chain.
+// A peer delivering an invalid block is penalized and the block is requested
+// again from another peer.
+func (m *SyncManager) connectBlocks() {
+	for {
+		height := m.chain.BestHeight() + 1
+		rb, ok := m.blocks[height]
+		if !ok {
+			break
+		}
+		delete(m.blocks, height)
+
+		if err := m.chain.ProcessBlock(rb.block); err != nil {
+			hash := rb.block.BlockHash()
+			log.Warnf("Rejected block %v at height %d from peer %s: %v",
+				hash, height, rb.peer, err)
+			m.Manage.AddBanScore(rb.peer, invalidDataBanScore, 0,
+				"invalid block "+hash.String())
+			if ps, ok := m.peers[rb.peer]; ok && ps.height >= height {
+				ps.height = height - 1
+			}
+			break
+		}
+		m.processed++
+	}
+	m.trimHeaders()
+}
+
+// handleNotFound releases the blocks the peer does not have so they are
+// requested from another peer.  The peer is no longer asked for them.
+func (m *SyncManager) handleNotFound(ps *peerSync, msg *wire.MsgNotFound) {
+	for _, iv := range msg.InvList {
+		height, ok := m.headerIndex[iv.Hash]
+		if !ok {
+			continue
+		}
+		req, ok := m.requests[height]
+		if !ok || req.peer != ps {
+			continue
+		}
+		delete(m.requests, height)
+		delete(ps.inFlight, height)
+		if ps.height >= height {
+			ps.height = height - 1
+		}
+	}
+}
+
+// handleStalls detects the peers stalling the download.  A peer stalls when
+// the next block to connect is awaited from it for longer than the stall
+// timeout while blocks above it were already received, when any block is
+// awaited from it for longer than the request timeout, or when it does not
+// answer a request for headers.
+func (m *SyncManager) handleStalls(now time.Time) {
+	if m.syncPeer != nil && !m.headersRequested.IsZero() &&
+		now.Sub(m.headersRequested) > headersRequestTimeout {
+
+		ps := m.syncPeer
+		log.Infof("Sync peer %s did not send headers in %s", ps.peer,
+			headersRequestTimeout)
+		ps.stalledUntil = now.Add(stallBackoff)
+		m.abandonSyncPeer()
+	}
+
+	tip := m.chain.BestHeight()
+	stalling := make(map[*peerSync]struct{})
+	for height, req := range m.requests {
+		timeout := blockRequestTimeout
+		if height == tip+1 && len(m.blocks) > 0 {
+			timeout = blockStallTimeout
+		}
+		if now.Sub(req.time) > timeout {
+			stalling[req.peer] = struct{}{}
+		}
+	}
+	for ps := range stalling {
+		log.Infof("Peer %s is stalling the download, requesting its %d "+
+			"blocks from other peers", ps.peer, len(ps.inFlight))
+		m.releaseRequests(ps)
+		ps.stalledUntil = now.Add(stallBackoff)
+	}
+}
+
+// releaseRequests forgets the blocks requested from the peer so they are
+// requested from the others.
+func (m *SyncManager) releaseRequests(ps *peerSync) {
+	for height := range ps.inFlight {
+		if req, ok := m.requests[height]; ok && req.peer == ps {
+			delete(m.requests, height)
+		}
+	}
+	ps.inFlight = make(map[uint64]struct{})
+}
+
+// serveBlocks answers a getdata message of a peer with the requested blocks
+// of the main chain and a notfound message listing the ones it does not
+// have.
+func (m *SyncManager) serveBlocks(p *p2p.PeerConn, msg *wire.MsgGetData) {
+	notFound := wire.NewMsgNotFound()
+	for _, iv := range msg.InvList {
+		var block *common.Block
+		if iv.Type == wire.InvTypeBlock {
+			block = m.chain.Block(&iv.Hash)
+		}
+		if block == nil {
+			notFound.AddInvVect(iv)
+			continue
+		}
+		msgBytes, err := m.Manage.EncodeMessage(wire.NewMsgBlock(block))
+		if err != nil {
+			log.Errorf("Failed to encode block %v: %v", iv.Hash, err)
+			notFound.AddInvVect(iv)
+			continue
+		}
+		if !p.Send(BlockChannel, msgBytes) {
+			return
+		}
+	}
+	if len(notFound.InvList) == 0 {
+		return
+	}
+	msgBytes, err := m.Manage.EncodeMessage(notFound)
+	if err != nil {
+		log.Errorf("Failed to encode notfound: %v", err)
+		return
+	}
+	p.Send(SyncChannel, msgBytes)
+}
@@ -0,0 +1,261 @@
+package blocksync
+
+import (
+	"time"
+
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/wire"
+)
+
+// headerTip returns the best validated header and its hash.
+func (m *SyncManager) headerTip() (*common.BlockHeader, common.Hash) {
+	if n := len(m.headers); n > 0 {
+		return m.headers[n-1].header, m.headers[n-1].hash
+	}
+	header := m.chain.HeaderByHeight(m.chain.BestHeight())
+	return header, header.BlockHash()
+}
+
+// headerTipHeight returns the height of the best validated header.
+func (m *SyncManager) headerTipHeight() uint64 {
+	if n := len(m.headers); n > 0 {
+		return m.headers[n-1].header.Height
+	}
+	return m.chain.BestHeight()
+}
+
+// headerByHeight returns the validated header at height, nil when there is
+// none yet.
+func (m *SyncManager) headerByHeight(height uint64) *headerNode {
+	if len(m.headers) == 0 {
+		return nil
+	}
+	first := m.headers[0].header.Height
+	if height < first || height-first >= uint64(len(m.headers)) {
+		return nil
+	}
+	return &m.headers[height-first]
+}
+
+// trimHeaders drops the headers whose blocks were connected.  When the chain
+// moved to another branch than the downloaded headers, for example through a
+// relayed block, the headers and the blocks awaited for them are dropped and
+// the header chain is downloaded again.
+func (m *SyncManager) trimHeaders() {
+	if len(m.headers) == 0 {
+		return
+	}
+	tip := m.chain.BestHeight()
+	for len(m.headers) > 0 && m.headers[0].header.Height <= tip {
+		delete(m.headerIndex, m.headers[0].hash)
+		m.headers = m.headers[1:]
+	}
+	for height, req := range m.requests {
+		if height <= tip {
+			delete(m.requests, height)
+			delete(req.peer.inFlight, height)
+		}
+	}
+	for height := range m.blocks {
+		if height <= tip {
+			delete(m.blocks, height)
+		}
+	}
+	if len(m.headers) == 0 {
+		return
+	}
+
+	tipHash := m.chain.HeaderByHeight(tip).BlockHash()
+	if m.headers[0].header.PrevBlock == tipHash {
+		return
+	}
+	log.Infof("Chain tip %v at height %d left the downloaded headers, "+
+		"downloading them again", tipHash, tip)
+	m.headers = nil
+	m.headerIndex = make(map[common.Hash]uint64)
+	for _, ps := range m.peers {
+		m.releaseRequests(ps)
+	}
+	m.blocks = make(map[uint64]*receivedBlock)
+	m.syncPeer = nil
+	m.headersRequested = time.Time{}
+}
+
+// startHeadersSync picks the sync peer among the peers higher than the best
+// header and requests headers from it.  Outbound peers are preferred since
+// they are less likely to be controlled by an attacker, then the highest.
+func (m *SyncManager) startHeadersSync() {
+	now := time.Now()
+	tipHeight := m.headerTipHeight()
+	var best *peerSync
+	for _, ps := range m.peers {
+		if ps.height <= tipHeight || now.Before(ps.stalledUntil) {
+			continue
+		}
+		if best == nil {
+			best = ps
+			continue
+		}
+		if ps.peer.IsOutbound() != best.peer.IsOutbound() {
+			if ps.peer.IsOutbound() {
+				best = ps
+			}
+			continue
+		}
+		if ps.height > best.height {
+			best = ps
+		}
+	}
+	if best == nil {
+		return
+	}
+
+	log.Infof("Syncing to height %d from peer %s", best.height, best.peer)
+	m.syncPeer = best
+	m.requestHeaders()
+}
+
+// requestHeaders asks the sync peer for the headers following the best
+// header.
+func (m *SyncManager) requestHeaders() {
+	msg := wire.NewMsgGetHeaders()
+	for _, hash := range m.blockLocator() {
+		msg.AddBlockLocatorHash(hash)
+	}
+	if !m.send(m.syncPeer.peer, SyncChannel, msg) {
+		// The send queue of the peer is full.  Let the headers
+		// request time out so another peer is tried.
+		log.Debugf("Failed to request headers from peer %s",
+			m.syncPeer.peer)
+	}
+	m.headersRequested = time.Now()
+}
+
+// blockLocator returns the locator of the best header: the hashes of the ten
+// best headers followed by hashes further and further apart down to the
+// genesis block.
+func (m *SyncManager) blockLocator() []*common.Hash {
+	var locator []*common.Hash
+	height := m.headerTipHeight()
+	step := uint64(1)
+	for {
+		var hash common.Hash
+		if node := m.headerByHeight(height); node != nil {
+			hash = node.hash
+		} else {
+			hash = m.chain.HeaderByHeight(height).BlockHash()
+		}
+		locator = append(locator, &hash)
+		if height == 0 {
+			return locator
+		}
+
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		if step > height {
+			height = 0
+		} else {
+			height -= step
+		}
+	}
+}
+
+// handleHeaders validates the headers sent by the sync peer and appends them
+// to the header chain.  More headers are requested as long as the peer sends
+// full messages.
+func (m *SyncManager) handleHeaders(ps *peerSync, msg *wire.MsgHeaders) {
+	if ps != m.syncPeer || m.headersRequested.IsZero() {
+		log.Debugf("Ignoring unrequested headers from peer %s", ps.peer)
+		return
+	}
+	m.headersRequested = time.Time{}
+
+	prev, prevHash := m.headerTip()
+	for _, header := range msg.Headers {
+		if header.PrevBlock != prevHash || header.Height != prev.Height+1 {
+			// The peer is on another branch or misbehaves.  It
+			// cannot be synced from either way.
+			m.Manage.AddBanScore(ps.peer, 0, badSyncBanScore,
+				"headers not connecting to the locator")
+			m.abandonSyncPeer()
+			return
+		}
+		if err := m.chain.CheckHeader(header, prev); err != nil {
+			hash := header.BlockHash()
+			log.Warnf("Invalid header %v at height %d from peer %s: %v",
+				hash, header.Height, ps.peer, err)
+			m.Manage.AddBanScore(ps.peer, invalidDataBanScore, 0,
+				"invalid header "+hash.String())
+			m.abandonSyncPeer()
+			return
+		}
+
+		hash := header.BlockHash()
+		m.headers = append(m.headers, headerNode{header: header, hash: hash})
+		m.headerIndex[hash] = header.Height
+		prev, prevHash = header, hash
+	}
+	if prev.Height > ps.height {
+		ps.height = prev.Height
+	}
+
+	if len(msg.Headers) == wire.MaxBlockHeadersPerMsg {
+		m.requestHeaders()
+		return
+	}
+
+	// The peer has no more headers, so it is no higher than the best
+	// header whatever it advertised.
+	ps.height = prev.Height
+	log.Infof("Downloaded headers up to height %d from peer %s",
+		prev.Height, ps.peer)
+	m.syncPeer = nil
+}
+
+// abandonSyncPeer stops syncing from the sync peer.  It is no longer
+// considered higher than the best header, so another peer is picked.
+func (m *SyncManager) abandonSyncPeer() {
+	ps := m.syncPeer
+	if tip := m.headerTipHeight(); ps.height > tip {
+		ps.height = tip
+	}
+	m.syncPeer = nil
+	m.headersRequested = time.Time{}
+}
+
+// serveHeaders answers a getheaders message of a peer with the headers of
+// the main chain following the first locator hash on it, up to the stop hash
+// or as many as fit in a message.
+func (m *SyncManager) serveHeaders(p *p2p.PeerConn, msg *wire.MsgGetHeaders) {
+	start := uint64(1)
+	for _, hash := range msg.BlockLocatorHashes {
+		if height, ok := m.chain.MainChainHeight(hash); ok {
+			start = height + 1
+			break
+		}
+	}
+
+	headers := wire.NewMsgHeaders()
+	best := m.chain.BestHeight()
+	for height := start; height <= best &&
+		len(headers.Headers) < wire.MaxBlockHeadersPerMsg; height++ {
+
+		header := m.chain.HeaderByHeight(height)
+		if header == nil {
+			break
+		}
+		headers.AddBlockHeader(header)
+		if header.BlockHash() == msg.HashStop {
+			break
+		}
+	}
+
+	msgBytes, err := m.Manage.EncodeMessage(headers)
+	if err != nil {
+		log.Errorf("Failed to encode headers: %v", err)
+		return
+	}
+	p.Send(SyncChannel, msgBytes)
+}
@@ -0,0 +1,512 @@
+package blocksync
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/p2p/conn"
+	"github.com/blockchainservice/wire"
+)
+
+const (
+	// SyncChannel is the channel the getheaders, headers, getdata and
+	// notfound messages are exchanged on.
+	SyncChannel byte = 0x40
+
+	// BlockChannel is the channel the blocks are delivered on.
+	BlockChannel byte = 0x41
+
+	// ReactorName is the name the sync manager is registered under.
+	ReactorName = "BLOCKSYNC"
+
+	// blockDownloadWindow is the number of blocks above the tip of the chain
+	// that may be requested.  The blocks are connected in order, so the
+	// window bounds the blocks held while the next one is missing.
+	blockDownloadWindow = 1024
+
+	// maxBlocksInFlightPerPeer is the maximum number of blocks requested
+	// from a peer and not delivered yet.
+	maxBlocksInFlightPerPeer = 16
+
+	// blockStallTimeout is the time the next block to connect may be
+	// awaited from a peer while blocks above it wait to be connected
+	// before the peer is considered stalling.
+	blockStallTimeout = 2 * time.Second
+
+	// blockRequestTimeout is the time any requested block may be awaited
+	// before the peer it was requested from is considered stalling.
+	blockRequestTimeout = 30 * time.Second
+
+	// headersRequestTimeout is the time the response of the sync peer to a
+	// getheaders message may be awaited before another sync peer is picked.
+	headersRequestTimeout = 30 * time.Second
+
+	// stallBackoff is the time no block is requested from a stalling peer.
+	stallBackoff = 30 * time.Second
+
+	// maxTipAge is the age of the tip of the chain below which the node is
+	// caught up with the network whatever the peers advertise.
+	maxTipAge = 24 * time.Hour
+
+	// noPeersTimeout is the time without peers after which a node leaves
+	// the initial download.  A standalone node has nobody to catch up
+	// with.
+	noPeersTimeout = 20 * time.Second
+
+	// tickInterval is the interval the stalls are looked for at.
+	tickInterval = time.Second
+
+	// progressLogInterval is the interval the download progress is logged
+	// at.
+	progressLogInterval = 10 * time.Second
+
+	// msgChanSize is the number of peer messages queued for the sync
+	// handler.
+	msgChanSize = 100
+
+	// invalidDataBanScore is the persistent ban score given to a peer that
+	// sends an invalid header or block.
+	invalidDataBanScore = 100
+
+	// badSyncBanScore is the decaying ban score given to a peer that
+	// misuses the sync protocol.
+	badSyncBanScore = 10
+)
+
+// Chain is the block chain the sync manager downloads.  It must be safe for
+// concurrent use since the peers are served from their own goroutines.
+type Chain interface {
+	// BestHeight returns the height of the tip of the main chain.
+	BestHeight() uint64
+
+	// HeaderByHeight returns the header of the block of the main chain at
+	// height, nil when the chain is not that high.
+	HeaderByHeight(height uint64) *common.BlockHeader
+
+	// MainChainHeight returns the height of the block with the given hash
+	// and whether it is part of the main chain.
+	MainChainHeight(hash *common.Hash) (uint64, bool)
+
+	// Block returns the block of the main chain with the given hash, nil
+	// when it is unknown.
+	Block(hash *common.Hash) *common.Block
+
+	// CheckHeader validates header as the successor of prev, which is
+	// already validated.
+	CheckHeader(header, prev *common.BlockHeader) error
+
+	// ProcessBlock validates block and connects it to the tip of the main
+	// chain.  The block is the successor of the tip.
+	ProcessBlock(block *common.Block) error
+}
+
+// Progress describes the state of the download of the chain.
+type Progress struct {
+	// InitialDownload is whether the node is still catching up to the
+	// network.
+	InitialDownload bool
+
+	// SyncPeer is the ID of the peer the headers are downloaded from,
+	// empty when the header chain is not being downloaded.
+	SyncPeer string
+
+	// HeaderHeight is the height of the best validated header.
+	HeaderHeight uint64
+
+	// BlockHeight is the height of the tip of the chain.
+	BlockHeight uint64
+
+	// PeerHeight is the best height advertised by the peers.
+	PeerHeight uint64
+
+	// BlocksInFlight is the number of blocks requested and not delivered
+	// yet.
+	BlocksInFlight int
+}
+
+// headerNode is a validated header whose block is not connected yet.
+type headerNode struct {
+	header *common.BlockHeader
+	hash   common.Hash
+}
+
+// peerSync is the download state of a peer.
+type peerSync struct {
+	peer *p2p.PeerConn
+
+	// height is the best height the peer is believed to have.
+	height uint64
+
+	// inFlight holds the heights of the blocks requested from the peer.
+	inFlight map[uint64]struct{}
+
+	// stalledUntil is the time until which nothing is requested from the
+	// peer because it stalled the download.
+	stalledUntil time.Time
+}
+
+// blockRequest is a block requested from a peer.
+type blockRequest struct {
+	peer *peerSync
+	time time.Time
+}
+
+// receivedBlock is a block waiting for its parent to be connected.
+type receivedBlock struct {
+	block *common.Block
+	peer  *p2p.PeerConn
+}
+
+// Messages handled by the sync handler.
+type (
+	addPeerMsg    struct{ peer *p2p.PeerConn }
+	removePeerMsg struct{ peer *p2p.PeerConn }
+	peerMsg       struct {
+		peer *p2p.PeerConn
+		msg  wire.Message
+	}
+)
+
+// SyncManager downloads the block chain from the peers.  It picks a sync peer
+// the header chain is downloaded and validated from first, then fetches the
+// blocks of the validated headers in parallel from all peers having them,
+// within a window sliding along as the blocks are connected.  Peers that stall
+// the download have their blocks requested from the others.  It also serves
+// the headers and blocks of the local chain to the peers.
+type SyncManager struct {
+	p2p.BaseReactor
+
+	chain Chain
+
+	started  int32
+	shutdown int32
+	msgChan  chan interface{}
+	quit     chan struct{}
+	wg       sync.WaitGroup
+
+	// The following fields are only accessed by the sync handler.
+	peers            map[*p2p.PeerConn]*peerSync
+	syncPeer         *peerSync
+	headersRequested time.Time
+	headers          []headerNode
+	headerIndex      map[common.Hash]uint64
+	requests         map[uint64]*blockRequest
+	blocks           map[uint64]*receivedBlock
+	initialDownload  bool
+	peerlessSince    time.Time
+	processed        int
+	lastProgressLog  time.Time
+
+	progressMtx sync.Mutex
+	progress    Progress
+}
+
+// NewSyncManager returns a sync manager downloading chain.  It has to be
+// started once registered.
+func NewSyncManager(chain Chain) *SyncManager {
+	return &SyncManager{
+		BaseReactor:     *p2p.NewBaseReactor(ReactorName),
+		chain:           chain,
+		msgChan:         make(chan interface{}, msgChanSize),
+		quit:            make(chan struct{}),
+		peers:           make(map[*p2p.PeerConn]*peerSync),
+		headerIndex:     make(map[common.Hash]uint64),
+		requests:        make(map[uint64]*blockRequest),
+		blocks:          make(map[uint64]*receivedBlock),
+		initialDownload: true,
+		progress:        Progress{InitialDownload: true},
+	}
+}
+
+// GetChannels declares SyncChannel and BlockChannel.
+func (m *SyncManager) GetChannels() []*conn.ChannelDescriptor {
+	return []*conn.ChannelDescriptor{{
+		ID:                SyncChannel,
+		Priority:          5,
+		SendQueueCapacity: 10,
+	}, {
+		ID:                  BlockChannel,
+		Priority:            3,
+		SendQueueCapacity:   maxBlocksInFlightPerPeer,
+		RecvMessageCapacity: wire.MessageHeaderSize + common.MaxBlockPayload,
+	}}
+}
+
+// AddPeer makes the peer available for the download.
+func (m *SyncManager) AddPeer(p *p2p.PeerConn) {
+	m.queue(&addPeerMsg{peer: p})
+}
+
+// RemovePeer requests the blocks awaited from the peer from the others.
+func (m *SyncManager) RemovePeer(p *p2p.PeerConn, reason interface{}) {
+	m.queue(&removePeerMsg{peer: p})
+}
+
+// Receive serves the requests of the peers and hands their responses to the
+// sync handler.
+func (m *SyncManager) Receive(chID byte, p *p2p.PeerConn, msgBytes []byte) {
+	msg, err := m.Manage.DecodeMessage(msgBytes)
+	if err != nil {
+		m.Manage.StopPeerForError(p, err)
+		return
+	}
+	log.Tracef("Received %s from peer %s", msg.Command(), p)
+
+	switch msg := msg.(type) {
+	case *wire.MsgGetHeaders:
+		if chID == SyncChannel {
+			m.serveHeaders(p, msg)
+			return
+		}
+	case *wire.MsgGetData:
+		if chID == SyncChannel {
+			m.serveBlocks(p, msg)
+			return
+		}
+	case *wire.MsgHeaders, *wire.MsgNotFound:
+		if chID == SyncChannel {
+			m.queue(&peerMsg{peer: p, msg: msg})
+			return
+		}
+	case *wire.MsgBlock:
+		if chID == BlockChannel {
+			m.queue(&peerMsg{peer: p, msg: msg})
+			return
+		}
+	}
+	m.Manage.AddBanScore(p, 0, badSyncBanScore, "unexpected "+
+		msg.Command()+" message on sync channel")
+}
+
+// queue hands msg to the sync handler.  It is dropped when the sync manager
+// is not running.
+func (m *SyncManager) queue(msg interface{}) {
+	if atomic.LoadInt32(&m.started) == 0 {
+		return
+	}
+	select {
+	case m.msgChan <- msg:
+	case <-m.quit:
+	}
+}
+
+// Start starts downloading the chain from the connected peers.
+func (m *SyncManager) Start() {
+	if atomic.AddInt32(&m.started, 1) != 1 {
+		return
+	}
+	log.Trace("Starting sync manager")
+	m.wg.Add(1)
+	go m.syncHandler()
+}
+
+// Stop stops the download and waits for the sync handler to exit.
+func (m *SyncManager) Stop() {
+	if atomic.AddInt32(&m.shutdown, 1) != 1 {
+		return
+	}
+	log.Info("Sync manager shutting down")
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// Progress returns the state of the download of the chain.
+func (m *SyncManager) Progress() Progress {
+	m.progressMtx.Lock()
+	defer m.progressMtx.Unlock()
+	return m.progress
+}
+
+// IsInitialDownload returns whether the node is still catching up to the
+// network.  It becomes false for good once the chain reached the height of
+// the peers.
+func (m *SyncManager) IsInitialDownload() bool {
+	return m.Progress().InitialDownload
+}
+
+// syncHandler is the goroutine the download runs on.  All peer events and
+// responses are handled on it, so the download state needs no locking.
+func (m *SyncManager) syncHandler() {
+	defer m.wg.Done()
+
+	// Peers that connected before the start were not announced.
+	for _, p := range m.Manage.Peers() {
+		m.handleAddPeer(p)
+	}
+	m.lastProgressLog = time.Now()
+	m.update()
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-m.msgChan:
+			switch msg := msg.(type) {
+			case *addPeerMsg:
+				m.handleAddPeer(msg.peer)
+
+			case *removePeerMsg:
+				m.handleRemovePeer(msg.peer)
+
+			case *peerMsg:
+				ps, ok := m.peers[msg.peer]
+				if !ok {
+					break
+				}
+				switch wmsg := msg.msg.(type) {
+				case *wire.MsgHeaders:
+					m.handleHeaders(ps, wmsg)
+				case *wire.MsgBlock:
+					m.handleBlock(ps, &wmsg.Block)
+				case *wire.MsgNotFound:
+					m.handleNotFound(ps, wmsg)
+				}
+			}
+
+		case now := <-ticker.C:
+			m.handleStalls(now)
+			m.logProgress(now)
+
+		case <-m.quit:
+			log.Trace("Sync handler done")
+			return
+		}
+		m.update()
+	}
+}
+
+// handleAddPeer starts tracking the download state of the peer.  A peer that
+// stopped already is ignored, it could never be removed otherwise.
+func (m *SyncManager) handleAddPeer(p *p2p.PeerConn) {
+	if _, ok := m.peers[p]; ok || !p.IsRunning() {
+		return
+	}
+	height := p.NodeInfo().BestHeight
+	log.Debugf("New sync candidate %s (height %d)", p, height)
+	m.peers[p] = &peerSync{
+		peer:     p,
+		height:   height,
+		inFlight: make(map[uint64]struct{}),
+	}
+}
+
+// handleRemovePeer forgets the peer and releases the blocks requested from
+// it.
+func (m *SyncManager) handleRemovePeer(p *p2p.PeerConn) {
+	ps, ok := m.peers[p]
+	if !ok {
+		return
+	}
+	m.releaseRequests(ps)
+	if m.syncPeer == ps {
+		log.Infof("Lost sync peer %s", p)
+		m.syncPeer = nil
+		m.headersRequested = time.Time{}
+	}
+	delete(m.peers, p)
+}
+
+// update moves the download forward after an event: a sync peer is picked
+// when the header chain may be extended, blocks are requested and the end of
+// the initial download is detected.
+func (m *SyncManager) update() {
+	m.trimHeaders()
+	if m.syncPeer == nil {
+		m.startHeadersSync()
+	}
+	m.fetchBlocks()
+	m.checkInitialDownload()
+	m.updateProgress()
+}
+
+// checkInitialDownload ends the initial download once no header is waiting
+// for its block and either the tip of the chain is recent, the chain is as
+// high as every peer, or there were no peers for noPeersTimeout.
+func (m *SyncManager) checkInitialDownload() {
+	now := time.Now()
+	if len(m.peers) > 0 {
+		m.peerlessSince = time.Time{}
+	} else if m.peerlessSince.IsZero() {
+		m.peerlessSince = now
+	}
+	if !m.initialDownload || m.syncPeer != nil || len(m.headers) > 0 {
+		return
+	}
+
+	tip := m.chain.HeaderByHeight(m.chain.BestHeight())
+	switch {
+	case now.Sub(tip.Timestamp) <= maxTipAge:
+	case len(m.peers) == 0:
+		if now.Sub(m.peerlessSince) < noPeersTimeout {
+			return
+		}
+	default:
+		for _, ps := range m.peers {
+			if ps.height > tip.Height {
+				return
+			}
+		}
+	}
+	m.initialDownload = false
+	log.Infof("Initial block download complete at height %d", tip.Height)
+}
+
+// updateProgress publishes the state of the download.
+func (m *SyncManager) updateProgress() {
+	progress := Progress{
+		InitialDownload: m.initialDownload,
+		HeaderHeight:    m.headerTipHeight(),
+		BlockHeight:     m.chain.BestHeight(),
+		BlocksInFlight:  len(m.requests),
+	}
+	if m.syncPeer != nil {
+		progress.SyncPeer = m.syncPeer.peer.ID()
+	}
+	for _, ps := range m.peers {
+		if ps.height > progress.PeerHeight {
+			progress.PeerHeight = ps.height
+		}
+	}
+
+	m.progressMtx.Lock()
+	changed := progress.BlockHeight != m.progress.BlockHeight
+	m.progress = progress
+	m.progressMtx.Unlock()
+
+	if changed {
+		m.Manage.SetBestHeight(progress.BlockHeight)
+	}
+}
+
+// logProgress logs the number of blocks connected since the last time when
+// the progress log interval elapsed.
+func (m *SyncManager) logProgress(now time.Time) {
+	duration := now.Sub(m.lastProgressLog)
+	if duration < progressLogInterval || m.processed == 0 {
+		return
+	}
+	blockStr := "blocks"
+	if m.processed == 1 {
+		blockStr = "block"
+	}
+	log.Infof("Processed %d %s in the last %s (height %d, headers %d, "+
+		"%d in flight)", m.processed, blockStr,
+		duration.Truncate(time.Millisecond), m.chain.BestHeight(),
+		m.headerTipHeight(), len(m.requests))
+	m.processed = 0
+	m.lastProgressLog = now
+}
+
+// send encodes msg and queues it for the peer on channel chID without
+// blocking the sync handler.  It returns whether the message was queued.
+func (m *SyncManager) send(p *p2p.PeerConn, chID byte, msg wire.Message) bool {
+	msgBytes, err := m.Manage.EncodeMessage(msg)
+	if err != nil {
+		log.Errorf("Failed to encode %s message: %v", msg.Command(), err)
+		return false
+	}
+	return p.TrySend(chID, msgBytes)
+}
@@ -0,0 +1,315 @@
+package blocksync
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blockchainservice/chaincfg"
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/wire"
+)
+
+// testChain is a Chain held in memory that accepts any header and block
+// following its tip.  It counts the requests it serves to the peers.
+type testChain struct {
+	mtx    sync.Mutex
+	blocks []*common.Block
+	index  map[common.Hash]uint64
+
+	// locatorLookups is the number of block locator hashes looked up,
+	// which only happens when the headers of the chain are served.
+	locatorLookups int
+
+	// blocksServed is the number of blocks looked up by hash, which only
+	// happens when they are served.
+	blocksServed int
+}
+
+// newTestChain returns a chain holding blocks, the first of which is the
+// genesis block.
+func newTestChain(blocks []*common.Block) *testChain {
+	c := &testChain{index: make(map[common.Hash]uint64)}
+	for _, block := range blocks {
+		c.index[block.BlockHash()] = block.Header.Height
+		c.blocks = append(c.blocks, block)
+	}
+	return c
+}
+
+func (c *testChain) BestHeight() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return uint64(len(c.blocks) - 1)
+}
+
+func (c *testChain) HeaderByHeight(height uint64) *common.BlockHeader {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if height >= uint64(len(c.blocks)) {
+		return nil
+	}
+	return &c.blocks[height].Header
+}
+
+func (c *testChain) MainChainHeight(hash *common.Hash) (uint64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.locatorLookups++
+	height, ok := c.index[*hash]
+	return height, ok
+}
+
+func (c *testChain) Block(hash *common.Hash) *common.Block {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.blocksServed++
+	height, ok := c.index[*hash]
+	if !ok {
+		return nil
+	}
+	return c.blocks[height]
+}
+
+func (c *testChain) CheckHeader(header, prev *common.BlockHeader) error {
+	return nil
+}
+
+func (c *testChain) ProcessBlock(block *common.Block) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	tip := c.blocks[len(c.blocks)-1]
+	if block.Header.PrevBlock != tip.BlockHash() {
+		return errors.New("block does not follow the tip")
+	}
+	c.index[block.BlockHash()] = block.Header.Height
+	c.blocks = append(c.blocks, block)
+	return nil
+}
+
+// stats returns the number of locator lookups and served blocks.
+func (c *testChain) stats() (int, int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.locatorLookups, c.blocksServed
+}
+
+// makeBlocks returns the regression test genesis block followed by n blocks.
+func makeBlocks(n int) []*common.Block {
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	blocks := []*common.Block{genesis}
+	for i := 1; i <= n; i++ {
+		prev := &blocks[i-1].Header
+		prevHash := prev.BlockHash()
+		block := common.NewBlock(common.NewBlockHeader(1, &prevHash,
+			&common.Hash{}, uint64(i), prev.Bits, 0))
+		block.Header.Timestamp = prev.Timestamp.Add(time.Minute)
+		block.AddTransaction(&common.Tx{
+			Version: 1,
+			TxIn: []*common.TxIn{{
+				PreviousOutPoint: common.OutPoint{
+					Index: common.MaxPrevOutIndex,
+				},
+				Sequence: common.MaxTxInSequenceNum,
+			}},
+			TxOut: []*common.TxOut{{Value: int64(i)}},
+		})
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// silentSyncManager is a sync manager that never answers getdata messages.
+type silentSyncManager struct {
+	*SyncManager
+}
+
+func (m *silentSyncManager) Receive(chID byte, p *p2p.PeerConn, msgBytes []byte) {
+	msg, err := m.Manage.DecodeMessage(msgBytes)
+	if err == nil {
+		if _, ok := msg.(*wire.MsgGetData); ok {
+			return
+		}
+	}
+	m.SyncManager.Receive(chID, p, msgBytes)
+}
+
+// newSyncNet returns a started TestNet whose node i downloads chains[i].  The
+// sync managers of the nodes listed in silent do not serve blocks.  The sync
+// manager of node 0 is not started so the peers can be connected first.
+func newSyncNet(t *testing.T, chains []*testChain, silent ...int) (*p2p.TestNet, []*SyncManager) {
+	t.Helper()
+	managers := make([]*SyncManager, len(chains))
+	setup := func(i int, m *p2p.Manage) error {
+		managers[i] = NewSyncManager(chains[i])
+		var reactor p2p.Reactor = managers[i]
+		for _, j := range silent {
+			if i == j {
+				reactor = &silentSyncManager{managers[i]}
+			}
+		}
+		m.SetBestHeight(chains[i].BestHeight())
+		return m.AddReactor(ReactorName, reactor)
+	}
+	tn, err := p2p.NewTestNet(len(chains), 1, nil, setup)
+	if err != nil {
+		t.Fatalf("NewTestNet: %v", err)
+	}
+	tn.Start()
+	for _, sm := range managers[1:] {
+		sm.Start()
+	}
+	t.Cleanup(func() {
+		for _, sm := range managers {
+			sm.Stop()
+		}
+		tn.Stop()
+	})
+
+	for i := 1; i < len(chains); i++ {
+		if err := tn.Connect(0, i); err != nil {
+			t.Fatalf("Connect(0, %d): %v", i, err)
+		}
+	}
+	return tn, managers
+}
+
+// waitForHeight waits until chain reaches height or fails the test after
+// timeout.
+func waitForHeight(t *testing.T, chain *testChain, height uint64,
+	timeout time.Duration) {
+
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for chain.BestHeight() < height {
+		if time.Now().After(deadline) {
+			t.Fatalf("chain at height %d after %v, want %d",
+				chain.BestHeight(), timeout, height)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSyncHeadersFirst ensures a node downloads the header chain from the
+// highest peer alone, then fetches the blocks from every peer having them and
+// leaves the initial download once it caught up.
+func TestSyncHeadersFirst(t *testing.T) {
+	blocks := makeBlocks(120)
+	chains := []*testChain{
+		newTestChain(blocks[:1]),
+		newTestChain(blocks),
+		newTestChain(blocks[:101]),
+	}
+	_, managers := newSyncNet(t, chains)
+
+	if !managers[0].IsInitialDownload() {
+		t.Fatal("new sync manager is not in the initial download")
+	}
+	managers[0].Start()
+	waitForHeight(t, chains[0], 120, 10*time.Second)
+
+	for height := uint64(1); height <= 120; height++ {
+		got := chains[0].HeaderByHeight(height).BlockHash()
+		if want := blocks[height].BlockHash(); got != want {
+			t.Fatalf("block %v at height %d, want %v", got, height,
+				want)
+		}
+	}
+
+	// Only the highest peer is asked for headers.
+	if lookups, _ := chains[1].stats(); lookups == 0 {
+		t.Error("headers not downloaded from the highest peer")
+	}
+	if lookups, _ := chains[2].stats(); lookups != 0 {
+		t.Errorf("%d locator hashes looked up on the lower peer, want 0",
+			lookups)
+	}
+
+	// Both peers get their share of the blocks they have and no block is
+	// downloaded twice.
+	_, served1 := chains[1].stats()
+	_, served2 := chains[2].stats()
+	if served1 == 0 || served2 == 0 {
+		t.Errorf("blocks served by the peers: %d and %d, want both "+
+			"above 0", served1, served2)
+	}
+	if served1+served2 != 120 {
+		t.Errorf("%d blocks served, want 120", served1+served2)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for managers[0].IsInitialDownload() {
+		if time.Now().After(deadline) {
+			t.Fatalf("still in the initial download: %+v",
+				managers[0].Progress())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	progress := managers[0].Progress()
+	if progress.SyncPeer != "" || progress.HeaderHeight != 120 ||
+		progress.BlocksInFlight != 0 {
+
+		t.Errorf("unexpected progress after the download: %+v", progress)
+	}
+}
+
+// TestSyncStalledPeer ensures the blocks requested from a peer that never
+// delivers them are requested from another peer once the stall timeout
+// elapsed, without waiting for the request timeout or disconnecting it.
+func TestSyncStalledPeer(t *testing.T) {
+	blocks := makeBlocks(64)
+	chains := []*testChain{
+		newTestChain(blocks[:1]),
+		newTestChain(blocks),
+		newTestChain(blocks),
+	}
+	tn, managers := newSyncNet(t, chains, 2)
+
+	start := time.Now()
+	managers[0].Start()
+	waitForHeight(t, chains[0], 64, blockRequestTimeout)
+	elapsed := time.Since(start)
+
+	if elapsed < blockStallTimeout || elapsed >= blockRequestTimeout {
+		t.Errorf("download took %v, want between %v and %v", elapsed,
+			blockStallTimeout, blockRequestTimeout)
+	}
+	if _, served := chains[1].stats(); served != 64 {
+		t.Errorf("%d blocks served by the responsive peer, want 64",
+			served)
+	}
+	if tn.Nodes[0].Peer(tn.Addr(2).ID) == nil {
+		t.Error("stalling peer disconnected")
+	}
+}
+
+// TestSyncNoPeers ensures a node without peers leaves the initial download
+// right away when its tip is recent and after noPeersTimeout otherwise.
+func TestSyncNoPeers(t *testing.T) {
+	blocks := makeBlocks(1)
+	blocks[1].Header.Timestamp = time.Unix(time.Now().Unix(), 0)
+	_, managers := newSyncNet(t, []*testChain{newTestChain(blocks)})
+	managers[0].Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for managers[0].IsInitialDownload() {
+		if time.Now().After(deadline) {
+			t.Fatal("node with a recent tip stays in the initial download")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The tip of a chain left alone for years is old.
+	m := NewSyncManager(newTestChain(makeBlocks(1)))
+	m.checkInitialDownload()
+	if !m.initialDownload {
+		t.Fatal("node with an old tip left the initial download at once")
+	}
+	m.peerlessSince = time.Now().Add(-noPeersTimeout)
+	m.checkInitialDownload()
+	if m.initialDownload {
+		t.Errorf("node without peers for %v stays in the initial download",
+			noPeersTimeout)
+	}
+}
@@ -0,0 +1,1183 @@
+package conn
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blockchainservice/common"
+)
+
+const (
+	defaultMaxPacketMsgPayloadSize = 1024
+
+	numBatchPacketMsgs = 10
+	minReadBufferSize  = 1024
+	minWriteBufferSize = 65536
+	updateStats        = 2 * time.Second
+
+	defaultFlushThrottle = 100 * time.Millisecond
+
+	defaultSendQueueCapacity   = 1
+	defaultRecvBufferCapacity  = 4096
+	defaultRecvMessageCapacity = 22020096 // 21MB
+	defaultSendTimeout         = 10 * time.Second
+	defaultMaxSendQueueBytes   = 16 * 1024 * 1024 // 16MB
+	defaultPingInterval        = 60 * time.Second
+	defaultPongTimeout         = 45 * time.Second
+)
+
+// ProtocolError describes a violation of the connection protocol by the
+// remote peer, such as an oversized message or an unknown channel.  It is
+// passed to the error callback so the owner of the connection can penalize
+// the peer.
+type ProtocolError struct {
+	Description string
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *ProtocolError) Error() string {
+	return "protocol violation: " + e.Description
+}
+
+// protocolError creates a ProtocolError given a set of arguments.
+func protocolError(format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Description: fmt.Sprintf(format, args...)}
+}
+
+// DisconnectError is passed to the error callback when the remote peer
+// closed the connection with a disconnect packet.  Reason is the reason the
+// peer gave.
+type DisconnectError struct {
+	Reason string
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *DisconnectError) Error() string {
+	return "peer disconnected: " + e.Reason
+}
+
+// Packet types of the multiplexed connection.
+const (
+	packetTypePing       byte = 0x01
+	packetTypePong       byte = 0x02
+	packetTypeMsg        byte = 0x03
+	packetTypeDisconnect byte = 0x04
+)
+
+// maxDisconnectReasonLen is the maximum length of the reason carried by a
+// disconnect packet.
+const maxDisconnectReasonLen = 256
+
+type receiveCbFunc func(chID byte, msgBytes []byte)
+type errorCbFunc func(interface{})
+
+/*
+MConnection multiplexes messages of several channels over a single
+connection.  Each channel is declared by a ChannelDescriptor and has its own
+send queue and priority.
+
+Each peer has one MConnection instance.  Messages are sent with Send or
+TrySend:
+
+	func (c *MConnection) Send(chID byte, msgBytes []byte) bool {}
+	func (c *MConnection) TrySend(chID byte, msgBytes []byte) bool {}
+
+Send(chID, msgBytes) is a blocking call that waits until msg is successfully
+queued for the channel with the given id byte chID, or until the request times
+out.  The message msg is serialized by the caller.
+
+TrySend(chID, msgBytes) is a nonblocking call that returns false if the
+channel's queue is full.
+
+Messages are split into packets of at most MaxPacketMsgPayloadSize bytes.
+The send routine picks the next packet from the channel with the lowest ratio
+of recently sent bytes to priority, so busy channels cannot starve the others.
+Complete messages received on a channel are handed to the onReceive callback.
+Inbound messages are delivered in order per channel.
+
+A ping is sent every PingInterval and the connection fails when no pong
+arrives within PongTimeout.
+*/
+type MConnection struct {
+	conn          net.Conn
+	bufConnReader *bufio.Reader
+	bufConnWriter *bufio.Writer
+	send          chan struct{}
+	pong          chan struct{}
+	channels      []*Channel
+	channelsIdx   map[byte]*Channel
+	onReceive     receiveCbFunc
+	onError       errorCbFunc
+	errored       uint32
+	config        MConnConfig
+
+	// Closing quitSendRoutine will cause the sendRoutine to eventually quit.
+	// doneSendRoutine is closed when the sendRoutine actually quits.
+	quitSendRoutine chan struct{}
+	doneSendRoutine chan struct{}
+
+	// Closing quitRecvRoutine will cause the recvRoutine to eventually quit.
+	quitRecvRoutine chan struct{}
+
+	// used to ensure Start and Stop are safe to call concurrently.
+	stopMtx sync.Mutex
+	started bool
+	stopped bool
+
+	flushTimer *time.Timer // flush writes as necessary but throttled.
+	pingTimer  *time.Ticker
+
+	// close conn if pong is not received in pongTimeout
+	pongTimer     *time.Timer
+	pongTimeoutCh chan bool // true - timeout, false - peer sent pong
+
+	// lastPingSent is the time the last ping was sent and pingTime, in
+	// nanoseconds, the round trip time of the last ping that was answered.
+	lastPingSent time.Time
+	pingTime     int64 // atomic
+
+	chStatsTimer *time.Ticker // update channel stats periodically
+
+	// sendLimiter and recvLimiter limit the bandwidth of the connection.
+	sendLimiter *RateLimiter
+	recvLimiter *RateLimiter
+
+	// queuedBytes is the number of bytes queued on the channels and not
+	// written yet.  queueSpace is signaled whenever some were written.
+	queuedBytes int64 // atomic
+	queueSpace  chan struct{}
+
+	// bytesSent and bytesRecv count the bytes written and read, and
+	// sendRate and recvRate are the bytes per second over the last stats
+	// period.
+	bytesSent     int64 // atomic
+	bytesRecv     int64 // atomic
+	sendRate      int64 // atomic
+	recvRate      int64 // atomic
+	lastBytesSent int64
+	lastBytesRecv int64
+	lastStats     time.Time
+
+	created time.Time // time of creation
+
+	maxPacketMsgSize int
+}
+
+// MConnConfig is a MConnection configuration.
+type MConnConfig struct {
+	// Maximum payload size of a message packet
+	MaxPacketMsgPayloadSize int
+
+	// Interval to flush writes (throttled)
+	FlushThrottle time.Duration
+
+	// Interval to send pings
+	PingInterval time.Duration
+
+	// Maximum wait time for pongs
+	PongTimeout time.Duration
+
+	// SendRate and RecvRate limit the bytes per second sent and received
+	// on the connection.  Zero means unlimited.
+	SendRate int64
+	RecvRate int64
+
+	// SharedSendLimiter and SharedRecvLimiter, when set, additionally
+	// limit the connection together with the others sharing them.
+	SharedSendLimiter *RateLimiter
+	SharedRecvLimiter *RateLimiter
+
+	// MaxSendQueueBytes bounds the bytes queued on the channels and not
+	// written yet.  Send blocks and TrySend fails while the bound is
+	// reached, so a slow peer pushes back on the senders instead of
+	// growing its queues.  A message is always accepted when nothing is
+	// queued.
+	MaxSendQueueBytes int
+}
+
+// DefaultMConnConfig returns the default config.
+func DefaultMConnConfig() MConnConfig {
+	return MConnConfig{
+		MaxPacketMsgPayloadSize: defaultMaxPacketMsgPayloadSize,
+		FlushThrottle:           defaultFlushThrottle,
+		PingInterval:            defaultPingInterval,
+		PongTimeout:             defaultPongTimeout,
+		MaxSendQueueBytes:       defaultMaxSendQueueBytes,
+	}
+}
+
+// NewMConnection wraps net.Conn and creates multiplex connection
+func NewMConnection(conn net.Conn, chDescs []*ChannelDescriptor,
+	onReceive receiveCbFunc, onError errorCbFunc) (*MConnection, error) {
+
+	return NewMConnectionWithConfig(conn, chDescs, onReceive, onError,
+		DefaultMConnConfig())
+}
+
+// NewMConnectionWithConfig wraps net.Conn and creates multiplex connection
+// with a config.  An error is returned when two channels share an ID, a
+// channel has no priority or the ping and pong timings are inconsistent.
+func NewMConnectionWithConfig(conn net.Conn, chDescs []*ChannelDescriptor,
+	onReceive receiveCbFunc, onError errorCbFunc,
+	config MConnConfig) (*MConnection, error) {
+
+	if config.PongTimeout >= config.PingInterval {
+		return nil, errors.New("pongTimeout must be less than pingInterval " +
+			"(otherwise, next ping will reset pong timer)")
+	}
+
+	mconn := &MConnection{
+		conn:          conn,
+		bufConnReader: bufio.NewReaderSize(conn, minReadBufferSize),
+		bufConnWriter: bufio.NewWriterSize(conn, minWriteBufferSize),
+		send:          make(chan struct{}, 1),
+		pong:          make(chan struct{}, 1),
+		onReceive:     onReceive,
+		onError:       onError,
+		config:        config,
+		created:       time.Now(),
+		sendLimiter:   NewRateLimiter(config.SendRate),
+		recvLimiter:   NewRateLimiter(config.RecvRate),
+		queueSpace:    make(chan struct{}, 1),
+	}
+
+	// Create channels
+	var channelsIdx = map[byte]*Channel{}
+	var channels = []*Channel{}
+
+	for _, desc := range chDescs {
+		if _, ok := channelsIdx[desc.ID]; ok {
+			return nil, fmt.Errorf("channel %#x declared twice", desc.ID)
+		}
+		if desc.Priority <= 0 {
+			return nil, fmt.Errorf("channel %#x priority must be a "+
+				"positive integer", desc.ID)
+		}
+		channel := newChannel(mconn, *desc)
+		channelsIdx[channel.desc.ID] = channel
+		channels = append(channels, channel)
+	}
+	mconn.channels = channels
+	mconn.channelsIdx = channelsIdx
+
+	// maxPacketMsgSize() is a bit heavy, so call just once
+	mconn.maxPacketMsgSize = mconn.maxPacketMsgPayloadSize() + 1 + 1 +
+		common.MaxVarIntPayload
+
+	return mconn, nil
+}
+
+// Start starts the send and receive routines.
+func (c *MConnection) Start() error {
+	c.stopMtx.Lock()
+	defer c.stopMtx.Unlock()
+
+	if c.started {
+		return errors.New("mconnection already started")
+	}
+	c.started = true
+
+	c.flushTimer = time.NewTimer(c.config.FlushThrottle)
+	c.flushTimer.Stop()
+	c.pingTimer = time.NewTicker(c.config.PingInterval)
+	c.pongTimeoutCh = make(chan bool, 1)
+	c.chStatsTimer = time.NewTicker(updateStats)
+	c.lastStats = time.Now()
+	c.quitSendRoutine = make(chan struct{})
+	c.doneSendRoutine = make(chan struct{})
+	c.quitRecvRoutine = make(chan struct{})
+	go c.sendRoutine()
+	go c.recvRoutine()
+	return nil
+}
+
+// stopServices stops the timers and closes the quit channels of the
+// routines.  It returns true if the connection was not running.  It uses the
+// stopMtx to ensure only one caller can do this at a time.
+func (c *MConnection) stopServices() (alreadyStopped bool) {
+	c.stopMtx.Lock()
+	defer c.stopMtx.Unlock()
+
+	if !c.started || c.stopped {
+		return true
+	}
+	c.stopped = true
+
+	c.flushTimer.Stop()
+	c.pingTimer.Stop()
+	c.chStatsTimer.Stop()
+
+	// inform the recvRouting that we are shutting down
+	close(c.quitRecvRoutine)
+	close(c.quitSendRoutine)
+	return false
+}
+
+// Stop stops the send and receive routines and closes the connection
+// without waiting for queued messages to be sent.
+func (c *MConnection) Stop() {
+	if c.stopServices() {
+		return
+	}
+
+	// We can't close pong safely here because recvRoutine may write to it
+	// after we've stopped. Though it doesn't need to get closed at all, we
+	// close it @ recvRoutine.
+
+	c.conn.Close()
+}
+
+// FlushStop stops the send and receive routines, writes the messages still
+// queued on the channels followed by a disconnect packet carrying reason and
+// closes the connection.  Writing gives up once timeout elapsed so a peer
+// that does not read cannot hold the shutdown.
+func (c *MConnection) FlushStop(reason string, timeout time.Duration) {
+	if c.stopServices() {
+		return
+	}
+
+	// The sendRoutine is the only writer to the connection, wait for it
+	// to quit before writing from here.
+	deadline := time.Now().Add(timeout)
+	select {
+	case <-c.doneSendRoutine:
+	case <-time.After(timeout):
+		log.Debugf("Send routine of %v did not quit in time", c)
+		c.conn.Close()
+		return
+	}
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		log.Debugf("Failed to set write deadline on %v: %v", c, err)
+	}
+
+	for !c.sendSomePacketMsgs() {
+	}
+	err := writeDisconnectPacket(c.bufConnWriter, reason)
+	if err == nil {
+		err = c.bufConnWriter.Flush()
+	}
+	if err != nil {
+		log.Debugf("Failed to send disconnect to %v: %v", c, err)
+	}
+	c.conn.Close()
+}
+
+// String returns the connection in human-readable form.
+func (c *MConnection) String() string {
+	return fmt.Sprintf("MConn{%v}", c.conn.RemoteAddr())
+}
+
+// IsRunning returns whether the connection was started and not stopped.
+func (c *MConnection) IsRunning() bool {
+	c.stopMtx.Lock()
+	defer c.stopMtx.Unlock()
+	return c.started && !c.stopped
+}
+
+func (c *MConnection) flush() {
+	log.Tracef("Flush %v", c)
+	err := c.bufConnWriter.Flush()
+	if err != nil {
+		log.Debugf("MConnection flush failed: %v", err)
+	}
+}
+
+// Catch panics, usually caused by remote disconnects.
+func (c *MConnection) _recover() {
+	if r := recover(); r != nil {
+		log.Errorf("MConnection panicked: %v\n%s", r, debug.Stack())
+		c.stopForError(fmt.Errorf("recovered from panic: %v", r))
+	}
+}
+
+func (c *MConnection) stopForError(r interface{}) {
+	c.Stop()
+	if atomic.CompareAndSwapUint32(&c.errored, 0, 1) {
+		if c.onError != nil {
+			c.onError(r)
+		}
+	}
+}
+
+// Send queues a message to be sent to channel.
+func (c *MConnection) Send(chID byte, msgBytes []byte) bool {
+	if !c.IsRunning() {
+		return false
+	}
+
+	log.Tracef("Send %v: channel %#x, %d bytes", c, chID, len(msgBytes))
+
+	// Send message to channel.
+	channel, ok := c.channelsIdx[chID]
+	if !ok {
+		log.Errorf("Cannot send bytes, unknown channel %#x", chID)
+		return false
+	}
+
+	if !c.reserveQueueBytes(len(msgBytes), true) {
+		log.Debugf("Send queue full %v: channel %#x, %d bytes", c, chID,
+			len(msgBytes))
+		return false
+	}
+	success := channel.sendBytes(msgBytes)
+	if !success {
+		c.releaseQueueBytes(len(msgBytes))
+	}
+	if success {
+		// Wake up sendRoutine if necessary
+		select {
+		case c.send <- struct{}{}:
+		default:
+		}
+	} else {
+		log.Debugf("Send failed %v: channel %#x, %d bytes", c, chID,
+			len(msgBytes))
+	}
+	return success
+}
+
+// TrySend queues a message to be sent to channel.  Nonblocking, returns true
+// if successful.
+func (c *MConnection) TrySend(chID byte, msgBytes []byte) bool {
+	if !c.IsRunning() {
+		return false
+	}
+
+	log.Tracef("TrySend %v: channel %#x, %d bytes", c, chID, len(msgBytes))
+
+	// Send message to channel.
+	channel, ok := c.channelsIdx[chID]
+	if !ok {
+		log.Errorf("Cannot send bytes, unknown channel %#x", chID)
+		return false
+	}
+
+	if !c.reserveQueueBytes(len(msgBytes), false) {
+		return false
+	}
+	ok = channel.trySendBytes(msgBytes)
+	if !ok {
+		c.releaseQueueBytes(len(msgBytes))
+	}
+	if ok {
+		// Wake up sendRoutine if necessary
+		select {
+		case c.send <- struct{}{}:
+		default:
+		}
+	}
+
+	return ok
+}
+
+// reserveQueueBytes accounts for n bytes queued for sending.  It fails when
+// MaxSendQueueBytes would be exceeded, unless block is set, in which case it
+// waits for the queued bytes to be written until the send timeout.
+func (c *MConnection) reserveQueueBytes(n int, block bool) bool {
+	max := int64(c.config.MaxSendQueueBytes)
+	var timeout <-chan time.Time
+	for {
+		queued := atomic.LoadInt64(&c.queuedBytes)
+		if max <= 0 || queued == 0 || queued+int64(n) <= max {
+			if atomic.CompareAndSwapInt64(&c.queuedBytes, queued,
+				queued+int64(n)) {
+
+				return true
+			}
+			continue
+		}
+		if !block {
+			return false
+		}
+		if timeout == nil {
+			timeout = time.After(defaultSendTimeout)
+		}
+		select {
+		case <-c.queueSpace:
+		case <-timeout:
+			return false
+		case <-c.quitSendRoutine:
+			return false
+		}
+	}
+}
+
+// releaseQueueBytes accounts for n queued bytes written or dropped and wakes
+// up a sender waiting for space.
+func (c *MConnection) releaseQueueBytes(n int) {
+	atomic.AddInt64(&c.queuedBytes, -int64(n))
+	select {
+	case c.queueSpace <- struct{}{}:
+	default:
+	}
+}
+
+// CanSend returns true if you can send more data onto the chID, false
+// otherwise.  Use only as a heuristic.
+func (c *MConnection) CanSend(chID byte) bool {
+	if !c.IsRunning() {
+		return false
+	}
+
+	channel, ok := c.channelsIdx[chID]
+	if !ok {
+		log.Errorf("Unknown channel %#x", chID)
+		return false
+	}
+	return channel.canSend()
+}
+
+// sendRoutine polls for packets to send from channels.
+func (c *MConnection) sendRoutine() {
+	defer c._recover()
+
+FOR_LOOP:
+	for {
+		var err error
+	SELECTION:
+		select {
+		case <-c.flushTimer.C:
+			// NOTE: flushTimer.Reset() must be called every time
+			// something is written to .bufConnWriter.
+			c.flush()
+		case <-c.chStatsTimer.C:
+			for _, channel := range c.channels {
+				channel.updateStats()
+			}
+			c.updateRates()
+		case <-c.pingTimer.C:
+			log.Tracef("Send Ping %v", c)
+			err = writePacket(c.bufConnWriter, packetTypePing)
+			if err != nil {
+				break SELECTION
+			}
+			c.lastPingSent = time.Now()
+			log.Tracef("Starting pong timer %v", c.config.PongTimeout)
+			c.pongTimer = time.AfterFunc(c.config.PongTimeout, func() {
+				select {
+				case c.pongTimeoutCh <- true:
+				default:
+				}
+			})
+			c.flush()
+		case timeout := <-c.pongTimeoutCh:
+			if timeout {
+				log.Debugf("Pong timeout %v", c)
+				err = errors.New("pong timeout")
+			} else {
+				c.stopPongTimer()
+				atomic.StoreInt64(&c.pingTime,
+					int64(time.Since(c.lastPingSent)))
+			}
+		case <-c.pong:
+			log.Tracef("Send Pong %v", c)
+			err = writePacket(c.bufConnWriter, packetTypePong)
+			if err != nil {
+				break SELECTION
+			}
+			c.flush()
+		case <-c.quitSendRoutine:
+			break FOR_LOOP
+		case <-c.send:
+			// Send some PacketMsgs
+			eof := c.sendSomePacketMsgs()
+			if !eof {
+				// Keep sendRoutine awake.
+				select {
+				case c.send <- struct{}{}:
+				default:
+				}
+			}
+		}
+
+		if !c.IsRunning() {
+			break FOR_LOOP
+		}
+		if err != nil {
+			log.Debugf("Connection failed @ sendRoutine %v: %v", c, err)
+			c.stopForError(err)
+			break FOR_LOOP
+		}
+	}
+
+	// Cleanup
+	c.stopPongTimer()
+	close(c.doneSendRoutine)
+}
+
+// Returns true if messages from channels were exhausted.
+func (c *MConnection) sendSomePacketMsgs() bool {
+	// Now send some PacketMsgs.
+	for i := 0; i < numBatchPacketMsgs; i++ {
+		if c.sendPacketMsg() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if messages from channels were exhausted.
+func (c *MConnection) sendPacketMsg() bool {
+	// Choose a channel to create a PacketMsg from.
+	// The chosen channel will be the one whose recentlySent/priority is the least.
+	var leastRatio float32 = math.MaxFloat32
+	var leastChannel *Channel
+	for _, channel := range c.channels {
+		// If nothing to send, skip this channel
+		if !channel.isSendPending() {
+			continue
+		}
+		// Get ratio, and keep track of lowest ratio.
+		ratio := float32(channel.recentlySent) / float32(channel.desc.Priority)
+		if ratio < leastRatio {
+			leastRatio = ratio
+			leastChannel = channel
+		}
+	}
+
+	// Nothing to send?
+	if leastChannel == nil {
+		return true
+	}
+	// Wait for the bandwidth the packet needs.  What is written is
+	// flushed first so it is not held back meanwhile.  Once the
+	// connection stops, the remaining packets are written at once.
+	delay := reserveAll(leastChannel.nextPacketMsgSize(), c.sendLimiter,
+		c.config.SharedSendLimiter)
+	if delay > 0 {
+		c.flush()
+		select {
+		case <-time.After(delay):
+		case <-c.quitSendRoutine:
+		}
+	}
+
+	// Make & send a PacketMsg from this channel
+	n, dataLen, err := leastChannel.writePacketMsgTo(c.bufConnWriter)
+	c.releaseQueueBytes(dataLen)
+	if err != nil {
+		log.Debugf("Failed to write PacketMsg: %v", err)
+		c.stopForError(err)
+		return true
+	}
+	atomic.AddInt64(&c.bytesSent, int64(n))
+	c.flushTimer.Reset(c.config.FlushThrottle)
+	return false
+}
+
+// updateRates computes the send and receive rates since the last call.
+// Not goroutine-safe, it is called by the sendRoutine only.
+func (c *MConnection) updateRates() {
+	now := time.Now()
+	elapsed := now.Sub(c.lastStats).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	sent := atomic.LoadInt64(&c.bytesSent)
+	recv := atomic.LoadInt64(&c.bytesRecv)
+	atomic.StoreInt64(&c.sendRate,
+		int64(float64(sent-c.lastBytesSent)/elapsed))
+	atomic.StoreInt64(&c.recvRate,
+		int64(float64(recv-c.lastBytesRecv)/elapsed))
+	c.lastBytesSent, c.lastBytesRecv = sent, recv
+	c.lastStats = now
+}
+
+// recvRoutine reads PacketMsgs and reconstructs the message using the
+// channels' "recving" buffer.  After a whole message has been assembled, it's
+// pushed to onReceive().  It never blocks on anything but the connection
+// and the callback.
+func (c *MConnection) recvRoutine() {
+	defer c._recover()
+
+FOR_LOOP:
+	for {
+		// Read packet type
+		packetType, err := c.bufConnReader.ReadByte()
+		if err != nil {
+			// stopServices was invoked and we are shutting down,
+			// receiving is expected to fail since the connection is closed.
+			select {
+			case <-c.quitRecvRoutine:
+				break FOR_LOOP
+			default:
+			}
+
+			if c.IsRunning() {
+				if err == io.EOF {
+					log.Debugf("Connection is closed @ recvRoutine "+
+						"(likely by the other side) %v", c)
+				} else {
+					log.Debugf("Connection failed @ recvRoutine "+
+						"(reading byte) %v: %v", c, err)
+				}
+				c.stopForError(err)
+			}
+			break FOR_LOOP
+		}
+
+		// Read more depending on packet type.
+		switch packetType {
+		case packetTypePing:
+			log.Tracef("Receive Ping %v", c)
+			select {
+			case c.pong <- struct{}{}:
+			default:
+				// never block
+			}
+		case packetTypePong:
+			log.Tracef("Receive Pong %v", c)
+			select {
+			case c.pongTimeoutCh <- false:
+			default:
+				// never block
+			}
+		case packetTypeDisconnect:
+			reason, err := common.ReadVarBytes(c.bufConnReader,
+				maxDisconnectReasonLen, "disconnect reason")
+			if err != nil {
+				if c.IsRunning() {
+					log.Debugf("Connection failed @ recvRoutine %v: %v",
+						c, err)
+					c.stopForError(err)
+				}
+				break FOR_LOOP
+			}
+			log.Debugf("Receive Disconnect %v: %s", c, reason)
+			c.stopForError(&DisconnectError{Reason: string(reason)})
+			break FOR_LOOP
+		case packetTypeMsg:
+			var pkt packetMsg
+			err = pkt.decode(c.bufConnReader, c.maxPacketMsgPayloadSize())
+			if err != nil {
+				if c.IsRunning() {
+					log.Debugf("Connection failed @ recvRoutine %v: %v",
+						c, err)
+					c.stopForError(err)
+				}
+				break FOR_LOOP
+			}
+			channel, ok := c.channelsIdx[pkt.ChannelID]
+			if !ok || channel == nil {
+				err := protocolError("unknown channel %#x", pkt.ChannelID)
+				log.Debugf("Connection failed @ recvRoutine %v: %v", c, err)
+				c.stopForError(err)
+				break FOR_LOOP
+			}
+
+			// Stop reading for the time the bandwidth of the packet
+			// needs, so a peer sending too fast is pushed back by
+			// the flow control of the transport.
+			n := pkt.size()
+			atomic.AddInt64(&c.bytesRecv, int64(n))
+			atomic.AddInt64(&channel.bytesRecv, int64(n))
+			delay := reserveAll(n, c.recvLimiter,
+				c.config.SharedRecvLimiter)
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-c.quitRecvRoutine:
+					break FOR_LOOP
+				}
+			}
+
+			msgBytes, err := channel.recvPacketMsg(pkt)
+			if err != nil {
+				if c.IsRunning() {
+					log.Debugf("Connection failed @ recvRoutine %v: %v",
+						c, err)
+					c.stopForError(err)
+				}
+				break FOR_LOOP
+			}
+			if msgBytes != nil {
+				log.Tracef("Received bytes: channel %#x, %d bytes",
+					pkt.ChannelID, len(msgBytes))
+				atomic.AddInt64(&channel.msgsRecv, 1)
+				// NOTE: This means the reactor.Receive runs in the
+				// same goroutine as the recv routine.
+				c.onReceive(pkt.ChannelID, msgBytes)
+			}
+		default:
+			err := protocolError("unknown packet type %#x", packetType)
+			log.Debugf("Connection failed @ recvRoutine %v: %v", c, err)
+			c.stopForError(err)
+			break FOR_LOOP
+		}
+	}
+
+	// Cleanup
+	close(c.pong)
+	for range c.pong {
+		// Drain
+	}
+}
+
+// not goroutine-safe
+func (c *MConnection) stopPongTimer() {
+	if c.pongTimer != nil {
+		_ = c.pongTimer.Stop()
+		c.pongTimer = nil
+	}
+}
+
+// maxPacketMsgPayloadSize returns the maximum number of data bytes a packet
+// carries.
+func (c *MConnection) maxPacketMsgPayloadSize() int {
+	return c.config.MaxPacketMsgPayloadSize
+}
+
+// ConnectionStatus describes the state of the connection and its channels.
+type ConnectionStatus struct {
+	Duration time.Duration
+
+	// PingTime is the round trip time of the last answered ping, zero
+	// until the first pong arrives.
+	PingTime time.Duration
+
+	// BytesSent and BytesRecv are the bytes written to and read from the
+	// connection, and SendRate and RecvRate the bytes per second over the
+	// last few seconds.
+	BytesSent int64
+	BytesRecv int64
+	SendRate  int64
+	RecvRate  int64
+
+	// SendQueueBytes is the number of bytes queued and not written yet.
+	SendQueueBytes int64
+
+	Channels []ChannelStatus
+}
+
+// ChannelStatus describes the state of a single channel.
+type ChannelStatus struct {
+	ID                byte
+	SendQueueCapacity int
+	SendQueueSize     int
+	Priority          int
+	RecentlySent      int64
+
+	// BytesSent and BytesRecv are the bytes of the packets of the channel
+	// written and read, MsgsSent and MsgsRecv its complete messages.
+	BytesSent int64
+	BytesRecv int64
+	MsgsSent  int64
+	MsgsRecv  int64
+}
+
+// Status returns the current state of the connection.
+func (c *MConnection) Status() ConnectionStatus {
+	var status ConnectionStatus
+	status.Duration = time.Since(c.created)
+	status.PingTime = time.Duration(atomic.LoadInt64(&c.pingTime))
+	status.BytesSent = atomic.LoadInt64(&c.bytesSent)
+	status.BytesRecv = atomic.LoadInt64(&c.bytesRecv)
+	status.SendRate = atomic.LoadInt64(&c.sendRate)
+	status.RecvRate = atomic.LoadInt64(&c.recvRate)
+	status.SendQueueBytes = atomic.LoadInt64(&c.queuedBytes)
+	status.Channels = make([]ChannelStatus, len(c.channels))
+	for i, channel := range c.channels {
+		status.Channels[i] = ChannelStatus{
+			ID:                channel.desc.ID,
+			SendQueueCapacity: cap(channel.sendQueue),
+			SendQueueSize:     int(atomic.LoadInt32(&channel.sendQueueSize)),
+			Priority:          channel.desc.Priority,
+			RecentlySent:      atomic.LoadInt64(&channel.recentlySent),
+			BytesSent:         atomic.LoadInt64(&channel.bytesSent),
+			BytesRecv:         atomic.LoadInt64(&channel.bytesRecv),
+			MsgsSent:          atomic.LoadInt64(&channel.msgsSent),
+			MsgsRecv:          atomic.LoadInt64(&channel.msgsRecv),
+		}
+	}
+	return status
+}
+
+//-----------------------------------------------------------------------------
+
+// ChannelDescriptor declares a channel of a MConnection.  Reactors return the
+// descriptors of the channels they own.
+type ChannelDescriptor struct {
+	// ID identifies the channel on the connection.
+	ID byte
+
+	// Priority is the share of the bandwidth the channel gets relative to
+	// the other channels.
+	Priority int
+
+	// SendQueueCapacity is the number of messages that can be queued for
+	// sending before Send blocks.
+	SendQueueCapacity int
+
+	// RecvBufferCapacity is the initial size of the buffer a message is
+	// assembled in.
+	RecvBufferCapacity int
+
+	// RecvMessageCapacity is the maximum size of a message received on the
+	// channel.
+	RecvMessageCapacity int
+}
+
+// FillDefaults returns a copy of the descriptor with the unset capacities set
+// to their defaults.
+func (chDesc ChannelDescriptor) FillDefaults() (filled ChannelDescriptor) {
+	if chDesc.SendQueueCapacity == 0 {
+		chDesc.SendQueueCapacity = defaultSendQueueCapacity
+	}
+	if chDesc.RecvBufferCapacity == 0 {
+		chDesc.RecvBufferCapacity = defaultRecvBufferCapacity
+	}
+	if chDesc.RecvMessageCapacity == 0 {
+		chDesc.RecvMessageCapacity = defaultRecvMessageCapacity
+	}
+	filled = chDesc
+	return
+}
+
+// Channel is the sending and receiving state of a single channel of a
+// MConnection.  NOTE: not goroutine-safe.
+type Channel struct {
+	conn          *MConnection
+	desc          ChannelDescriptor
+	sendQueue     chan []byte
+	sendQueueSize int32 // atomic.
+	recving       []byte
+	sending       []byte
+	recentlySent  int64 // exponential moving average
+	bytesSent     int64 // atomic
+	bytesRecv     int64 // atomic
+	msgsSent      int64 // atomic
+	msgsRecv      int64 // atomic
+
+	maxPacketMsgPayloadSize int
+}
+
+func newChannel(conn *MConnection, desc ChannelDescriptor) *Channel {
+	desc = desc.FillDefaults()
+	return &Channel{
+		conn:                    conn,
+		desc:                    desc,
+		sendQueue:               make(chan []byte, desc.SendQueueCapacity),
+		recving:                 make([]byte, 0, desc.RecvBufferCapacity),
+		maxPacketMsgPayloadSize: conn.config.MaxPacketMsgPayloadSize,
+	}
+}
+
+// Queues message to send to this channel.
+// Goroutine-safe
+// Times out (and returns false) after defaultSendTimeout
+func (ch *Channel) sendBytes(bytes []byte) bool {
+	select {
+	case ch.sendQueue <- bytes:
+		atomic.AddInt32(&ch.sendQueueSize, 1)
+		return true
+	case <-time.After(defaultSendTimeout):
+		return false
+	}
+}
+
+// Queues message to send to this channel.
+// Nonblocking, returns true if successful.
+// Goroutine-safe
+func (ch *Channel) trySendBytes(bytes []byte) bool {
+	select {
+	case ch.sendQueue <- bytes:
+		atomic.AddInt32(&ch.sendQueueSize, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+// Goroutine-safe
+func (ch *Channel) loadSendQueueSize() (size int) {
+	return int(atomic.LoadInt32(&ch.sendQueueSize))
+}
+
+// Goroutine-safe
+// Use only as a heuristic.
+func (ch *Channel) canSend() bool {
+	return ch.loadSendQueueSize() < ch.desc.SendQueueCapacity
+}
+
+// Returns true if any PacketMsgs are pending to be sent.
+// Call before calling nextPacketMsg()
+// Goroutine-safe
+func (ch *Channel) isSendPending() bool {
+	if len(ch.sending) == 0 {
+		if len(ch.sendQueue) == 0 {
+			return false
+		}
+		ch.sending = <-ch.sendQueue
+	}
+	return true
+}
+
+// Creates a new PacketMsg to send.
+// Not goroutine-safe
+func (ch *Channel) nextPacketMsg() packetMsg {
+	packet := packetMsg{ChannelID: ch.desc.ID}
+	maxSize := ch.maxPacketMsgPayloadSize
+	packet.Data = ch.sending[:min(maxSize, len(ch.sending))]
+	if len(ch.sending) <= maxSize {
+		packet.EOF = true
+		ch.sending = nil
+		atomic.AddInt32(&ch.sendQueueSize, -1) // decrement sendQueueSize
+	} else {
+		packet.EOF = false
+		ch.sending = ch.sending[min(maxSize, len(ch.sending)):]
+	}
+	return packet
+}
+
+// Returns the size of the next PacketMsg on the wire.
+// Call after isSendPending() returned true.
+// Not goroutine-safe
+func (ch *Channel) nextPacketMsgSize() int {
+	packet := packetMsg{Data: ch.sending[:min(ch.maxPacketMsgPayloadSize,
+		len(ch.sending))]}
+	return packet.size()
+}
+
+// Writes next PacketMsg to w and updates c.recentlySent.  It returns the
+// bytes written and the message bytes the packet carried.
+// Not goroutine-safe
+func (ch *Channel) writePacketMsgTo(w io.Writer) (n, dataLen int, err error) {
+	packet := ch.nextPacketMsg()
+	n, err = packet.encode(w)
+	atomic.AddInt64(&ch.recentlySent, int64(n))
+	atomic.AddInt64(&ch.bytesSent, int64(n))
+	if packet.EOF {
+		atomic.AddInt64(&ch.msgsSent, 1)
+	}
+	return n, len(packet.Data), err
+}
+
+// Handles incoming PacketMsgs. It returns a message bytes if message is
+// complete.  NOTE message bytes may change on next call to recvPacketMsg.
+// Not goroutine-safe
+func (ch *Channel) recvPacketMsg(packet packetMsg) ([]byte, error) {
+	log.Tracef("Read PacketMsg %v: channel %#x, %d bytes", ch.conn,
+		packet.ChannelID, len(packet.Data))
+	var recvCap, recvReceived = ch.desc.RecvMessageCapacity, len(ch.recving) + len(packet.Data)
+	if recvCap < recvReceived {
+		return nil, protocolError("received message exceeds available "+
+			"capacity: %v < %v", recvCap, recvReceived)
+	}
+	ch.recving = append(ch.recving, packet.Data...)
+	if packet.EOF {
+		// The message is handed to the reactor which may keep it, so
+		// it is copied out of the buffer reused for the next one.
+		msgBytes := make([]byte, len(ch.recving))
+		copy(msgBytes, ch.recving)
+		ch.recving = ch.recving[:0]
+		return msgBytes, nil
+	}
+	return nil, nil
+}
+
+// Call this periodically to update stats for throttling purposes.
+// Not goroutine-safe
+func (ch *Channel) updateStats() {
+	// Exponential decay of stats.
+	atomic.StoreInt64(&ch.recentlySent, int64(float64(atomic.LoadInt64(&ch.recentlySent))*0.8))
+}
+
+//-----------------------------------------------------------------------------
+// Packet
+
+// packetMsg is a chunk of a message sent on a channel.  EOF marks the last
+// chunk of the message.
+type packetMsg struct {
+	ChannelID byte
+	EOF       bool
+	Data      []byte
+}
+
+// String returns the packet in human-readable form.
+func (mp packetMsg) String() string {
+	return fmt.Sprintf("PacketMsg{%X:%X T:%v}", mp.ChannelID, mp.Data, mp.EOF)
+}
+
+// encode writes the packet including its type to w and returns the number of
+// bytes written.
+func (mp *packetMsg) encode(w io.Writer) (int, error) {
+	var eof byte
+	if mp.EOF {
+		eof = 0x01
+	}
+	n, err := w.Write([]byte{packetTypeMsg, mp.ChannelID, eof})
+	if err != nil {
+		return n, err
+	}
+	if err := common.WriteVarBytes(w, mp.Data); err != nil {
+		return n, err
+	}
+	return n + common.VarIntSerializeSize(uint64(len(mp.Data))) +
+		len(mp.Data), nil
+}
+
+// size returns the number of bytes of the encoded packet.
+func (mp *packetMsg) size() int {
+	return 3 + common.VarIntSerializeSize(uint64(len(mp.Data))) +
+		len(mp.Data)
+}
+
+// decode reads a packet whose type was already consumed from r.
+func (mp *packetMsg) decode(r io.Reader, maxPayloadSize int) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] > 0x01 {
+		return protocolError("invalid packet eof flag %#x", hdr[1])
+	}
+	count, err := common.ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+	if count > uint64(maxPayloadSize) {
+		return protocolError("packet data is larger than the max allowed "+
+			"size [count %d, max %d]", count, maxPayloadSize)
+	}
+	data := make([]byte, count)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	mp.ChannelID = hdr[0]
+	mp.EOF = hdr[1] == 0x01
+	mp.Data = data
+	return nil
+}
+
+// writePacket writes a packet without payload such as a ping or pong.
+func writePacket(w io.Writer, packetType byte) error {
+	_, err := w.Write([]byte{packetType})
+	return err
+}
+
+// writeDisconnectPacket writes a disconnect packet carrying reason, cut to
+// maxDisconnectReasonLen bytes.
+func writeDisconnectPacket(w io.Writer, reason string) error {
+	if len(reason) > maxDisconnectReasonLen {
+		reason = reason[:maxDisconnectReasonLen]
+	}
+	if err := writePacket(w, packetTypeDisconnect); err != nil {
+		return err
+	}
+	return common.WriteVarBytes(w, []byte(reason))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,175 @@
+package conn
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testCh = byte(0x01)
+
+// newTestMConnection returns a started connection over a pipe whose other
+// end is read by a goroutine counting the bytes.
+func newTestMConnection(t *testing.T, config MConnConfig) (*MConnection, *int64) {
+	client, server := net.Pipe()
+	var read int64
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := server.Read(buf)
+			atomic.AddInt64(&read, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	chDescs := []*ChannelDescriptor{{
+		ID:                testCh,
+		Priority:          1,
+		SendQueueCapacity: 100,
+	}}
+	onReceive := func(chID byte, msgBytes []byte) {}
+	onError := func(r interface{}) {}
+	c, err := NewMConnectionWithConfig(client, chDescs, onReceive, onError,
+		config)
+	if err != nil {
+		t.Fatalf("NewMConnectionWithConfig: %v", err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		c.Stop()
+		server.Close()
+	})
+	return c, &read
+}
+
+// TestMConnectionSendRate ensures the send rate limit throttles the bytes
+// written to the connection.
+func TestMConnectionSendRate(t *testing.T) {
+	const (
+		rate     = 2000
+		msgSize  = 500
+		numMsgs  = 12
+		expected = (numMsgs*msgSize - rate) * time.Second / rate
+	)
+	config := DefaultMConnConfig()
+	config.SendRate = rate
+	c, read := newTestMConnection(t, config)
+
+	start := time.Now()
+	for i := 0; i < numMsgs; i++ {
+		if !c.Send(testCh, make([]byte, msgSize)) {
+			t.Fatalf("Send %d failed", i)
+		}
+	}
+	for atomic.LoadInt64(read) < numMsgs*msgSize {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("%d bytes written in 10s", atomic.LoadInt64(read))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The first second worth of bytes goes out at once.
+	if elapsed := time.Since(start); elapsed < expected {
+		t.Errorf("%d bytes written in %v at %d bytes per second, want "+
+			"at least %v", numMsgs*msgSize, elapsed, rate, expected)
+	}
+	if status := c.Status(); status.BytesSent < numMsgs*msgSize {
+		t.Errorf("Status: %d bytes sent, want at least %d",
+			status.BytesSent, numMsgs*msgSize)
+	}
+}
+
+// TestMConnectionSendQueueBytes ensures the bytes queued and not written
+// yet are bounded: TrySend fails and Send blocks until the send routine
+// wrote enough of them.
+func TestMConnectionSendQueueBytes(t *testing.T) {
+	const (
+		rate    = 200
+		maxSize = 500
+		msgSize = 400
+	)
+	// The first message takes about a second to go out since it is
+	// larger than the burst of the limiter.
+	config := DefaultMConnConfig()
+	config.SendRate = rate
+	config.MaxSendQueueBytes = maxSize
+	c, _ := newTestMConnection(t, config)
+
+	if !c.TrySend(testCh, make([]byte, msgSize)) {
+		t.Fatal("TrySend on an empty queue failed")
+	}
+	if queued := c.Status().SendQueueBytes; queued != msgSize {
+		t.Errorf("Status: %d bytes queued, want %d", queued, msgSize)
+	}
+	if c.TrySend(testCh, make([]byte, msgSize)) {
+		t.Fatal("TrySend beyond MaxSendQueueBytes succeeded")
+	}
+	if c.reserveQueueBytes(msgSize, false) {
+		t.Fatal("reserveQueueBytes beyond MaxSendQueueBytes succeeded")
+	}
+
+	start := time.Now()
+	if !c.Send(testCh, make([]byte, msgSize)) {
+		t.Fatal("Send failed")
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Send returned after %v, want it to wait for the "+
+			"queue to drain", elapsed)
+	}
+}
+
+// TestMConnectionSendQueueBytesStop ensures a Send waiting for queue space
+// gives up when the connection stops.
+func TestMConnectionSendQueueBytesStop(t *testing.T) {
+	config := DefaultMConnConfig()
+	config.SendRate = 1
+	config.MaxSendQueueBytes = 100
+	c, _ := newTestMConnection(t, config)
+
+	if !c.TrySend(testCh, make([]byte, 100)) {
+		t.Fatal("TrySend on an empty queue failed")
+	}
+	done := make(chan bool)
+	go func() {
+		done <- c.reserveQueueBytes(100, true)
+	}()
+	select {
+	case <-done:
+		t.Fatal("reserveQueueBytes did not block on a full queue")
+	case <-time.After(200 * time.Millisecond):
+	}
+	c.Stop()
+	select {
+	case ok := <-done:
+		if ok {
+			// The send routine flushed the queue on its way out.
+			c.releaseQueueBytes(100)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reserveQueueBytes still blocked after Stop")
+	}
+}
+
+// TestMConnectionOversizedMessage ensures a message larger than
+// MaxSendQueueBytes is accepted when nothing is queued, otherwise it could
+// never be sent.
+func TestMConnectionOversizedMessage(t *testing.T) {
+	config := DefaultMConnConfig()
+	config.MaxSendQueueBytes = 100
+	c, read := newTestMConnection(t, config)
+
+	if !c.TrySend(testCh, make([]byte, 1000)) {
+		t.Fatal("TrySend of an oversized message on an empty queue failed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(read) < 1000 {
+		if time.Now().After(deadline) {
+			t.Fatal("oversized message not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,78 @@
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the number of bytes per second
+// transferred.  The bucket fills at the rate and holds at most one second
+// worth of tokens, so transfers may burst up to the rate after an idle
+// period.  A nil RateLimiter does not limit anything.  It is safe for
+// concurrent use, so a single limiter can be shared by all connections.
+type RateLimiter struct {
+	mtx    sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate bytes per second.  It
+// returns nil, which limits nothing, when rate is not positive.
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns the number of bytes per second allowed, zero when unlimited.
+func (rl *RateLimiter) Rate() int64 {
+	if rl == nil {
+		return 0
+	}
+	return int64(rl.rate)
+}
+
+// Reserve takes n tokens from the bucket and returns the time to wait before
+// transferring n bytes.  The bucket goes into debt when it holds fewer than n
+// tokens, so transfers larger than the burst are possible and the following
+// ones wait for the debt to be paid back.
+func (rl *RateLimiter) Reserve(n int) time.Duration {
+	if rl == nil || n <= 0 {
+		return 0
+	}
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+// reserveAll takes n tokens from every limiter and returns the longest time to
+// wait.
+func reserveAll(n int, limiters ...*RateLimiter) time.Duration {
+	var delay time.Duration
+	for _, rl := range limiters {
+		if d := rl.Reserve(n); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
@@ -0,0 +1,98 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRateLimiterUnlimited ensures a limiter without a positive rate limits
+// nothing.
+func TestRateLimiterUnlimited(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		if rl := NewRateLimiter(rate); rl != nil {
+			t.Errorf("NewRateLimiter(%d) returned a limiter", rate)
+		}
+	}
+	var rl *RateLimiter
+	if rl.Rate() != 0 {
+		t.Errorf("Rate of a nil limiter: got %d, want 0", rl.Rate())
+	}
+	if d := rl.Reserve(1 << 30); d != 0 {
+		t.Errorf("Reserve on a nil limiter: got %v, want 0", d)
+	}
+}
+
+// TestRateLimiterReserve ensures a limiter lets a burst of a second worth of
+// bytes through and delays the bytes above it by the time they take at the
+// rate.
+func TestRateLimiterReserve(t *testing.T) {
+	const rate = 1000
+	rl := NewRateLimiter(rate)
+	if rl.Rate() != rate {
+		t.Errorf("Rate: got %d, want %d", rl.Rate(), rate)
+	}
+
+	if d := rl.Reserve(rate); d != 0 {
+		t.Errorf("Reserve of the burst: got %v, want 0", d)
+	}
+	// The bucket is empty, the next bytes wait for their share of the
+	// rate and each reservation adds to the debt.
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{500, 500 * time.Millisecond},
+		{500, time.Second},
+		{2000, 3 * time.Second},
+	}
+	for _, test := range tests {
+		d := rl.Reserve(test.n)
+		if d < test.want-50*time.Millisecond || d > test.want {
+			t.Errorf("Reserve(%d): got %v, want %v", test.n, d,
+				test.want)
+		}
+	}
+	if d := rl.Reserve(0); d != 0 {
+		t.Errorf("Reserve(0): got %v, want 0", d)
+	}
+}
+
+// TestRateLimiterRefill ensures the tokens come back at the rate, up to the
+// burst.
+func TestRateLimiterRefill(t *testing.T) {
+	const rate = 10000
+	rl := NewRateLimiter(rate)
+	rl.Reserve(rate)
+	time.Sleep(200 * time.Millisecond)
+	if d := rl.Reserve(rate / 10); d != 0 {
+		t.Errorf("Reserve after a refill: got %v, want 0", d)
+	}
+
+	// Idling longer than a second does not bank more than the burst.
+	rl = NewRateLimiter(rate)
+	time.Sleep(1100 * time.Millisecond)
+	if d := rl.Reserve(2 * rate); d < 900*time.Millisecond {
+		t.Errorf("Reserve of two bursts after idling: got %v, want "+
+			"about a second", d)
+	}
+}
+
+// TestReserveAll ensures the wait over several limiters is the longest one
+// and that nil limiters are skipped.
+func TestReserveAll(t *testing.T) {
+	slow, fast := NewRateLimiter(100), NewRateLimiter(1000)
+	d := reserveAll(300, nil, fast, slow)
+	if d < 1900*time.Millisecond || d > 2*time.Second {
+		t.Errorf("reserveAll: got %v, want 2s", d)
+	}
+	// Both limiters were charged.
+	if d := fast.Reserve(700); d != 0 {
+		t.Errorf("fast limiter: got %v, want 0", d)
+	}
+	if d := fast.Reserve(100); d < 50*time.Millisecond {
+		t.Errorf("fast limiter: got %v, want about 100ms", d)
+	}
+	if d := reserveAll(1000, nil, nil); d != 0 {
+		t.Errorf("reserveAll without limiters: got %v, want 0", d)
+	}
+}
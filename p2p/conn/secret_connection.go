@@ -0,0 +1,443 @@
+// Package conn implements the transport a peer connection runs over.
+package conn
+
+import (
+	"bytes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/crypto"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 4 + 1024 == 1028 total frame size
+const (
+	dataLenSize      = 4
+	dataMaxSize      = 1024
+	totalFrameSize   = dataMaxSize + dataLenSize
+	aeadSizeOverhead = 16 // overhead of poly 1305 authentication tag
+	aeadKeySize      = chacha20poly1305.KeySize
+	aeadNonceSize    = chacha20poly1305.NonceSize
+	sealedFrameSize  = totalFrameSize + aeadSizeOverhead
+)
+
+// Maximum sizes of the fields of the authentication message.
+const (
+	maxAuthPubKeyLen    = 1 + crypto.Secp256k1PubKeyLen
+	maxAuthSignatureLen = 72
+)
+
+// secretConnKeyAndChallengeGen is the HKDF info the session keys and the
+// authentication challenge are derived with.
+var secretConnKeyAndChallengeGen = []byte("BLOCKCHAINSERVICE_SECRET_CONNECTION_KEY_AND_CHALLENGE_GEN")
+
+var (
+	// ErrSmallOrderRemotePubKey is returned when the remote ephemeral key
+	// is a low order point, which would make the shared secret
+	// predictable.
+	ErrSmallOrderRemotePubKey = errors.New("detected low order point from remote peer")
+
+	// ErrSharedSecretIsZero is returned when the Diffie-Hellman shared
+	// secret is all zeroes.
+	ErrSharedSecretIsZero = errors.New("shared secret is all zeroes")
+
+	// ErrChallengeVerification is returned when the remote peer fails to
+	// prove it holds the private key of the public key it sent.
+	ErrChallengeVerification = errors.New("challenge verification failed")
+)
+
+// SecretConnection implements net.Conn.  It is an implementation of the
+// STS protocol: the peers exchange ephemeral X25519 keys, derive one
+// ChaCha20-Poly1305 key per direction from the shared secret and then sign a
+// challenge bound to both ephemeral keys with their node keys.  The remote
+// public key is therefore authenticated for the lifetime of the connection.
+//
+// Data is sent in frames of at most dataMaxSize bytes, each sealed with a
+// nonce that is incremented per frame so frames cannot be replayed,
+// reordered or dropped without the connection failing.
+//
+// Consumers of the SecretConnection are responsible for authenticating the
+// remote peer's public key against their own list of known keys.
+type SecretConnection struct {
+	// immutable
+	recvAead cipher.AEAD
+	sendAead cipher.AEAD
+
+	remPubKey crypto.PublicKey
+	conn      net.Conn
+
+	// net.Conn must be thread safe:
+	// https://golang.org/pkg/net/#Conn.
+	// Since we have internal mutable state,
+	// we need mtxs. But recv and send states
+	// are independent, so we can use two mtxs.
+	// All .Read are covered by recvMtx,
+	// all .Write are covered by sendMtx.
+	recvMtx    sync.Mutex
+	recvBuffer []byte
+	recvNonce  *[aeadNonceSize]byte
+
+	sendMtx   sync.Mutex
+	sendNonce *[aeadNonceSize]byte
+}
+
+// MakeSecretConnection performs the handshake over conn and returns a new
+// authenticated SecretConnection.  It returns an error if the handshake
+// fails or the remote peer cannot prove it holds the key it advertises, in
+// which case the caller is responsible for closing conn.
+func MakeSecretConnection(conn net.Conn, locPrivKey crypto.PrivateKey) (*SecretConnection, error) {
+	locPubKey := locPrivKey.PubKey()
+
+	// Generate ephemeral keys for perfect forward secrecy.
+	locEphPub, locEphPriv, err := genEphKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// Write local ephemeral pubkey and receive one too.
+	// NOTE: every 32-byte string is accepted as a Curve25519 public key
+	// (see DJB's Curve25519 paper: http://cr.yp.to/ecdh/curve25519-20060209.pdf)
+	remEphPub, err := shareEphPubKey(conn, locEphPub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort by lexical order.
+	loEphPub, hiEphPub := sort32(locEphPub, remEphPub)
+	locIsLeast := bytes.Equal(locEphPub[:], loEphPub[:])
+
+	// Compute common diffie hellman secret using X25519.
+	dhSecret, err := computeDHSecret(remEphPub, locEphPriv)
+	if err != nil {
+		return nil, err
+	}
+
+	recvSecret, sendSecret, challenge, err := deriveSecrets(dhSecret,
+		loEphPub, hiEphPub, locIsLeast)
+	if err != nil {
+		return nil, err
+	}
+
+	sendAead, err := chacha20poly1305.New(sendSecret[:])
+	if err != nil {
+		return nil, errors.New("invalid send SecretConnection Key")
+	}
+	recvAead, err := chacha20poly1305.New(recvSecret[:])
+	if err != nil {
+		return nil, errors.New("invalid receive SecretConnection Key")
+	}
+
+	sc := &SecretConnection{
+		conn:       conn,
+		recvBuffer: nil,
+		recvNonce:  new([aeadNonceSize]byte),
+		sendNonce:  new([aeadNonceSize]byte),
+		recvAead:   recvAead,
+		sendAead:   sendAead,
+	}
+
+	// Sign the challenge bytes for authentication.
+	locSignature, err := locPrivKey.Sign(challenge[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Share (in secret) each other's pubkey & challenge signature
+	remPubKey, remSignature, err := shareAuthSignature(sc, locPubKey,
+		locSignature)
+	if err != nil {
+		return nil, err
+	}
+	if !remPubKey.Verify(challenge[:], remSignature) {
+		return nil, ErrChallengeVerification
+	}
+
+	// We've authorized.
+	sc.remPubKey = remPubKey
+	return sc, nil
+}
+
+// RemotePubKey returns authenticated remote pubkey
+func (sc *SecretConnection) RemotePubKey() crypto.PublicKey {
+	return sc.remPubKey
+}
+
+// Write writes encrypted frames of sealedFrameSize.  CONTRACT: data smaller
+// than dataMaxSize is written atomically.
+func (sc *SecretConnection) Write(data []byte) (n int, err error) {
+	sc.sendMtx.Lock()
+	defer sc.sendMtx.Unlock()
+
+	var frame [totalFrameSize]byte
+	var sealedFrame [sealedFrameSize]byte
+	for 0 < len(data) {
+		var chunk []byte
+		if dataMaxSize < len(data) {
+			chunk = data[:dataMaxSize]
+			data = data[dataMaxSize:]
+		} else {
+			chunk = data
+			data = nil
+		}
+		chunkLength := len(chunk)
+		binary.LittleEndian.PutUint32(frame[:dataLenSize], uint32(chunkLength))
+		copy(frame[dataLenSize:], chunk)
+		for i := dataLenSize + chunkLength; i < totalFrameSize; i++ {
+			frame[i] = 0
+		}
+
+		// encrypt the frame
+		sc.sendAead.Seal(sealedFrame[:0], sc.sendNonce[:], frame[:], nil)
+		incrNonce(sc.sendNonce)
+
+		_, err = sc.conn.Write(sealedFrame[:])
+		if err != nil {
+			return n, err
+		}
+		n += chunkLength
+	}
+	return n, err
+}
+
+// Read reads and decrypts a frame from the connection.  CONTRACT: data
+// smaller than dataMaxSize is read atomically.
+func (sc *SecretConnection) Read(data []byte) (n int, err error) {
+	sc.recvMtx.Lock()
+	defer sc.recvMtx.Unlock()
+
+	// read off and update the recvBuffer, if non-empty
+	if 0 < len(sc.recvBuffer) {
+		n = copy(data, sc.recvBuffer)
+		sc.recvBuffer = sc.recvBuffer[n:]
+		return
+	}
+
+	// read off the conn
+	var sealedFrame [sealedFrameSize]byte
+	_, err = io.ReadFull(sc.conn, sealedFrame[:])
+	if err != nil {
+		return
+	}
+
+	// decrypt the frame.
+	var frame [totalFrameSize]byte
+	_, err = sc.recvAead.Open(frame[:0], sc.recvNonce[:], sealedFrame[:], nil)
+	if err != nil {
+		return n, fmt.Errorf("failed to decrypt SecretConnection: %v", err)
+	}
+	incrNonce(sc.recvNonce)
+
+	// copy checkLength worth into data,
+	// set recvBuffer to the rest.
+	chunkLength := binary.LittleEndian.Uint32(frame[:dataLenSize])
+	if chunkLength > dataMaxSize {
+		return 0, errors.New("chunkLength is greater than dataMaxSize")
+	}
+	chunk := frame[dataLenSize : dataLenSize+chunkLength]
+	n = copy(data, chunk)
+	if n < len(chunk) {
+		sc.recvBuffer = make([]byte, len(chunk)-n)
+		copy(sc.recvBuffer, chunk[n:])
+	}
+	return n, err
+}
+
+// Close closes the underlying connection.
+func (sc *SecretConnection) Close() error { return sc.conn.Close() }
+
+// LocalAddr returns the local network address of the underlying connection.
+func (sc *SecretConnection) LocalAddr() net.Addr { return sc.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address of the underlying
+// connection.
+func (sc *SecretConnection) RemoteAddr() net.Addr { return sc.conn.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines of the underlying
+// connection.
+func (sc *SecretConnection) SetDeadline(t time.Time) error { return sc.conn.SetDeadline(t) }
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (sc *SecretConnection) SetReadDeadline(t time.Time) error {
+	return sc.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (sc *SecretConnection) SetWriteDeadline(t time.Time) error {
+	return sc.conn.SetWriteDeadline(t)
+}
+
+// genEphKeys returns a new ephemeral X25519 key pair.
+func genEphKeys() (ephPub, ephPriv *[32]byte, err error) {
+	ephPriv = new([32]byte)
+	if _, err := crand.Read(ephPriv[:]); err != nil {
+		return nil, nil, err
+	}
+	pub, err := curve25519.X25519(ephPriv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephPub = new([32]byte)
+	copy(ephPub[:], pub)
+	return ephPub, ephPriv, nil
+}
+
+// shareEphPubKey sends the local ephemeral public key and reads the remote
+// one.  Both happen concurrently so the exchange cannot deadlock on
+// unbuffered connections.
+func shareEphPubKey(conn net.Conn, locEphPub *[32]byte) (*[32]byte, error) {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(locEphPub[:])
+		errc <- err
+	}()
+
+	remEphPub := new([32]byte)
+	_, readErr := io.ReadFull(conn, remEphPub[:])
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	return remEphPub, nil
+}
+
+// deriveSecrets derives the receive and send keys and the challenge to sign
+// from the Diffie-Hellman secret.  The ephemeral keys are part of the HKDF
+// info so the challenge is bound to this very handshake.
+func deriveSecrets(dhSecret *[32]byte, loEphPub, hiEphPub *[32]byte,
+	locIsLeast bool) (recvSecret, sendSecret, challenge *[32]byte, err error) {
+
+	info := make([]byte, 0, len(secretConnKeyAndChallengeGen)+64)
+	info = append(info, secretConnKeyAndChallengeGen...)
+	info = append(info, loEphPub[:]...)
+	info = append(info, hiEphPub[:]...)
+	hkdfReader := hkdf.New(sha256.New, dhSecret[:], nil, info)
+
+	// get enough data for 2 aead keys, and a 32 byte challenge
+	res := new([2*aeadKeySize + 32]byte)
+	if _, err := io.ReadFull(hkdfReader, res[:]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	recvSecret = new([aeadKeySize]byte)
+	sendSecret = new([aeadKeySize]byte)
+	challenge = new([32]byte)
+
+	// bytes 0 through aeadKeySize - 1 are one aead key.
+	// bytes aeadKeySize through 2*aeadKeySize -1 are another aead key.
+	// which key corresponds to sending and receiving key depends on whether
+	// the local key is less than the remote key.
+	if locIsLeast {
+		copy(recvSecret[:], res[0:aeadKeySize])
+		copy(sendSecret[:], res[aeadKeySize:aeadKeySize*2])
+	} else {
+		copy(sendSecret[:], res[0:aeadKeySize])
+		copy(recvSecret[:], res[aeadKeySize:aeadKeySize*2])
+	}
+	copy(challenge[:], res[aeadKeySize*2:])
+	return recvSecret, sendSecret, challenge, nil
+}
+
+// computeDHSecret computes a Diffie-Hellman shared secret key from our own
+// local private key and the other's public key.  Low order remote keys,
+// which would make the secret independent of the local key, are rejected.
+func computeDHSecret(remPubKey, locPrivKey *[32]byte) (*[32]byte, error) {
+	shrKey, err := curve25519.X25519(locPrivKey[:], remPubKey[:])
+	if err != nil {
+		return nil, ErrSmallOrderRemotePubKey
+	}
+	var zero [32]byte
+	if bytes.Equal(shrKey, zero[:]) {
+		return nil, ErrSharedSecretIsZero
+	}
+	secret := new([32]byte)
+	copy(secret[:], shrKey)
+	return secret, nil
+}
+
+// sort32 returns the two keys in lexical order.
+func sort32(foo, bar *[32]byte) (lo, hi *[32]byte) {
+	if bytes.Compare(foo[:], bar[:]) < 0 {
+		lo = foo
+		hi = bar
+	} else {
+		lo = bar
+		hi = foo
+	}
+	return
+}
+
+// shareAuthSignature sends the local public key and challenge signature over
+// the encrypted connection and reads those of the remote peer.
+func shareAuthSignature(sc *SecretConnection, pubKey crypto.PublicKey,
+	signature []byte) (crypto.PublicKey, []byte, error) {
+
+	var buf bytes.Buffer
+	if err := common.WriteVarBytes(&buf, crypto.EncodePublicKey(pubKey)); err != nil {
+		return nil, nil, err
+	}
+	if err := common.WriteVarBytes(&buf, signature); err != nil {
+		return nil, nil, err
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sc.Write(buf.Bytes())
+		errc <- err
+	}()
+
+	remPubKey, remSignature, readErr := readAuthSignature(sc)
+	if err := <-errc; err != nil {
+		return nil, nil, err
+	}
+	if readErr != nil {
+		return nil, nil, readErr
+	}
+	return remPubKey, remSignature, nil
+}
+
+// readAuthSignature reads the public key and challenge signature of the
+// remote peer.
+func readAuthSignature(r io.Reader) (crypto.PublicKey, []byte, error) {
+	encodedPubKey, err := common.ReadVarBytes(r, maxAuthPubKeyLen,
+		"auth public key")
+	if err != nil {
+		return nil, nil, err
+	}
+	remPubKey, err := crypto.DecodePublicKey(encodedPubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	remSignature, err := common.ReadVarBytes(r, maxAuthSignatureLen,
+		"auth signature")
+	if err != nil {
+		return nil, nil, err
+	}
+	return remPubKey, remSignature, nil
+}
+
+// incrNonce increments the nonce counter held by the last 8 bytes of the
+// nonce in little endian.  It panics on overflow since reusing a nonce would
+// break the encryption.
+func incrNonce(nonce *[aeadNonceSize]byte) {
+	counter := binary.LittleEndian.Uint64(nonce[4:])
+	if counter == ^uint64(0) {
+		// Reached max counter, the connection must be rekeyed which
+		// this protocol does not support.
+		panic("can't increase nonce without overflow")
+	}
+	counter++
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+}
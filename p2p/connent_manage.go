@@ -1,47 +1,562 @@
 package p2p
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/blockchainservice/p2p/conn"
+	"github.com/blockchainservice/wire"
+)
+
+const (
+	// handshakeTimeout is the time a peer has to complete the handshake.
+	handshakeTimeout = 30 * time.Second
+
+	// defaultBanThreshold is the ban score at which a misbehaving peer is
+	// banned when the configuration does not say otherwise.
+	defaultBanThreshold = 100
+
+	// defaultBanDuration is how long a misbehaving peer is banned when the
+	// configuration does not say otherwise.
+	defaultBanDuration = 24 * time.Hour
+
+	// protocolViolationBanScore is the ban score given to a peer that
+	// violates the connection protocol, enough to ban it at the default
+	// threshold.
+	protocolViolationBanScore = defaultBanThreshold
+
+	// shutdownFlushTimeout bounds the time spent sending the messages
+	// queued for the peers when the Manage stops.
+	shutdownFlushTimeout = 5 * time.Second
+
+	// shutdownReason is the reason given to the peers disconnected because
+	// the Manage stops.
+	shutdownReason = "node shutting down"
+)
+
+var (
+	// ErrPeerNotFound is returned when a message is sent to a peer the node
+	// is not connected to.
+	ErrPeerNotFound = errors.New("peer not found")
+
+	// ErrPeerBanned is returned when connecting with a banned peer.
+	ErrPeerBanned = errors.New("peer is banned")
+
+	// ErrShuttingDown is returned when the Manage is stopping.
+	ErrShuttingDown = errors.New("p2p manager is shutting down")
 )
 
 // Manage handles peer connections and exposes an API to receive incoming messages on `Business`
 type Manage struct {
+	config     Config
+	peerConfig *peerConfig
+
+	// nodeInfo is what the node advertises in the handshake.  Its listen
+	// address follows the external address.
+	nodeInfoMtx sync.RWMutex
+	nodeInfo    *NodeInfo
+
 	reactors map[string]Reactor
 	server   Listener
 	addpeer  chan *PeerConn
 	quit     chan struct{}
+
+	// chDescs and reactorsByCh describe the channels of the registered
+	// reactors which are multiplexed over every peer connection.
+	chDescs      []*conn.ChannelDescriptor
+	reactorsByCh map[byte]Reactor
+
+	peersMtx sync.RWMutex
+	peers    map[string]*PeerConn
+
+	// peerAddrs and persistentAddrs are the configured addresses of the
+	// peers to dial.
+	peerAddrs       []*NetAddress
+	persistentAddrs []*NetAddress
+
+	// dialing and reconnecting hold the addresses, by dial string, of the
+	// dials in progress and of the persistent peers being redialed.
+	dialMtx      sync.Mutex
+	dialing      map[string]struct{}
+	reconnecting map[string]struct{}
+
+	// bootnodes are the nodes the discovery table is bootstrapped from and
+	// discv is the table, nil when discovery is disabled.
+	bootnodes []*Node
+	discv     *Table
+
+	// addrManager is the book of known peer addresses the outbound peers
+	// are picked from.
+	addrManager *AddrManager
+
+	// banList holds the banned hosts and whitelists the networks of the
+	// peers that are never banned.
+	banList    *banList
+	whitelists []*net.IPNet
+
+	// handshakes holds the raw connections of the handshakes in progress
+	// so Stop can cancel them.
+	handshakeMtx sync.Mutex
+	handshakes   map[*PeerConn]net.Conn
+
+	// wg tracks the goroutines started by spawn, which refuses to start
+	// new ones once stopping is set.
+	wg       sync.WaitGroup
+	stateMtx sync.Mutex
+	started  bool
+	stopping bool
 }
 
-func NewManage(port uint16) {
+// NewManage returns a new manager of the peers of the node described by
+// config and starts listening for inbound connections.
+func NewManage(config Config) (*Manage, error) {
+	if config.ChainParams == nil {
+		return nil, errors.New("p2p: no chain parameters configured")
+	}
+	// The block hashes exchanged with the peers are computed with the
+	// process wide algorithm, which has to be the one of the network.
+	params := config.ChainParams
+	if hash := params.GenesisBlock.BlockHash(); hash != *params.GenesisHash {
+		return nil, fmt.Errorf("p2p: genesis block of %s hashes to %v, "+
+			"not %v", params.Name, hash, params.GenesisHash)
+	}
+	if config.NodeKey == nil {
+		return nil, errors.New("p2p: no node key configured")
+	}
+
+	if config.ProxyOnly {
+		if config.Proxy == "" {
+			return nil, errors.New("p2p: proxy only without a proxy")
+		}
+		if config.DiscoveryAddr != "" {
+			return nil, errors.New("p2p: node discovery would bypass " +
+				"the proxy")
+		}
+		// A static external address is all that does not talk to
+		// the gateway.
+		switch strings.ToLower(strings.SplitN(config.NAT, ":", 2)[0]) {
+		case "", "none", "off", "extip", "ip":
+		default:
+			return nil, errors.New("p2p: port mapping would bypass " +
+				"the proxy")
+		}
+	}
+	if config.Proxy != "" {
+		if config.Transport != nil {
+			return nil, errors.New("p2p: proxy with a custom transport")
+		}
+		if config.ProxyIsolation &&
+			(config.ProxyUser != "" || config.ProxyPass != "") {
+
+			return nil, errors.New("p2p: proxy credentials would be " +
+				"replaced by the isolation ones")
+		}
+		config.Transport = proxyTransport{proxy: &socksProxy{
+			addr:     config.Proxy,
+			user:     config.ProxyUser,
+			password: config.ProxyPass,
+			isolate:  config.ProxyIsolation,
+		}}
+	}
+
+	if config.TargetOutbound == 0 {
+		config.TargetOutbound = defaultTargetOutbound
+	}
+	if config.Transport == nil {
+		config.Transport = tcpTransport{}
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	if config.MaxInbound == 0 {
+		config.MaxInbound = defaultMaxInbound
+	}
+	if config.MaxOutbound == 0 {
+		config.MaxOutbound = defaultMaxOutbound
+	}
+	if config.TargetOutbound > config.MaxOutbound {
+		config.TargetOutbound = config.MaxOutbound
+	}
+	if config.MaxPerIP == 0 {
+		config.MaxPerIP = defaultMaxPerIP
+	}
+	if config.MaxPerNetGroup == 0 {
+		config.MaxPerNetGroup = defaultMaxPerNetGroup
+	}
+	if config.ReservedInbound == 0 {
+		config.ReservedInbound = defaultReservedInbound
+	}
+	if config.ReservedInbound > config.MaxInbound {
+		config.ReservedInbound = config.MaxInbound
+	}
+	if config.MaxPendingInbound == 0 {
+		config.MaxPendingInbound = config.MaxInbound
+	}
+	if config.BanThreshold == 0 {
+		config.BanThreshold = defaultBanThreshold
+	}
+	if config.BanDuration == 0 {
+		config.BanDuration = defaultBanDuration
+	}
+	whitelists, err := parseWhitelists(config.Whitelists)
+	if err != nil {
+		return nil, err
+	}
+	peerAddrs, err := parseNetAddresses(config.Peers, !config.ProxyOnly)
+	if err != nil {
+		return nil, err
+	}
+	persistentAddrs, err := parseNetAddresses(config.PersistentPeers,
+		!config.ProxyOnly)
+	if err != nil {
+		return nil, err
+	}
+	bootnodes := make([]*Node, 0, len(config.BootstrapNodes))
+	for _, s := range config.BootstrapNodes {
+		node, err := ParseNode(s)
+		if err != nil {
+			return nil, err
+		}
+		bootnodes = append(bootnodes, node)
+	}
+
+	nonce, err := randomUint64()
+	if err != nil {
+		return nil, err
+	}
+	nodeInfo := &NodeInfo{
+		ProtocolVersion: wire.ProtocolVersion,
+		ChainID:         params.ChainID,
+		GenesisHash:     *params.GenesisHash,
+		ID:              config.NodeKey.ID(),
+		Services:        config.Services,
+		UserAgent:       wire.DefaultUserAgent,
+		ListenAddr:      config.ListenAddr,
+		Nonce:           nonce,
+	}
+
+	mConfig := conn.DefaultMConnConfig()
+	mConfig.SendRate = config.PeerSendRate
+	mConfig.RecvRate = config.PeerRecvRate
+	mConfig.SharedSendLimiter = conn.NewRateLimiter(config.SendRate)
+	mConfig.SharedRecvLimiter = conn.NewRateLimiter(config.RecvRate)
+	if config.MaxSendQueueBytes != 0 {
+		mConfig.MaxSendQueueBytes = config.MaxSendQueueBytes
+	}
 
 	// NewServer create
-	config := Config{ListenAddr: fmt.Sprintf(":%d", port)}
 	server := Server{Config: config}
-	server.StartListening()
-	manage := Manage{reactors: make(map[string]Reactor), server: &server}
-	fmt.Println(manage)
+	if err := server.StartListening(); err != nil {
+		return nil, err
+	}
+	manage := Manage{
+		config: config,
+		peerConfig: &peerConfig{
+			magic:   params.Net,
+			nodeKey: config.NodeKey,
+			mConfig: mConfig,
+		},
+		nodeInfo:        nodeInfo,
+		reactors:        make(map[string]Reactor),
+		reactorsByCh:    make(map[byte]Reactor),
+		server:          &server,
+		addpeer:         make(chan *PeerConn),
+		quit:            make(chan struct{}),
+		peers:           make(map[string]*PeerConn),
+		peerAddrs:       peerAddrs,
+		persistentAddrs: persistentAddrs,
+		dialing:         make(map[string]struct{}),
+		reconnecting:    make(map[string]struct{}),
+		bootnodes:       bootnodes,
+		addrManager: NewAddrManager(config.DataDir,
+			!config.AllowLocalAddrs),
+		banList:    newBanList(config.DataDir),
+		whitelists: whitelists,
+		handshakes: make(map[*PeerConn]net.Conn),
+	}
+	if config.DiscoveryAddr != "" {
+		tcpPort := server.listener.Addr().(*net.TCPAddr).Port
+		manage.discv, err = ListenUDP(config.NodeKey.PrivKey, params.Net,
+			config.DiscoveryAddr, uint16(tcpPort), bootnodes)
+		if err != nil {
+			server.Stop()
+			return nil, err
+		}
+	}
+	if err := manage.AddReactor(manageReactorName,
+		newManageReactor()); err != nil {
+		server.Stop()
+		return nil, err
+	}
+	return &manage, nil
+}
 
+// randomUint64 returns a cryptographically random uint64.
+func randomUint64() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
 }
 
-// connect is to connect to other services
-func (m *Manage) connect() {
+// AddReactor registers reactor under name.  The channels it declares are
+// multiplexed over the connections of all peers started afterwards, so
+// reactors must be added before the Manage is started.  An error is returned
+// when the name is taken or a channel is already owned by another reactor,
+// ManageChannel included.
+func (m *Manage) AddReactor(name string, reactor Reactor) error {
+	if _, ok := m.reactors[name]; ok {
+		return fmt.Errorf("reactor %s already registered", name)
+	}
+	reactorChannels := reactor.GetChannels()
+	for _, chDesc := range reactorChannels {
+		if _, ok := m.reactorsByCh[chDesc.ID]; ok {
+			return fmt.Errorf("channel %#x of reactor %s is already "+
+				"owned by another reactor", chDesc.ID, name)
+		}
+	}
+	for _, chDesc := range reactorChannels {
+		m.chDescs = append(m.chDescs, chDesc)
+		m.reactorsByCh[chDesc.ID] = reactor
+	}
+	m.reactors[name] = reactor
+	reactor.SetManage(m)
+	return nil
+}
+
+// Reactor returns the reactor registered under name, nil if there is none.
+func (m *Manage) Reactor(name string) Reactor {
+	return m.reactors[name]
+}
+
+// NodeInfo returns a copy of the information the local node advertises to
+// its peers.
+func (m *Manage) NodeInfo() *NodeInfo {
+	m.nodeInfoMtx.RLock()
+	defer m.nodeInfoMtx.RUnlock()
+	info := *m.nodeInfo
+	return &info
+}
+
+// SetBestHeight sets the height of the chain advertised in the handshake with
+// the peers connecting from now on.
+func (m *Manage) SetBestHeight(height uint64) {
+	m.nodeInfoMtx.Lock()
+	m.nodeInfo.BestHeight = height
+	m.nodeInfoMtx.Unlock()
+}
+
+// Discovery returns the node discovery table, nil when discovery is
+// disabled.
+func (m *Manage) Discovery() *Table {
+	return m.discv
+}
+
+// AddrManager returns the book of known peer addresses.
+func (m *Manage) AddrManager() *AddrManager {
+	return m.addrManager
+}
+
+// Peers returns the peers that completed the handshake.
+func (m *Manage) Peers() []*PeerConn {
+	m.peersMtx.RLock()
+	defer m.peersMtx.RUnlock()
+
+	peers := make([]*PeerConn, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// ConnectedCount returns the number of peers that completed the handshake.
+func (m *Manage) ConnectedCount() int {
+	m.peersMtx.RLock()
+	defer m.peersMtx.RUnlock()
+	return len(m.peers)
+}
+
+// Peer returns the peer with the given node ID, nil if the node is not
+// connected to it.
+func (m *Manage) Peer(id string) *PeerConn {
+	m.peersMtx.RLock()
+	defer m.peersMtx.RUnlock()
+	return m.peers[id]
+}
+
+// Broadcast queues msgBytes for sending on channel chID to all peers.  It
+// returns a channel receiving whether the message was queued for each peer,
+// which is closed once all peers are done.
+func (m *Manage) Broadcast(chID byte, msgBytes []byte) chan bool {
+	peers := m.Peers()
+	successChan := make(chan bool, len(peers))
+	log.Tracef("Broadcast on channel %#x: %d bytes to %d peers", chID,
+		len(msgBytes), len(peers))
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer *PeerConn) {
+			defer wg.Done()
+			successChan <- peer.Send(chID, msgBytes)
+		}(peer)
+	}
+	go func() {
+		wg.Wait()
+		close(successChan)
+	}()
+	return successChan
+}
 
+// Send queues msgBytes for sending on channel chID to the peer with the given
+// node ID.  It blocks until the message is queued or the send times out.
+func (m *Manage) Send(peerID string, chID byte, msgBytes []byte) error {
+	peer := m.Peer(peerID)
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	if !peer.Send(chID, msgBytes) {
+		return fmt.Errorf("failed to queue message for peer %s on "+
+			"channel %#x", peer, chID)
+	}
+	return nil
 }
 
+// Start starts accepting and dialing peers.  It does nothing when the Manage
+// was already started or stopped.
 func (m *Manage) Start() {
-	m.addpeer = make(chan *PeerConn)
-	m.quit = make(chan struct{})
-	//m.server.StartListening()
-	go m.listenerRoutine(m.server)
-	go m.run()
+	m.stateMtx.Lock()
+	if m.started || m.stopping {
+		m.stateMtx.Unlock()
+		return
+	}
+	m.started = true
+	m.stateMtx.Unlock()
+
+	m.addrManager.Start()
+	m.server.OnExternalAddrChange(m.externalAddrChanged)
+	m.spawn(func() { m.listenerRoutine(m.server) })
+	m.spawn(m.run)
+	m.spawn(m.connect)
+	if m.discv != nil {
+		it := m.discv.RandomNodes()
+		m.spawn(func() { m.discoverPeers(it) })
+	}
+}
+
+// Stop shuts the peer to peer service down so a new Manage can take its
+// place.  It closes the listener and removes the NAT mapping first, then
+// stops dialing peers, cancels the handshakes in progress, closes the
+// discovery table and waits for the goroutines of the Manage to finish.  The
+// peers are then disconnected with a reason message after the messages queued
+// for them were sent, giving up after shutdownFlushTimeout.  Finally the
+// address book and the ban list are saved.  It is safe to call several
+// times.
+func (m *Manage) Stop() {
+	m.stateMtx.Lock()
+	if m.stopping {
+		m.stateMtx.Unlock()
+		return
+	}
+	m.stopping = true
+	m.stateMtx.Unlock()
+
+	log.Infof("P2P manager shutting down")
+	close(m.quit)
+	if err := m.server.Stop(); err != nil {
+		log.Debugf("Failed to close listener %s: %v", m.server, err)
+	}
+	m.cancelHandshakes()
+	if m.discv != nil {
+		m.discv.Close()
+	}
+	m.wg.Wait()
+
+	// Nothing adds peers anymore, disconnect the remaining ones
+	// concurrently so they share the flush deadline.
+	var wg sync.WaitGroup
+	for _, p := range m.Peers() {
+		wg.Add(1)
+		go func(p *PeerConn) {
+			defer wg.Done()
+			p.FlushStop(shutdownReason, shutdownFlushTimeout)
+			m.stopAndRemovePeer(p, ErrShuttingDown)
+		}(p)
+	}
+	wg.Wait()
+
+	m.addrManager.Stop()
+	m.banList.flush()
+	log.Infof("P2P manager stopped")
+}
+
+// spawn runs f in a goroutine Stop waits for.  It returns false without
+// running f once the Manage is stopping.
+func (m *Manage) spawn(f func()) bool {
+	m.stateMtx.Lock()
+	defer m.stateMtx.Unlock()
+	if m.stopping {
+		return false
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// cancelHandshakes closes the connections of the handshakes in progress.
+func (m *Manage) cancelHandshakes() {
+	m.handshakeMtx.Lock()
+	defer m.handshakeMtx.Unlock()
+	for _, c := range m.handshakes {
+		c.Close()
+	}
+}
+
+// handshakePeer runs the handshake with the peer and hands it to the run
+// loop.  The handshake is cancelled when the Manage stops.
+func (m *Manage) handshakePeer(pc *PeerConn) error {
+	m.handshakeMtx.Lock()
+	select {
+	case <-m.quit:
+		m.handshakeMtx.Unlock()
+		pc.CloseConn()
+		return ErrShuttingDown
+	default:
+	}
+	m.handshakes[pc] = pc.conn
+	m.handshakeMtx.Unlock()
+
+	err := pc.HandshakeTimeout(m.NodeInfo(), handshakeTimeout)
+
+	m.handshakeMtx.Lock()
+	delete(m.handshakes, pc)
+	m.handshakeMtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case m.addpeer <- pc:
+		return nil
+	case <-m.quit:
+		pc.CloseConn()
+		return ErrShuttingDown
+	}
 }
 
 func (m *Manage) listenerRoutine(l Listener) {
-	tokens := 50
-	slots := make(chan struct{}, tokens)
-	for i := 0; i < tokens; i++ {
+	slots := make(chan struct{}, m.config.MaxPendingInbound)
+	for i := 0; i < cap(slots); i++ {
 		slots <- struct{}{}
 	}
 	for {
@@ -51,46 +566,133 @@ func (m *Manage) listenerRoutine(l Listener) {
 		if !ok {
 			break
 		}
-		fmt.Println(inConn)
 
 		//deal inConn
-		go func() {
+		ok = m.spawn(func() {
 			err := m.inboundPeerConnected(inConn)
 			if err != nil {
-				log.Error("Ignoring inbound connection: error while adding peer", "address", inConn.RemoteAddr().String(), "err", err)
+				log.Debugf("Ignoring inbound connection from %s: %v",
+					inConn.RemoteAddr(), err)
 			}
 			slots <- struct{}{}
-		}()
-
+		})
+		if !ok {
+			inConn.Close()
+			slots <- struct{}{}
+		}
 	}
 }
 
 func (m *Manage) inboundPeerConnected(conn net.Conn) error {
-	peerConn, err := newPeerConn(conn, false, false)
+	peerConn, err := newPeerConn(conn, false, false, m.peerConfig)
 	if err != nil {
 		conn.Close() // peer is nil
 		return err
 	}
-	m.addPeer(peerConn)
-	return nil
+	return m.addPeer(peerConn)
 }
 
-func (m *Manage) addPeer(conn PeerConn) bool {
-	// todo 检查是否存在白名单
-	if m.isWhitelisted(conn.conn.RemoteAddr()) {
-		log.Errorf("connection from %s dropped (banned)", conn.conn.RemoteAddr().String())
+func (m *Manage) addPeer(conn *PeerConn) error {
+	// Drop banned hosts, the allowlisted ones are never banned.
+	if m.isBanned(conn.RemoteAddr()) {
+		log.Debugf("connection from %s dropped (banned)", conn.RemoteAddr())
 		conn.CloseConn()
-		return false
+		return ErrPeerBanned
 	}
-	// todo Timeout
-	conn.HandshakeTimeout(30*time.Second, m.addpeer)
-	return true
+	if !m.isWhitelisted(conn.RemoteAddr()) {
+		if err := m.checkAddrLimits(conn.RemoteAddr()); err != nil {
+			conn.CloseConn()
+			return err
+		}
+	}
+	return m.handshakePeer(conn)
 }
 
+// isWhitelisted returns whether the IP address of addr is part of the
+// allowlisted networks.
 func (m *Manage) isWhitelisted(addr net.Addr) bool {
+	ip := net.ParseIP(hostOf(addr))
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range m.whitelists {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBanned returns whether the host of addr is banned.  Allowlisted hosts
+// are never banned.
+func (m *Manage) isBanned(addr net.Addr) bool {
+	return !m.isWhitelisted(addr) && m.banList.isBanned(hostOf(addr))
+}
+
+// AddBanScore increases the persistent and decaying ban scores of the peer
+// by the values passed as parameters.  Reactors call it when the peer
+// misbehaves, with reason describing the misbehavior.  The peer is banned
+// and disconnected when its score reaches the ban threshold, in which case
+// true is returned.  Allowlisted peers are never banned.
+func (m *Manage) AddBanScore(p *PeerConn, persistent, transient uint32,
+	reason string) bool {
+
+	// No warning is logged and no score is calculated if banning is
+	// disabled.
+	if m.config.DisableBanning {
+		return false
+	}
+	if m.isWhitelisted(p.RemoteAddr()) {
+		log.Debugf("Misbehaving whitelisted peer %s: %s", p, reason)
+		return false
+	}
+
+	warnThreshold := m.config.BanThreshold >> 1
+	if transient == 0 && persistent == 0 {
+		// The score is not being increased, but a warning message is
+		// still logged if the score is above the warn threshold.
+		score := p.banScore.Int()
+		if score > warnThreshold {
+			log.Warnf("Misbehaving peer %s: %s -- ban score is %d, "+
+				"it was not increased this time", p, reason, score)
+		}
+		return false
+	}
+	score := p.banScore.Increase(persistent, transient)
+	if score > warnThreshold {
+		log.Warnf("Misbehaving peer %s: %s -- ban score increased to %d",
+			p, reason, score)
+		if score >= m.config.BanThreshold {
+			log.Warnf("Misbehaving peer %s -- banning and disconnecting",
+				p)
+			m.BanPeer(p)
+			m.stopAndRemovePeer(p, ErrPeerBanned)
+			return true
+		}
+	}
 	return false
 }
 
+// BanPeer bans the host of the peer for the configured ban duration.  It does
+// not disconnect the peer.
+func (m *Manage) BanPeer(p *PeerConn) {
+	host := hostOf(p.RemoteAddr())
+	until := time.Now().Add(m.config.BanDuration)
+	log.Infof("Banned peer %s (%s) until %v", p, host, until)
+	m.banList.ban(host, until)
+}
+
+// Unban lifts the ban of host.  It returns false when the host was not
+// banned.
+func (m *Manage) Unban(host string) bool {
+	return m.banList.unban(host)
+}
+
+// BannedHosts returns the banned hosts and the expiry of their bans.
+func (m *Manage) BannedHosts() map[string]time.Time {
+	return m.banList.banned()
+}
+
 func (m *Manage) run() {
 running:
 	for {
@@ -98,8 +700,106 @@ running:
 		case <-m.quit:
 			// The server was stopped. Run the cleanup logic.
 			break running
-		case c := <-m.addpeer:
-			fmt.Println(c)
+		case p := <-m.addpeer:
+			if m.Peer(p.ID()) != nil {
+				log.Debugf("Dropping duplicate connection to %s", p)
+				p.CloseConn()
+				continue
+			}
+			if err := m.admitPeer(p); err != nil {
+				log.Debugf("Rejecting peer %s: %v", p, err)
+				p.CloseConn()
+				continue
+			}
+			if err := m.startPeer(p); err != nil {
+				log.Errorf("Failed to start peer %s: %v", p, err)
+				p.CloseConn()
+				continue
+			}
+
+			// Add the peer to the reactors once it runs so they can
+			// send to it right away, but before it is published.  Only
+			// a published peer is removed from the reactors, so they
+			// always see AddPeer before RemovePeer.
+			for _, reactor := range m.reactors {
+				reactor.AddPeer(p)
+			}
+
+			// Publish the peer only once its connection runs so
+			// everyone who finds it can send to it.  A peer that
+			// failed in the meantime is removed right away.
+			m.peersMtx.Lock()
+			m.peers[p.ID()] = p
+			m.peersMtx.Unlock()
+			if !p.IsRunning() {
+				m.stopAndRemovePeer(p, errors.New("peer stopped "+
+					"while starting"))
+				continue
+			}
+			log.Infof("New peer %s: %s", p, p.NodeInfo())
+			if p.IsOutbound() && p.DialedAddr() != nil {
+				addr := *p.DialedAddr()
+				addr.ID = p.ID()
+				m.addrManager.Good(&addr)
+			}
 		}
 	}
 }
+
+// startPeer multiplexes the channels of the reactors over the connection of
+// the peer, lets the reactors initialize their state for it and starts it.
+func (m *Manage) startPeer(p *PeerConn) error {
+	err := p.createMConnection(m.reactorsByCh, m.chDescs, m.StopPeerForError)
+	if err != nil {
+		return err
+	}
+	for _, reactor := range m.reactors {
+		reactor.InitPeer(p)
+	}
+	return p.Start()
+}
+
+// removePeer forgets the peer.  It returns false when the peer was already
+// removed.
+func (m *Manage) removePeer(p *PeerConn) bool {
+	m.peersMtx.Lock()
+	defer m.peersMtx.Unlock()
+	if m.peers[p.ID()] != p {
+		return false
+	}
+	delete(m.peers, p.ID())
+	return true
+}
+
+// StopPeerForError disconnects from a peer due to external error.  A peer
+// that violated the connection protocol is penalized.
+func (m *Manage) StopPeerForError(p *PeerConn, reason interface{}) {
+	log.Infof("Stopping peer %s for error: %v", p, reason)
+	if perr, ok := reason.(*conn.ProtocolError); ok {
+		m.AddBanScore(p, protocolViolationBanScore, 0, perr.Description)
+	}
+	m.stopAndRemovePeer(p, reason)
+}
+
+// StopPeerGracefully disconnects from a peer gracefully.
+func (m *Manage) StopPeerGracefully(p *PeerConn) {
+	log.Infof("Stopping peer %s gracefully", p)
+	m.stopAndRemovePeer(p, nil)
+}
+
+// stopAndRemovePeer stops the peer and tells the reactors it is gone.  It is
+// safe to call several times for the same peer.
+func (m *Manage) stopAndRemovePeer(p *PeerConn, reason interface{}) {
+	p.Stop()
+	if !m.removePeer(p) {
+		return
+	}
+	for _, reactor := range m.reactors {
+		reactor.RemovePeer(p, reason)
+	}
+
+	if p.IsPersistent() && p.DialedAddr() != nil {
+		addr := p.DialedAddr()
+		m.spawn(func() { m.reconnectToPeer(addr) })
+	}
+}
@@ -0,0 +1,344 @@
+package p2p
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	// defaultTargetOutbound is the number of outbound connections the node
+	// tries to maintain when the configuration does not say otherwise.
+	defaultTargetOutbound = 8
+
+	// defaultDialTimeout bounds the time to establish an outbound TCP
+	// connection when the configuration does not say otherwise.
+	defaultDialTimeout = 3 * time.Second
+
+	// ensurePeersPeriod is how often the Manage checks whether it needs
+	// more outbound peers.
+	ensurePeersPeriod = 30 * time.Second
+
+	// reconnectBaseInterval is the wait before the first attempt to
+	// reconnect to a persistent peer.  It doubles after every failed
+	// attempt up to reconnectMaxInterval.
+	reconnectBaseInterval = time.Second
+	reconnectMaxInterval  = 10 * time.Minute
+)
+
+var (
+	// ErrAlreadyDialing is returned when a dial to the address is already
+	// in progress.
+	ErrAlreadyDialing = errors.New("already dialing address")
+
+	// ErrAlreadyConnected is returned when the node is already connected
+	// to the dialed peer.
+	ErrAlreadyConnected = errors.New("already connected to peer")
+)
+
+// connect is to connect to other services.  It dials the persistent peers,
+// which are redialed with backoff until they connect, and then keeps the
+// number of outbound peers at the target until the Manage quits.
+func (m *Manage) connect() {
+	for _, addr := range m.persistentAddrs {
+		addr := addr
+		m.spawn(func() {
+			err := m.DialPeerWithAddress(addr, true)
+			if err != nil {
+				log.Debugf("Failed to dial persistent peer %s: %v",
+					addr, err)
+				m.reconnectToPeer(addr)
+			}
+		})
+	}
+
+	m.ensureOutboundPeers()
+	ticker := time.NewTicker(ensurePeersPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.ensureOutboundPeers()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// ensureOutboundPeers dials configured peers the node is not connected to
+// until enough dials are in progress to reach the outbound target.
+func (m *Manage) ensureOutboundPeers() {
+	need := m.config.TargetOutbound - m.numOutboundPeers() - m.numDialing()
+	if need <= 0 {
+		return
+	}
+
+	for _, i := range rand.Perm(len(m.peerAddrs)) {
+		if need == 0 {
+			break
+		}
+		addr := m.peerAddrs[i]
+		if m.isDialingOrConnected(addr) {
+			continue
+		}
+		need--
+		m.spawn(func() { m.dialPeer(addr) })
+	}
+
+	// Fill the remaining slots from the address book.  The book hands out
+	// biased random picks, retry a bounded number of times to skip the
+	// addresses that are in use or were attempted recently.  At most one
+	// outbound peer is dialed per network group so the outbound peers
+	// cannot all be controlled by one network.
+	ourID := m.config.NodeKey.ID()
+	groups := m.outboundGroups()
+	for tries := 0; need > 0 && tries < 100; tries++ {
+		ka := m.addrManager.GetAddress()
+		if ka == nil {
+			break
+		}
+		addr := ka.NetAddress()
+		if addr.ID == ourID || m.isDialingOrConnected(addr) {
+			continue
+		}
+		if IsOnion(addr) && m.config.Proxy == "" {
+			continue
+		}
+		group := GroupKey(addr)
+		if _, ok := groups[group]; ok && IsRoutable(addr) {
+			continue
+		}
+
+		// Only allow recent nodes (10mins) after we failed 30 times.
+		if tries < 30 && time.Since(ka.LastAttempt()) < 10*time.Minute {
+			continue
+		}
+		groups[group] = struct{}{}
+		need--
+		m.spawn(func() { m.dialPeer(addr) })
+	}
+}
+
+// outboundGroups returns the network groups of the outbound peers and of the
+// dials in progress.
+func (m *Manage) outboundGroups() map[string]struct{} {
+	groups := make(map[string]struct{})
+	m.peersMtx.RLock()
+	for _, p := range m.peers {
+		if !p.IsOutbound() {
+			continue
+		}
+		if ip := ipOf(p.RemoteAddr()); ip != nil {
+			groups[GroupKey(&NetAddress{IP: ip})] = struct{}{}
+		}
+	}
+	m.peersMtx.RUnlock()
+
+	m.dialMtx.Lock()
+	for dialString := range m.dialing {
+		host, _, err := net.SplitHostPort(dialString)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			groups[GroupKey(&NetAddress{IP: ip})] = struct{}{}
+		}
+	}
+	m.dialMtx.Unlock()
+	return groups
+}
+
+// dialPeer dials a peer that is not persistent and logs the failure.
+func (m *Manage) dialPeer(addr *NetAddress) {
+	err := m.DialPeerWithAddress(addr, false)
+	if err != nil {
+		log.Debugf("Failed to dial peer %s: %v", addr, err)
+	}
+}
+
+// discoverPeers adds the nodes returned by the discovery iterator to the
+// address book and dials from it whenever the node has fewer outbound peers
+// than its target.
+func (m *Manage) discoverPeers(it *NodeIterator) {
+	src := m.discv.Self().NetAddress()
+	m.spawn(func() {
+		<-m.quit
+		it.Close()
+	})
+
+	for {
+		for m.numOutboundPeers()+m.numDialing() >= m.config.TargetOutbound {
+			select {
+			case <-time.After(ensurePeersPeriod):
+			case <-m.quit:
+				return
+			}
+		}
+		if !it.Next() {
+			return
+		}
+		m.addrManager.AddAddress(it.Node().NetAddress(), src)
+		m.ensureOutboundPeers()
+	}
+}
+
+// DialPeerWithAddress dials the given address and runs the handshake with
+// the peer.  A persistent peer is reconnected whenever the connection is
+// lost.  The peer is handed to the Manage once the handshake succeeded.
+func (m *Manage) DialPeerWithAddress(addr *NetAddress, persistent bool) error {
+	if addr.ID == m.config.NodeKey.ID() {
+		return ErrSelfConnect
+	}
+	if addr.ID != "" && m.Peer(addr.ID) != nil {
+		return ErrAlreadyConnected
+	}
+	if IsOnion(addr) && m.config.Proxy == "" {
+		return ErrOnionWithoutProxy
+	}
+	// Persistent peers are dialed even when banned since the operator
+	// asked for them.
+	if !persistent && !m.isWhitelisted(addr.tcpAddr()) &&
+		m.banList.isBanned(addr.host()) {
+		return ErrPeerBanned
+	}
+	if !m.markDialing(addr) {
+		return ErrAlreadyDialing
+	}
+	defer m.unmarkDialing(addr)
+
+	log.Debugf("Dialing peer %s", addr)
+	m.addrManager.Attempt(addr)
+	conn, err := m.config.Transport.Dial(addr, m.config.DialTimeout)
+	if err != nil {
+		return err
+	}
+	peerConn, err := newPeerConn(conn, true, persistent, m.peerConfig)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	peerConn.addr = addr
+	return m.handshakePeer(peerConn)
+}
+
+// reconnectToPeer redials a persistent peer until the connection succeeds
+// or the Manage quits.  The wait between attempts grows exponentially with
+// random jitter so peers that lost each other do not redial in lockstep.
+func (m *Manage) reconnectToPeer(addr *NetAddress) {
+	if !m.markReconnecting(addr) {
+		return
+	}
+	defer m.unmarkReconnecting(addr)
+
+	backoff := reconnectBaseInterval
+	for attempt := 1; ; attempt++ {
+		jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		select {
+		case <-time.After(backoff + jitter):
+		case <-m.quit:
+			return
+		}
+
+		err := m.DialPeerWithAddress(addr, true)
+		switch err {
+		case nil, ErrAlreadyConnected:
+			return
+		case ErrSelfConnect:
+			log.Warnf("Persistent peer %s is the local node, giving up",
+				addr)
+			return
+		}
+		log.Debugf("Failed to reconnect to persistent peer %s "+
+			"(attempt %d): %v", addr, attempt, err)
+
+		backoff *= 2
+		if backoff > reconnectMaxInterval {
+			backoff = reconnectMaxInterval
+		}
+	}
+}
+
+// markDialing records that a dial to addr is in progress.  It returns false
+// when one already is.
+func (m *Manage) markDialing(addr *NetAddress) bool {
+	m.dialMtx.Lock()
+	defer m.dialMtx.Unlock()
+	key := addr.DialString()
+	if _, ok := m.dialing[key]; ok {
+		return false
+	}
+	m.dialing[key] = struct{}{}
+	return true
+}
+
+// unmarkDialing records that the dial to addr is over.
+func (m *Manage) unmarkDialing(addr *NetAddress) {
+	m.dialMtx.Lock()
+	delete(m.dialing, addr.DialString())
+	m.dialMtx.Unlock()
+}
+
+// markReconnecting records that addr is being reconnected.  It returns false
+// when it already is.
+func (m *Manage) markReconnecting(addr *NetAddress) bool {
+	m.dialMtx.Lock()
+	defer m.dialMtx.Unlock()
+	key := addr.DialString()
+	if _, ok := m.reconnecting[key]; ok {
+		return false
+	}
+	m.reconnecting[key] = struct{}{}
+	return true
+}
+
+// unmarkReconnecting records that addr is no longer being reconnected.
+func (m *Manage) unmarkReconnecting(addr *NetAddress) {
+	m.dialMtx.Lock()
+	delete(m.reconnecting, addr.DialString())
+	m.dialMtx.Unlock()
+}
+
+// numDialing returns the number of dials in progress.
+func (m *Manage) numDialing() int {
+	m.dialMtx.Lock()
+	defer m.dialMtx.Unlock()
+	return len(m.dialing)
+}
+
+// numOutboundPeers returns the number of connected outbound peers.
+func (m *Manage) numOutboundPeers() int {
+	m.peersMtx.RLock()
+	defer m.peersMtx.RUnlock()
+	n := 0
+	for _, p := range m.peers {
+		if p.IsOutbound() {
+			n++
+		}
+	}
+	return n
+}
+
+// isDialingOrConnected returns whether a dial to addr is in progress or the
+// node is connected to the peer at addr.
+func (m *Manage) isDialingOrConnected(addr *NetAddress) bool {
+	m.dialMtx.Lock()
+	_, dialing := m.dialing[addr.DialString()]
+	m.dialMtx.Unlock()
+	if dialing {
+		return true
+	}
+
+	m.peersMtx.RLock()
+	defer m.peersMtx.RUnlock()
+	if addr.ID != "" {
+		_, ok := m.peers[addr.ID]
+		return ok
+	}
+	for _, p := range m.peers {
+		if p.addr != nil && p.addr.DialString() == addr.DialString() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/blockchainservice/address"
+	"github.com/blockchainservice/crypto"
+)
+
+// IDByteLength is the length of the hash a node ID is derived from.
+const IDByteLength = address.Hash160Size
+
+// NodeKey is the persistent key of a node.  It identifies the node to its
+// peers, which know it by the ID derived from the public key.
+type NodeKey struct {
+	PrivKey crypto.PrivateKey
+}
+
+// ID returns the node ID of the key.
+func (nk *NodeKey) ID() string {
+	return PubKeyToID(nk.PubKey())
+}
+
+// PubKey returns the public key of the node key.
+func (nk *NodeKey) PubKey() crypto.PublicKey {
+	return nk.PrivKey.PubKey()
+}
+
+// PubKeyToID returns the node ID corresponding to the given public key, the
+// hex encoded hash160 of the type prefixed key.
+func PubKeyToID(pubKey crypto.PublicKey) string {
+	return hex.EncodeToString(address.PubKeyHash(pubKey))
+}
+
+// validateID returns an error when id is not a well formed node ID.
+func validateID(id string) error {
+	if len(id) != 2*IDByteLength {
+		return fmt.Errorf("invalid node id length %d, expected %d",
+			len(id), 2*IDByteLength)
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return fmt.Errorf("node id %q is not hex encoded", id)
+	}
+	return nil
+}
+
+// GenNodeKey returns a new Ed25519 node key.
+func GenNodeKey() (*NodeKey, error) {
+	privKey, err := crypto.GeneratePrivateKey(crypto.KeyTypeEd25519)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeKey{PrivKey: privKey}, nil
+}
+
+// LoadNodeKey loads the node key stored in filePath.
+func LoadNodeKey(filePath string) (*NodeKey, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed node key file %s: %v", filePath,
+			err)
+	}
+	privKey, err := crypto.DecodePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("malformed node key file %s: %v", filePath,
+			err)
+	}
+	return &NodeKey{PrivKey: privKey}, nil
+}
+
+// SaveAs persists the node key to filePath, readable by its owner only.
+func (nk *NodeKey) SaveAs(filePath string) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return err
+	}
+	encoded := hex.EncodeToString(crypto.EncodePrivateKey(nk.PrivKey))
+	return ioutil.WriteFile(filePath, []byte(encoded+"\n"), 0600)
+}
+
+// LoadOrGenNodeKey attempts to load the node key from filePath.  If the file
+// does not exist, a new key is generated and saved to it.
+func LoadOrGenNodeKey(filePath string) (*NodeKey, error) {
+	if _, err := os.Stat(filePath); err == nil {
+		return LoadNodeKey(filePath)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	nodeKey, err := GenNodeKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := nodeKey.SaveAs(filePath); err != nil {
+		return nil, err
+	}
+	return nodeKey, nil
+}
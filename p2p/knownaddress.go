@@ -0,0 +1,118 @@
+// Copyright (c) 2013-2014 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package p2p
+
+import (
+	"time"
+)
+
+// KnownAddress tracks information about a known network address that is used
+// to determine how viable an address is.
+type KnownAddress struct {
+	na          *NetAddress
+	srcAddr     *NetAddress
+	attempts    int
+	successes   int
+	lastseen    time.Time
+	lastattempt time.Time
+	lastsuccess time.Time
+	tried       bool
+	refs        int // reference count of new buckets
+}
+
+// NetAddress returns the underlying NetAddress associated with the known
+// address.
+func (ka *KnownAddress) NetAddress() *NetAddress {
+	return ka.na
+}
+
+// Source returns the address of the node that told us about the address.
+func (ka *KnownAddress) Source() *NetAddress {
+	return ka.srcAddr
+}
+
+// LastSeen returns the last time the address was heard of.
+func (ka *KnownAddress) LastSeen() time.Time {
+	return ka.lastseen
+}
+
+// LastAttempt returns the last time the known address was attempted.
+func (ka *KnownAddress) LastAttempt() time.Time {
+	return ka.lastattempt
+}
+
+// LastSuccess returns the last time a connection to the address succeeded.
+func (ka *KnownAddress) LastSuccess() time.Time {
+	return ka.lastsuccess
+}
+
+// Successes returns the number of connections to the address that
+// succeeded.
+func (ka *KnownAddress) Successes() int {
+	return ka.successes
+}
+
+// chance returns the selection probability for a known address.  The priority
+// depends upon how recently the address has been seen, how recently it was
+// last attempted and how often attempts to connect to it have failed.
+func (ka *KnownAddress) chance() float64 {
+	now := time.Now()
+	lastAttempt := now.Sub(ka.lastattempt)
+
+	if lastAttempt < 0 {
+		lastAttempt = 0
+	}
+
+	c := 1.0
+
+	// Very recent attempts are less likely to be retried.
+	if lastAttempt < 10*time.Minute {
+		c *= 0.01
+	}
+
+	// Failed attempts deprioritise.
+	for i := ka.attempts; i > 0; i-- {
+		c /= 1.5
+	}
+
+	return c
+}
+
+// isBad returns true if the address in question has not been tried in the last
+// minute and meets one of the following criteria:
+// 1) It claims to be from the future
+// 2) It hasn't been seen in over a month
+// 3) It has failed at least three times and never succeeded
+// 4) It has failed ten times in the last week
+// All addresses that meet these criteria are assumed to be worthless and not
+// worth keeping hold of.
+func (ka *KnownAddress) isBad() bool {
+	if ka.lastattempt.After(time.Now().Add(-1 * time.Minute)) {
+		return false
+	}
+
+	// From the future?
+	if ka.lastseen.After(time.Now().Add(10 * time.Minute)) {
+		return true
+	}
+
+	// Over a month old?
+	if ka.lastseen.Before(time.Now().Add(-1 * numMissingDays * time.Hour * 24)) {
+		return true
+	}
+
+	// Never succeeded?
+	if ka.lastsuccess.IsZero() && ka.attempts >= numRetries {
+		return true
+	}
+
+	// Hasn't succeeded in too long?
+	if !ka.lastsuccess.After(time.Now().Add(-1*minBadDays*time.Hour*24)) &&
+		ka.attempts >= maxFailures {
+		return true
+	}
+
+	return false
+}
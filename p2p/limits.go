@@ -0,0 +1,269 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultMaxInbound, defaultMaxOutbound, defaultMaxPerIP,
+	// defaultMaxPerNetGroup and defaultReservedInbound are the connection
+	// limits used when the configuration does not say otherwise.
+	defaultMaxInbound      = 40
+	defaultMaxOutbound     = 10
+	defaultMaxPerIP        = 3
+	defaultMaxPerNetGroup  = 8
+	defaultReservedInbound = 4
+
+	// evictProtectLowLatency, evictProtectTxRelay and evictProtectBlockRelay
+	// are the numbers of inbound peers protected from eviction for their
+	// low latency and for having relayed transactions and blocks recently.
+	evictProtectLowLatency = 8
+	evictProtectTxRelay    = 4
+	evictProtectBlockRelay = 4
+)
+
+var (
+	// ErrTooManyPeers is returned when the node has no slot left for a
+	// peer.
+	ErrTooManyPeers = errors.New("too many peers")
+
+	// ErrTooManyFromIP is returned when the node is connected to too many
+	// peers at the IP address of a peer.
+	ErrTooManyFromIP = errors.New("too many peers from the same IP")
+
+	// ErrTooManyFromNetGroup is returned when the node is connected to too
+	// many peers in the network group of a peer.
+	ErrTooManyFromNetGroup = errors.New("too many peers from the same " +
+		"network group")
+
+	// errEvicted is the reason given to the reactors for the removal of an
+	// inbound peer evicted to make room for another one.
+	errEvicted = errors.New("evicted to make room for another peer")
+)
+
+// ipOf returns the IP address of a network address, nil when it has none.
+func ipOf(addr net.Addr) net.IP {
+	return net.ParseIP(hostOf(addr))
+}
+
+// isPrivileged returns whether the peer is allowlisted or persistent, which
+// exempts it from the per-IP and network group limits and gives it access to
+// the reserved inbound slots.  An inbound peer is persistent when its ID is
+// the one of a configured persistent peer.
+func (m *Manage) isPrivileged(p *PeerConn) bool {
+	if p.IsPersistent() || m.isWhitelisted(p.RemoteAddr()) {
+		return true
+	}
+	for _, addr := range m.persistentAddrs {
+		if addr.ID != "" && addr.ID == p.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddrLimits returns an error when one more peer at addr would exceed
+// the per-IP or the network group limit.
+func (m *Manage) checkAddrLimits(addr net.Addr) error {
+	ip := ipOf(addr)
+	if ip == nil {
+		return nil
+	}
+	na := &NetAddress{IP: ip}
+	limitGroup := IsRoutable(na)
+	group := GroupKey(na)
+
+	var perIP, perGroup int
+	m.peersMtx.RLock()
+	for _, p := range m.peers {
+		peerIP := ipOf(p.RemoteAddr())
+		if peerIP == nil {
+			continue
+		}
+		if peerIP.Equal(ip) {
+			perIP++
+		}
+		if limitGroup && GroupKey(&NetAddress{IP: peerIP}) == group {
+			perGroup++
+		}
+	}
+	m.peersMtx.RUnlock()
+
+	if perIP >= m.config.MaxPerIP {
+		return ErrTooManyFromIP
+	}
+	if limitGroup && perGroup >= m.config.MaxPerNetGroup {
+		return ErrTooManyFromNetGroup
+	}
+	return nil
+}
+
+// admitPeer decides whether a peer that completed the handshake may be
+// added.  Persistent outbound peers are always admitted, the others only
+// while there are outbound slots.  An inbound peer has to fit the per-IP
+// and network group limits, and when the inbound slots are taken the least
+// useful inbound peer is evicted to make room for it.
+func (m *Manage) admitPeer(p *PeerConn) error {
+	privileged := m.isPrivileged(p)
+	if p.IsOutbound() {
+		if !privileged && m.numNonPersistentOutbound() >=
+			m.config.MaxOutbound {
+			return ErrTooManyPeers
+		}
+		return nil
+	}
+
+	if !privileged {
+		if err := m.checkAddrLimits(p.RemoteAddr()); err != nil {
+			return err
+		}
+	}
+	limit := m.config.MaxInbound
+	if !privileged {
+		limit -= m.config.ReservedInbound
+	}
+	if m.numInboundPeers() < limit {
+		return nil
+	}
+
+	victim := m.selectInboundToEvict()
+	if victim == nil {
+		return ErrTooManyPeers
+	}
+	log.Infof("Evicting inbound peer %s to make room for %s", victim, p)
+	m.stopAndRemovePeer(victim, errEvicted)
+	return nil
+}
+
+// numInboundPeers returns the number of connected inbound peers.
+func (m *Manage) numInboundPeers() int {
+	m.peersMtx.RLock()
+	defer m.peersMtx.RUnlock()
+	n := 0
+	for _, p := range m.peers {
+		if !p.IsOutbound() {
+			n++
+		}
+	}
+	return n
+}
+
+// numNonPersistentOutbound returns the number of connected outbound peers
+// that are not persistent.
+func (m *Manage) numNonPersistentOutbound() int {
+	m.peersMtx.RLock()
+	defer m.peersMtx.RUnlock()
+	n := 0
+	for _, p := range m.peers {
+		if p.IsOutbound() && !p.IsPersistent() {
+			n++
+		}
+	}
+	return n
+}
+
+// evictCandidate holds the metrics of an inbound peer eviction is decided
+// on.
+type evictCandidate struct {
+	peer      *PeerConn
+	group     string
+	connected time.Duration
+	pingTime  time.Duration
+	lastBlock time.Time
+	lastTx    time.Time
+}
+
+// selectInboundToEvict selects the inbound peer to evict when the inbound
+// slots are taken, nil when every inbound peer is protected.  Privileged
+// peers are never evicted.  Of the others, the peers with the lowest
+// latency, the ones that relayed transactions and blocks most recently and
+// then the half connected the longest are protected, so an attacker cannot
+// take the slots of the useful peers by opening many connections.  The
+// youngest peer of the network group with the most remaining peers is
+// evicted.
+func (m *Manage) selectInboundToEvict() *PeerConn {
+	var candidates []*evictCandidate
+	for _, p := range m.Peers() {
+		if p.IsOutbound() || m.isPrivileged(p) {
+			continue
+		}
+		status := p.Status()
+		group := "unknown"
+		if ip := ipOf(p.RemoteAddr()); ip != nil {
+			group = GroupKey(&NetAddress{IP: ip})
+		}
+		candidates = append(candidates, &evictCandidate{
+			peer:      p,
+			group:     group,
+			connected: status.Duration,
+			pingTime:  status.PingTime,
+			lastBlock: p.LastBlockTime(),
+			lastTx:    p.LastTxTime(),
+		})
+	}
+
+	candidates = protectCandidates(candidates, evictProtectLowLatency,
+		func(c *evictCandidate) bool { return c.pingTime > 0 },
+		func(a, b *evictCandidate) bool { return a.pingTime < b.pingTime })
+	candidates = protectCandidates(candidates, evictProtectTxRelay,
+		func(c *evictCandidate) bool { return c.lastTx.UnixNano() > 0 },
+		func(a, b *evictCandidate) bool { return a.lastTx.After(b.lastTx) })
+	candidates = protectCandidates(candidates, evictProtectBlockRelay,
+		func(c *evictCandidate) bool { return c.lastBlock.UnixNano() > 0 },
+		func(a, b *evictCandidate) bool {
+			return a.lastBlock.After(b.lastBlock)
+		})
+	candidates = protectCandidates(candidates, len(candidates)/2,
+		func(c *evictCandidate) bool { return true },
+		func(a, b *evictCandidate) bool { return a.connected > b.connected })
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Find the network group with the most peers, the one with the
+	// youngest peer on ties, and evict its youngest peer.
+	groups := make(map[string][]*evictCandidate)
+	for _, c := range candidates {
+		groups[c.group] = append(groups[c.group], c)
+	}
+	var victims []*evictCandidate
+	var youngest time.Duration
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].connected < group[j].connected
+		})
+		if len(group) > len(victims) || (len(group) == len(victims) &&
+			group[0].connected < youngest) {
+			victims = group
+			youngest = group[0].connected
+		}
+	}
+	return victims[0].peer
+}
+
+// protectCandidates removes up to n candidates from the eviction candidates.
+// The candidates eligible for protection are sorted with less and the first
+// n of them are protected.
+func protectCandidates(candidates []*evictCandidate, n int,
+	eligible func(*evictCandidate) bool,
+	less func(a, b *evictCandidate) bool) []*evictCandidate {
+
+	var protectable, rest []*evictCandidate
+	for _, c := range candidates {
+		if eligible(c) {
+			protectable = append(protectable, c)
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	sort.Slice(protectable, func(i, j int) bool {
+		return less(protectable[i], protectable[j])
+	})
+	if n > len(protectable) {
+		n = len(protectable)
+	}
+	return append(rest, protectable[n:]...)
+}
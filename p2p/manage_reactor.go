@@ -0,0 +1,162 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/blockchainservice/p2p/conn"
+	"github.com/blockchainservice/wire"
+)
+
+const (
+	// ManageChannel is the channel the Manage exchanges its own messages
+	// with the peers on.  Reactors cannot claim it.
+	ManageChannel byte = 0x00
+
+	// manageReactorName is the name the reactor handling ManageChannel is
+	// registered under.
+	manageReactorName = "MANAGE"
+
+	// badLocalAddrBanScore is the decaying ban score given to a peer that
+	// sends a malformed address announcement or announces its address
+	// more than once on a connection.
+	badLocalAddrBanScore = 10
+
+	// localAddrKey is the key the address announced by a peer is stored
+	// under in the peer.
+	localAddrKey = "manage/localAddr"
+)
+
+// manageReactor handles the messages of ManageChannel.  The peers announce
+// the address they are reachable at from the internet on it, which is added
+// to the address book, and are told the external address of the local node
+// when they connect and whenever it changes.
+type manageReactor struct {
+	BaseReactor
+}
+
+// newManageReactor returns the reactor handling ManageChannel.
+func newManageReactor() *manageReactor {
+	return &manageReactor{BaseReactor: *NewBaseReactor(manageReactorName)}
+}
+
+// GetChannels declares ManageChannel.
+func (r *manageReactor) GetChannels() []*conn.ChannelDescriptor {
+	return []*conn.ChannelDescriptor{{
+		ID:                ManageChannel,
+		Priority:          1,
+		SendQueueCapacity: 1,
+	}}
+}
+
+// AddPeer tells the peer the external address of the local node when it is
+// known.
+func (r *manageReactor) AddPeer(p *PeerConn) {
+	addr := r.Manage.ExternalAddr()
+	if addr == nil {
+		return
+	}
+	msgBytes, err := r.Manage.localAddrMsg(addr)
+	if err != nil {
+		log.Errorf("Failed to encode local address: %v", err)
+		return
+	}
+	p.TrySend(ManageChannel, msgBytes)
+}
+
+// Receive handles the address announcements of the peers.  A peer may
+// announce one address per connection, at the IP address it is connected
+// from unless it is allowlisted, so it cannot fill the address book with
+// addresses it does not own.
+func (r *manageReactor) Receive(chID byte, p *PeerConn, msgBytes []byte) {
+	msg, err := r.Manage.DecodeMessage(msgBytes)
+	if err != nil {
+		r.Manage.StopPeerForError(p, err)
+		return
+	}
+
+	addrMsg, ok := msg.(*wire.MsgAddr)
+	if !ok {
+		r.Manage.AddBanScore(p, 0, badLocalAddrBanScore,
+			"unexpected "+msg.Command()+" message on manage channel")
+		return
+	}
+	if len(addrMsg.AddrList) != 1 {
+		r.Manage.AddBanScore(p, 0, badLocalAddrBanScore,
+			"address announcement with several addresses")
+		return
+	}
+	if p.Get(localAddrKey) != nil {
+		r.Manage.AddBanScore(p, 0, badLocalAddrBanScore,
+			"repeated address announcement")
+		return
+	}
+	na := addrMsg.AddrList[0]
+	addr := NewNetAddressIPPort(p.ID(), na.IP, na.Port)
+	p.Set(localAddrKey, addr)
+	if !r.Manage.isWhitelisted(p.RemoteAddr()) &&
+		!na.IP.Equal(ipOf(p.RemoteAddr())) {
+
+		log.Debugf("Ignoring address %s announced by peer %s connected "+
+			"from another address", addr, p)
+		return
+	}
+	log.Debugf("Peer %s is reachable at %s", p, addr)
+	r.Manage.addrManager.AddAddress(addr, NewNetAddress(p.ID(), p.RemoteAddr()))
+}
+
+// EncodeMessage returns the bytes of msg as sent on the channels of the
+// reactors.
+func (m *Manage) EncodeMessage(msg wire.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	err := wire.WriteMessage(&buf, msg, wire.ProtocolVersion,
+		m.peerConfig.magic)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeMessage returns the message encoded by EncodeMessage in msgBytes.
+func (m *Manage) DecodeMessage(msgBytes []byte) (wire.Message, error) {
+	msg, _, err := wire.ReadMessage(bytes.NewReader(msgBytes),
+		wire.ProtocolVersion, m.peerConfig.magic)
+	return msg, err
+}
+
+// ExternalAddr returns the address the node is reachable at from the
+// internet, nil when it is unknown.
+func (m *Manage) ExternalAddr() *net.TCPAddr {
+	return m.server.ExternalAddr()
+}
+
+// externalAddrChanged advertises addr as the address of the node in the
+// handshake, in the discovery protocol and to the connected peers.
+func (m *Manage) externalAddrChanged(addr *net.TCPAddr) {
+	m.nodeInfoMtx.Lock()
+	m.nodeInfo.ListenAddr = addr.String()
+	m.nodeInfoMtx.Unlock()
+
+	if m.discv != nil {
+		m.discv.SetExternalIP(addr.IP)
+	}
+
+	msgBytes, err := m.localAddrMsg(addr)
+	if err != nil {
+		log.Errorf("Failed to encode local address: %v", err)
+		return
+	}
+	m.Broadcast(ManageChannel, msgBytes)
+}
+
+// localAddrMsg returns the encoded announcement of addr as the address of
+// the node.
+func (m *Manage) localAddrMsg(addr *net.TCPAddr) ([]byte, error) {
+	msg := wire.NewMsgAddr()
+	err := msg.AddAddress(wire.NewNetAddressIPPort(addr.IP,
+		uint16(addr.Port), m.config.Services))
+	if err != nil {
+		return nil, err
+	}
+	return m.EncodeMessage(msg)
+}
@@ -0,0 +1,549 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// memWriteQueueSize is the number of writes a memConn buffers before
+	// Write blocks, the in-memory counterpart of the socket send buffer.
+	memWriteQueueSize = 1024
+
+	// memCloseLinger bounds the time a closed memConn spends delivering
+	// the writes queued before the close.
+	memCloseLinger = time.Second
+
+	// memFirstPort is the first port handed out to dialing connections.
+	memFirstPort = 49152
+
+	// defaultRetransmitTimeout is the delay added to a dropped write when
+	// the link configuration does not say otherwise.
+	defaultRetransmitTimeout = 200 * time.Millisecond
+
+	// maxMemRetransmits is the number of times a write may be lost in a
+	// row.  It bounds the delay of a write like the retry limit of TCP.
+	maxMemRetransmits = 15
+)
+
+var (
+	// errMemPartitioned is returned when dialing a node the dialer is
+	// partitioned from.
+	errMemPartitioned = errors.New("network partitioned")
+
+	// errMemRefused is returned when dialing an address nobody listens on.
+	errMemRefused = errors.New("connection refused")
+
+	// errMemDropRate is returned when configuring a link with a drop rate
+	// outside [0, 1).
+	errMemDropRate = errors.New("drop rate must be at least 0 and below 1")
+)
+
+// LinkConfig describes the link between two nodes of a MemNetwork.
+type LinkConfig struct {
+	// Latency is the time a write takes to reach the other end.
+	Latency time.Duration
+
+	// DropRate is the probability, at least 0 and below 1, a write is
+	// lost on the link.  Connections are streams, so a lost write is
+	// retransmitted after RetransmitTimeout like TCP does, delaying it and
+	// the writes following it.  A write is lost at most maxMemRetransmits
+	// times in a row.
+	DropRate float64
+
+	// RetransmitTimeout is the delay a lost write adds.  It defaults to
+	// defaultRetransmitTimeout.
+	RetransmitTimeout time.Duration
+}
+
+// memPair identifies the link between two hosts regardless of direction.
+type memPair struct {
+	a, b string
+}
+
+// makeMemPair returns the memPair of the hosts a and b.
+func makeMemPair(a, b net.IP) memPair {
+	sa, sb := a.String(), b.String()
+	if sa > sb {
+		sa, sb = sb, sa
+	}
+	return memPair{a: sa, b: sb}
+}
+
+// MemNetwork connects nodes in one process without sockets.  Every node uses
+// the Transport of its own IP address, the connections between two addresses
+// follow the configuration of their link, and pairs of addresses can be
+// partitioned from each other.  Every connection picks its lost writes from
+// a random source derived from the seed of the network and the addresses of
+// the connection, so with the same seed a connection between the same
+// addresses loses the same writes whatever the other connections do.
+type MemNetwork struct {
+	seed       int64
+	mtx        sync.Mutex
+	listeners  map[string]*memListener
+	links      map[memPair]LinkConfig
+	partitions map[memPair]struct{}
+	conns      map[*memConn]struct{}
+	nextPort   map[string]int
+}
+
+// NewMemNetwork returns an empty in-memory network whose lost writes are
+// picked by random sources derived from seed.
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		seed:       seed,
+		listeners:  make(map[string]*memListener),
+		links:      make(map[memPair]LinkConfig),
+		partitions: make(map[memPair]struct{}),
+		conns:      make(map[*memConn]struct{}),
+		nextPort:   make(map[string]int),
+	}
+}
+
+// Transport returns the Transport of the node with the IP address ip.
+func (n *MemNetwork) Transport(ip net.IP) Transport {
+	return &memTransport{net: n, ip: ip}
+}
+
+// SetLink configures the link between the hosts a and b.  It applies to the
+// writes made afterwards.  It returns an error when the drop rate of config is
+// not at least 0 and below 1.
+func (n *MemNetwork) SetLink(a, b net.IP, config LinkConfig) error {
+	if !(config.DropRate >= 0 && config.DropRate < 1) {
+		return errMemDropRate
+	}
+	n.mtx.Lock()
+	n.links[makeMemPair(a, b)] = config
+	n.mtx.Unlock()
+	return nil
+}
+
+// Partition cuts the link between the hosts a and b.  Their connections are
+// reset and dials between them fail until the partition is healed.
+func (n *MemNetwork) Partition(a, b net.IP) {
+	pair := makeMemPair(a, b)
+	n.mtx.Lock()
+	n.partitions[pair] = struct{}{}
+	var cut []*memConn
+	for c := range n.conns {
+		if makeMemPair(c.local.IP, c.remote.IP) == pair {
+			cut = append(cut, c)
+		}
+	}
+	n.mtx.Unlock()
+
+	for _, c := range cut {
+		c.reset()
+	}
+}
+
+// Heal restores the link between the hosts a and b.
+func (n *MemNetwork) Heal(a, b net.IP) {
+	n.mtx.Lock()
+	delete(n.partitions, makeMemPair(a, b))
+	n.mtx.Unlock()
+}
+
+// link returns the configuration of the link between the hosts a and b.
+func (n *MemNetwork) link(a, b net.IP) LinkConfig {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.links[makeMemPair(a, b)]
+}
+
+// connRand returns the random source picking the lost writes of the
+// connection from local to remote.
+func (n *MemNetwork) connRand(local, remote *net.TCPAddr) *rand.Rand {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, n.seed)
+	h.Write([]byte(local.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(remote.String()))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// removeConn forgets the closed connection c.
+func (n *MemNetwork) removeConn(c *memConn) {
+	n.mtx.Lock()
+	delete(n.conns, c)
+	n.mtx.Unlock()
+}
+
+// memTransport is the Transport of one host of a MemNetwork.
+type memTransport struct {
+	net *MemNetwork
+	ip  net.IP
+}
+
+// Listen announces on laddr, whose host must be empty, unspecified or the IP
+// address of the transport.  A port of 0 picks a free port.
+func (t *memTransport) Listen(laddr string) (net.Listener, error) {
+	host, portStr, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil || (!ip.IsUnspecified() && !ip.Equal(t.ip)) {
+			return nil, fmt.Errorf("cannot listen on %s from host %v",
+				laddr, t.ip)
+		}
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	n := t.net
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if port == 0 {
+		port = uint64(n.allocPort(t.ip))
+	}
+	addr := &net.TCPAddr{IP: t.ip, Port: int(port)}
+	if _, ok := n.listeners[addr.String()]; ok {
+		return nil, fmt.Errorf("address %v already in use", addr)
+	}
+	l := &memListener{
+		net:    n,
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	n.listeners[addr.String()] = l
+	return l, nil
+}
+
+// allocPort returns a port of ip no connection or listener uses.  The caller
+// must hold the lock of the network.
+func (n *MemNetwork) allocPort(ip net.IP) int {
+	for {
+		port := n.nextPort[ip.String()]
+		if port < memFirstPort || port > 65535 {
+			port = memFirstPort
+		}
+		n.nextPort[ip.String()] = port + 1
+		addr := &net.TCPAddr{IP: ip, Port: port}
+		if _, ok := n.listeners[addr.String()]; !ok {
+			return port
+		}
+	}
+}
+
+// Dial connects to the listener of addr.  It fails right away when the hosts
+// are partitioned or nobody listens on addr.
+func (t *memTransport) Dial(addr *NetAddress, timeout time.Duration) (net.Conn, error) {
+	raddr := addr.tcpAddr()
+	n := t.net
+	n.mtx.Lock()
+	if _, ok := n.partitions[makeMemPair(t.ip, raddr.IP)]; ok {
+		n.mtx.Unlock()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: raddr,
+			Err: errMemPartitioned}
+	}
+	l, ok := n.listeners[raddr.String()]
+	if !ok {
+		n.mtx.Unlock()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: raddr,
+			Err: errMemRefused}
+	}
+	laddr := &net.TCPAddr{IP: t.ip, Port: n.allocPort(t.ip)}
+	p1, p2 := net.Pipe()
+	local := newMemConn(n, p1, laddr, l.addr)
+	remote := newMemConn(n, p2, l.addr, laddr)
+	n.conns[local] = struct{}{}
+	n.conns[remote] = struct{}{}
+	n.mtx.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.closed:
+		local.reset()
+		remote.reset()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: raddr,
+			Err: errMemRefused}
+	case <-timer.C:
+		local.reset()
+		remote.reset()
+		return nil, &net.OpError{Op: "dial", Net: "mem", Addr: raddr,
+			Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// memListener is a listener of a MemNetwork.
+type memListener struct {
+	net       *MemNetwork
+	addr      *net.TCPAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept waits for the next connection dialed to the listener.
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: l.addr,
+			Err: net.ErrClosed}
+	}
+}
+
+// Close stops listening.
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.net.mtx.Lock()
+		delete(l.net.listeners, l.addr.String())
+		l.net.mtx.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memWrite is a write waiting to be delivered.
+type memWrite struct {
+	data []byte
+	at   time.Time
+}
+
+// memConn is one end of a connection of a MemNetwork.  Writes are queued and
+// delivered to the other end once the latency of the link elapsed, so like
+// with a socket the writer does not wait on the reader.
+type memConn struct {
+	net    *MemNetwork
+	pipe   net.Conn
+	local  *net.TCPAddr
+	remote *net.TCPAddr
+	writes chan memWrite
+
+	// mtx serializes the writes and protects the time the last write is
+	// delivered, which keeps the writes in order, and the random source
+	// picking the lost writes.
+	mtx          sync.Mutex
+	lastDelivery time.Time
+	rand         *rand.Rand
+
+	deadlineMtx   sync.Mutex
+	writeDeadline time.Time
+
+	// closed is closed by Close, after which the queued writes are still
+	// delivered, and resetc by reset, which drops them.
+	closed    chan struct{}
+	closeOnce sync.Once
+	resetc    chan struct{}
+	resetOnce sync.Once
+}
+
+// newMemConn returns the end of a connection writing to pipe and starts
+// delivering its writes.
+func newMemConn(n *MemNetwork, pipe net.Conn, local, remote *net.TCPAddr) *memConn {
+	c := &memConn{
+		net:    n,
+		pipe:   pipe,
+		local:  local,
+		remote: remote,
+		writes: make(chan memWrite, memWriteQueueSize),
+		rand:   n.connRand(local, remote),
+		closed: make(chan struct{}),
+		resetc: make(chan struct{}),
+	}
+	go c.deliverLoop()
+	return c
+}
+
+// deliverLoop writes the queued writes to the pipe when they are due.  After
+// a close it delivers the remaining writes and closes the pipe.  It must be
+// run as a goroutine.
+func (c *memConn) deliverLoop() {
+	defer c.net.removeConn(c)
+	defer c.pipe.Close()
+
+	for {
+		select {
+		case w := <-c.writes:
+			if !c.deliver(w) {
+				return
+			}
+		case <-c.closed:
+			for {
+				select {
+				case w := <-c.writes:
+					if !c.deliver(w) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-c.resetc:
+			return
+		}
+	}
+}
+
+// deliver waits until w is due and writes it to the pipe.  It returns false
+// when the connection broke.
+func (c *memConn) deliver(w memWrite) bool {
+	if d := time.Until(w.at); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-c.resetc:
+			timer.Stop()
+			return false
+		}
+	}
+	_, err := c.pipe.Write(w.data)
+	return err == nil
+}
+
+// deliveryTime returns when a write made now reaches the other end.  The
+// caller must hold the lock of the connection.
+func (c *memConn) deliveryTime() time.Time {
+	config := c.net.link(c.local.IP, c.remote.IP)
+	delay := config.Latency
+	retransmit := config.RetransmitTimeout
+	if retransmit == 0 {
+		retransmit = defaultRetransmitTimeout
+	}
+	for i := 0; i < maxMemRetransmits && config.DropRate > 0 &&
+		c.rand.Float64() < config.DropRate; i++ {
+
+		delay += retransmit
+	}
+	if at := time.Now().Add(delay); at.After(c.lastDelivery) {
+		c.lastDelivery = at
+	}
+	return c.lastDelivery
+}
+
+// Read reads data written by the other end.
+func (c *memConn) Read(b []byte) (int, error) {
+	n, err := c.pipe.Read(b)
+	if err != nil {
+		select {
+		case <-c.closed:
+			return n, net.ErrClosed
+		case <-c.resetc:
+			return n, io.EOF
+		default:
+		}
+	}
+	return n, err
+}
+
+// Write queues b for delivery to the other end.  It blocks only when the
+// queue is full.
+func (c *memConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.resetc:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	w := memWrite{
+		data: append([]byte(nil), b...),
+		at:   c.deliveryTime(),
+	}
+
+	c.deadlineMtx.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMtx.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.writes <- w:
+		return len(b), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.resetc:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Close closes the connection.  The data written before is still delivered.
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		// Unblock the readers, the pipe itself is closed once the
+		// queued writes were delivered or the linger time elapsed.
+		c.pipe.SetReadDeadline(time.Now())
+		c.pipe.SetWriteDeadline(time.Now().Add(memCloseLinger))
+	})
+	return nil
+}
+
+// reset breaks the connection, dropping the data not delivered yet.
+func (c *memConn) reset() {
+	c.resetOnce.Do(func() {
+		close(c.resetc)
+		c.pipe.Close()
+	})
+}
+
+// LocalAddr returns the local address of the connection.
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the other end of the connection.
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of the reads.
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	return c.pipe.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the writes.  A write times out when
+// it cannot be queued before the deadline.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMtx.Lock()
+	c.writeDeadline = t
+	c.deadlineMtx.Unlock()
+	return nil
+}
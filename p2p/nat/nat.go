@@ -7,8 +7,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/ethereum/go-ethereum/log"
 )
 
 // NAT is an interface representing a NAT traversal options for example UPNP or
@@ -77,17 +75,21 @@ const (
 // Map adds a port mapping on m and keeps it alive until c is closed.
 // This function is typically invoked in its own goroutine.
 func Map(m NAT, c chan struct{}, protocol string, extport, intport int, name string) {
-	//log := log.New("proto", protocol, "extport", extport, "intport", intport, "interface", m)
 	refresh := time.NewTimer(mapUpdateInterval)
 	defer func() {
 		refresh.Stop()
-		log.Debug("Deleting port mapping")
-		m.DeletePortMapping(protocol, extport, intport)
+		log.Debugf("Deleting %s port mapping %d -> %d on %v", protocol,
+			extport, intport, m)
+		if err := m.DeletePortMapping(protocol, extport, intport); err != nil {
+			log.Debugf("Couldn't delete port mapping: %v", err)
+		}
 	}()
 	if _, err := m.AddPortMapping(protocol, extport, intport, name, int(mapTimeout/time.Second)); err != nil {
-		log.Debug("Couldn't add port mapping", "err", err)
+		log.Debugf("Couldn't add %s port mapping %d -> %d on %v: %v",
+			protocol, extport, intport, m, err)
 	} else {
-		log.Info("Mapped network port")
+		log.Infof("Mapped %s network port %d -> %d on %v", protocol,
+			extport, intport, m)
 	}
 	for {
 		select {
@@ -96,9 +98,10 @@ func Map(m NAT, c chan struct{}, protocol string, extport, intport int, name str
 				return
 			}
 		case <-refresh.C:
-			log.Trace("Refreshing port mapping")
+			log.Tracef("Refreshing %s port mapping %d -> %d", protocol,
+				extport, intport)
 			if _, err := m.AddPortMapping(protocol, extport, intport, name, int(mapTimeout/time.Second)); err != nil {
-				log.Debug("Couldn't add port mapping", "err", err)
+				log.Debugf("Couldn't refresh port mapping: %v", err)
 			}
 			refresh.Reset(mapUpdateInterval)
 		}
@@ -125,11 +128,19 @@ func (extIP) DeletePortMapping(protocol string, externalPort, internalPort int)
 	return nil
 }
 
+// discoverUPnP and discoverPMP are the discovery functions raced by Any.
+// They are variables so the tests can replace them with fakes.
+var (
+	discoverUPnP = DiscoverUPnP
+	discoverPMP  = DiscoverPMP
+)
+
 // Any returns a port mapper that tries to discover any supported
 // mechanism on the local network.
 func Any() NAT {
 	// TODO: attempt to discover whether the local machine has an
 	// Internet-class address. Return ExtIP in this case.
+	upnp, pmp := discoverUPnP, discoverPMP
 	return startautodisc("UPnP or NAT-PMP", func() (NAT, error) {
 		type NATERR struct {
 			nat NAT
@@ -137,19 +148,25 @@ func Any() NAT {
 		}
 		found := make(chan NATERR, 2)
 		go func() {
-			nat, err := DiscoverUPnP()
+			nat, err := upnp()
 			found <- NATERR{nat: nat, err: err}
 		}()
 		go func() {
-			nat, err := DiscoverUPnP()
+			nat, err := pmp()
 			found <- NATERR{nat: nat, err: err}
 		}()
+		// The first mechanism discovered wins.
+		var err error
 		for i := 0; i < cap(found); i++ {
-			if nat := <-found; nat.nat != nil {
-				return nat.nat, nat.err
+			nat := <-found
+			if nat.err == nil && nat.nat != nil {
+				return nat.nat, nil
+			}
+			if nat.err != nil {
+				err = nat.err
 			}
 		}
-		return nil, nil
+		return nil, err
 	})
 }
 
@@ -163,9 +180,9 @@ func UPnP() NAT {
 // address should be the IP of your router. If the given gateway
 // address is nil, PMP will attempt to auto-discover the router.
 func PMP(gateway net.IP) NAT {
-	//if gateway != nil {
-	//	return &pmp{gw: gateway, c: natpmp.NewClient(gateway)}
-	//}
+	if gateway != nil {
+		return newPMP(gateway)
+	}
 	return startautodisc("NAT-PMP", DiscoverPMP)
 }
 
@@ -226,6 +243,8 @@ func (n *autodisc) wait() error {
 
 		n.mu.Unlock()
 	})
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if n.found == nil {
 		return fmt.Errorf("no %s router discovered", n.what)
 	}
@@ -1,33 +1,305 @@
 package nat
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func DiscoverPMP() (nat NAT, err error) {
-	return nil, nil
+const (
+	// pmpPort is the UDP port NAT-PMP gateways listen on.
+	pmpPort = 5351
+
+	// pmpVersion is the version of the NAT-PMP protocol spoken.
+	pmpVersion = 0
+
+	// NAT-PMP request opcodes.  The opcode of a response is the opcode of
+	// its request plus 128.
+	pmpOpExternalAddress = 0
+	pmpOpMapUDP          = 1
+	pmpOpMapTCP          = 2
+
+	// pmpInitialTimeout is the time waited for the first response.  It
+	// doubles with every retransmission as RFC 6886 section 3.1 specifies.
+	pmpInitialTimeout = 250 * time.Millisecond
+
+	// pmpTimeout bounds the time spent on a request, retransmissions
+	// included.
+	pmpTimeout = 4 * time.Second
+
+	// pmpDiscoverTimeout bounds the time spent probing a potential
+	// gateway during auto-discovery.
+	pmpDiscoverTimeout = time.Second
+)
+
+// pmpResultMessages describes the result codes of RFC 6886 section 3.5.
+var pmpResultMessages = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized/refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
 }
 
+// pmp is a NAT-PMP (RFC 6886) port mapper talking to a single gateway.
 type pmp struct {
-	gw net.IP
+	gw      net.IP
+	addr    *net.UDPAddr
+	timeout time.Duration
+
+	// mu serializes the requests since responses carry no request id.
+	mu sync.Mutex
+}
+
+// newPMP returns a port mapper for the NAT-PMP gateway at gw.
+func newPMP(gw net.IP) *pmp {
+	return &pmp{
+		gw:      gw,
+		addr:    &net.UDPAddr{IP: gw, Port: pmpPort},
+		timeout: pmpTimeout,
+	}
 }
 
 func (n *pmp) String() string {
 	return fmt.Sprintf("NAT-PMP(%v)", n.gw)
 }
 
+// GetExternalAddress asks the gateway for its external IPv4 address.
 func (n *pmp) GetExternalAddress() (addr net.IP, err error) {
-	// todo
-	return nil, nil
+	resp, err := n.call([]byte{pmpVersion, pmpOpExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
 }
 
+// AddPortMapping maps externalPort of the gateway to internalPort of the
+// local machine for timeout seconds.  The gateway may pick another external
+// port, which is returned.
 func (n *pmp) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (mappedExternalPort int, err error) {
-	// todo
-	return 0, nil
+	if timeout <= 0 {
+		return 0, errors.New("timeout must not be <= 0")
+	}
+	return n.mapPort(protocol, externalPort, internalPort, timeout)
 }
 
+// DeletePortMapping removes the mapping of internalPort.  RFC 6886 section
+// 3.4 deletes a mapping with a request of zero lifetime and external port.
 func (n *pmp) DeletePortMapping(protocol string, externalPort, internalPort int) (err error) {
-	// todo
-	return nil
+	_, err = n.mapPort(protocol, 0, internalPort, 0)
+	return err
+}
+
+// mapPort sends a mapping request and returns the external port assigned by
+// the gateway.
+func (n *pmp) mapPort(protocol string, externalPort, internalPort, lifetime int) (int, error) {
+	var op byte
+	switch strings.ToLower(protocol) {
+	case "udp":
+		op = pmpOpMapUDP
+	case "tcp":
+		op = pmpOpMapTCP
+	default:
+		return 0, fmt.Errorf("unknown protocol %q", protocol)
+	}
+
+	req := make([]byte, 12)
+	req[0] = pmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime))
+	resp, err := n.call(req, 16)
+	if err != nil {
+		return 0, err
+	}
+	if port := binary.BigEndian.Uint16(resp[8:10]); int(port) != internalPort {
+		return 0, fmt.Errorf("gateway mapped internal port %d instead "+
+			"of %d", port, internalPort)
+	}
+	return int(binary.BigEndian.Uint16(resp[10:12])), nil
+}
+
+// call sends req to the gateway and returns its response of size bytes.  The
+// request is retransmitted with exponential backoff until a response arrives
+// or the timeout of the mapper elapsed.
+func (n *pmp) call(req []byte, size int) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	conn, err := net.DialUDP("udp4", nil, n.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(n.timeout)
+	wait := pmpInitialTimeout
+	buf := make([]byte, 16)
+	for {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		try := time.Now().Add(wait)
+		if try.After(deadline) {
+			try = deadline
+		}
+		if err := conn.SetReadDeadline(try); err != nil {
+			return nil, err
+		}
+
+		for {
+			nr, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			// Ignore what is not the response to the request, such
+			// as the external address announcements of section 3.2.1.
+			if nr < size || buf[0] != pmpVersion || buf[1] != req[1]|0x80 {
+				continue
+			}
+			result := binary.BigEndian.Uint16(buf[2:4])
+			if result != 0 {
+				msg, ok := pmpResultMessages[result]
+				if !ok {
+					msg = fmt.Sprintf("result code %d", result)
+				}
+				return nil, fmt.Errorf("NAT-PMP request failed: %s", msg)
+			}
+			return buf[:size], nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("no NAT-PMP response from %v", n.gw)
+		}
+		wait *= 2
+	}
+}
+
+// DiscoverPMP looks for a NAT-PMP gateway on the local network.  The gateway
+// of the default route is probed together with the first address of every
+// private network the machine is part of, and the first one answering an
+// external address request is used.
+func DiscoverPMP() (nat NAT, err error) {
+	gws := potentialGateways()
+	if len(gws) == 0 {
+		return nil, errors.New("no potential NAT-PMP gateway")
+	}
+
+	found := make(chan *pmp, len(gws))
+	for _, gw := range gws {
+		go func(gw net.IP) {
+			c := newPMP(gw)
+			c.timeout = pmpDiscoverTimeout
+			if _, err := c.GetExternalAddress(); err != nil {
+				found <- nil
+				return
+			}
+			c.timeout = pmpTimeout
+			found <- c
+		}(gw)
+	}
+	for i := 0; i < len(gws); i++ {
+		if c := <-found; c != nil {
+			return c, nil
+		}
+	}
+	return nil, errors.New("no NAT-PMP gateway discovered")
+}
+
+// potentialGateways returns the gateway of the default route followed by the
+// first address of the private IPv4 networks of the local interfaces, which
+// is where home routers usually live.
+func potentialGateways() (gws []net.IP) {
+	seen := make(map[string]bool)
+	add := func(ip net.IP) {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			gws = append(gws, ip)
+		}
+	}
+
+	if gw, err := defaultGateway(); err == nil {
+		add(gw)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return gws
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			if ip == nil || !isPrivateIPv4(ip) {
+				continue
+			}
+			gw := ip.Mask(ipnet.Mask).To4()
+			gw[3] |= 1
+			if !gw.Equal(ip) {
+				add(gw)
+			}
+		}
+	}
+	return gws
+}
+
+// isPrivateIPv4 returns whether ip is part of the private networks of
+// RFC 1918.
+func isPrivateIPv4(ip net.IP) bool {
+	return ip[0] == 10 ||
+		(ip[0] == 172 && ip[1]&0xf0 == 16) ||
+		(ip[0] == 192 && ip[1] == 168)
+}
+
+// defaultGateway returns the gateway of the IPv4 default route read from the
+// routing table of the kernel.  It is only supported on Linux.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseRouteTable(bufio.NewScanner(f))
+}
+
+// parseRouteTable returns the gateway of the default route of a routing table
+// in the format of /proc/net/route, whose addresses are little endian hex.
+func parseRouteTable(s *bufio.Scanner) (net.IP, error) {
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gw))
+		return ip, nil
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default route")
 }
@@ -0,0 +1,535 @@
+package nat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway is a NAT-PMP gateway listening on a loopback UDP socket.  It
+// records the requests it receives and answers them with the responses
+// returned by its handler.
+type fakeGateway struct {
+	conn   *net.UDPConn
+	handle func(n int, req []byte) [][]byte
+
+	mtx      sync.Mutex
+	requests [][]byte
+	times    []time.Time
+}
+
+// newFakeGateway starts a fake gateway calling handle with the number of
+// requests received so far and the request.
+func newFakeGateway(t *testing.T, handle func(n int, req []byte) [][]byte) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	gw := &fakeGateway{conn: conn, handle: handle}
+	go gw.serve()
+	return gw
+}
+
+func (gw *fakeGateway) serve() {
+	buf := make([]byte, 64)
+	for {
+		nr, from, err := gw.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:nr]...)
+		gw.mtx.Lock()
+		gw.requests = append(gw.requests, req)
+		gw.times = append(gw.times, time.Now())
+		n := len(gw.requests)
+		gw.mtx.Unlock()
+
+		for _, resp := range gw.handle(n, req) {
+			gw.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+// client returns a NAT-PMP client talking to the gateway.
+func (gw *fakeGateway) client() *pmp {
+	c := newPMP(net.IPv4(127, 0, 0, 1))
+	c.addr = gw.conn.LocalAddr().(*net.UDPAddr)
+	return c
+}
+
+// received returns the requests received and their arrival times.
+func (gw *fakeGateway) received() ([][]byte, []time.Time) {
+	gw.mtx.Lock()
+	defer gw.mtx.Unlock()
+	return append([][]byte(nil), gw.requests...),
+		append([]time.Time(nil), gw.times...)
+}
+
+func (gw *fakeGateway) Close() {
+	gw.conn.Close()
+}
+
+// externalAddressResponse returns the response to an external address
+// request.
+func externalAddressResponse(result uint16, ip net.IP) []byte {
+	resp := make([]byte, 12)
+	resp[1] = 0x80 | pmpOpExternalAddress
+	binary.BigEndian.PutUint16(resp[2:4], result)
+	binary.BigEndian.PutUint32(resp[4:8], 1000)
+	copy(resp[8:12], ip.To4())
+	return resp
+}
+
+// mapResponse returns the response to a mapping request.
+func mapResponse(op byte, result uint16, internal, external uint16, lifetime uint32) []byte {
+	resp := make([]byte, 16)
+	resp[1] = 0x80 | op
+	binary.BigEndian.PutUint16(resp[2:4], result)
+	binary.BigEndian.PutUint32(resp[4:8], 1000)
+	binary.BigEndian.PutUint16(resp[8:10], internal)
+	binary.BigEndian.PutUint16(resp[10:12], external)
+	binary.BigEndian.PutUint32(resp[12:16], lifetime)
+	return resp
+}
+
+// echoMapping answers a mapping request with the requested ports, or with
+// externalPort when it is not zero.
+func echoMapping(externalPort uint16) func(int, []byte) [][]byte {
+	return func(_ int, req []byte) [][]byte {
+		internal := binary.BigEndian.Uint16(req[4:6])
+		external := binary.BigEndian.Uint16(req[6:8])
+		if externalPort != 0 {
+			external = externalPort
+		}
+		lifetime := binary.BigEndian.Uint32(req[8:12])
+		return [][]byte{mapResponse(req[1], 0, internal, external, lifetime)}
+	}
+}
+
+// TestPMPGetExternalAddress ensures the external address announced by the
+// gateway is returned.
+func TestPMPGetExternalAddress(t *testing.T) {
+	extIP := net.IPv4(203, 0, 113, 7)
+	gw := newFakeGateway(t, func(_ int, req []byte) [][]byte {
+		return [][]byte{externalAddressResponse(0, extIP)}
+	})
+	defer gw.Close()
+
+	ip, err := gw.client().GetExternalAddress()
+	if err != nil {
+		t.Fatalf("GetExternalAddress: %v", err)
+	}
+	if !ip.Equal(extIP) {
+		t.Errorf("GetExternalAddress: got %v, want %v", ip, extIP)
+	}
+	reqs, _ := gw.received()
+	if len(reqs) != 1 || string(reqs[0]) != string([]byte{0, 0}) {
+		t.Errorf("GetExternalAddress: unexpected requests %x", reqs)
+	}
+}
+
+// TestPMPAddPortMapping ensures mapping requests carry the protocol, the
+// ports and the lifetime, and that the external port picked by the gateway
+// is returned.
+func TestPMPAddPortMapping(t *testing.T) {
+	tests := []struct {
+		name        string
+		protocol    string
+		op          byte
+		external    int
+		internal    int
+		lifetime    int
+		gatewayPort uint16 // external port picked by the gateway
+		want        int
+	}{
+		{
+			name:     "tcp",
+			protocol: "TCP",
+			op:       pmpOpMapTCP,
+			external: 18444,
+			internal: 18444,
+			lifetime: 1200,
+			want:     18444,
+		},
+		{
+			name:     "udp",
+			protocol: "udp",
+			op:       pmpOpMapUDP,
+			external: 30303,
+			internal: 30304,
+			lifetime: 60,
+			want:     30303,
+		},
+		{
+			name:        "other external port",
+			protocol:    "tcp",
+			op:          pmpOpMapTCP,
+			external:    18444,
+			internal:    18444,
+			lifetime:    1200,
+			gatewayPort: 40000,
+			want:        40000,
+		},
+	}
+
+	for _, test := range tests {
+		gw := newFakeGateway(t, echoMapping(test.gatewayPort))
+		port, err := gw.client().AddPortMapping(test.protocol,
+			test.external, test.internal, "test", test.lifetime)
+		reqs, _ := gw.received()
+		gw.Close()
+		if err != nil {
+			t.Errorf("%s: AddPortMapping: %v", test.name, err)
+			continue
+		}
+		if port != test.want {
+			t.Errorf("%s: got external port %d, want %d", test.name,
+				port, test.want)
+		}
+		if len(reqs) != 1 || len(reqs[0]) != 12 {
+			t.Errorf("%s: unexpected requests %x", test.name, reqs)
+			continue
+		}
+		req := reqs[0]
+		if req[0] != pmpVersion || req[1] != test.op {
+			t.Errorf("%s: got version %d opcode %d, want %d %d",
+				test.name, req[0], req[1], pmpVersion, test.op)
+		}
+		if got := binary.BigEndian.Uint16(req[4:6]); int(got) != test.internal {
+			t.Errorf("%s: got internal port %d, want %d", test.name,
+				got, test.internal)
+		}
+		if got := binary.BigEndian.Uint16(req[6:8]); int(got) != test.external {
+			t.Errorf("%s: got external port %d, want %d", test.name,
+				got, test.external)
+		}
+		if got := binary.BigEndian.Uint32(req[8:12]); int(got) != test.lifetime {
+			t.Errorf("%s: got lifetime %d, want %d", test.name, got,
+				test.lifetime)
+		}
+	}
+
+	// A mapping needs a lifetime and a known protocol.
+	c := newPMP(net.IPv4(127, 0, 0, 1))
+	if _, err := c.AddPortMapping("tcp", 1, 1, "test", 0); err == nil {
+		t.Error("AddPortMapping accepted a zero lifetime")
+	}
+	if _, err := c.AddPortMapping("sctp", 1, 1, "test", 60); err == nil {
+		t.Error("AddPortMapping accepted an unknown protocol")
+	}
+}
+
+// TestPMPDeletePortMapping ensures a mapping is deleted with a request of
+// zero lifetime and external port.
+func TestPMPDeletePortMapping(t *testing.T) {
+	gw := newFakeGateway(t, echoMapping(0))
+	defer gw.Close()
+
+	if err := gw.client().DeletePortMapping("udp", 30303, 30304); err != nil {
+		t.Fatalf("DeletePortMapping: %v", err)
+	}
+	reqs, _ := gw.received()
+	if len(reqs) != 1 || len(reqs[0]) != 12 {
+		t.Fatalf("DeletePortMapping: unexpected requests %x", reqs)
+	}
+	req := reqs[0]
+	if req[1] != pmpOpMapUDP {
+		t.Errorf("DeletePortMapping: got opcode %d, want %d", req[1],
+			pmpOpMapUDP)
+	}
+	if got := binary.BigEndian.Uint16(req[4:6]); got != 30304 {
+		t.Errorf("DeletePortMapping: got internal port %d, want 30304", got)
+	}
+	if got := binary.BigEndian.Uint16(req[6:8]); got != 0 {
+		t.Errorf("DeletePortMapping: got external port %d, want 0", got)
+	}
+	if got := binary.BigEndian.Uint32(req[8:12]); got != 0 {
+		t.Errorf("DeletePortMapping: got lifetime %d, want 0", got)
+	}
+}
+
+// TestPMPResultCodes ensures the requests refused by the gateway fail with
+// the description of the result code.
+func TestPMPResultCodes(t *testing.T) {
+	tests := []struct {
+		result uint16
+		want   string
+	}{
+		{1, "unsupported version"},
+		{2, "not authorized/refused"},
+		{3, "network failure"},
+		{4, "out of resources"},
+		{5, "unsupported opcode"},
+		{99, "result code 99"},
+	}
+
+	for _, test := range tests {
+		result := test.result
+		gw := newFakeGateway(t, func(_ int, req []byte) [][]byte {
+			if req[1] == pmpOpExternalAddress {
+				return [][]byte{externalAddressResponse(result, nil)}
+			}
+			return [][]byte{mapResponse(req[1], result, 1, 1, 0)}
+		})
+		c := gw.client()
+		_, err := c.GetExternalAddress()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("GetExternalAddress with result %d: got error "+
+				"%v, want %q", test.result, err, test.want)
+		}
+		_, err = c.AddPortMapping("tcp", 1, 1, "test", 60)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("AddPortMapping with result %d: got error %v, "+
+				"want %q", test.result, err, test.want)
+		}
+		gw.Close()
+	}
+}
+
+// TestPMPRetransmit ensures unanswered requests are retransmitted with
+// doubling waits until the timeout of the client elapsed, and that a late
+// answer to a retransmission is accepted.
+func TestPMPRetransmit(t *testing.T) {
+	gw := newFakeGateway(t, func(int, []byte) [][]byte { return nil })
+	defer gw.Close()
+
+	c := gw.client()
+	c.timeout = 2 * time.Second
+	start := time.Now()
+	_, err := c.GetExternalAddress()
+	elapsed := time.Since(start)
+	if err == nil || !strings.Contains(err.Error(), "no NAT-PMP response") {
+		t.Fatalf("GetExternalAddress: got error %v, want a timeout", err)
+	}
+	if elapsed < c.timeout || elapsed > c.timeout+time.Second {
+		t.Errorf("GetExternalAddress gave up after %v, want %v", elapsed,
+			c.timeout)
+	}
+
+	// The requests are sent at 0, 250ms, 750ms and 1750ms.
+	_, times := gw.received()
+	if len(times) != 4 {
+		t.Fatalf("got %d requests, want 4", len(times))
+	}
+	wait := pmpInitialTimeout
+	for i := 1; i < len(times); i++ {
+		gap := times[i].Sub(times[i-1])
+		if gap < wait-20*time.Millisecond || gap > wait+200*time.Millisecond {
+			t.Errorf("retransmission %d after %v, want %v", i, gap, wait)
+		}
+		wait *= 2
+	}
+
+	// Answer the third request only.
+	extIP := net.IPv4(203, 0, 113, 8)
+	late := newFakeGateway(t, func(n int, _ []byte) [][]byte {
+		if n < 3 {
+			return nil
+		}
+		return [][]byte{externalAddressResponse(0, extIP)}
+	})
+	defer late.Close()
+	ip, err := late.client().GetExternalAddress()
+	if err != nil {
+		t.Fatalf("GetExternalAddress with late answer: %v", err)
+	}
+	if !ip.Equal(extIP) {
+		t.Errorf("GetExternalAddress with late answer: got %v, want %v",
+			ip, extIP)
+	}
+}
+
+// TestPMPIgnoresStrayPackets ensures the packets that are not the response
+// to the request, such as the external address announcements gateways
+// multicast, are skipped.
+func TestPMPIgnoresStrayPackets(t *testing.T) {
+	gw := newFakeGateway(t, func(_ int, req []byte) [][]byte {
+		good := mapResponse(req[1], 0, 18444, 18444, 60)
+		badVersion := append([]byte(nil), good...)
+		badVersion[0] = 1
+		return [][]byte{
+			// An announcement carries the opcode of an external
+			// address response.
+			externalAddressResponse(0, net.IPv4(198, 51, 100, 1)),
+			// A truncated response.
+			good[:12],
+			badVersion,
+			mapResponse(req[1], 0, 18444, 20000, 60),
+		}
+	})
+	defer gw.Close()
+
+	port, err := gw.client().AddPortMapping("tcp", 18444, 18444, "test", 60)
+	if err != nil {
+		t.Fatalf("AddPortMapping: %v", err)
+	}
+	if port != 20000 {
+		t.Errorf("AddPortMapping: got external port %d, want 20000", port)
+	}
+	if reqs, _ := gw.received(); len(reqs) != 1 {
+		t.Errorf("AddPortMapping: sent %d requests, want 1", len(reqs))
+	}
+}
+
+// TestParseRouteTable ensures the gateway of the default route is read from
+// a routing table in the format of /proc/net/route.
+func TestParseRouteTable(t *testing.T) {
+	const header = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\t" +
+		"Metric\tMask\t\tMTU\tWindow\tIRTT\n"
+	tests := []struct {
+		name  string
+		table string
+		want  net.IP // nil when an error is expected
+	}{
+		{
+			name: "default route",
+			table: header +
+				"eth0\t0000A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+				"eth0\t00000000\t0100A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+			want: net.IPv4(192, 168, 0, 1),
+		},
+		{
+			name: "default route without gateway skipped",
+			table: header +
+				"tun0\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n" +
+				"eth0\t00000000\t0101000A\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+			want: net.IPv4(10, 0, 1, 1),
+		},
+		{
+			name: "malformed gateway skipped",
+			table: header +
+				"eth0\t00000000\tZZZZZZZZ\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+		},
+		{
+			name: "no default route",
+			table: header +
+				"eth0\t0000A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, test := range tests {
+		s := bufio.NewScanner(strings.NewReader(test.table))
+		ip, err := parseRouteTable(s)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got gateway %v, want an error", test.name,
+					ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseRouteTable: %v", test.name, err)
+			continue
+		}
+		if !ip.Equal(test.want) {
+			t.Errorf("%s: got gateway %v, want %v", test.name, ip,
+				test.want)
+		}
+	}
+}
+
+// fakeNAT is a port mapper standing in for a discovered UPnP device.
+type fakeNAT struct {
+	ip net.IP
+}
+
+func (n *fakeNAT) GetExternalAddress() (net.IP, error) { return n.ip, nil }
+func (n *fakeNAT) String() string                      { return "fake" }
+
+func (n *fakeNAT) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (int, error) {
+	return externalPort, nil
+}
+
+func (n *fakeNAT) DeletePortMapping(protocol string, externalPort, internalPort int) error {
+	return nil
+}
+
+// TestAny ensures Any uses whichever of UPnP and NAT-PMP is discovered first
+// and fails only when both fail.
+func TestAny(t *testing.T) {
+	defer func(upnp, pmp func() (NAT, error)) {
+		discoverUPnP, discoverPMP = upnp, pmp
+	}(discoverUPnP, discoverPMP)
+
+	pmpIP := net.IPv4(203, 0, 113, 9)
+	gw := newFakeGateway(t, func(_ int, req []byte) [][]byte {
+		return [][]byte{externalAddressResponse(0, pmpIP)}
+	})
+	defer gw.Close()
+	upnpIP := net.IPv4(198, 51, 100, 9)
+	errUPnP := errors.New("no UPnP device")
+	errPMP := errors.New("no NAT-PMP gateway")
+
+	// discover returns a discovery function answering after delay.
+	discover := func(delay time.Duration, nat NAT, err error) func() (NAT, error) {
+		return func() (NAT, error) {
+			time.Sleep(delay)
+			return nat, err
+		}
+	}
+	tests := []struct {
+		name string
+		upnp func() (NAT, error)
+		pmp  func() (NAT, error)
+		want net.IP // nil when discovery is expected to fail
+	}{
+		{
+			name: "pmp first",
+			upnp: discover(500*time.Millisecond, &fakeNAT{upnpIP}, nil),
+			pmp:  discover(0, gw.client(), nil),
+			want: pmpIP,
+		},
+		{
+			name: "upnp first",
+			upnp: discover(0, &fakeNAT{upnpIP}, nil),
+			pmp:  discover(500*time.Millisecond, gw.client(), nil),
+			want: upnpIP,
+		},
+		{
+			name: "upnp fails",
+			upnp: discover(0, nil, errUPnP),
+			pmp:  discover(100*time.Millisecond, gw.client(), nil),
+			want: pmpIP,
+		},
+		{
+			name: "pmp fails",
+			upnp: discover(100*time.Millisecond, &fakeNAT{upnpIP}, nil),
+			pmp:  discover(0, nil, errPMP),
+			want: upnpIP,
+		},
+		{
+			name: "both fail",
+			upnp: discover(0, nil, errUPnP),
+			pmp:  discover(0, nil, errPMP),
+		},
+	}
+
+	for _, test := range tests {
+		discoverUPnP, discoverPMP = test.upnp, test.pmp
+		n := Any()
+		ip, err := n.GetExternalAddress()
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got external address %v, want an error",
+					test.name, ip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: GetExternalAddress: %v", test.name, err)
+			continue
+		}
+		if !ip.Equal(test.want) {
+			t.Errorf("%s: got external address %v, want %v", test.name,
+				ip, test.want)
+		}
+	}
+}
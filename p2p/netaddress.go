@@ -0,0 +1,176 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NetAddress defines information about a peer on the network including its
+// node ID, IP address, and port.  Version 2 onion services have the OnionCat
+// address of their name as IP address.
+type NetAddress struct {
+	ID   string
+	IP   net.IP
+	Port uint16
+
+	// Host is the name of an address that is not resolved locally, such
+	// as a version 3 onion service, whose IP is nil.  It is resolved when
+	// dialed, by the proxy when there is one.
+	Host string
+
+	// str is the address in the form it was given, kept for logging.
+	str string
+}
+
+// NewNetAddress returns a new NetAddress using the provided TCP address and
+// node ID, which may be empty when it is not known.
+func NewNetAddress(id string, addr net.Addr) *NetAddress {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		if na, err := parseNetAddress(addr.String(), false); err == nil {
+			na.ID, na.str = id, ""
+			return na
+		}
+		return &NetAddress{ID: id, IP: net.IPv4zero, str: addr.String()}
+	}
+	return NewNetAddressIPPort(id, tcpAddr.IP, uint16(tcpAddr.Port))
+}
+
+// NewNetAddressIPPort returns a new NetAddress using the provided node ID, IP
+// address and port number.
+func NewNetAddressIPPort(id string, ip net.IP, port uint16) *NetAddress {
+	return &NetAddress{
+		ID:   id,
+		IP:   ip,
+		Port: port,
+	}
+}
+
+// NewNetAddressString returns a new NetAddress parsed from a string of the
+// form "host:port" or "id@host:port".  The host is resolved when it is a
+// name, except for onion names which are never looked up.
+func NewNetAddressString(addr string) (*NetAddress, error) {
+	return parseNetAddress(addr, true)
+}
+
+// NewNetAddressStringUnresolved is like NewNetAddressString but leaves host
+// names unresolved.  They are resolved when the address is dialed, by the
+// proxy when there is one, so the lookups do not bypass it.
+func NewNetAddressStringUnresolved(addr string) (*NetAddress, error) {
+	return parseNetAddress(addr, false)
+}
+
+// parseNetAddress parses an address of the form "host:port" or
+// "id@host:port", resolving host names when resolve is set.
+func parseNetAddress(addr string, resolve bool) (*NetAddress, error) {
+	var id string
+	hostport := addr
+	if i := strings.Index(addr, "@"); i >= 0 {
+		id, hostport = addr[:i], addr[i+1:]
+		if err := validateID(id); err != nil {
+			return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in address %s: %v", addr, err)
+	}
+
+	na := NewNetAddressIPPort(id, net.ParseIP(host), uint16(port))
+	na.str = addr
+	switch {
+	case na.IP != nil:
+	case isOnionHost(host):
+		if na.IP = onionCatIP(host); na.IP == nil {
+			if !isOnionV3Host(host) {
+				return nil, fmt.Errorf("invalid onion address %s",
+					addr)
+			}
+			na.Host = strings.ToLower(host)
+		}
+	case !resolve:
+		na.Host = host
+	default:
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses found for %s", host)
+		}
+		na.IP = ips[0]
+	}
+	return na, nil
+}
+
+// NewNetAddressStrings returns the addresses parsed from the given strings.
+func NewNetAddressStrings(addrs []string) ([]*NetAddress, error) {
+	return parseNetAddresses(addrs, true)
+}
+
+// parseNetAddresses returns the addresses parsed from the given strings,
+// resolving host names when resolve is set.
+func parseNetAddresses(addrs []string, resolve bool) ([]*NetAddress, error) {
+	netAddrs := make([]*NetAddress, 0, len(addrs))
+	for _, addr := range addrs {
+		netAddr, err := parseNetAddress(addr, resolve)
+		if err != nil {
+			return nil, err
+		}
+		netAddrs = append(netAddrs, netAddr)
+	}
+	return netAddrs, nil
+}
+
+// Equals reports whether na and other are the same addresses.
+func (na *NetAddress) Equals(other *NetAddress) bool {
+	return na.ID == other.ID && na.IP.Equal(other.IP) &&
+		na.Host == other.Host && na.Port == other.Port
+}
+
+// String returns the address in "id@host:port" form, or "host:port" when the
+// node ID is not known.
+func (na *NetAddress) String() string {
+	if na.str != "" {
+		return na.str
+	}
+	if na.ID != "" {
+		return na.ID + "@" + na.DialString()
+	}
+	return na.DialString()
+}
+
+// DialString returns the host:port to dial.
+func (na *NetAddress) DialString() string {
+	return net.JoinHostPort(na.host(), strconv.FormatUint(uint64(na.Port), 10))
+}
+
+// host returns the host to dial: the name of an address given by name, the
+// onion name of an OnionCat address or else the IP address.
+func (na *NetAddress) host() string {
+	switch {
+	case na.Host != "":
+		return na.Host
+	case IsOnionCatTor(na):
+		return onionCatHost(na.IP)
+	}
+	return na.IP.String()
+}
+
+// tcpAddr returns the address as a *net.TCPAddr.
+func (na *NetAddress) tcpAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: na.IP, Port: int(na.Port)}
+}
+
+// DialTimeout calls net.DialTimeout on the address.
+func (na *NetAddress) DialTimeout(timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", na.DialString(), timeout)
+}
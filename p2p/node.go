@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NodeID is the binary form of the ID of a node, the hash160 of its node
+// key.  The discovery protocol measures the distance between nodes as the
+// XOR of their IDs.
+type NodeID [IDByteLength]byte
+
+// String returns the hex encoded node ID, the form used by the rest of the
+// p2p package.
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// HexID parses a hex encoded node ID.
+func HexID(s string) (NodeID, error) {
+	var id NodeID
+	if err := validateID(s); err != nil {
+		return id, err
+	}
+	hex.Decode(id[:], []byte(s))
+	return id, nil
+}
+
+// logdist returns the logarithmic distance between a and b, log2(a ^ b).
+func logdist(a, b NodeID) int {
+	lz := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			lz += 8
+		} else {
+			lz += bits.LeadingZeros8(x)
+			break
+		}
+	}
+	return len(a)*8 - lz
+}
+
+// distcmp compares the distances a->target and b->target.  Returns -1 if a
+// is closer to target, 1 if b is closer to target and 0 if they are equal.
+func distcmp(target, a, b NodeID) int {
+	for i := range target {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+		if da > db {
+			return 1
+		} else if da < db {
+			return -1
+		}
+	}
+	return 0
+}
+
+// Node is the record of a node found by discovery.
+type Node struct {
+	ID  NodeID
+	IP  net.IP
+	UDP uint16 // port of the discovery protocol
+	TCP uint16 // port peer connections are accepted on
+
+	// addedAt is the time the node was added to the routing table and
+	// livenessChecks counts the revalidations it answered since.
+	addedAt        time.Time
+	livenessChecks uint
+}
+
+// ParseNode parses a node record of the form "id@host:port", where port is
+// the UDP port of the discovery protocol.  The TCP port is assumed to be the
+// same.
+func ParseNode(s string) (*Node, error) {
+	i := strings.Index(s, "@")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid node %s: missing node id", s)
+	}
+	id, err := HexID(s[:i])
+	if err != nil {
+		return nil, fmt.Errorf("invalid node %s: %v", s, err)
+	}
+	addr, err := net.ResolveUDPAddr("udp", s[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid node %s: %v", s, err)
+	}
+	return &Node{
+		ID:  id,
+		IP:  addr.IP,
+		UDP: uint16(addr.Port),
+		TCP: uint16(addr.Port),
+	}, nil
+}
+
+// addr returns the UDP address of the node.
+func (n *Node) addr() *net.UDPAddr {
+	return &net.UDPAddr{IP: n.IP, Port: int(n.UDP)}
+}
+
+// NetAddress returns the address peer connections to the node are dialed at.
+func (n *Node) NetAddress() *NetAddress {
+	return NewNetAddressIPPort(n.ID.String(), n.IP, n.TCP)
+}
+
+// String returns the node in "id@host:port" form with the UDP port.
+func (n *Node) String() string {
+	return n.ID.String() + "@" + net.JoinHostPort(n.IP.String(),
+		strconv.Itoa(int(n.UDP)))
+}
@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/wire"
+)
+
+var (
+	// ErrSelfConnect is returned by the handshake when the remote peer
+	// turns out to be the local node.
+	ErrSelfConnect = errors.New("connected to self")
+
+	// ErrIncompatibleNetwork is returned by the handshake when the remote
+	// peer is on another network.
+	ErrIncompatibleNetwork = errors.New("peer is on an incompatible network")
+
+	// ErrIncompatibleVersion is returned by the handshake when the remote
+	// peer runs a protocol version that is no longer supported.
+	ErrIncompatibleVersion = errors.New("peer protocol version is too old")
+)
+
+// NodeInfo is the information a node advertises about itself during the
+// handshake.
+type NodeInfo struct {
+	ProtocolVersion uint32
+	ChainID         uint32
+	GenesisHash     common.Hash
+	ID              string
+	Services        wire.ServiceFlag
+	BestHeight      uint64
+	UserAgent       string
+	ListenAddr      string
+
+	// Nonce is picked at random when the node starts so that the node can
+	// recognize its own version message when it connects to itself.
+	Nonce uint64
+}
+
+// CompatibleWith returns nil when a node advertising other can be a peer of
+// the node advertising info.
+func (info *NodeInfo) CompatibleWith(other *NodeInfo) error {
+	if other.Nonce == info.Nonce || other.ID == info.ID {
+		return ErrSelfConnect
+	}
+	if other.ChainID != info.ChainID || other.GenesisHash != info.GenesisHash {
+		return fmt.Errorf("%v: chain id %d, genesis %v", ErrIncompatibleNetwork,
+			other.ChainID, other.GenesisHash)
+	}
+	if other.ProtocolVersion < wire.MinProtocolVersion {
+		return fmt.Errorf("%v: version %d, minimum %d", ErrIncompatibleVersion,
+			other.ProtocolVersion, wire.MinProtocolVersion)
+	}
+	return nil
+}
+
+// String returns a short description of the node for logging.
+func (info *NodeInfo) String() string {
+	return fmt.Sprintf("%s (%s, version %d, height %d)", info.ID,
+		info.UserAgent, info.ProtocolVersion, info.BestHeight)
+}
+
+// versionMsg returns the version message advertising info.
+func (info *NodeInfo) versionMsg() *wire.MsgVersion {
+	msg := wire.NewMsgVersion(info.ChainID, &info.GenesisHash, info.ID,
+		info.Nonce, info.BestHeight)
+	msg.ProtocolVersion = info.ProtocolVersion
+	msg.Services = info.Services
+	msg.ListenAddr = info.ListenAddr
+	if info.UserAgent != "" {
+		msg.UserAgent = info.UserAgent
+	}
+	return msg
+}
+
+// nodeInfoFromVersionMsg returns the information advertised by msg.  An error
+// is returned when the node ID is malformed.
+func nodeInfoFromVersionMsg(msg *wire.MsgVersion) (*NodeInfo, error) {
+	if err := validateID(msg.NodeID); err != nil {
+		return nil, err
+	}
+	return &NodeInfo{
+		ProtocolVersion: msg.ProtocolVersion,
+		ChainID:         msg.ChainID,
+		GenesisHash:     msg.GenesisHash,
+		ID:              msg.NodeID,
+		Services:        msg.Services,
+		BestHeight:      msg.BestHeight,
+		UserAgent:       msg.UserAgent,
+		ListenAddr:      msg.ListenAddr,
+		Nonce:           msg.Nonce,
+	}, nil
+}
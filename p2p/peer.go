@@ -3,78 +3,418 @@ package p2p
 import (
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/blockchainservice/crypto"
+	"github.com/blockchainservice/p2p/conn"
+	"github.com/blockchainservice/wire"
 )
 
-// PeerConn contains the raw connection
+// peerConfig holds the settings shared by all peer connections of a node.
+type peerConfig struct {
+	// magic is the network magic messages are framed with.
+	magic uint32
+
+	// nodeKey authenticates the local node to its peers.
+	nodeKey *NodeKey
+
+	// mConfig configures the multiplexed connection of the peers.
+	mConfig conn.MConnConfig
+}
+
+// PeerConn contains the connection to a peer.  The raw connection is replaced
+// by an encrypted one authenticated with the node key of the peer during the
+// handshake.
 type PeerConn struct {
 	outbound   bool
 	persistent bool
 	conn       net.Conn
+	config     *peerConfig
+
+	// addr is the address the peer was dialed at, nil for inbound peers.
+	addr *NetAddress
+
+	// remotePubKey is the node key of the remote peer authenticated by the
+	// secret connection.
+	remotePubKey crypto.PublicKey
+
+	// nodeInfo is the information the remote node advertised during the
+	// handshake.  It is nil until the handshake completed.
+	nodeInfo *NodeInfo
+
+	// mconn multiplexes the channels of the reactors over the connection
+	// once the handshake completed.
+	mconn *conn.MConnection
+
+	// data holds the state reactors keep about the peer.
+	dataMtx sync.Mutex
+	data    map[string]interface{}
+
+	// banScore accumulates the misbehavior of the peer.
+	banScore DynamicBanScore
+
+	// lastBlockTime and lastTxTime are the unix nanoseconds the peer last
+	// relayed a new block and a new transaction, as reported by the
+	// reactors.  Peers that relay useful data are protected from eviction.
+	lastBlockTime int64 // atomic
+	lastTxTime    int64 // atomic
 }
 
-func newPeerConn(rawConn net.Conn, outbound, persistent bool) (PeerConn, error) {
-	return PeerConn{
+func newPeerConn(rawConn net.Conn, outbound, persistent bool, config *peerConfig) (*PeerConn, error) {
+	return &PeerConn{
 		outbound:   outbound,
 		persistent: persistent,
 		conn:       rawConn,
+		config:     config,
+		data:       make(map[string]interface{}),
 	}, nil
 }
 
+// ID returns the node ID of the remote peer.
+func (pc *PeerConn) ID() string {
+	return pc.nodeInfo.ID
+}
+
+// NodeInfo returns the information the remote peer advertised during the
+// handshake.
+func (pc *PeerConn) NodeInfo() *NodeInfo {
+	return pc.nodeInfo
+}
+
+// Get returns the data reactors stored about the peer under key.
+func (pc *PeerConn) Get(key string) interface{} {
+	pc.dataMtx.Lock()
+	defer pc.dataMtx.Unlock()
+	return pc.data[key]
+}
+
+// Set stores data about the peer under key.  Reactors use it to keep their
+// per peer state, typically set up in InitPeer.
+func (pc *PeerConn) Set(key string, data interface{}) {
+	pc.dataMtx.Lock()
+	defer pc.dataMtx.Unlock()
+	pc.data[key] = data
+}
+
+// PubKey returns the authenticated node key of the remote peer.
+func (pc *PeerConn) PubKey() crypto.PublicKey {
+	return pc.remotePubKey
+}
+
+// DialedAddr returns the address an outbound peer was dialed at, nil for
+// inbound peers.
+func (pc *PeerConn) DialedAddr() *NetAddress {
+	return pc.addr
+}
+
+// BanScore returns the current ban score of the peer.
+func (pc *PeerConn) BanScore() uint32 {
+	return pc.banScore.Int()
+}
+
+// MarkBlockRelayed records that the peer relayed a block the node did not
+// know of.
+func (pc *PeerConn) MarkBlockRelayed() {
+	atomic.StoreInt64(&pc.lastBlockTime, time.Now().UnixNano())
+}
+
+// MarkTxRelayed records that the peer relayed a transaction the node did not
+// know of.
+func (pc *PeerConn) MarkTxRelayed() {
+	atomic.StoreInt64(&pc.lastTxTime, time.Now().UnixNano())
+}
+
+// LastBlockTime returns the last time the peer relayed a new block.
+func (pc *PeerConn) LastBlockTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&pc.lastBlockTime))
+}
+
+// LastTxTime returns the last time the peer relayed a new transaction.
+func (pc *PeerConn) LastTxTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&pc.lastTxTime))
+}
+
+// IsOutbound returns whether the connection was dialed by the local node.
+func (pc *PeerConn) IsOutbound() bool {
+	return pc.outbound
+}
+
+// IsPersistent returns whether the local node keeps reconnecting to the peer.
+func (pc *PeerConn) IsPersistent() bool {
+	return pc.persistent
+}
+
+// RemoteAddr returns the remote network address of the connection.
+func (pc *PeerConn) RemoteAddr() net.Addr {
+	return pc.conn.RemoteAddr()
+}
+
+// String returns the peer in human-readable form.
+func (pc *PeerConn) String() string {
+	direction := "inbound"
+	if pc.outbound {
+		direction = "outbound"
+	}
+	if pc.nodeInfo == nil {
+		return fmt.Sprintf("%s (%s)", pc.conn.RemoteAddr(), direction)
+	}
+	return fmt.Sprintf("%s@%s (%s)", pc.nodeInfo.ID, pc.conn.RemoteAddr(),
+		direction)
+}
+
+// createMConnection sets up the multiplexed connection of the peer.  Messages
+// received on a channel are dispatched to the reactor owning it, and errors
+// of the connection are reported to onPeerError.
+func (pc *PeerConn) createMConnection(reactorsByCh map[byte]Reactor,
+	chDescs []*conn.ChannelDescriptor,
+	onPeerError func(*PeerConn, interface{})) error {
+
+	onReceive := func(chID byte, msgBytes []byte) {
+		reactor := reactorsByCh[chID]
+		if reactor == nil {
+			// Note that its ok to panic here as it's caught in the
+			// MConnection._recover, which does onPeerError.
+			panic(fmt.Sprintf("Unknown channel %#x", chID))
+		}
+		reactor.Receive(chID, pc, msgBytes)
+	}
+	onError := func(r interface{}) {
+		onPeerError(pc, r)
+	}
+
+	mconn, err := conn.NewMConnectionWithConfig(pc.conn, chDescs, onReceive,
+		onError, pc.config.mConfig)
+	if err != nil {
+		return err
+	}
+	pc.mconn = mconn
+	return nil
+}
+
+// Start starts the multiplexed connection of the peer.
+func (pc *PeerConn) Start() error {
+	return pc.mconn.Start()
+}
+
+// Stop stops the multiplexed connection of the peer and closes the
+// connection.
+func (pc *PeerConn) Stop() {
+	pc.mconn.Stop()
+}
+
+// FlushStop stops the peer after sending the messages queued for it followed
+// by a disconnect message carrying reason.  Sending gives up once timeout
+// elapsed.
+func (pc *PeerConn) FlushStop(reason string, timeout time.Duration) {
+	pc.mconn.FlushStop(reason, timeout)
+}
+
+// IsRunning returns whether the multiplexed connection of the peer runs.
+func (pc *PeerConn) IsRunning() bool {
+	return pc.mconn != nil && pc.mconn.IsRunning()
+}
+
+// Send queues msgBytes for sending on channel chID.  It blocks until the
+// message is queued or the send times out and returns false when the message
+// was not queued.
+func (pc *PeerConn) Send(chID byte, msgBytes []byte) bool {
+	if !pc.IsRunning() {
+		return false
+	}
+	return pc.mconn.Send(chID, msgBytes)
+}
+
+// TrySend queues msgBytes for sending on channel chID without blocking.  It
+// returns false when the send queue of the channel is full.
+func (pc *PeerConn) TrySend(chID byte, msgBytes []byte) bool {
+	if !pc.IsRunning() {
+		return false
+	}
+	return pc.mconn.TrySend(chID, msgBytes)
+}
+
+// CanSend returns whether the send queue of channel chID has room.  Use only
+// as a heuristic.
+func (pc *PeerConn) CanSend(chID byte) bool {
+	if !pc.IsRunning() {
+		return false
+	}
+	return pc.mconn.CanSend(chID)
+}
+
+// Status returns the state of the multiplexed connection of the peer.
+func (pc *PeerConn) Status() conn.ConnectionStatus {
+	return pc.mconn.Status()
+}
+
 // CloseConn should be called if the peer was created but never started.
 func (pc *PeerConn) CloseConn() {
 	pc.conn.Close()
 }
 
 // HandshakeTimeout performs the P2P handshake between a given node and the peer by exchanging their NodeInfo.
-func (pc *PeerConn) HandshakeTimeout(timeout time.Duration, stage chan<- *PeerConn) error {
+// The connection is first upgraded to a secret connection which authenticates
+// the node key of the peer, then the NodeInfo is exchanged over it.  The
+// remote peer is rejected when its node ID does not match its key, it is on
+// another network, runs an unsupported protocol version or turns out to be
+// the local node.
+func (pc *PeerConn) HandshakeTimeout(ourNodeInfo *NodeInfo, timeout time.Duration) error {
 	// Set deadline for handshake so we don't block forever on conn.ReadFull
 	if err := pc.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		log.Error("Error setting deadline")
 		pc.CloseConn()
-		return fmt.Errorf("Error setting deadline")
+		return fmt.Errorf("error setting handshake deadline: %v", err)
+	}
+
+	secretConn, err := conn.MakeSecretConnection(pc.conn,
+		pc.config.nodeKey.PrivKey)
+	if err != nil {
+		pc.CloseConn()
+		return fmt.Errorf("secret connection handshake: %v", err)
+	}
+	pc.conn = secretConn
+	pc.remotePubKey = secretConn.RemotePubKey()
+
+	if err := pc.handshake(ourNodeInfo); err != nil {
+		pc.CloseConn()
+		return err
 	}
+
+	// Remove deadline
+	if err := pc.conn.SetDeadline(time.Time{}); err != nil {
+		pc.CloseConn()
+		return fmt.Errorf("error removing handshake deadline: %v", err)
+	}
+	return nil
+}
+
+// handshake exchanges version messages followed by verack messages.  The
+// dialing side speaks first so the exchange also works over unbuffered
+// connections.
+func (pc *PeerConn) handshake(ourNodeInfo *NodeInfo) error {
 	if pc.outbound {
 		// 发送版本号
-		if err := pc.writeLocalVersionMsg(); err != nil {
-			log.Error("writeLocalVersionMsg")
-			pc.CloseConn()
-			return fmt.Errorf("writeLocalVersionMsg")
-		}
-		// 读取版本号
-		if err := pc.readRemoteVersionMsg(); err != nil {
-			log.Error("readRemoteVersionMsg")
-			pc.CloseConn()
-			return fmt.Errorf("readRemoteVersionMsg")
+		if err := pc.writeLocalVersionMsg(ourNodeInfo); err != nil {
+			return fmt.Errorf("writeLocalVersionMsg: %v", err)
 		}
-	} else {
 		// 读取版本号
-		if err := pc.readRemoteVersionMsg(); err != nil {
-			log.Error("readRemoteVersionMsg")
-			pc.CloseConn()
-			return fmt.Errorf("readRemoteVersionMsg")
+		if err := pc.readRemoteVersionMsg(ourNodeInfo); err != nil {
+			if err == ErrSelfConnect {
+				return err
+			}
+			return fmt.Errorf("readRemoteVersionMsg: %v", err)
 		}
-		// 发送版本号
-		if err := pc.writeLocalVersionMsg(); err != nil {
-			log.Error("writeLocalVersionMsg")
-			pc.CloseConn()
-			return fmt.Errorf("writeLocalVersionMsg")
+		if err := pc.writeMessage(wire.NewMsgVerAck()); err != nil {
+			return fmt.Errorf("writeVerAckMsg: %v", err)
 		}
+		return pc.readVerAckMsg()
 	}
 
-	// Remove deadline
-	if err := pc.conn.SetDeadline(time.Time{}); err != nil {
-		log.Error("Error removing deadline")
-		return fmt.Errorf("Error removing deadline")
+	// 读取版本号
+	if err := pc.readRemoteVersionMsg(ourNodeInfo); err != nil {
+		if err == ErrSelfConnect {
+			return err
+		}
+		return fmt.Errorf("readRemoteVersionMsg: %v", err)
+	}
+	// 发送版本号
+	if err := pc.writeLocalVersionMsg(ourNodeInfo); err != nil {
+		return fmt.Errorf("writeLocalVersionMsg: %v", err)
+	}
+	if err := pc.readVerAckMsg(); err != nil {
+		return err
+	}
+	if err := pc.writeMessage(wire.NewMsgVerAck()); err != nil {
+		return fmt.Errorf("writeVerAckMsg: %v", err)
 	}
-	stage <- pc
 	return nil
 }
 
-func (pc *PeerConn) readRemoteVersionMsg() error {
-	return nil
+// readMessage reads the next message from the connection.
+func (pc *PeerConn) readMessage() (wire.Message, error) {
+	msg, _, err := wire.ReadMessage(pc.conn, wire.ProtocolVersion, pc.config.magic)
+	return msg, err
 }
 
-func (pc *PeerConn) writeLocalVersionMsg() error {
+// writeMessage writes msg to the connection.
+func (pc *PeerConn) writeMessage(msg wire.Message) error {
+	return wire.WriteMessage(pc.conn, msg, wire.ProtocolVersion,
+		pc.config.magic)
+}
+
+// readRemoteVersionMsg reads the version message of the remote peer and
+// checks that it is compatible with the local node.  Incompatible peers are
+// sent a reject message explaining why before the error is returned.
+func (pc *PeerConn) readRemoteVersionMsg(ourNodeInfo *NodeInfo) error {
+	msg, err := pc.readMessage()
+	if err != nil {
+		return err
+	}
+	var versionMsg *wire.MsgVersion
+	switch m := msg.(type) {
+	case *wire.MsgVersion:
+		versionMsg = m
+	case *wire.MsgReject:
+		return fmt.Errorf("version rejected by peer: %v %s", m.Code,
+			m.Reason)
+	default:
+		return fmt.Errorf("expected %s message, received %s",
+			wire.CmdVersion, msg.Command())
+	}
+
+	nodeInfo, err := nodeInfoFromVersionMsg(versionMsg)
+	if err != nil {
+		pc.writeMessage(wire.NewMsgReject(wire.CmdVersion,
+			wire.RejectMalformed, err.Error()))
+		return err
+	}
+	if nodeInfo.ID != PubKeyToID(pc.remotePubKey) {
+		err := fmt.Errorf("node id %s does not match the authenticated "+
+			"key of the peer", nodeInfo.ID)
+		pc.writeMessage(wire.NewMsgReject(wire.CmdVersion,
+			wire.RejectInvalid, err.Error()))
+		return err
+	}
+	if pc.addr != nil && pc.addr.ID != "" && pc.addr.ID != nodeInfo.ID {
+		return fmt.Errorf("dialed node id %s, connected to %s",
+			pc.addr.ID, nodeInfo.ID)
+	}
+	if err := ourNodeInfo.CompatibleWith(nodeInfo); err != nil {
+		if err != ErrSelfConnect {
+			code := wire.RejectInvalid
+			if nodeInfo.ProtocolVersion < wire.MinProtocolVersion {
+				code = wire.RejectObsolete
+			}
+			pc.writeMessage(wire.NewMsgReject(wire.CmdVersion, code,
+				err.Error()))
+		}
+		return err
+	}
+
+	pc.nodeInfo = nodeInfo
 	return nil
 }
+
+// writeLocalVersionMsg sends the version message advertising the local node.
+func (pc *PeerConn) writeLocalVersionMsg(ourNodeInfo *NodeInfo) error {
+	return pc.writeMessage(ourNodeInfo.versionMsg())
+}
+
+// readVerAckMsg reads the verack message acknowledging the local version.  A
+// reject message sent instead is reported as the error.
+func (pc *PeerConn) readVerAckMsg() error {
+	msg, err := pc.readMessage()
+	if err != nil {
+		return fmt.Errorf("readVerAckMsg: %v", err)
+	}
+	switch m := msg.(type) {
+	case *wire.MsgVerAck:
+		return nil
+	case *wire.MsgReject:
+		return fmt.Errorf("version rejected by peer: %v %s", m.Code,
+			m.Reason)
+	}
+	return fmt.Errorf("expected %s message, received %s", wire.CmdVerAck,
+		msg.Command())
+}
@@ -0,0 +1,68 @@
+package p2p
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/blockchainservice/p2p/conn"
+	"github.com/blockchainservice/wire"
+)
+
+// PeerStats is a snapshot of the state and the traffic of a connected peer.
+type PeerStats struct {
+	ID         string
+	Addr       net.Addr
+	Inbound    bool
+	Persistent bool
+	Services   wire.ServiceFlag
+	UserAgent  string
+	BestHeight uint64
+	BanScore   uint32
+
+	// LastBlock and LastTx are when the peer last relayed a new block and
+	// a new transaction, zero if it never did.
+	LastBlock time.Time
+	LastTx    time.Time
+
+	// Conn is the state of the connection: its age, ping time, byte
+	// counters and rates, and the same per channel.
+	Conn conn.ConnectionStatus
+}
+
+// Stats returns a snapshot of the state and the traffic of the peer.
+func (pc *PeerConn) Stats() PeerStats {
+	stats := PeerStats{
+		ID:         pc.ID(),
+		Addr:       pc.RemoteAddr(),
+		Inbound:    !pc.IsOutbound(),
+		Persistent: pc.IsPersistent(),
+		BanScore:   pc.BanScore(),
+	}
+	if atomic.LoadInt64(&pc.lastBlockTime) != 0 {
+		stats.LastBlock = pc.LastBlockTime()
+	}
+	if atomic.LoadInt64(&pc.lastTxTime) != 0 {
+		stats.LastTx = pc.LastTxTime()
+	}
+	if info := pc.NodeInfo(); info != nil {
+		stats.Services = info.Services
+		stats.UserAgent = info.UserAgent
+		stats.BestHeight = info.BestHeight
+	}
+	if pc.mconn != nil {
+		stats.Conn = pc.Status()
+	}
+	return stats
+}
+
+// PeerStats returns a snapshot of the state and the traffic of each peer that
+// completed the handshake.
+func (m *Manage) PeerStats() []PeerStats {
+	peers := m.Peers()
+	stats := make([]PeerStats, 0, len(peers))
+	for _, p := range peers {
+		stats = append(stats, p.Stats())
+	}
+	return stats
+}
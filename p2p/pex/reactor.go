@@ -0,0 +1,579 @@
+package pex
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/p2p/conn"
+	"github.com/blockchainservice/wire"
+)
+
+const (
+	// PexChannel is the channel the getaddr and addr messages are
+	// exchanged on.
+	PexChannel byte = 0x20
+
+	// ReactorName is the name the reactor is registered under.
+	ReactorName = "PEX"
+
+	// peerStateKey is the key the state of a peer is stored under in the
+	// peer.
+	peerStateKey = "pex/peerState"
+
+	// defaultRequestInterval is how often the reactor checks whether the
+	// address book needs more addresses when the configuration does not
+	// say otherwise.
+	defaultRequestInterval = 30 * time.Second
+
+	// defaultCrawlInterval is how often a seed node dials addresses of its
+	// book when the configuration does not say otherwise.
+	defaultCrawlInterval = 30 * time.Second
+
+	// defaultCrawlBatch is the number of addresses a seed node dials per
+	// crawl when the configuration does not say otherwise.
+	defaultCrawlBatch = 8
+
+	// defaultSeedPeerTimeout is how long a seed node stays connected to a
+	// peer the address exchange did not complete with when the
+	// configuration does not say otherwise.
+	defaultSeedPeerTimeout = 30 * time.Second
+
+	// recrawlInterval is the minimum time between two dials of the same
+	// address by a seed node.
+	recrawlInterval = 10 * time.Minute
+
+	// seedRedialInterval is the minimum time between two dials of the
+	// seeds.
+	seedRedialInterval = 2 * time.Minute
+
+	// requestTimeout is the time after which a getaddr left unanswered is
+	// given up on.
+	requestTimeout = time.Minute
+
+	// minGetAddrInterval is the minimum time between two getaddr messages
+	// of a peer.  Requests arriving faster are ignored.
+	minGetAddrInterval = 10 * time.Minute
+
+	// maxTimeOffset is how far in the future the timestamp of an address
+	// may be.
+	maxTimeOffset = 10 * time.Minute
+
+	// seedDisconnectReason is the reason a seed node gives to the peers it
+	// disconnects after the address exchange.
+	seedDisconnectReason = "seed node, address exchange done"
+
+	// seedFlushTimeout bounds the time a seed node spends sending the
+	// queued messages to a peer it disconnects.
+	seedFlushTimeout = 5 * time.Second
+
+	// badPexBanScore is the decaying ban score given to a peer that misuses
+	// the address exchange, for example by sending addresses that were not
+	// requested or invalid ones.
+	badPexBanScore = 10
+)
+
+// Config is the configuration of a Reactor.
+type Config struct {
+	// SeedMode makes the node a seed: it crawls the network by dialing
+	// the addresses of its book and asking the peers for theirs, hands
+	// out addresses to the peers asking for them and disconnects every
+	// peer once the exchange is over.
+	SeedMode bool
+
+	// Seeds are the addresses of the form "host:port" or "id@host:port"
+	// of the seed nodes dialed when the address book needs more
+	// addresses and no connected peer can provide them.
+	Seeds []string
+
+	// RequestInterval is how often the reactor checks whether the address
+	// book needs more addresses.  It defaults to 30 seconds.
+	RequestInterval time.Duration
+
+	// CrawlInterval is how often a seed node dials addresses of its book.
+	// It defaults to 30 seconds.
+	CrawlInterval time.Duration
+
+	// CrawlBatch is the number of addresses a seed node dials per crawl.
+	// It defaults to 8.
+	CrawlBatch int
+
+	// SeedPeerTimeout is how long a seed node stays connected to a peer
+	// the address exchange did not complete with.  It defaults to 30
+	// seconds.
+	SeedPeerTimeout time.Duration
+}
+
+// peerState is the address exchange state of a peer.
+type peerState struct {
+	mtx       sync.Mutex
+	connected time.Time // when the peer was added
+	asked     bool      // a getaddr was sent to the peer
+	requested time.Time // when the unanswered getaddr was sent
+	answered  bool      // the peer answered the getaddr
+	served    time.Time // when the last getaddr of the peer was answered
+	leaving   bool      // a seed node is disconnecting the peer
+}
+
+// Reactor exchanges peer addresses with the peers.  The address book is
+// filled with the addresses of the outbound peers when it needs more, and
+// the peers asking for addresses get a random sample of it.  Each peer is
+// asked and answered at most once in a while and addresses are only accepted
+// as the answer to a request, so a peer cannot flood the address book.
+type Reactor struct {
+	p2p.BaseReactor
+
+	config Config
+	seeds  []*p2p.NetAddress
+
+	randMtx sync.Mutex
+	rand    *rand.Rand
+
+	// seedDialed is when the seeds were last dialed and crawled when the
+	// addresses were last dialed by a seed node.  They are only accessed
+	// by the routines of the reactor.
+	seedDialed time.Time
+	crawled    map[string]time.Time
+
+	started  int32
+	shutdown int32
+	wg       sync.WaitGroup
+	quit     chan struct{}
+
+	// stateMtx orders the routines spawned with the stop of the reactor.
+	stateMtx sync.Mutex
+	stopping bool
+}
+
+// NewReactor returns a peer exchange reactor.
+func NewReactor(config Config) (*Reactor, error) {
+	if config.RequestInterval <= 0 {
+		config.RequestInterval = defaultRequestInterval
+	}
+	if config.CrawlInterval <= 0 {
+		config.CrawlInterval = defaultCrawlInterval
+	}
+	if config.CrawlBatch <= 0 {
+		config.CrawlBatch = defaultCrawlBatch
+	}
+	if config.SeedPeerTimeout <= 0 {
+		config.SeedPeerTimeout = defaultSeedPeerTimeout
+	}
+	// The seeds are resolved when dialed, so the lookups go through the
+	// proxy when there is one.
+	seeds := make([]*p2p.NetAddress, 0, len(config.Seeds))
+	for _, s := range config.Seeds {
+		seed, err := p2p.NewNetAddressStringUnresolved(s)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+	return &Reactor{
+		BaseReactor: *p2p.NewBaseReactor(ReactorName),
+		config:      config,
+		seeds:       seeds,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		crawled:     make(map[string]time.Time),
+		quit:        make(chan struct{}),
+	}, nil
+}
+
+// Start starts requesting addresses periodically and, in seed mode,
+// crawling the network.
+func (r *Reactor) Start() {
+	if atomic.AddInt32(&r.started, 1) != 1 {
+		return
+	}
+	log.Trace("Starting peer exchange reactor")
+	r.wg.Add(1)
+	go r.ensurePeersRoutine()
+	if r.config.SeedMode {
+		r.wg.Add(1)
+		go r.crawlRoutine()
+	}
+}
+
+// Stop stops the routines of the reactor and waits for them to exit.
+func (r *Reactor) Stop() {
+	if atomic.AddInt32(&r.shutdown, 1) != 1 {
+		return
+	}
+	log.Info("Peer exchange reactor shutting down")
+	r.stateMtx.Lock()
+	r.stopping = true
+	r.stateMtx.Unlock()
+	close(r.quit)
+	r.wg.Wait()
+}
+
+// spawn runs f in a routine Stop waits for.  It returns false without running
+// f once the reactor is stopping.
+func (r *Reactor) spawn(f func()) bool {
+	r.stateMtx.Lock()
+	defer r.stateMtx.Unlock()
+	if r.stopping {
+		return false
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// GetChannels declares PexChannel.
+func (r *Reactor) GetChannels() []*conn.ChannelDescriptor {
+	return []*conn.ChannelDescriptor{{
+		ID:                PexChannel,
+		Priority:          1,
+		SendQueueCapacity: 10,
+		RecvMessageCapacity: wire.MessageHeaderSize +
+			int(wire.NewMsgAddr().MaxPayloadLength(wire.ProtocolVersion)),
+	}}
+}
+
+// InitPeer sets up the address exchange state of the peer.
+func (r *Reactor) InitPeer(p *p2p.PeerConn) {
+	p.Set(peerStateKey, &peerState{connected: time.Now()})
+}
+
+// AddPeer asks an outbound peer for addresses when the address book needs
+// more or the node is a seed.  Inbound peers are not asked since whoever
+// connects to the node could otherwise fill its address book.  A peer that
+// stopped already is ignored.
+func (r *Reactor) AddPeer(p *p2p.PeerConn) {
+	ps := getPeerState(p)
+	if ps == nil || !p.IsOutbound() || !p.IsRunning() {
+		return
+	}
+	if r.config.SeedMode || r.Manage.AddrManager().NeedMoreAddresses() {
+		r.requestAddrs(p, ps)
+	}
+}
+
+// getPeerState returns the address exchange state of the peer, nil when the
+// peer was not initialized by the reactor.
+func getPeerState(p *p2p.PeerConn) *peerState {
+	ps, _ := p.Get(peerStateKey).(*peerState)
+	return ps
+}
+
+// requestAddrs sends a getaddr to the peer unless it was already asked on
+// this connection.
+func (r *Reactor) requestAddrs(p *p2p.PeerConn, ps *peerState) {
+	ps.mtx.Lock()
+	if ps.asked {
+		ps.mtx.Unlock()
+		return
+	}
+	ps.asked = true
+	ps.requested = time.Now()
+	ps.mtx.Unlock()
+
+	log.Debugf("Requesting addresses from peer %s", p)
+	if !r.send(p, wire.NewMsgGetAddr()) {
+		ps.mtx.Lock()
+		ps.requested = time.Time{}
+		ps.mtx.Unlock()
+	}
+}
+
+// send queues msg for sending to the peer without blocking.
+func (r *Reactor) send(p *p2p.PeerConn, msg wire.Message) bool {
+	msgBytes, err := r.Manage.EncodeMessage(msg)
+	if err != nil {
+		log.Errorf("Failed to encode %s: %v", msg.Command(), err)
+		return false
+	}
+	return p.TrySend(PexChannel, msgBytes)
+}
+
+// Receive handles the messages of the peers.
+func (r *Reactor) Receive(chID byte, p *p2p.PeerConn, msgBytes []byte) {
+	ps := getPeerState(p)
+	if ps == nil {
+		return
+	}
+	msg, err := r.Manage.DecodeMessage(msgBytes)
+	if err != nil {
+		r.Manage.StopPeerForError(p, err)
+		return
+	}
+
+	switch msg := msg.(type) {
+	case *wire.MsgGetAddr:
+		r.handleGetAddr(p, ps)
+	case *wire.MsgAddr:
+		r.handleAddr(p, ps, msg)
+	default:
+		r.Manage.AddBanScore(p, 0, badPexBanScore,
+			"unexpected "+msg.Command()+" message on pex channel")
+	}
+}
+
+// handleGetAddr answers a getaddr of the peer with a random sample of the
+// address book.  A peer asking again too soon is penalized and ignored.  A
+// seed node disconnects the peer once answered.
+func (r *Reactor) handleGetAddr(p *p2p.PeerConn, ps *peerState) {
+	now := time.Now()
+	ps.mtx.Lock()
+	if !ps.served.IsZero() && now.Sub(ps.served) < minGetAddrInterval {
+		ps.mtx.Unlock()
+		r.Manage.AddBanScore(p, 0, badPexBanScore,
+			"getaddr sent too often")
+		return
+	}
+	ps.served = now
+	ps.mtx.Unlock()
+
+	book := r.Manage.AddrManager()
+	msg := wire.NewMsgAddr()
+	for _, addr := range book.AddressCache() {
+		if len(msg.AddrList) == wire.MaxAddrPerMsg {
+			break
+		}
+		// Addresses given by name, such as version 3 onion
+		// services, do not fit in the message.  See the
+		// documentation of p2p.Config.Proxy.
+		if addr.ID == p.ID() || addr.IP == nil {
+			continue
+		}
+		// The address was removed from the book since.
+		lastSeen := book.LastSeen(addr)
+		if lastSeen.IsZero() {
+			continue
+		}
+		msg.AddAddress(wire.NewNetAddressTimestamp(lastSeen, 0,
+			addr.IP, addr.Port))
+	}
+	log.Debugf("Sending %d addresses to peer %s", len(msg.AddrList), p)
+	r.send(p, msg)
+
+	if r.config.SeedMode && r.exchangeDone(p, ps) {
+		r.disconnect(p, ps)
+	}
+}
+
+// handleAddr adds the addresses the peer sent in answer to a getaddr to the
+// address book.  Addresses that were not requested are ignored and the peer
+// penalized, so a peer gets to fill the address book at most once per
+// connection.  A seed node disconnects the peer once the exchange is over.
+func (r *Reactor) handleAddr(p *p2p.PeerConn, ps *peerState,
+	msg *wire.MsgAddr) {
+
+	ps.mtx.Lock()
+	requested := !ps.requested.IsZero()
+	ps.requested = time.Time{}
+	if requested {
+		ps.answered = true
+	}
+	ps.mtx.Unlock()
+	if !requested {
+		r.Manage.AddBanScore(p, 0, badPexBanScore,
+			"unrequested addresses")
+		return
+	}
+
+	src := p2p.NewNetAddress(p.ID(), p.RemoteAddr())
+	self := r.Manage.ExternalAddr()
+	book := r.Manage.AddrManager()
+	maxTime := time.Now().Add(maxTimeOffset)
+	invalid := 0
+	for _, na := range msg.AddrList {
+		addr := p2p.NewNetAddressIPPort("", na.IP, na.Port)
+		if na.Port == 0 || na.Timestamp.After(maxTime) ||
+			!p2p.IsValid(addr) {
+
+			invalid++
+			continue
+		}
+		if self != nil && self.IP.Equal(na.IP) && self.Port == int(na.Port) {
+			continue
+		}
+		// The book keeps when the peer last heard of the address, so
+		// the addresses nobody heard of for long are evicted first.
+		book.AddAddressSeen(addr, src, na.Timestamp)
+	}
+	log.Debugf("Received %d addresses from peer %s, %d invalid",
+		len(msg.AddrList), p, invalid)
+	if invalid > 0 {
+		r.Manage.AddBanScore(p, 0, badPexBanScore,
+			"invalid addresses")
+	}
+
+	if r.config.SeedMode && r.exchangeDone(p, ps) {
+		r.disconnect(p, ps)
+	}
+}
+
+// exchangeDone returns whether a seed node is done with the peer: an
+// outbound peer answered the getaddr of the node, an inbound one was answered.
+func (r *Reactor) exchangeDone(p *p2p.PeerConn, ps *peerState) bool {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	if p.IsOutbound() {
+		return ps.answered
+	}
+	return !ps.served.IsZero()
+}
+
+// disconnect disconnects the peer after sending it the queued messages.
+func (r *Reactor) disconnect(p *p2p.PeerConn, ps *peerState) {
+	ps.mtx.Lock()
+	leaving := ps.leaving
+	ps.leaving = true
+	ps.mtx.Unlock()
+	if leaving {
+		return
+	}
+
+	log.Debugf("Disconnecting peer %s after the address exchange", p)
+	r.spawn(func() {
+		p.FlushStop(seedDisconnectReason, seedFlushTimeout)
+		r.Manage.StopPeerGracefully(p)
+	})
+}
+
+// ensurePeersRoutine periodically asks a peer for addresses when the address
+// book needs more.  Seeds are dialed when no connected peer is left to ask.
+func (r *Reactor) ensurePeersRoutine() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.config.RequestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.ensurePeers()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// ensurePeers gives up on the unanswered requests, disconnects the peers a
+// seed node is done with and asks a random outbound peer not asked yet for
+// addresses when the address book needs more.
+func (r *Reactor) ensurePeers() {
+	now := time.Now()
+	var candidates []*p2p.PeerConn
+	for _, p := range r.Manage.Peers() {
+		ps := getPeerState(p)
+		if ps == nil {
+			continue
+		}
+		ps.mtx.Lock()
+		if !ps.requested.IsZero() && now.Sub(ps.requested) > requestTimeout {
+			log.Debugf("Peer %s did not answer getaddr", p)
+			ps.requested = time.Time{}
+		}
+		expired := now.Sub(ps.connected) > r.config.SeedPeerTimeout
+		asked := ps.asked
+		ps.mtx.Unlock()
+
+		if r.config.SeedMode && expired {
+			r.disconnect(p, ps)
+			continue
+		}
+		if p.IsOutbound() && !asked {
+			candidates = append(candidates, p)
+		}
+	}
+
+	book := r.Manage.AddrManager()
+	if r.config.SeedMode || !book.NeedMoreAddresses() {
+		return
+	}
+	if len(candidates) > 0 {
+		p := candidates[r.intn(len(candidates))]
+		r.requestAddrs(p, getPeerState(p))
+		return
+	}
+	if len(r.seeds) > 0 && now.Sub(r.seedDialed) > seedRedialInterval {
+		r.seedDialed = now
+		seed := r.seeds[r.intn(len(r.seeds))]
+		log.Infof("Address book needs more addresses, dialing seed %s",
+			seed)
+		r.spawn(func() { r.dial(seed) })
+	}
+}
+
+// crawlRoutine periodically dials addresses of the address book so a seed
+// node learns the addresses of their peers.
+func (r *Reactor) crawlRoutine() {
+	defer r.wg.Done()
+	r.crawl()
+	ticker := time.NewTicker(r.config.CrawlInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.crawl()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// crawl dials up to CrawlBatch addresses of the address book not dialed
+// recently, falling back to the seeds while the book is empty.
+func (r *Reactor) crawl() {
+	now := time.Now()
+	for key, t := range r.crawled {
+		if now.Sub(t) > recrawlInterval {
+			delete(r.crawled, key)
+		}
+	}
+
+	book := r.Manage.AddrManager()
+	if book.NumAddresses() == 0 {
+		if now.Sub(r.seedDialed) > seedRedialInterval {
+			r.seedDialed = now
+			for _, seed := range r.seeds {
+				seed := seed
+				r.spawn(func() { r.dial(seed) })
+			}
+		}
+		return
+	}
+
+	self := r.Manage.NodeInfo().ID
+	picked := make(map[string]struct{})
+	for tries := 0; len(picked) < r.config.CrawlBatch && tries < 100; tries++ {
+		ka := book.GetAddress()
+		if ka == nil {
+			break
+		}
+		addr := ka.NetAddress()
+		key := p2p.NetAddressKey(addr)
+		if _, ok := r.crawled[key]; ok || addr.ID == self {
+			continue
+		}
+		if addr.ID != "" && r.Manage.Peer(addr.ID) != nil {
+			continue
+		}
+		picked[key] = struct{}{}
+		r.crawled[key] = now
+		r.spawn(func() { r.dial(addr) })
+	}
+	log.Debugf("Crawling %d addresses of %d known", len(picked),
+		book.NumAddresses())
+}
+
+// dial dials the address and logs the failure.
+func (r *Reactor) dial(addr *p2p.NetAddress) {
+	err := r.Manage.DialPeerWithAddress(addr, false)
+	if err != nil {
+		log.Debugf("Failed to dial %s: %v", addr, err)
+	}
+}
+
+// intn returns a random number in [0, n).
+func (r *Reactor) intn(n int) int {
+	r.randMtx.Lock()
+	defer r.randMtx.Unlock()
+	return r.rand.Intn(n)
+}
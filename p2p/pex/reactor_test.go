@@ -0,0 +1,247 @@
+package pex
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/wire"
+)
+
+// peerRecorder is a reactor remembering the peers it was given.
+type peerRecorder struct {
+	p2p.BaseReactor
+
+	mtx     sync.Mutex
+	added   map[string]bool
+	removed map[string]bool
+}
+
+func newPeerRecorder() *peerRecorder {
+	return &peerRecorder{
+		BaseReactor: *p2p.NewBaseReactor("RECORDER"),
+		added:       make(map[string]bool),
+		removed:     make(map[string]bool),
+	}
+}
+
+func (r *peerRecorder) AddPeer(p *p2p.PeerConn) {
+	r.mtx.Lock()
+	r.added[p.ID()] = true
+	r.mtx.Unlock()
+}
+
+func (r *peerRecorder) RemovePeer(p *p2p.PeerConn, reason interface{}) {
+	r.mtx.Lock()
+	r.removed[p.ID()] = true
+	r.mtx.Unlock()
+}
+
+// seen returns whether the peer with the given ID was added and removed.
+func (r *peerRecorder) seen(id string) (bool, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.added[id], r.removed[id]
+}
+
+// newPexNet returns a started TestNet of n nodes running a peer exchange
+// reactor configured by configure, when not nil, and a peerRecorder.
+func newPexNet(t *testing.T, n int, configure func(i int, config *Config)) (*p2p.TestNet, []*Reactor, []*peerRecorder) {
+	t.Helper()
+	reactors := make([]*Reactor, n)
+	recorders := make([]*peerRecorder, n)
+	setup := func(i int, m *p2p.Manage) error {
+		var config Config
+		if configure != nil {
+			configure(i, &config)
+		}
+		r, err := NewReactor(config)
+		if err != nil {
+			return err
+		}
+		reactors[i] = r
+		recorders[i] = newPeerRecorder()
+		if err := m.AddReactor(ReactorName, r); err != nil {
+			return err
+		}
+		return m.AddReactor("RECORDER", recorders[i])
+	}
+	tn, err := p2p.NewTestNet(n, 1, nil, setup)
+	if err != nil {
+		t.Fatalf("NewTestNet: %v", err)
+	}
+	tn.Start()
+	for _, r := range reactors {
+		r.Start()
+	}
+	t.Cleanup(func() {
+		for _, r := range reactors {
+			r.Stop()
+		}
+		tn.Stop()
+	})
+	return tn, reactors, recorders
+}
+
+// testAddr returns the address of a node outside the TestNet.
+func testAddr(i int) *p2p.NetAddress {
+	return p2p.NewNetAddressIPPort("", net.IPv4(10, 200, byte(i>>8),
+		byte(i)), 18444)
+}
+
+// waitFor waits until cond holds or fails the test after timeout.
+func waitFor(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not done after %v", what, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPexRequestLimits ensures an outbound peer is asked for addresses once,
+// gets a sample of the address book with the times the addresses were last
+// heard of and is penalized for asking again too soon.
+func TestPexRequestLimits(t *testing.T) {
+	const numAddrs = 100
+	tn, reactors, _ := newPexNet(t, 2, nil)
+	lastSeen := time.Unix(time.Now().Add(-48*time.Hour).Unix(), 0)
+	src := tn.Addr(1)
+	for i := 0; i < numAddrs; i++ {
+		tn.Nodes[1].AddrManager().AddAddressSeen(testAddr(i), src,
+			lastSeen)
+	}
+
+	if err := tn.Connect(0, 1); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	book := tn.Nodes[0].AddrManager()
+	// The peer hands out 23 percent of its book, which holds part of the
+	// addresses since they are all in the same network group.
+	want := tn.Nodes[1].AddrManager().NumAddresses() * 23 / 100
+	waitFor(t, "address exchange", 5*time.Second, func() bool {
+		return book.NumAddresses() >= want
+	})
+
+	received := 0
+	for i := 0; i < numAddrs; i++ {
+		seen := book.LastSeen(testAddr(i))
+		if seen.IsZero() {
+			continue
+		}
+		received++
+		if !seen.Equal(lastSeen) {
+			t.Errorf("address %v last seen %v, want %v", testAddr(i),
+				seen, lastSeen)
+		}
+	}
+	if received != want {
+		t.Errorf("%d addresses received, want %d", received, want)
+	}
+
+	// The inbound peer is not asked and a second request of the outbound
+	// peer is not answered.
+	var p0, p1 *p2p.PeerConn
+	waitFor(t, "connection", 5*time.Second, func() bool {
+		p0 = tn.Nodes[1].Peer(tn.Addr(0).ID)
+		p1 = tn.Nodes[0].Peer(tn.Addr(1).ID)
+		return p0 != nil && p1 != nil
+	})
+	ps := getPeerState(p0)
+	ps.mtx.Lock()
+	asked := ps.asked
+	ps.mtx.Unlock()
+	if asked {
+		t.Error("inbound peer asked for addresses")
+	}
+	if p0.BanScore() != 0 {
+		t.Fatalf("ban score %d after the exchange, want 0", p0.BanScore())
+	}
+	if !reactors[0].send(p1, wire.NewMsgGetAddr()) {
+		t.Fatal("getaddr not sent")
+	}
+	waitFor(t, "ban score increase", 5*time.Second, func() bool {
+		return p0.BanScore() > 0
+	})
+}
+
+// TestPexUnrequestedAddrs ensures addresses a peer sends without being asked
+// are dropped and the peer is penalized.
+func TestPexUnrequestedAddrs(t *testing.T) {
+	tn, reactors, _ := newPexNet(t, 2, nil)
+	if err := tn.Connect(0, 1); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	var p0, p1 *p2p.PeerConn
+	waitFor(t, "connection", 5*time.Second, func() bool {
+		p0 = tn.Nodes[1].Peer(tn.Addr(0).ID)
+		p1 = tn.Nodes[0].Peer(tn.Addr(1).ID)
+		return p0 != nil && p1 != nil
+	})
+
+	msg := wire.NewMsgAddr()
+	for i := 0; i < 10; i++ {
+		addr := testAddr(i)
+		msg.AddAddress(wire.NewNetAddressIPPort(addr.IP, addr.Port, 0))
+	}
+	if !reactors[0].send(p1, msg) {
+		t.Fatal("addr not sent")
+	}
+	waitFor(t, "ban score increase", 5*time.Second, func() bool {
+		return p0.BanScore() > 0
+	})
+	if n := tn.Nodes[1].AddrManager().NumAddresses(); n != 0 {
+		t.Errorf("%d unrequested addresses added to the book", n)
+	}
+}
+
+// TestPexSeedCrawl ensures a seed node dials the addresses of its book, learns
+// the addresses the peers know and dials them in turn, disconnecting every
+// peer once the exchange is over.
+func TestPexSeedCrawl(t *testing.T) {
+	// Node 0 is the seed, it knows node 1 which knows the nodes 2 to 6.
+	// Node 1 hands out 23 percent of them, one node.
+	const numNodes = 7
+	tn, _, recorders := newPexNet(t, numNodes, func(i int, config *Config) {
+		if i == 0 {
+			config.SeedMode = true
+			config.CrawlInterval = 50 * time.Millisecond
+		}
+	})
+	for i := 2; i < numNodes; i++ {
+		tn.Nodes[1].AddrManager().AddAddress(tn.Addr(i), tn.Addr(1))
+	}
+	tn.Nodes[0].AddrManager().AddAddress(tn.Addr(1), tn.Addr(0))
+
+	seed := tn.Addr(0).ID
+	crawled := func(i int) bool {
+		added, _ := recorders[i].seen(seed)
+		return added
+	}
+	waitFor(t, "crawl of node 1", 5*time.Second, func() bool {
+		return crawled(1)
+	})
+	waitFor(t, "crawl of the nodes known to node 1", 5*time.Second,
+		func() bool {
+			for i := 2; i < numNodes; i++ {
+				if crawled(i) {
+					return true
+				}
+			}
+			return false
+		})
+
+	for i := 1; i < numNodes; i++ {
+		if !crawled(i) {
+			continue
+		}
+		waitFor(t, "disconnection by the seed", 5*time.Second, func() bool {
+			_, removed := recorders[i].seen(seed)
+			return removed
+		})
+	}
+}
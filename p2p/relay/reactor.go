@@ -0,0 +1,594 @@
+package relay
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/p2p/conn"
+	"github.com/blockchainservice/wire"
+)
+
+const (
+	// InvChannel is the channel the inv, getdata and notfound messages are
+	// exchanged on.
+	InvChannel byte = 0x30
+
+	// DataChannel is the channel the blocks and transactions are delivered
+	// on.
+	DataChannel byte = 0x31
+
+	// ReactorName is the name the reactor is registered under.
+	ReactorName = "RELAY"
+
+	// peerStateKey is the key the state of a peer is stored under in the
+	// peer.
+	peerStateKey = "relay/peerState"
+
+	// maxKnownInventory is the maximum number of items remembered as known
+	// to a peer.
+	maxKnownInventory = 1000
+
+	// maxRecentRejects is the maximum number of rejected items remembered
+	// so they are not requested again.
+	maxRecentRejects = 1000
+
+	// maxRequestsPerPeer is the maximum number of items requested from a
+	// peer and not delivered yet.
+	maxRequestsPerPeer = 1000
+
+	// maxPendingGetData is the maximum number of items a peer may request
+	// from the local node before they are served.
+	maxPendingGetData = wire.MaxInvPerMsg
+
+	// requestTimeout is the time after which an item requested from a peer
+	// and not delivered is requested from another peer announcing it.
+	requestTimeout = time.Minute
+
+	// defaultTrickleInterval is the mean delay between the transaction
+	// announcements to an inbound peer.  Outbound peers get them twice as
+	// often.
+	defaultTrickleInterval = 5 * time.Second
+
+	// invalidDataBanScore is the persistent ban score given to a peer that
+	// delivers an invalid block or transaction.
+	invalidDataBanScore = 100
+
+	// badRelayBanScore is the decaying ban score given to a peer that
+	// misuses the relay protocol, for example by delivering an item that
+	// was not requested.
+	badRelayBanScore = 10
+)
+
+// Store is where the reactor looks up and submits the blocks and
+// transactions it relays, usually the chain and the memory pool.
+type Store interface {
+	// HaveBlock returns whether the block is known.
+	HaveBlock(hash *common.Hash) bool
+
+	// HaveTx returns whether the transaction is known.
+	HaveTx(hash *common.Hash) bool
+
+	// Block returns the block, nil when it is unknown.
+	Block(hash *common.Hash) *common.Block
+
+	// Tx returns the transaction, nil when it is unknown.
+	Tx(hash *common.Hash) *common.Tx
+
+	// ProcessBlock validates and accepts a block received from a peer.  It
+	// returns whether the block is new and valid, in which case it is
+	// relayed to the other peers, and an error when it is invalid.
+	ProcessBlock(block *common.Block) (bool, error)
+
+	// ProcessTx validates and accepts a transaction received from a peer.
+	// It returns whether the transaction is new and valid, in which case it
+	// is relayed to the other peers, and an error when it is invalid.
+	ProcessTx(tx *common.Tx) (bool, error)
+}
+
+// Config is the configuration of a Reactor.
+type Config struct {
+	// TrickleInterval is the mean delay between the transaction
+	// announcements to an inbound peer.  The delays are randomized so the
+	// peers cannot tell which node a transaction originates from by the
+	// time it is announced.  Outbound peers get the announcements twice as
+	// often.  It defaults to 5 seconds.
+	TrickleInterval time.Duration
+}
+
+// request is an item requested from a peer.
+type request struct {
+	peer *p2p.PeerConn
+	time time.Time
+}
+
+// peerState is the relay state of a peer.
+type peerState struct {
+	// known is the inventory the peer is known to have.  Nothing in it is
+	// announced to the peer.
+	known *mruInventoryMap
+
+	mtx       sync.Mutex
+	outMsgs   []wire.Message  // messages to send as soon as possible
+	txInvs    []*wire.InvVect // transactions to announce at the next trickle
+	getData   []*wire.InvVect // items requested by the peer
+	requested int             // items requested from the peer
+	wake      chan struct{}   // signals outMsgs or getData are not empty
+	quit      chan struct{}
+}
+
+// queueMsg queues msg for sending to the peer.
+func (ps *peerState) queueMsg(msg wire.Message) {
+	ps.mtx.Lock()
+	ps.outMsgs = append(ps.outMsgs, msg)
+	ps.mtx.Unlock()
+	ps.signal()
+}
+
+// signal wakes up the routine sending to the peer.
+func (ps *peerState) signal() {
+	select {
+	case ps.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Reactor relays blocks and transactions between the peers.  New items are
+// announced with inv messages to the peers not known to have them and
+// delivered on request with getdata.  Blocks are announced to all peers at
+// once while transaction announcements are trickled with random delays.
+type Reactor struct {
+	p2p.BaseReactor
+
+	store  Store
+	config Config
+
+	reqMtx        sync.Mutex
+	requested     map[wire.InvVect]*request
+	recentRejects *mruInventoryMap
+
+	randMtx sync.Mutex
+	rand    *rand.Rand
+}
+
+// NewReactor returns a relay reactor submitting the items it receives to
+// store.
+func NewReactor(store Store, config Config) *Reactor {
+	if config.TrickleInterval <= 0 {
+		config.TrickleInterval = defaultTrickleInterval
+	}
+	return &Reactor{
+		BaseReactor:   *p2p.NewBaseReactor(ReactorName),
+		store:         store,
+		config:        config,
+		requested:     make(map[wire.InvVect]*request),
+		recentRejects: newMruInventoryMap(maxRecentRejects),
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// GetChannels declares InvChannel and DataChannel.
+func (r *Reactor) GetChannels() []*conn.ChannelDescriptor {
+	return []*conn.ChannelDescriptor{{
+		ID:                InvChannel,
+		Priority:          5,
+		SendQueueCapacity: 10,
+	}, {
+		ID:                  DataChannel,
+		Priority:            3,
+		SendQueueCapacity:   10,
+		RecvMessageCapacity: wire.MessageHeaderSize + common.MaxBlockPayload,
+	}}
+}
+
+// InitPeer sets up the relay state of the peer.
+func (r *Reactor) InitPeer(p *p2p.PeerConn) {
+	p.Set(peerStateKey, &peerState{
+		known: newMruInventoryMap(maxKnownInventory),
+		wake:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+	})
+}
+
+// AddPeer starts the routine sending to the peer.  A peer that stopped
+// already is ignored.
+func (r *Reactor) AddPeer(p *p2p.PeerConn) {
+	ps := getPeerState(p)
+	if ps == nil || !p.IsRunning() {
+		return
+	}
+	go r.sendRoutine(p, ps)
+}
+
+// RemovePeer stops the routine sending to the peer and forgets the items
+// requested from it, so they are requested from the next peer announcing
+// them.
+func (r *Reactor) RemovePeer(p *p2p.PeerConn, reason interface{}) {
+	ps := getPeerState(p)
+	if ps == nil {
+		return
+	}
+	close(ps.quit)
+
+	r.reqMtx.Lock()
+	for iv, req := range r.requested {
+		if req.peer == p {
+			delete(r.requested, iv)
+		}
+	}
+	r.reqMtx.Unlock()
+}
+
+// getPeerState returns the relay state of the peer, nil when the peer was
+// not initialized by the reactor.
+func getPeerState(p *p2p.PeerConn) *peerState {
+	ps, _ := p.Get(peerStateKey).(*peerState)
+	return ps
+}
+
+// RelayBlock announces block to all peers not known to have it.
+func (r *Reactor) RelayBlock(block *common.Block) {
+	hash := block.BlockHash()
+	iv := wire.NewInvVect(wire.InvTypeBlock, &hash)
+	for _, p := range r.Manage.Peers() {
+		ps := getPeerState(p)
+		if ps == nil || !ps.known.Add(iv) {
+			continue
+		}
+		msg := wire.NewMsgInv()
+		msg.AddInvVect(iv)
+		ps.queueMsg(msg)
+	}
+}
+
+// RelayTx queues the announcement of tx to all peers not known to have it
+// for their next trickle.
+func (r *Reactor) RelayTx(tx *common.Tx) {
+	hash := tx.TxHash()
+	iv := wire.NewInvVect(wire.InvTypeTx, &hash)
+	for _, p := range r.Manage.Peers() {
+		ps := getPeerState(p)
+		if ps == nil || ps.known.Exists(iv) {
+			continue
+		}
+		ps.mtx.Lock()
+		if len(ps.txInvs) < wire.MaxInvPerMsg {
+			ps.txInvs = append(ps.txInvs, iv)
+		}
+		ps.mtx.Unlock()
+	}
+}
+
+// Receive handles the messages of the peers.
+func (r *Reactor) Receive(chID byte, p *p2p.PeerConn, msgBytes []byte) {
+	ps := getPeerState(p)
+	if ps == nil {
+		return
+	}
+	msg, err := r.Manage.DecodeMessage(msgBytes)
+	if err != nil {
+		r.Manage.StopPeerForError(p, err)
+		return
+	}
+	log.Tracef("Received %s from peer %s", msg.Command(), p)
+
+	switch msg := msg.(type) {
+	case *wire.MsgInv:
+		if chID == InvChannel {
+			r.handleInv(p, ps, msg)
+			return
+		}
+	case *wire.MsgGetData:
+		if chID == InvChannel {
+			r.handleGetData(p, ps, msg)
+			return
+		}
+	case *wire.MsgNotFound:
+		if chID == InvChannel {
+			r.handleNotFound(p, ps, msg)
+			return
+		}
+	case *wire.MsgBlock:
+		if chID == DataChannel {
+			r.handleBlock(p, ps, &msg.Block)
+			return
+		}
+	case *wire.MsgTx:
+		if chID == DataChannel {
+			r.handleTx(p, ps, &msg.Tx)
+			return
+		}
+	}
+	r.Manage.AddBanScore(p, 0, badRelayBanScore, "unexpected "+
+		msg.Command()+" message on relay channel")
+}
+
+// handleInv requests the announced items the node does not have and did not
+// request from another peer already.
+func (r *Reactor) handleInv(p *p2p.PeerConn, ps *peerState, msg *wire.MsgInv) {
+	getData := wire.NewMsgGetData()
+	now := time.Now()
+
+	r.reqMtx.Lock()
+	for _, iv := range msg.InvList {
+		ps.known.Add(iv)
+
+		switch iv.Type {
+		case wire.InvTypeBlock:
+			if r.store.HaveBlock(&iv.Hash) {
+				continue
+			}
+		case wire.InvTypeTx:
+			if r.store.HaveTx(&iv.Hash) {
+				continue
+			}
+		default:
+			continue
+		}
+		if r.recentRejects.Exists(iv) {
+			continue
+		}
+		if req, ok := r.requested[*iv]; ok {
+			if now.Sub(req.time) < requestTimeout {
+				continue
+			}
+			r.forgetRequest(iv, req)
+		}
+
+		ps.mtx.Lock()
+		full := ps.requested >= maxRequestsPerPeer
+		if !full {
+			ps.requested++
+		}
+		ps.mtx.Unlock()
+		if full {
+			break
+		}
+		r.requested[*iv] = &request{peer: p, time: now}
+		getData.AddInvVect(iv)
+	}
+	r.reqMtx.Unlock()
+
+	if len(getData.InvList) > 0 {
+		ps.queueMsg(getData)
+	}
+}
+
+// handleGetData queues the requested items for delivery by the routine
+// sending to the peer.
+func (r *Reactor) handleGetData(p *p2p.PeerConn, ps *peerState,
+	msg *wire.MsgGetData) {
+
+	ps.mtx.Lock()
+	full := len(ps.getData)+len(msg.InvList) > maxPendingGetData
+	if !full {
+		ps.getData = append(ps.getData, msg.InvList...)
+	}
+	ps.mtx.Unlock()
+	if full {
+		r.Manage.AddBanScore(p, 0, badRelayBanScore,
+			"too many pending getdata requests")
+		return
+	}
+	ps.signal()
+}
+
+// handleNotFound forgets the items the peer does not have, so they are
+// requested from the next peer announcing them.
+func (r *Reactor) handleNotFound(p *p2p.PeerConn, ps *peerState,
+	msg *wire.MsgNotFound) {
+
+	r.reqMtx.Lock()
+	for _, iv := range msg.InvList {
+		if req, ok := r.requested[*iv]; ok && req.peer == p {
+			r.forgetRequest(iv, req)
+		}
+	}
+	r.reqMtx.Unlock()
+}
+
+// handleBlock submits a block delivered by the peer to the store and relays
+// it when it is new.
+func (r *Reactor) handleBlock(p *p2p.PeerConn, ps *peerState,
+	block *common.Block) {
+
+	hash := block.BlockHash()
+	iv := wire.NewInvVect(wire.InvTypeBlock, &hash)
+	ps.known.Add(iv)
+	if !r.takeRequest(p, iv) {
+		r.Manage.AddBanScore(p, 0, badRelayBanScore,
+			"unrequested block "+hash.String())
+		return
+	}
+
+	isNew, err := r.store.ProcessBlock(block)
+	if err != nil {
+		r.recentRejects.Add(iv)
+		r.Manage.AddBanScore(p, invalidDataBanScore, 0,
+			"invalid block "+hash.String()+": "+err.Error())
+		return
+	}
+	if !isNew {
+		return
+	}
+	log.Debugf("Accepted block %s from peer %s", hash, p)
+	p.MarkBlockRelayed()
+	r.RelayBlock(block)
+}
+
+// handleTx submits a transaction delivered by the peer to the store and
+// relays it when it is new.
+func (r *Reactor) handleTx(p *p2p.PeerConn, ps *peerState, tx *common.Tx) {
+	hash := tx.TxHash()
+	iv := wire.NewInvVect(wire.InvTypeTx, &hash)
+	ps.known.Add(iv)
+	if !r.takeRequest(p, iv) {
+		r.Manage.AddBanScore(p, 0, badRelayBanScore,
+			"unrequested transaction "+hash.String())
+		return
+	}
+
+	isNew, err := r.store.ProcessTx(tx)
+	if err != nil {
+		r.recentRejects.Add(iv)
+		r.Manage.AddBanScore(p, invalidDataBanScore, 0,
+			"invalid transaction "+hash.String()+": "+err.Error())
+		return
+	}
+	if !isNew {
+		return
+	}
+	log.Debugf("Accepted transaction %s from peer %s", hash, p)
+	p.MarkTxRelayed()
+	r.RelayTx(tx)
+}
+
+// takeRequest forgets the request of iv from the peer.  It returns whether
+// there was one.
+func (r *Reactor) takeRequest(p *p2p.PeerConn, iv *wire.InvVect) bool {
+	r.reqMtx.Lock()
+	defer r.reqMtx.Unlock()
+
+	req, ok := r.requested[*iv]
+	if !ok || req.peer != p {
+		return false
+	}
+	r.forgetRequest(iv, req)
+	return true
+}
+
+// forgetRequest removes the request of iv.  reqMtx must be held.
+func (r *Reactor) forgetRequest(iv *wire.InvVect, req *request) {
+	delete(r.requested, *iv)
+	if ps := getPeerState(req.peer); ps != nil {
+		ps.mtx.Lock()
+		ps.requested--
+		ps.mtx.Unlock()
+	}
+}
+
+// trickleDelay returns a random delay until the next transaction
+// announcements to the peer.  The delays are exponentially distributed so
+// the announcements of the peers are independent of each other.
+func (r *Reactor) trickleDelay(p *p2p.PeerConn) time.Duration {
+	mean := r.config.TrickleInterval
+	if p.IsOutbound() {
+		mean /= 2
+	}
+	r.randMtx.Lock()
+	delay := time.Duration(r.rand.ExpFloat64() * float64(mean))
+	r.randMtx.Unlock()
+	return delay
+}
+
+// sendRoutine sends the queued messages, the requested items and the
+// trickled transaction announcements to the peer until it is removed.
+func (r *Reactor) sendRoutine(p *p2p.PeerConn, ps *peerState) {
+	trickle := time.NewTimer(r.trickleDelay(p))
+	defer trickle.Stop()
+
+	for {
+		select {
+		case <-ps.wake:
+			ps.mtx.Lock()
+			msgs, getData := ps.outMsgs, ps.getData
+			ps.outMsgs, ps.getData = nil, nil
+			ps.mtx.Unlock()
+
+			for _, msg := range msgs {
+				if !r.send(p, InvChannel, msg) {
+					return
+				}
+			}
+			if !r.serveGetData(p, ps, getData) {
+				return
+			}
+
+		case <-trickle.C:
+			if !r.sendTxInvs(p, ps) {
+				return
+			}
+			trickle.Reset(r.trickleDelay(p))
+
+		case <-ps.quit:
+			return
+		}
+	}
+}
+
+// serveGetData delivers the requested items to the peer and tells it which
+// ones the node does not have.  It returns false when the peer is gone.
+func (r *Reactor) serveGetData(p *p2p.PeerConn, ps *peerState,
+	getData []*wire.InvVect) bool {
+
+	notFound := wire.NewMsgNotFound()
+	for _, iv := range getData {
+		var msg wire.Message
+		switch iv.Type {
+		case wire.InvTypeBlock:
+			if block := r.store.Block(&iv.Hash); block != nil {
+				msg = wire.NewMsgBlock(block)
+			}
+		case wire.InvTypeTx:
+			if tx := r.store.Tx(&iv.Hash); tx != nil {
+				msg = wire.NewMsgTx(tx)
+			}
+		}
+		if msg == nil {
+			notFound.AddInvVect(iv)
+			continue
+		}
+		ps.known.Add(iv)
+		if !r.send(p, DataChannel, msg) {
+			return false
+		}
+	}
+	if len(notFound.InvList) > 0 {
+		return r.send(p, InvChannel, notFound)
+	}
+	return true
+}
+
+// sendTxInvs announces the trickled transactions the peer is not known to
+// have.  They are shuffled so their order does not reveal when the node
+// learnt of them.  It returns false when the peer is gone.
+func (r *Reactor) sendTxInvs(p *p2p.PeerConn, ps *peerState) bool {
+	ps.mtx.Lock()
+	txInvs := ps.txInvs
+	ps.txInvs = nil
+	ps.mtx.Unlock()
+
+	r.randMtx.Lock()
+	r.rand.Shuffle(len(txInvs), func(i, j int) {
+		txInvs[i], txInvs[j] = txInvs[j], txInvs[i]
+	})
+	r.randMtx.Unlock()
+
+	msg := wire.NewMsgInv()
+	for _, iv := range txInvs {
+		if ps.known.Add(iv) {
+			msg.AddInvVect(iv)
+		}
+	}
+	if len(msg.InvList) == 0 {
+		return true
+	}
+	return r.send(p, InvChannel, msg)
+}
+
+// send encodes msg and sends it to the peer on channel chID.  It returns
+// false when the peer is gone.
+func (r *Reactor) send(p *p2p.PeerConn, chID byte, msg wire.Message) bool {
+	msgBytes, err := r.Manage.EncodeMessage(msg)
+	if err != nil {
+		log.Errorf("Failed to encode %s message: %v", msg.Command(), err)
+		return true
+	}
+	if !p.Send(chID, msgBytes) {
+		log.Debugf("Failed to send %s message to peer %s", msg.Command(), p)
+		return p.IsRunning()
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+package relay
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/p2p"
+	"github.com/blockchainservice/wire"
+)
+
+// memStore is a Store held in memory accepting every block and transaction.
+// It counts the items it serves and processes.
+type memStore struct {
+	mtx       sync.Mutex
+	blocks    map[common.Hash]*common.Block
+	txs       map[common.Hash]*common.Tx
+	served    int
+	processed int
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		blocks: make(map[common.Hash]*common.Block),
+		txs:    make(map[common.Hash]*common.Tx),
+	}
+}
+
+func (s *memStore) HaveBlock(hash *common.Hash) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.blocks[*hash]
+	return ok
+}
+
+func (s *memStore) HaveTx(hash *common.Hash) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.txs[*hash]
+	return ok
+}
+
+func (s *memStore) Block(hash *common.Hash) *common.Block {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.served++
+	return s.blocks[*hash]
+}
+
+func (s *memStore) Tx(hash *common.Hash) *common.Tx {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.served++
+	return s.txs[*hash]
+}
+
+func (s *memStore) ProcessBlock(block *common.Block) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.processed++
+	hash := block.BlockHash()
+	if _, ok := s.blocks[hash]; ok {
+		return false, nil
+	}
+	s.blocks[hash] = block
+	return true, nil
+}
+
+func (s *memStore) ProcessTx(tx *common.Tx) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.processed++
+	hash := tx.TxHash()
+	if _, ok := s.txs[hash]; ok {
+		return false, nil
+	}
+	s.txs[hash] = tx
+	return true, nil
+}
+
+// stats returns the number of items served and processed.
+func (s *memStore) stats() (int, int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.served, s.processed
+}
+
+// invCounter is a relay reactor counting the inv messages it receives.
+type invCounter struct {
+	*Reactor
+
+	mtx  sync.Mutex
+	invs []int // number of items of every inv received
+}
+
+func (r *invCounter) Receive(chID byte, p *p2p.PeerConn, msgBytes []byte) {
+	msg, err := r.Manage.DecodeMessage(msgBytes)
+	if err == nil {
+		if inv, ok := msg.(*wire.MsgInv); ok {
+			r.mtx.Lock()
+			r.invs = append(r.invs, len(inv.InvList))
+			r.mtx.Unlock()
+		}
+	}
+	r.Reactor.Receive(chID, p, msgBytes)
+}
+
+// received returns the number of items of every inv received.
+func (r *invCounter) received() []int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]int(nil), r.invs...)
+}
+
+// newRelayNet returns a started TestNet of n nodes whose relay reactors
+// trickle the transactions every trickleInterval on average.  The reactors
+// count the inv messages they receive.
+func newRelayNet(t *testing.T, n int, trickleInterval time.Duration) (*p2p.TestNet, []*invCounter, []*memStore) {
+	t.Helper()
+	reactors := make([]*invCounter, n)
+	stores := make([]*memStore, n)
+	setup := func(i int, m *p2p.Manage) error {
+		stores[i] = newMemStore()
+		reactors[i] = &invCounter{Reactor: NewReactor(stores[i],
+			Config{TrickleInterval: trickleInterval})}
+		return m.AddReactor(ReactorName, reactors[i])
+	}
+	tn, err := p2p.NewTestNet(n, 1, nil, setup)
+	if err != nil {
+		t.Fatalf("NewTestNet: %v", err)
+	}
+	tn.Start()
+	t.Cleanup(tn.Stop)
+	return tn, reactors, stores
+}
+
+// connect connects node i to node j and returns the peers they see each other
+// as.
+func connect(t *testing.T, tn *p2p.TestNet, i, j int) (*p2p.PeerConn, *p2p.PeerConn) {
+	t.Helper()
+	if err := tn.Connect(i, j); err != nil {
+		t.Fatalf("Connect(%d, %d): %v", i, j, err)
+	}
+	var pi, pj *p2p.PeerConn
+	waitFor(t, "connection", func() bool {
+		pi = tn.Nodes[j].Peer(tn.Addr(i).ID)
+		pj = tn.Nodes[i].Peer(tn.Addr(j).ID)
+		return pi != nil && pj != nil
+	})
+	return pi, pj
+}
+
+// waitFor waits until cond holds or fails the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not done after 5s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// makeTx returns a transaction distinct for every value.
+func makeTx(value int64) *common.Tx {
+	return &common.Tx{
+		Version: 1,
+		TxIn: []*common.TxIn{{
+			PreviousOutPoint: common.OutPoint{Index: common.MaxPrevOutIndex},
+			Sequence:         common.MaxTxInSequenceNum,
+		}},
+		TxOut: []*common.TxOut{{Value: value}},
+	}
+}
+
+// makeBlock returns a block holding a transaction paying value.
+func makeBlock(value int64) *common.Block {
+	block := common.NewBlock(common.NewBlockHeader(1, &common.Hash{},
+		&common.Hash{}, 1, 0x207fffff, 0))
+	block.AddTransaction(makeTx(value))
+	return block
+}
+
+// TestRelayDelivery ensures blocks and transactions are announced, requested
+// and delivered along a line of nodes, every node getting each item once and
+// nothing being announced back to the node it came from.
+func TestRelayDelivery(t *testing.T) {
+	tn, reactors, stores := newRelayNet(t, 3, 50*time.Millisecond)
+	connect(t, tn, 0, 1)
+	connect(t, tn, 1, 2)
+
+	block := makeBlock(1)
+	tx := makeTx(2)
+	blockHash := block.BlockHash()
+	txHash := tx.TxHash()
+	stores[0].ProcessBlock(block)
+	stores[0].ProcessTx(tx)
+	reactors[0].RelayBlock(block)
+	reactors[0].RelayTx(tx)
+
+	waitFor(t, "delivery", func() bool {
+		return stores[2].HaveBlock(&blockHash) && stores[2].HaveTx(&txHash)
+	})
+
+	// Relaying again announces nothing, the peers are known to have the
+	// items.
+	reactors[0].RelayBlock(block)
+	reactors[0].RelayTx(tx)
+	time.Sleep(200 * time.Millisecond)
+
+	for i, want := range []struct{ served, processed int }{
+		{2, 2}, // the items were processed before being relayed
+		{2, 2},
+		{0, 2},
+	} {
+		served, processed := stores[i].stats()
+		if served != want.served || processed != want.processed {
+			t.Errorf("node %d served %d and processed %d items, want "+
+				"%d and %d", i, served, processed, want.served,
+				want.processed)
+		}
+	}
+	if invs := reactors[0].received(); len(invs) != 0 {
+		t.Errorf("node 0 received %d invs of items it announced",
+			len(invs))
+	}
+}
+
+// TestRelayUnrequestedData ensures a block or transaction delivered without
+// being requested is dropped and the peer penalized.
+func TestRelayUnrequestedData(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  wire.Message
+	}{
+		{name: "block", msg: wire.NewMsgBlock(makeBlock(1))},
+		{name: "transaction", msg: wire.NewMsgTx(makeTx(1))},
+	}
+
+	for _, test := range tests {
+		tn, reactors, stores := newRelayNet(t, 2, time.Second)
+		p0, p1 := connect(t, tn, 0, 1)
+		if !reactors[0].send(p1, DataChannel, test.msg) {
+			t.Fatalf("%s: not sent", test.name)
+		}
+		waitFor(t, test.name+" ban score increase", func() bool {
+			return p0.BanScore() > 0
+		})
+		if _, processed := stores[1].stats(); processed != 0 {
+			t.Errorf("%s: unrequested item processed", test.name)
+		}
+	}
+}
+
+// TestRelayTrickle ensures the transactions relayed in a burst are announced
+// together at the next trickle, while blocks are announced at once.
+func TestRelayTrickle(t *testing.T) {
+	const numTxs = 20
+	tn, reactors, stores := newRelayNet(t, 2, 500*time.Millisecond)
+	connect(t, tn, 0, 1)
+
+	block := makeBlock(0)
+	stores[0].ProcessBlock(block)
+	reactors[0].RelayBlock(block)
+	for i := 0; i < numTxs; i++ {
+		tx := makeTx(int64(i))
+		stores[0].ProcessTx(tx)
+		reactors[0].RelayTx(tx)
+	}
+
+	waitFor(t, "announcements", func() bool {
+		total := 0
+		for _, n := range reactors[1].received() {
+			total += n
+		}
+		return total == numTxs+1
+	})
+	// The block goes first on its own, the transactions follow in a
+	// single inv unless a trickle fired in the middle of the burst.
+	invs := reactors[1].received()
+	if len(invs) < 2 || len(invs) > 3 || invs[0] != 1 {
+		t.Errorf("inv sizes %v, want the block then the %d "+
+			"transactions", invs, numTxs)
+	}
+}
@@ -1,22 +1,176 @@
 package p2p
 
 import (
-	"fmt"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/blockchainservice/chaincfg"
 	"github.com/blockchainservice/p2p/nat"
+	"github.com/blockchainservice/wire"
 )
 
+// externalIPCheckInterval is how often the NAT is asked for the external IP
+// address so changes of the address are noticed.
+const externalIPCheckInterval = 5 * time.Minute
+
+// Listener accepts the inbound connections of the node.
 type Listener interface {
 	Connections() <-chan net.Conn
-	//	String() string
-	//	Stop() error
+
+	// ExternalAddr returns the address the listener is reachable at from
+	// the internet, nil when it is unknown.
+	ExternalAddr() *net.TCPAddr
+
+	// OnExternalAddrChange registers f to be called with the new external
+	// address whenever it changes, and right away when it is known.
+	OnExternalAddrChange(f func(*net.TCPAddr))
+
+	String() string
+	Stop() error
 }
 
 // Config Server options.
 type Config struct {
 	ListenAddr string //fmt.Sprintf(":%d", port)
+
+	// Transport creates the connections of the node.  It defaults to TCP
+	// sockets.
+	Transport Transport
+
+	// NAT is the port mapping mechanism used to make the listen port
+	// reachable from the internet, one of "", "none", "any", "upnp",
+	// "pmp", "pmp:<IP>" or "extip:<IP>".  No mapping is made when it is
+	// empty.
+	NAT string
+
+	// ChainParams identifies the network the node is on.
+	ChainParams *chaincfg.Params
+
+	// NodeKey is the key identifying the node to its peers.
+	NodeKey *NodeKey
+
+	// Services are the services advertised to peers.
+	Services wire.ServiceFlag
+
+	// Peers are the addresses of the form "host:port" or "id@host:port"
+	// dialed to reach TargetOutbound outbound connections.
+	Peers []string
+
+	// PersistentPeers are the addresses of peers the node stays connected
+	// to, reconnecting with backoff whenever the connection is lost.
+	PersistentPeers []string
+
+	// TargetOutbound is the number of outbound connections the node tries
+	// to maintain.  It defaults to defaultTargetOutbound.
+	TargetOutbound int
+
+	// DialTimeout bounds the time to establish an outbound TCP connection.
+	// It defaults to defaultDialTimeout.
+	DialTimeout time.Duration
+
+	// DiscoveryAddr is the UDP address the node discovery protocol listens
+	// on.  Discovery is disabled when it is empty.
+	DiscoveryAddr string
+
+	// BootstrapNodes are the "id@host:port" records of the discovery
+	// nodes used to join the network.
+	BootstrapNodes []string
+
+	// DataDir is the directory the known peer addresses are saved to.  The
+	// addresses are kept in memory only when it is empty.
+	DataDir string
+
+	// AllowLocalAddrs lets the address book keep addresses that are not
+	// routable over the public internet, such as loopback and private
+	// ones.  It is meant for local test networks.
+	AllowLocalAddrs bool
+
+	// DisableBanning turns off the banning of misbehaving peers.
+	DisableBanning bool
+
+	// BanThreshold is the ban score at which a misbehaving peer is banned.
+	// It defaults to defaultBanThreshold.
+	BanThreshold uint32
+
+	// BanDuration is how long a misbehaving peer is banned.  It defaults
+	// to defaultBanDuration.
+	BanDuration time.Duration
+
+	// Whitelists are the networks, in CIDR notation or as single IP
+	// addresses, of the peers that are never banned.
+	Whitelists []string
+
+	// MaxInbound is the maximum number of inbound peers.  It defaults to
+	// defaultMaxInbound.
+	MaxInbound int
+
+	// MaxOutbound is the maximum number of outbound peers, not counting the
+	// persistent ones.  It defaults to defaultMaxOutbound.
+	MaxOutbound int
+
+	// MaxPerIP is the maximum number of peers connected from one IP
+	// address.  It defaults to defaultMaxPerIP.
+	MaxPerIP int
+
+	// MaxPerNetGroup is the maximum number of peers connected from one
+	// network group, the /16 of IPv4 and the /32 of IPv6 addresses.
+	// Addresses that are not publicly routable are not limited.  It
+	// defaults to defaultMaxPerNetGroup.
+	MaxPerNetGroup int
+
+	// ReservedInbound is the number of inbound slots only allowlisted and
+	// persistent peers may take.  It defaults to defaultReservedInbound.
+	ReservedInbound int
+
+	// MaxPendingInbound is the maximum number of inbound connections
+	// handshaking at once.  Further connections wait in the listen queue
+	// of the kernel.  It defaults to MaxInbound.
+	MaxPendingInbound int
+
+	// SendRate and RecvRate limit the bytes per second sent to and
+	// received from all peers together.  Zero means unlimited.
+	SendRate int64
+	RecvRate int64
+
+	// PeerSendRate and PeerRecvRate limit the bytes per second sent to and
+	// received from each peer.  Zero means unlimited.
+	PeerSendRate int64
+	PeerRecvRate int64
+
+	// MaxSendQueueBytes bounds the bytes queued for sending to each peer.
+	// Sending to a peer not reading fast enough blocks once it is reached
+	// instead of queuing more.  It defaults to the default of the conn
+	// package.
+	MaxSendQueueBytes int
+
+	// Proxy is the "host:port" of the SOCKS5 proxy the outbound peers are
+	// dialed through.  Onion addresses can only be dialed through a
+	// proxy, such as the one of Tor.  It cannot be combined with
+	// Transport.
+	//
+	// Only the 16 character v2 onion addresses fit the 16 byte addresses
+	// of the addr messages, so the address book learns no v3 onion
+	// address from the peers.  v3 onion peers have to be configured in
+	// Peers, PersistentPeers or the seeds.
+	Proxy string
+
+	// ProxyUser and ProxyPass are the credentials the proxy is
+	// authenticated with, if it requires them.
+	ProxyUser string
+	ProxyPass string
+
+	// ProxyIsolation makes every connection through the proxy
+	// authenticate with random credentials.  Tor then carries each
+	// connection over its own circuit.  It cannot be combined with
+	// ProxyUser and ProxyPass.
+	ProxyIsolation bool
+
+	// ProxyOnly makes sure no connection bypasses the proxy.  The host
+	// names of the peers are resolved by the proxy instead of locally,
+	// and the node discovery protocol and the port mapping mechanisms,
+	// which cannot go through the proxy, are refused.
+	ProxyOnly bool
 }
 
 type temporary interface {
@@ -35,48 +189,142 @@ type Server struct {
 	listener    net.Listener
 	wg          sync.WaitGroup
 	connections chan net.Conn
-	natSpec     string
-	//	extIP       net.IP
+	quit        chan struct{}
+	stopOnce    sync.Once
+
+	// natm is the NAT the listen port is mapped on, nil if none.  extIP
+	// is the external IP address it last reported and extAddrChanged is
+	// called when that address changes.
+	natm           nat.NAT
+	extMtx         sync.RWMutex
+	extIP          net.IP
+	extAddrChanged func(*net.TCPAddr)
 }
 
 // StartListening start server
 func (s *Server) StartListening() error {
 
-	listener, err := net.Listen("tcp", s.ListenAddr)
+	if s.Transport == nil {
+		s.Transport = tcpTransport{}
+	}
+	listener, err := s.Transport.Listen(s.ListenAddr)
 	if err != nil {
 		return err
 	}
+	s.listener = listener
+	s.connections = make(chan net.Conn)
+	s.quit = make(chan struct{})
+	// add nat
 	if err = s.mappingExternalNetwork(); err != nil {
 		log.Error(err)
+		listener.Close()
 		return err
 	}
-	// add nat
-	s.listener = listener
 	s.wg.Add(1)
 	go s.listenLoop()
 	return nil
 }
 
+// mappingExternalNetwork maps the listen port on the configured NAT device
+// and starts tracking the external IP address.  The mapping is kept alive
+// until the server is stopped, which removes it.
 func (s *Server) mappingExternalNetwork() error {
-	natm, err := nat.Parse(s.natSpec)
+	natm, err := nat.Parse(s.NAT)
 	if err != nil {
+		return err
 	}
-	s.listener.Addr()
-	realaddr := s.listener.Addr().(*net.TCPAddr)
-	if natm != nil {
-		go nat.Map(natm, nil, "tcp", realaddr.Port, realaddr.Port, "ethereum discovery")
-
-		// TODO: react to external IP changes over time.
-		if ext, err := natm.GetExternalAddress(); err == nil {
-			fmt.Println(ext)
-			realaddr = &net.TCPAddr{IP: ext, Port: realaddr.Port}
-		}
+	if natm == nil {
+		return nil
 	}
+	s.natm = natm
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		nat.Map(natm, s.quit, "tcp", port, port, "blockchainservice p2p")
+	}()
+	go s.externalIPLoop()
 	return nil
 }
 
+// externalIPLoop asks the NAT for the external IP address every
+// externalIPCheckInterval until the server stops.  It must be run as a
+// goroutine.
+func (s *Server) externalIPLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(externalIPCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.checkExternalIP()
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// checkExternalIP asks the NAT for the external IP address and reports a
+// change of it.
+func (s *Server) checkExternalIP() {
+	ip, err := s.natm.GetExternalAddress()
+	if err != nil {
+		log.Debugf("Failed to get external address from %v: %v", s.natm, err)
+		return
+	}
+
+	s.extMtx.Lock()
+	defer s.extMtx.Unlock()
+	if ip.Equal(s.extIP) {
+		return
+	}
+	if s.extIP == nil {
+		log.Infof("External IP address is %v (%v)", ip, s.natm)
+	} else {
+		log.Infof("External IP address changed from %v to %v (%v)",
+			s.extIP, ip, s.natm)
+	}
+	s.extIP = ip
+	if s.extAddrChanged != nil {
+		s.extAddrChanged(s.externalAddr())
+	}
+}
+
+// ExternalAddr returns the address the server is reachable at from the
+// internet, nil when it is unknown.  The listen port is mapped to the same
+// external port.
+func (s *Server) ExternalAddr() *net.TCPAddr {
+	s.extMtx.RLock()
+	defer s.extMtx.RUnlock()
+	return s.externalAddr()
+}
+
+// externalAddr returns the external address.  The caller must hold extMtx.
+func (s *Server) externalAddr() *net.TCPAddr {
+	if s.extIP == nil {
+		return nil
+	}
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	return &net.TCPAddr{IP: s.extIP, Port: port}
+}
+
+// OnExternalAddrChange registers f to be called with the new external
+// address whenever it changes, and right away when it is known.  f is called
+// with the lock of the address held so it must not call back into the
+// server.
+func (s *Server) OnExternalAddrChange(f func(*net.TCPAddr)) {
+	s.extMtx.Lock()
+	defer s.extMtx.Unlock()
+	s.extAddrChanged = f
+	if s.extIP != nil {
+		f(s.externalAddr())
+	}
+}
+
 func (s *Server) listenLoop() {
-	s.wg.Done()
+	defer s.wg.Done()
+	defer close(s.connections)
 	for {
 		var (
 			conn net.Conn
@@ -90,17 +338,45 @@ func (s *Server) listenLoop() {
 				log.Debug("Temporary read error", "err", err)
 				continue
 			} else if err != nil {
-				log.Debug("Read error", "err", err)
-				close(s.connections)
+				select {
+				case <-s.quit:
+				default:
+					log.Debug("Read error", "err", err)
+				}
 				return
 			}
 			break
 		}
-		s.connections <- conn
+		select {
+		case s.connections <- conn:
+		case <-s.quit:
+			conn.Close()
+			return
+		}
 	}
 
 }
 
+// Connections returns the channel receiving the accepted connections.  It is
+// closed once the server stops listening.
 func (s *Server) Connections() <-chan net.Conn {
 	return s.connections
 }
+
+// String returns the address the server listens on.
+func (s *Server) String() string {
+	return s.listener.Addr().String()
+}
+
+// Stop closes the listener and removes the NAT port mapping.  It waits for
+// the listen loop and the port mapping to finish.  It is safe to call several
+// times.
+func (s *Server) Stop() error {
+	var err error
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		err = s.listener.Close()
+		s.wg.Wait()
+	})
+	return err
+}
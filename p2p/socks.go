@@ -0,0 +1,257 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksPasswordVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+)
+
+// socksReplies are the descriptions of the reply codes of a SOCKS5 proxy.
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+var (
+	// ErrProxyAuth is returned when the SOCKS5 proxy rejects the
+	// credentials or accepts none of the offered authentication methods.
+	ErrProxyAuth = errors.New("proxy authentication failed")
+
+	// ErrOnionWithoutProxy is returned when an onion address is dialed and
+	// no proxy is configured to reach it.
+	ErrOnionWithoutProxy = errors.New("onion address needs a proxy")
+)
+
+// socksProxy dials TCP connections through a SOCKS5 proxy.
+type socksProxy struct {
+	addr     string
+	user     string
+	password string
+
+	// isolate makes every connection authenticate with random
+	// credentials.  Tor then carries each connection over its own
+	// circuit so they cannot be linked to each other.
+	isolate bool
+}
+
+// dial connects to target, of the form "host:port", through the proxy.  Host
+// names are resolved by the proxy.  timeout bounds the whole negotiation.
+func (p *socksProxy) dial(target string, timeout time.Duration) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in address %s: %v", target, err)
+	}
+
+	conn, err := net.DialTimeout("tcp", p.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := p.negotiate(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", p.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// negotiate authenticates with the proxy on conn and asks it to connect to
+// host and port.
+func (p *socksProxy) negotiate(conn net.Conn, host string, port uint16) error {
+	user, password := p.user, p.password
+	if p.isolate {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		user = hex.EncodeToString(b[:4])
+		password = hex.EncodeToString(b[4:])
+	}
+
+	method := byte(socksAuthNone)
+	if user != "" || password != "" {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if method != socksAuthPassword {
+			return ErrProxyAuth
+		}
+		if err := authenticate(conn, user, password); err != nil {
+			return err
+		}
+	case socksAuthNoAcceptable:
+		return ErrProxyAuth
+	default:
+		return fmt.Errorf("unexpected authentication method %d", reply[1])
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		req = append(req, socksAtypIPv4)
+		req = append(req, ip.To4()...)
+	case ip != nil:
+		req = append(req, socksAtypIPv6)
+		req = append(req, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s too long", host)
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	var portBytes [2]byte
+	binary.BigEndian.PutUint16(portBytes[:], port)
+	req = append(req, portBytes[:]...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply carries the address the proxy bound, which is of no use
+	// but has to be read past.
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", hdr[0])
+	}
+	if hdr[1] != 0 {
+		if desc, ok := socksReplies[hdr[1]]; ok {
+			return errors.New(desc)
+		}
+		return fmt.Errorf("unknown SOCKS reply %d", hdr[1])
+	}
+	var addrLen int
+	switch hdr[3] {
+	case socksAtypIPv4:
+		addrLen = net.IPv4len
+	case socksAtypIPv6:
+		addrLen = net.IPv6len
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("unknown address type %d", hdr[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// authenticate sends the username and password to the proxy on conn.
+func authenticate(conn net.Conn, user, password string) error {
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("proxy username or password too long")
+	}
+	req := []byte{socksPasswordVersion, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksPasswordVersion {
+		return fmt.Errorf("unexpected authentication version %d",
+			reply[0])
+	}
+	if reply[1] != 0 {
+		return ErrProxyAuth
+	}
+	return nil
+}
+
+// proxyTransport is the Transport listening on TCP sockets and dialing the
+// outbound connections through a SOCKS5 proxy.
+type proxyTransport struct {
+	tcpTransport
+	proxy *socksProxy
+}
+
+// Dial connects to addr through the proxy.  The connection reports addr as
+// its remote address rather than the one of the proxy.  Onion addresses are
+// reported by name, which is the host they are banned under.
+func (t proxyTransport) Dial(addr *NetAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := t.proxy.dial(addr.DialString(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr = proxiedAddr(addr.DialString())
+	if addr.IP != nil && !IsOnionCatTor(addr) {
+		remote = addr.tcpAddr()
+	}
+	return &proxiedConn{Conn: conn, remote: remote}, nil
+}
+
+// proxiedConn is a connection through a proxy reporting the address of the
+// peer as its remote address.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// proxiedAddr is the "host:port" of a peer dialed by name through a proxy.
+type proxiedAddr string
+
+// Network returns "tcp".
+func (a proxiedAddr) Network() string { return "tcp" }
+
+// String returns the address in "host:port" form.
+func (a proxiedAddr) String() string { return string(a) }
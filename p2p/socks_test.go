@@ -0,0 +1,562 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blockchainservice/chaincfg"
+)
+
+// socksRequest is what a client sent to the SOCKS5 stand-in.
+type socksRequest struct {
+	methods  []byte
+	user     string
+	password string
+	atyp     byte
+	host     string
+	port     uint16
+}
+
+// socksStandIn is a minimal SOCKS5 proxy listening on the loopback
+// interface.  It forwards every connection to its backend whatever the
+// requested address, and records the CONNECT requests.
+type socksStandIn struct {
+	l       net.Listener
+	backend string
+
+	// user and password are the credentials required, none when user is
+	// empty.
+	user     string
+	password string
+
+	// authVersion is the version sent in the reply to the authentication,
+	// socksPasswordVersion when 0.
+	authVersion byte
+
+	// reply is the reply code sent to the CONNECT requests and bind the
+	// address reported in the reply, address type included.
+	reply byte
+	bind  []byte
+
+	mtx      sync.Mutex
+	requests []socksRequest
+}
+
+// newSocksStandIn starts a SOCKS5 stand-in forwarding to an echo server.
+func newSocksStandIn(t *testing.T) *socksStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := &socksStandIn{
+		l:       l,
+		backend: newEchoServer(t),
+		bind:    []byte{socksAtypIPv4, 127, 0, 0, 1},
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+// newEchoServer starts a server writing back what it reads and returns its
+// address.
+func newEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// proxy returns a client of the stand-in.
+func (s *socksStandIn) proxy() *socksProxy {
+	return &socksProxy{addr: s.l.Addr().String()}
+}
+
+// lastRequest returns the last CONNECT request received.
+func (s *socksStandIn) lastRequest(t *testing.T) socksRequest {
+	t.Helper()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("the proxy received no request")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+func (s *socksStandIn) handle(c net.Conn) {
+	defer c.Close()
+	var req socksRequest
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil || hdr[0] != socksVersion {
+		return
+	}
+	req.methods = make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, req.methods); err != nil {
+		return
+	}
+	offered := func(method byte) bool {
+		for _, m := range req.methods {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case offered(socksAuthPassword):
+		c.Write([]byte{socksVersion, socksAuthPassword})
+		var ver [2]byte
+		if _, err := io.ReadFull(c, ver[:]); err != nil {
+			return
+		}
+		user := make([]byte, ver[1])
+		io.ReadFull(c, user)
+		var l [1]byte
+		io.ReadFull(c, l[:])
+		password := make([]byte, l[0])
+		io.ReadFull(c, password)
+		req.user, req.password = string(user), string(password)
+		authVersion := s.authVersion
+		if authVersion == 0 {
+			authVersion = socksPasswordVersion
+		}
+		if s.user != "" && (req.user != s.user || req.password != s.password) {
+			c.Write([]byte{authVersion, 1})
+			return
+		}
+		c.Write([]byte{authVersion, 0})
+	case s.user == "" && offered(socksAuthNone):
+		c.Write([]byte{socksVersion, socksAuthNone})
+	default:
+		c.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return
+	}
+
+	var cmd [4]byte
+	if _, err := io.ReadFull(c, cmd[:]); err != nil || cmd[1] != socksCmdConnect {
+		return
+	}
+	req.atyp = cmd[3]
+	switch req.atyp {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req.atyp == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		io.ReadFull(c, ip)
+		req.host = ip.String()
+	case socksAtypDomain:
+		var l [1]byte
+		io.ReadFull(c, l[:])
+		host := make([]byte, l[0])
+		io.ReadFull(c, host)
+		req.host = string(host)
+	default:
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return
+	}
+	req.port = binary.BigEndian.Uint16(port[:])
+	s.mtx.Lock()
+	s.requests = append(s.requests, req)
+	s.mtx.Unlock()
+
+	reply := append([]byte{socksVersion, s.reply, 0}, s.bind...)
+	reply = append(reply, 0, 0)
+	if s.reply != 0 {
+		c.Write(reply)
+		return
+	}
+	backend, err := net.Dial("tcp", s.backend)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+	c.Write(reply)
+	go io.Copy(backend, c)
+	io.Copy(c, backend)
+}
+
+// checkEcho ensures data flows both ways on c.
+func checkEcho(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("read %q through the proxy, want %q", buf, "ping")
+	}
+}
+
+// TestSocksConnect ensures the proxy is asked to connect to IPv4, IPv6 and
+// named addresses with the matching address type, without authentication
+// when no credentials are configured.
+func TestSocksConnect(t *testing.T) {
+	tests := []struct {
+		target string
+		atyp   byte
+		host   string
+		bind   []byte
+	}{
+		{
+			target: "203.0.113.5:18444",
+			atyp:   socksAtypIPv4,
+			host:   "203.0.113.5",
+		},
+		{
+			target: "[2001:db8::5]:18444",
+			atyp:   socksAtypIPv6,
+			host:   "2001:db8::5",
+			bind:   append([]byte{socksAtypIPv6}, net.IPv6loopback...),
+		},
+		{
+			target: "seed.example.org:8333",
+			atyp:   socksAtypDomain,
+			host:   "seed.example.org",
+			bind:   []byte{socksAtypDomain, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't'},
+		},
+	}
+
+	s := newSocksStandIn(t)
+	for _, test := range tests {
+		if test.bind != nil {
+			s.bind = test.bind
+		}
+		c, err := s.proxy().dial(test.target, 5*time.Second)
+		if err != nil {
+			t.Errorf("dial %s: %v", test.target, err)
+			continue
+		}
+		checkEcho(t, c)
+		c.Close()
+
+		req := s.lastRequest(t)
+		_, portStr, _ := net.SplitHostPort(test.target)
+		if req.atyp != test.atyp || req.host != test.host ||
+			strconv.Itoa(int(req.port)) != portStr {
+
+			t.Errorf("dial %s: proxy got address type %d host %s port "+
+				"%d", test.target, req.atyp, req.host, req.port)
+		}
+		if string(req.methods) != string([]byte{socksAuthNone}) {
+			t.Errorf("dial %s: offered methods %v, want none",
+				test.target, req.methods)
+		}
+	}
+}
+
+// TestSocksPassword ensures the configured credentials are sent and a
+// rejection of the proxy fails with ErrProxyAuth.
+func TestSocksPassword(t *testing.T) {
+	s := newSocksStandIn(t)
+	s.user, s.password = "alice", "secret"
+
+	p := s.proxy()
+	p.user, p.password = "alice", "secret"
+	c, err := p.dial("203.0.113.5:18444", 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial with the right password: %v", err)
+	}
+	checkEcho(t, c)
+	c.Close()
+	req := s.lastRequest(t)
+	if req.user != "alice" || req.password != "secret" {
+		t.Errorf("proxy got credentials %s:%s, want alice:secret",
+			req.user, req.password)
+	}
+
+	p.password = "wrong"
+	_, err = p.dial("203.0.113.5:18444", 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), ErrProxyAuth.Error()) {
+		t.Errorf("dial with a wrong password: got %v, want %v", err,
+			ErrProxyAuth)
+	}
+
+	// A proxy refusing to go without credentials accepts none of the
+	// offered methods.
+	_, err = s.proxy().dial("203.0.113.5:18444", 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), ErrProxyAuth.Error()) {
+		t.Errorf("dial without credentials: got %v, want %v", err,
+			ErrProxyAuth)
+	}
+
+	// The reply to the authentication is versioned like the request.
+	s.authVersion = socksVersion
+	p.password = "secret"
+	_, err = p.dial("203.0.113.5:18444", 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(),
+		"unexpected authentication version") {
+
+		t.Errorf("dial with a bad authentication reply: got %v", err)
+	}
+}
+
+// TestSocksIsolation ensures stream isolation authenticates every
+// connection with its own random credentials.
+func TestSocksIsolation(t *testing.T) {
+	s := newSocksStandIn(t)
+	p := s.proxy()
+	p.user, p.password, p.isolate = "alice", "secret", true
+
+	seen := make(map[string]struct{})
+	for i := 0; i < 3; i++ {
+		c, err := p.dial("203.0.113.5:18444", 5*time.Second)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		c.Close()
+		req := s.lastRequest(t)
+		if req.user == "" || req.user == "alice" || req.password == "secret" {
+			t.Errorf("dial %d: got credentials %s:%s, want random ones",
+				i, req.user, req.password)
+		}
+		creds := req.user + ":" + req.password
+		if _, ok := seen[creds]; ok {
+			t.Errorf("dial %d: credentials %s reused", i, creds)
+		}
+		seen[creds] = struct{}{}
+	}
+}
+
+// TestSocksReplyErrors ensures a refused CONNECT fails with the description
+// of the reply code.
+func TestSocksReplyErrors(t *testing.T) {
+	s := newSocksStandIn(t)
+	for code := byte(1); code <= 9; code++ {
+		want, ok := socksReplies[code]
+		if !ok {
+			want = "unknown SOCKS reply 9"
+		}
+		s.reply = code
+		_, err := s.proxy().dial("203.0.113.5:18444", 5*time.Second)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("reply %d: got error %v, want %q", code, err, want)
+		}
+	}
+}
+
+// TestProxyTransportDial ensures the proxy transport dials onion addresses
+// by name and that its connections report the address of the peer rather
+// than the one of the proxy.
+func TestProxyTransportDial(t *testing.T) {
+	const (
+		v2 = "expyuzz4wqqyqhjn.onion"
+		v3 = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion"
+	)
+	tests := []struct {
+		addr   string
+		atyp   byte
+		host   string
+		remote string
+	}{
+		{
+			addr:   "203.0.113.5:18444",
+			atyp:   socksAtypIPv4,
+			host:   "203.0.113.5",
+			remote: "203.0.113.5:18444",
+		},
+		{
+			addr:   v2 + ":18444",
+			atyp:   socksAtypDomain,
+			host:   v2,
+			remote: v2 + ":18444",
+		},
+		{
+			addr:   v3 + ":18444",
+			atyp:   socksAtypDomain,
+			host:   v3,
+			remote: v3 + ":18444",
+		},
+	}
+
+	s := newSocksStandIn(t)
+	tr := proxyTransport{proxy: s.proxy()}
+	for _, test := range tests {
+		addr, err := NewNetAddressString(test.addr)
+		if err != nil {
+			t.Errorf("NewNetAddressString(%s): %v", test.addr, err)
+			continue
+		}
+		c, err := tr.Dial(addr, 5*time.Second)
+		if err != nil {
+			t.Errorf("Dial %s: %v", test.addr, err)
+			continue
+		}
+		checkEcho(t, c)
+		if got := c.RemoteAddr().String(); got != test.remote {
+			t.Errorf("Dial %s: remote address %s, want %s", test.addr,
+				got, test.remote)
+		}
+		c.Close()
+
+		req := s.lastRequest(t)
+		if req.atyp != test.atyp || req.host != test.host || req.port != 18444 {
+			t.Errorf("Dial %s: proxy got address type %d host %s port "+
+				"%d", test.addr, req.atyp, req.host, req.port)
+		}
+	}
+}
+
+// TestNewManageProxyOnly ensures the configurations that would connect
+// around the proxy are refused in proxy only mode, like the credentials the
+// stream isolation would replace.
+func TestNewManageProxyOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*Config)
+		valid  bool
+	}{
+		{
+			name:   "no proxy",
+			config: func(c *Config) { c.Proxy = "" },
+		},
+		{
+			name:   "discovery",
+			config: func(c *Config) { c.DiscoveryAddr = "127.0.0.1:0" },
+		},
+		{
+			name:   "upnp",
+			config: func(c *Config) { c.NAT = "upnp" },
+		},
+		{
+			name:   "pmp",
+			config: func(c *Config) { c.NAT = "pmp:192.168.0.1" },
+		},
+		{
+			name:   "any",
+			config: func(c *Config) { c.NAT = "any" },
+		},
+		{
+			name:   "extip",
+			config: func(c *Config) { c.NAT = "extip:203.0.113.5" },
+			valid:  true,
+		},
+		{
+			name: "isolation with credentials",
+			config: func(c *Config) {
+				c.ProxyIsolation = true
+				c.ProxyUser, c.ProxyPass = "alice", "secret"
+			},
+		},
+		{
+			name:   "isolation",
+			config: func(c *Config) { c.ProxyIsolation = true },
+			valid:  true,
+		},
+		{
+			name: "unresolved peer",
+			config: func(c *Config) {
+				c.Peers = []string{"seed.example.invalid:18444"}
+			},
+			valid: true,
+		},
+	}
+
+	s := newSocksStandIn(t)
+	for _, test := range tests {
+		key, err := GenNodeKey()
+		if err != nil {
+			t.Fatalf("GenNodeKey: %v", err)
+		}
+		config := Config{
+			ListenAddr:  "127.0.0.1:0",
+			ChainParams: &chaincfg.RegressionNetParams,
+			NodeKey:     key,
+			Proxy:       s.l.Addr().String(),
+			ProxyOnly:   true,
+		}
+		test.config(&config)
+		m, err := NewManage(config)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: NewManage: %v", test.name, err)
+				continue
+			}
+			m.Stop()
+			continue
+		}
+		if err == nil {
+			m.Stop()
+			t.Errorf("%s: NewManage accepted a proxy only "+
+				"configuration bypassing the proxy", test.name)
+		}
+	}
+}
+
+// TestDialBannedOnion ensures onion peers are banned under the name their
+// connections report, so a banned onion peer is not dialed again.
+func TestDialBannedOnion(t *testing.T) {
+	s := newSocksStandIn(t)
+	key, err := GenNodeKey()
+	if err != nil {
+		t.Fatalf("GenNodeKey: %v", err)
+	}
+	m, err := NewManage(Config{
+		ListenAddr:  "127.0.0.1:0",
+		ChainParams: &chaincfg.RegressionNetParams,
+		NodeKey:     key,
+		Proxy:       s.l.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("NewManage: %v", err)
+	}
+	defer m.Stop()
+
+	for _, name := range []string{
+		"expyuzz4wqqyqhjn.onion",
+		"pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion",
+	} {
+		addr, err := NewNetAddressString(name + ":18444")
+		if err != nil {
+			t.Fatalf("NewNetAddressString: %v", err)
+		}
+		c, err := m.config.Transport.Dial(addr, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Dial %s: %v", name, err)
+		}
+		host := hostOf(c.RemoteAddr())
+		c.Close()
+
+		m.banList.ban(host, time.Now().Add(time.Hour))
+		if err := m.DialPeerWithAddress(addr, false); err != ErrPeerBanned {
+			t.Errorf("dialing banned %s: got %v, want %v", name, err,
+				ErrPeerBanned)
+		}
+	}
+}
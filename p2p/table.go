@@ -0,0 +1,652 @@
+package p2p
+
+import (
+	crand "crypto/rand"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	alpha           = 3  // Kademlia concurrency factor
+	bucketSize      = 16 // Kademlia bucket size
+	maxReplacements = 10 // Size of per-bucket replacement list
+
+	// nBuckets is the number of buckets of the routing table, one per
+	// possible logarithmic distance between node IDs.
+	nBuckets = IDByteLength * 8
+
+	refreshInterval    = 30 * time.Minute
+	revalidateInterval = 10 * time.Second
+
+	// lookupInterval is the minimum time between the lookups run by a
+	// NodeIterator.
+	lookupInterval = time.Second
+)
+
+// Table is the Kademlia routing table of the discovery protocol.  Nodes are
+// sorted into buckets by their logarithmic distance to the local node, each
+// holding at most bucketSize live entries ordered by recent activity and a
+// list of replacements used when an entry stops answering.
+type Table struct {
+	mutex   sync.Mutex        // protects buckets, bucket content, nursery, rand
+	buckets [nBuckets]*bucket // index of known nodes by distance
+	nursery []*Node           // bootstrap nodes
+	rand    *rand.Rand        // source of randomness, periodically reseeded
+
+	net  transport
+	self *Node // metadata of the local node
+
+	refreshReq chan chan struct{}
+	initDone   chan struct{}
+	closeReq   chan struct{}
+	closed     chan struct{}
+}
+
+// transport is implemented by the UDP transport.  It is an interface so the
+// table can be driven without a network.
+type transport interface {
+	self() *Node
+	setExternalIP(net.IP)
+	ping(*Node) error
+	findnode(toNode *Node, target NodeID) ([]*Node, error)
+	close()
+}
+
+// bucket contains nodes, ordered by their last activity.  The entry that was
+// most recently active is the first element in entries.
+type bucket struct {
+	entries      []*Node // live entries, sorted by time of last contact
+	replacements []*Node // recently seen nodes to be used if revalidation fails
+}
+
+func newTable(t transport, bootnodes []*Node) *Table {
+	tab := &Table{
+		net:        t,
+		self:       t.self(),
+		refreshReq: make(chan chan struct{}),
+		initDone:   make(chan struct{}),
+		closeReq:   make(chan struct{}),
+		closed:     make(chan struct{}),
+		rand:       rand.New(rand.NewSource(0)),
+	}
+	tab.nursery = append(tab.nursery, bootnodes...)
+	for i := range tab.buckets {
+		tab.buckets[i] = &bucket{}
+	}
+	tab.seedRand()
+	return tab
+}
+
+func (tab *Table) seedRand() {
+	var b [8]byte
+	crand.Read(b[:])
+
+	tab.mutex.Lock()
+	tab.rand.Seed(int64(b[0]) | int64(b[1])<<8 | int64(b[2])<<16 |
+		int64(b[3])<<24 | int64(b[4])<<32 | int64(b[5])<<40 |
+		int64(b[6])<<48 | int64(b[7]&0x7f)<<56)
+	tab.mutex.Unlock()
+}
+
+// Self returns the local node.
+func (tab *Table) Self() *Node {
+	return tab.net.self()
+}
+
+// SetExternalIP sets the IP address the local node advertises to the nodes
+// it pings, the address it is reachable at from the internet.
+func (tab *Table) SetExternalIP(ip net.IP) {
+	tab.net.setExternalIP(ip)
+}
+
+// ReadRandomNodes fills the given slice with random nodes from the table.
+// The results are guaranteed to be unique for a single invocation, no node
+// will appear twice.
+func (tab *Table) ReadRandomNodes(buf []*Node) (n int) {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+
+	var nodes []*Node
+	for _, b := range &tab.buckets {
+		nodes = append(nodes, b.entries...)
+	}
+	// Shuffle.
+	for i := 0; i < len(nodes); i++ {
+		j := tab.rand.Intn(len(nodes))
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+	return copy(buf, nodes)
+}
+
+// Len returns the number of live nodes in the table.
+func (tab *Table) Len() (n int) {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+	for _, b := range &tab.buckets {
+		n += len(b.entries)
+	}
+	return n
+}
+
+// Close stops the table maintenance and closes the network listener.
+func (tab *Table) Close() {
+	select {
+	case <-tab.closed:
+		// already closed.
+	case tab.closeReq <- struct{}{}:
+		<-tab.closed // wait for loop to end.
+	}
+}
+
+// Lookup performs a network search for nodes close to the given target.  It
+// approaches the target by querying nodes that are closer to it on each
+// iteration.  The given target does not need to be an actual node
+// identifier.
+func (tab *Table) Lookup(target NodeID) []*Node {
+	return tab.lookup(target, true)
+}
+
+func (tab *Table) lookup(target NodeID, refreshIfEmpty bool) []*Node {
+	var (
+		asked          = make(map[NodeID]bool)
+		seen           = make(map[NodeID]bool)
+		reply          = make(chan []*Node, alpha)
+		pendingQueries = 0
+		result         *nodesByDistance
+	)
+	// don't query further if we hit ourself.
+	// unlikely to happen often in practice.
+	asked[tab.self.ID] = true
+
+	for {
+		tab.mutex.Lock()
+		// generate initial result set
+		result = tab.closest(target, bucketSize)
+		tab.mutex.Unlock()
+		if len(result.entries) > 0 || !refreshIfEmpty {
+			break
+		}
+		// The result set is empty, all nodes were dropped, refresh.
+		// We actually wait for the refresh to complete here. The very
+		// first query will hit this case and run the bootstrapping
+		// logic.
+		<-tab.refresh()
+		refreshIfEmpty = false
+	}
+
+	for {
+		// ask the alpha closest nodes that we haven't asked yet
+		for i := 0; i < len(result.entries) && pendingQueries < alpha; i++ {
+			n := result.entries[i]
+			if !asked[n.ID] {
+				asked[n.ID] = true
+				pendingQueries++
+				go tab.findnode(n, target, reply)
+			}
+		}
+		if pendingQueries == 0 {
+			// we have asked all closest nodes, stop the search
+			break
+		}
+		// Queries fail fast once the table is closed, so waiting for
+		// the replies does not block shutdown.
+		for _, n := range <-reply {
+			if n != nil && !seen[n.ID] {
+				seen[n.ID] = true
+				result.push(n, bucketSize)
+			}
+		}
+		pendingQueries--
+	}
+	return result.entries
+}
+
+// findnode asks n for the nodes closest to target and sends them to reply.
+// Nodes that do not answer are dropped from the table, the others and the
+// nodes they return are added to it.
+func (tab *Table) findnode(n *Node, target NodeID, reply chan<- []*Node) {
+	r, err := tab.net.findnode(n, target)
+	if err != nil {
+		log.Tracef("Findnode to %s failed: %v", n, err)
+		tab.delete(n)
+	} else {
+		tab.addSeenNode(n)
+	}
+	// Grab as many nodes as possible. Some of them might not be alive
+	// anymore, but we'll just remove those again during revalidation.
+	for _, n := range r {
+		tab.addSeenNode(n)
+	}
+	reply <- r
+}
+
+func (tab *Table) refresh() <-chan struct{} {
+	done := make(chan struct{})
+	select {
+	case tab.refreshReq <- done:
+	case <-tab.closed:
+		close(done)
+	}
+	return done
+}
+
+// loop schedules refresh, revalidate runs and coordinates shutdown.
+func (tab *Table) loop() {
+	var (
+		revalidate     = time.NewTimer(tab.nextRevalidateTime())
+		refresh        = time.NewTicker(refreshInterval)
+		revalidateDone chan struct{}
+		refreshDone    = make(chan struct{})           // where doRefresh reports completion
+		waiting        = []chan struct{}{tab.initDone} // holds waiting callers while doRefresh runs
+	)
+	defer refresh.Stop()
+	defer revalidate.Stop()
+
+	// Start initial refresh.
+	go tab.doRefresh(refreshDone)
+
+loop:
+	for {
+		select {
+		case <-refresh.C:
+			tab.seedRand()
+			if refreshDone == nil {
+				refreshDone = make(chan struct{})
+				go tab.doRefresh(refreshDone)
+			}
+		case req := <-tab.refreshReq:
+			waiting = append(waiting, req)
+			if refreshDone == nil {
+				refreshDone = make(chan struct{})
+				go tab.doRefresh(refreshDone)
+			}
+		case <-refreshDone:
+			for _, ch := range waiting {
+				close(ch)
+			}
+			waiting, refreshDone = nil, nil
+		case <-revalidate.C:
+			revalidateDone = make(chan struct{})
+			go tab.doRevalidate(revalidateDone)
+		case <-revalidateDone:
+			revalidate.Reset(tab.nextRevalidateTime())
+			revalidateDone = nil
+		case <-tab.closeReq:
+			break loop
+		}
+	}
+
+	if tab.net != nil {
+		tab.net.close()
+	}
+	if refreshDone != nil {
+		<-refreshDone
+	}
+	for _, ch := range waiting {
+		close(ch)
+	}
+	close(tab.closed)
+}
+
+// doRefresh performs a lookup for a random target to keep buckets full.
+// Bootstrap nodes are added if the table is empty.
+func (tab *Table) doRefresh(done chan struct{}) {
+	defer close(done)
+
+	tab.loadSeedNodes()
+
+	// Run self lookup to discover new neighbor nodes.
+	tab.lookup(tab.self.ID, false)
+
+	// The Kademlia paper specifies that the bucket refresh should
+	// perform a lookup in the least recently used bucket. We cannot
+	// adhere to this because the findnode target is a 160 bit value
+	// (not hash-sized) and it is not easily possible to generate a
+	// node ID that falls into a chosen bucket.  We perform a few
+	// lookups with random targets instead.
+	for i := 0; i < 3; i++ {
+		var target NodeID
+		crand.Read(target[:])
+		tab.lookup(target, false)
+	}
+}
+
+// loadSeedNodes adds the bootstrap nodes to the table.
+func (tab *Table) loadSeedNodes() {
+	for _, seed := range tab.nursery {
+		log.Debugf("Found seed node in database %s", seed)
+		tab.addSeenNode(seed)
+	}
+}
+
+// doRevalidate checks that the last node in a random bucket is still live
+// and replaces or deletes the node if it isn't.
+func (tab *Table) doRevalidate(done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+
+	last, bi := tab.nodeToRevalidate()
+	if last == nil {
+		// No non-empty bucket found.
+		return
+	}
+
+	// Ping the selected node and wait for a pong.
+	err := tab.net.ping(last)
+
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+	b := tab.buckets[bi]
+	if err == nil {
+		// The node responded, move it to the front.
+		last.livenessChecks++
+		log.Tracef("Revalidated node %s (checks %d)", last,
+			last.livenessChecks)
+		tab.bumpInBucket(b, last)
+		return
+	}
+	// No reply received, pick a replacement or delete the node if there
+	// aren't any replacements.
+	if r := tab.replace(b, last); r != nil {
+		log.Debugf("Replaced dead node %s with %s: %v", last, r, err)
+	} else {
+		log.Debugf("Removed dead node %s: %v", last, err)
+	}
+}
+
+// nodeToRevalidate returns the last node in a random, non-empty bucket.
+func (tab *Table) nodeToRevalidate() (n *Node, bi int) {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+
+	for _, bi = range tab.rand.Perm(len(tab.buckets)) {
+		b := tab.buckets[bi]
+		if len(b.entries) > 0 {
+			last := b.entries[len(b.entries)-1]
+			return last, bi
+		}
+	}
+	return nil, 0
+}
+
+func (tab *Table) nextRevalidateTime() time.Duration {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+
+	return time.Duration(tab.rand.Int63n(int64(revalidateInterval)))
+}
+
+// closest returns the n nodes in the table that are closest to the given
+// id.  The caller must hold tab.mutex.
+func (tab *Table) closest(target NodeID, nresults int) *nodesByDistance {
+	// This is a very wasteful way to find the closest nodes but
+	// obviously correct. I believe that tree-based buckets would make
+	// this easier to implement efficiently.
+	close := &nodesByDistance{target: target}
+	for _, b := range &tab.buckets {
+		for _, n := range b.entries {
+			close.push(n, nresults)
+		}
+	}
+	return close
+}
+
+// bucket returns the bucket for the given node ID.
+func (tab *Table) bucket(id NodeID) *bucket {
+	d := logdist(tab.self.ID, id)
+	if d == 0 {
+		return nil
+	}
+	return tab.buckets[d-1]
+}
+
+// addSeenNode adds a node which may or may not be live to the end of a
+// bucket.  If the bucket has space available, adding the node succeeds
+// immediately.  Otherwise, the node is added to the replacements list.
+//
+// The caller must not hold tab.mutex.
+func (tab *Table) addSeenNode(n *Node) {
+	if n.ID == tab.self.ID {
+		return
+	}
+
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+	b := tab.bucket(n.ID)
+	if contains(b.entries, n.ID) {
+		// Already in bucket, don't add.
+		return
+	}
+	if len(b.entries) >= bucketSize {
+		// Bucket full, maybe add as replacement.
+		tab.addReplacement(b, n)
+		return
+	}
+	// Add to end of bucket:
+	b.entries = append(b.entries, n)
+	b.replacements = deleteNode(b.replacements, n)
+	n.addedAt = time.Now()
+}
+
+// addVerifiedNode adds a node whose existence has been verified recently to
+// the front of a bucket.  If the node is already in the bucket, it is moved
+// to the front.  If the bucket has no space, the node is added to the
+// replacements list.
+//
+// There is an additional safety measure: if the table is still
+// initializing the node is not added.  This prevents an attack where the
+// table could be filled by just sending ping repeatedly.
+//
+// The caller must not hold tab.mutex.
+func (tab *Table) addVerifiedNode(n *Node) {
+	if !tab.isInitDone() {
+		return
+	}
+	if n.ID == tab.self.ID {
+		return
+	}
+
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+	b := tab.bucket(n.ID)
+	if tab.bumpInBucket(b, n) {
+		// Already in bucket, moved to front.
+		return
+	}
+	if len(b.entries) >= bucketSize {
+		// Bucket full, maybe add as replacement.
+		tab.addReplacement(b, n)
+		return
+	}
+	// Add to front of bucket.
+	b.entries, _ = pushNode(b.entries, n, bucketSize)
+	b.replacements = deleteNode(b.replacements, n)
+	n.addedAt = time.Now()
+}
+
+func (tab *Table) isInitDone() bool {
+	select {
+	case <-tab.initDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// delete removes an entry from the node table.  It is used to evacuate dead
+// nodes.
+func (tab *Table) delete(node *Node) {
+	tab.mutex.Lock()
+	defer tab.mutex.Unlock()
+
+	tab.deleteInBucket(tab.bucket(node.ID), node)
+}
+
+func (tab *Table) addReplacement(b *bucket, n *Node) {
+	for _, e := range b.replacements {
+		if e.ID == n.ID {
+			return // already in list
+		}
+	}
+	b.replacements, _ = pushNode(b.replacements, n, maxReplacements)
+}
+
+// replace removes n from the replacement list and replaces 'last' with it
+// if it is the last entry in the bucket.  If 'last' isn't the last entry, it
+// has either been replaced with someone else or became active.
+func (tab *Table) replace(b *bucket, last *Node) *Node {
+	if len(b.entries) == 0 || b.entries[len(b.entries)-1].ID != last.ID {
+		// Entry has moved, don't replace it.
+		return nil
+	}
+	// Still the last entry.
+	if len(b.replacements) == 0 {
+		tab.deleteInBucket(b, last)
+		return nil
+	}
+	r := b.replacements[tab.rand.Intn(len(b.replacements))]
+	b.replacements = deleteNode(b.replacements, r)
+	b.entries[len(b.entries)-1] = r
+	return r
+}
+
+// bumpInBucket moves the given node to the front of the bucket entry list
+// if it is contained in that list.
+func (tab *Table) bumpInBucket(b *bucket, n *Node) bool {
+	for i := range b.entries {
+		if b.entries[i].ID == n.ID {
+			e := b.entries[i]
+			if !n.IP.Equal(e.IP) || n.UDP != e.UDP || n.TCP != e.TCP {
+				// Endpoint has changed, keep the newer record.
+				b.entries[i] = n
+			}
+			// Move it to the front.
+			copy(b.entries[1:], b.entries[:i])
+			b.entries[0] = n
+			return true
+		}
+	}
+	return false
+}
+
+func (tab *Table) deleteInBucket(b *bucket, n *Node) {
+	b.entries = deleteNode(b.entries, n)
+}
+
+func contains(ns []*Node, id NodeID) bool {
+	for _, n := range ns {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// pushNode adds n to the front of list, keeping at most max items.
+func pushNode(list []*Node, n *Node, max int) ([]*Node, *Node) {
+	if len(list) < max {
+		list = append(list, nil)
+	}
+	removed := list[len(list)-1]
+	copy(list[1:], list)
+	list[0] = n
+	return list, removed
+}
+
+// deleteNode removes n from list.
+func deleteNode(list []*Node, n *Node) []*Node {
+	for i := range list {
+		if list[i].ID == n.ID {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// nodesByDistance is a list of nodes, ordered by distance to target.
+type nodesByDistance struct {
+	entries []*Node
+	target  NodeID
+}
+
+// push adds the given node to the list, keeping the total size below
+// maxElems.
+func (h *nodesByDistance) push(n *Node, maxElems int) {
+	ix := sort.Search(len(h.entries), func(i int) bool {
+		return distcmp(h.target, h.entries[i].ID, n.ID) > 0
+	})
+	if len(h.entries) < maxElems {
+		h.entries = append(h.entries, n)
+	}
+	if ix == len(h.entries) {
+		// farther away than all nodes we already have.
+		// if there was room for it, the node is now the last element.
+	} else {
+		// slide existing entries down to make room
+		// this will overwrite the entry we just appended.
+		copy(h.entries[ix+1:], h.entries[ix:])
+		h.entries[ix] = n
+	}
+}
+
+// NodeIterator iterates over the nodes found by random lookups in the
+// discovery table.  It is consumed by the dialer of the Manage.
+type NodeIterator struct {
+	tab        *Table
+	lastLookup time.Time
+	buf        []*Node
+	cur        *Node
+	closed     chan struct{}
+	once       sync.Once
+}
+
+// RandomNodes returns an iterator over the nodes found by lookups of random
+// targets.  Nodes may be returned more than once.
+func (tab *Table) RandomNodes() *NodeIterator {
+	return &NodeIterator{tab: tab, closed: make(chan struct{})}
+}
+
+// Next moves the iterator to the next node.  It blocks until a node is found
+// and returns false once the iterator or the table is closed.
+func (it *NodeIterator) Next() bool {
+	it.cur = nil
+	for len(it.buf) == 0 {
+		select {
+		case <-it.closed:
+			return false
+		case <-it.tab.closed:
+			return false
+		default:
+		}
+		// Space out the lookups so a small network that is already
+		// fully known is not flooded with queries.
+		if wait := lookupInterval - time.Since(it.lastLookup); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-it.closed:
+				return false
+			case <-it.tab.closed:
+				return false
+			}
+		}
+		var target NodeID
+		crand.Read(target[:])
+		it.lastLookup = time.Now()
+		it.buf = it.tab.Lookup(target)
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Node returns the current node.
+func (it *NodeIterator) Node() *Node {
+	return it.cur
+}
+
+// Close ends the iteration.  A pending call to Next returns false once the
+// lookup in progress completes.
+func (it *NodeIterator) Close() {
+	it.once.Do(func() { close(it.closed) })
+}
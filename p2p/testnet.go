@@ -0,0 +1,156 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/blockchainservice/chaincfg"
+)
+
+// testNetPort is the port the nodes of a TestNet listen on.
+const testNetPort = 18444
+
+// TestNet is a network of fully wired nodes running in one process over a
+// MemNetwork.  It lets consensus and gossip be exercised without sockets,
+// with the latency, losses and partitions of the links between the nodes
+// under control of the caller.
+type TestNet struct {
+	Network *MemNetwork
+	Nodes   []*Manage
+	addrs   []*NetAddress
+}
+
+// NewTestNet creates n nodes on a new MemNetwork whose lost writes are picked
+// by random sources derived from seed.  Node i has the IP address
+// TestNetIP(i).  The nodes run on the regression test network and accept as
+// many peers as there are nodes.  configure, when not nil, may change the
+// configuration of every node before it is created and setup, when not nil,
+// registers the reactors of every node.  The nodes are not started.
+func NewTestNet(n int, seed int64, configure func(i int, config *Config),
+	setup func(i int, m *Manage) error) (*TestNet, error) {
+
+	tn := &TestNet{Network: NewMemNetwork(seed)}
+	for i := 0; i < n; i++ {
+		key, err := GenNodeKey()
+		if err != nil {
+			tn.Stop()
+			return nil, err
+		}
+		ip := TestNetIP(i)
+		config := Config{
+			ListenAddr:      net.JoinHostPort(ip.String(), fmt.Sprint(testNetPort)),
+			ChainParams:     &chaincfg.RegressionNetParams,
+			NodeKey:         key,
+			Transport:       tn.Network.Transport(ip),
+			AllowLocalAddrs: true,
+			MaxOutbound:     n,
+			MaxInbound:      n + defaultReservedInbound,
+		}
+		if configure != nil {
+			configure(i, &config)
+		}
+		m, err := NewManage(config)
+		if err != nil {
+			tn.Stop()
+			return nil, err
+		}
+		tn.Nodes = append(tn.Nodes, m)
+		tn.addrs = append(tn.addrs, NewNetAddressIPPort(key.ID(), ip,
+			testNetPort))
+		if setup != nil {
+			if err := setup(i, m); err != nil {
+				tn.Stop()
+				return nil, err
+			}
+		}
+	}
+	return tn, nil
+}
+
+// TestNetIP returns the IP address of node i of a TestNet.
+func TestNetIP(i int) net.IP {
+	i++
+	return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+}
+
+// Addr returns the address of node i.
+func (tn *TestNet) Addr(i int) *NetAddress {
+	return tn.addrs[i]
+}
+
+// Start starts all nodes.
+func (tn *TestNet) Start() {
+	for _, m := range tn.Nodes {
+		m.Start()
+	}
+}
+
+// Stop stops all nodes.
+func (tn *TestNet) Stop() {
+	for _, m := range tn.Nodes {
+		m.Stop()
+	}
+}
+
+// Connect makes node i dial node j.  It returns once the handshake completed.
+func (tn *TestNet) Connect(i, j int) error {
+	return tn.Nodes[i].DialPeerWithAddress(tn.addrs[j], false)
+}
+
+// ConnectAll connects every pair of nodes, the node with the lower index
+// dialing.
+func (tn *TestNet) ConnectAll() error {
+	for i := range tn.Nodes {
+		for j := i + 1; j < len(tn.Nodes); j++ {
+			if err := tn.Connect(i, j); err != nil {
+				return fmt.Errorf("connect node %d to node %d: %v",
+					i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+// WaitForPeers waits until every node has at least n peers.  It returns an
+// error when timeout elapsed first.
+func (tn *TestNet) WaitForPeers(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for i, m := range tn.Nodes {
+		for m.ConnectedCount() < n {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("node %d has %d peers, want %d", i,
+					m.ConnectedCount(), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// SetLink configures the link between the nodes i and j.  It returns an error
+// when the drop rate of config is not at least 0 and below 1.
+func (tn *TestNet) SetLink(i, j int, config LinkConfig) error {
+	return tn.Network.SetLink(TestNetIP(i), TestNetIP(j), config)
+}
+
+// Partition cuts the link between the nodes i and j.  Their connection is
+// reset and they cannot reconnect until the partition is healed.
+func (tn *TestNet) Partition(i, j int) {
+	tn.Network.Partition(TestNetIP(i), TestNetIP(j))
+}
+
+// PartitionGroups cuts every link between a node of group a and a node of
+// group b.
+func (tn *TestNet) PartitionGroups(a, b []int) {
+	for _, i := range a {
+		for _, j := range b {
+			tn.Partition(i, j)
+		}
+	}
+}
+
+// Heal restores the link between the nodes i and j.
+func (tn *TestNet) Heal(i, j int) {
+	tn.Network.Heal(TestNetIP(i), TestNetIP(j))
+}
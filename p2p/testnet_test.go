@@ -0,0 +1,331 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStartedTestNet returns a started TestNet of n nodes stopped when the
+// test ends.
+func newStartedTestNet(t *testing.T, n int, seed int64) *TestNet {
+	tn, err := NewTestNet(n, seed, nil, nil)
+	if err != nil {
+		t.Fatalf("NewTestNet: %v", err)
+	}
+	tn.Start()
+	t.Cleanup(tn.Stop)
+	return tn
+}
+
+// TestTestNetConnectAll ensures the nodes of a TestNet connect to each other
+// and complete the handshake.
+func TestTestNetConnectAll(t *testing.T) {
+	const numNodes = 4
+	tn := newStartedTestNet(t, numNodes, 1)
+	if err := tn.ConnectAll(); err != nil {
+		t.Fatalf("ConnectAll: %v", err)
+	}
+	if err := tn.WaitForPeers(numNodes-1, 10*time.Second); err != nil {
+		t.Fatalf("WaitForPeers: %v", err)
+	}
+
+	for i, m := range tn.Nodes {
+		for j := range tn.Nodes {
+			if i == j {
+				continue
+			}
+			p := m.Peer(tn.Addr(j).ID)
+			if p == nil {
+				t.Errorf("node %d is not connected to node %d", i, j)
+				continue
+			}
+			if p.NodeInfo().ID != tn.Addr(j).ID {
+				t.Errorf("node %d sees node %d as %s, want %s", i, j,
+					p.NodeInfo().ID, tn.Addr(j).ID)
+			}
+			if p.IsOutbound() != (i < j) {
+				t.Errorf("node %d: outbound %v for node %d", i,
+					p.IsOutbound(), j)
+			}
+			if !ipOf(p.RemoteAddr()).Equal(TestNetIP(j)) {
+				t.Errorf("node %d sees node %d at %v, want %v", i, j,
+					p.RemoteAddr(), TestNetIP(j))
+			}
+		}
+	}
+
+	if err := tn.Connect(0, 1); err != ErrAlreadyConnected {
+		t.Errorf("Connect to a peer: got %v, want %v", err,
+			ErrAlreadyConnected)
+	}
+}
+
+// TestTestNetPartition ensures a partition resets the connections between
+// the nodes and refuses their dials until it is healed.
+func TestTestNetPartition(t *testing.T) {
+	tn := newStartedTestNet(t, 3, 1)
+	if err := tn.ConnectAll(); err != nil {
+		t.Fatalf("ConnectAll: %v", err)
+	}
+	if err := tn.WaitForPeers(2, 10*time.Second); err != nil {
+		t.Fatalf("WaitForPeers: %v", err)
+	}
+
+	tn.Partition(0, 1)
+	waitFor(t, "the partitioned nodes to disconnect", func() bool {
+		return tn.Nodes[0].Peer(tn.Addr(1).ID) == nil &&
+			tn.Nodes[1].Peer(tn.Addr(0).ID) == nil
+	})
+	// The other links are untouched.
+	if tn.Nodes[2].ConnectedCount() != 2 {
+		t.Errorf("node 2 has %d peers, want 2",
+			tn.Nodes[2].ConnectedCount())
+	}
+
+	for _, dial := range [][2]int{{0, 1}, {1, 0}} {
+		err := tn.Connect(dial[0], dial[1])
+		if !errors.Is(err, errMemPartitioned) {
+			t.Errorf("node %d dialing node %d across the partition: "+
+				"got %v, want %v", dial[0], dial[1], err,
+				errMemPartitioned)
+		}
+	}
+
+	tn.Heal(0, 1)
+	if err := tn.Connect(0, 1); err != nil {
+		t.Fatalf("Connect after Heal: %v", err)
+	}
+	if err := tn.WaitForPeers(2, 10*time.Second); err != nil {
+		t.Fatalf("WaitForPeers after Heal: %v", err)
+	}
+}
+
+// waitFor waits up to 10 seconds for cond to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// memDial connects host a to a listener of host b on network n and returns
+// both ends of the connection.
+func memDial(t *testing.T, n *MemNetwork, a, b net.IP) (net.Conn, net.Conn) {
+	l, err := n.Transport(b).Listen(net.JoinHostPort(b.String(), "0"))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+	c, err := n.Transport(a).Dial(NewNetAddressIPPort("", lAddr.IP,
+		uint16(lAddr.Port)), time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("Accept failed")
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c, s
+}
+
+// TestMemNetworkLatency ensures the writes take the latency of the link to
+// reach the other end, and arrive complete and in order when some of them
+// are lost and retransmitted.
+func TestMemNetworkLatency(t *testing.T) {
+	const latency = 200 * time.Millisecond
+	n := NewMemNetwork(1)
+	a, b := TestNetIP(0), TestNetIP(1)
+	if err := n.SetLink(a, b, LinkConfig{Latency: latency}); err != nil {
+		t.Fatalf("SetLink: %v", err)
+	}
+	c, s := memDial(t, n, a, b)
+
+	start := time.Now()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("write delivered after %v, want at least %v", elapsed,
+			latency)
+	}
+
+	// The link applies in both directions.
+	start = time.Now()
+	s.Write([]byte("pong"))
+	io.ReadFull(c, buf)
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("reply delivered after %v, want at least %v", elapsed,
+			latency)
+	}
+
+	err := n.SetLink(a, b, LinkConfig{
+		DropRate:          0.3,
+		RetransmitTimeout: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("SetLink: %v", err)
+	}
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		msg := []byte{byte(i), byte(i + 1), byte(i + 2)}
+		want.Write(msg)
+		if _, err := c.Write(msg); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+	got := make([]byte, want.Len())
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Error("writes on a lossy link arrived corrupted or out of order")
+	}
+}
+
+// dropPattern returns how many times each of count writes made on c is lost.
+// A lost write is delayed by the retransmit timeout of an hour, so the
+// losses are read from the time it is due.  The writes are not queued, so
+// they do not delay each other.
+func dropPattern(c *memConn, count int) []int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	drops := make([]int, count)
+	for i := range drops {
+		c.lastDelivery = time.Time{}
+		drops[i] = int(time.Until(c.deliveryTime()).Round(time.Hour) /
+			time.Hour)
+	}
+	return drops
+}
+
+// TestMemNetworkDropRate ensures the writes lost on a connection only depend
+// on the seed of the network and the addresses of the connection, not on
+// the writes made on the other connections.
+func TestMemNetworkDropRate(t *testing.T) {
+	const numWrites = 200
+	link := LinkConfig{DropRate: 0.2, RetransmitTimeout: time.Hour}
+
+	// run returns the drop pattern of a connection from node 0 to node 1
+	// while, when busy, other connections write concurrently.
+	run := func(seed int64, busy bool) []int {
+		n := NewMemNetwork(seed)
+		for i := 0; i < 3; i++ {
+			for j := i + 1; j < 3; j++ {
+				err := n.SetLink(TestNetIP(i), TestNetIP(j), link)
+				if err != nil {
+					t.Fatalf("SetLink: %v", err)
+				}
+			}
+		}
+		c, _ := memDial(t, n, TestNetIP(0), TestNetIP(1))
+		if !busy {
+			return dropPattern(c.(*memConn), numWrites)
+		}
+
+		var wg sync.WaitGroup
+		for _, pair := range [][2]int{{0, 2}, {2, 1}, {1, 0}} {
+			other, _ := memDial(t, n, TestNetIP(pair[0]),
+				TestNetIP(pair[1]))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				dropPattern(other.(*memConn), numWrites)
+			}()
+		}
+		drops := dropPattern(c.(*memConn), numWrites)
+		wg.Wait()
+		return drops
+	}
+
+	first := run(7, false)
+	lost := 0
+	for _, d := range first {
+		lost += d
+	}
+	if lost < numWrites/10 || lost > numWrites*4/10 {
+		t.Errorf("%d losses in %d writes, want about %d", lost,
+			numWrites, numWrites/4)
+	}
+	for i := 0; i < 3; i++ {
+		if again := run(7, true); !equalInts(again, first) {
+			t.Fatalf("same seed lost writes %v, then %v", first, again)
+		}
+	}
+	if other := run(8, false); equalInts(other, first) {
+		t.Errorf("seeds 7 and 8 lost the same writes %v", first)
+	}
+}
+
+// TestMemNetworkDropRateBounds ensures links losing every write are refused
+// and a write on a link losing nearly all of them is still delivered after
+// the retransmits allowed.
+func TestMemNetworkDropRateBounds(t *testing.T) {
+	n := NewMemNetwork(1)
+	a, b := TestNetIP(0), TestNetIP(1)
+	for _, rate := range []float64{-0.1, 1, 1.5, math.NaN()} {
+		err := n.SetLink(a, b, LinkConfig{DropRate: rate})
+		if err != errMemDropRate {
+			t.Errorf("drop rate %v: got %v, want %v", rate, err,
+				errMemDropRate)
+		}
+	}
+
+	err := n.SetLink(a, b, LinkConfig{
+		DropRate:          0.9999,
+		RetransmitTimeout: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("SetLink: %v", err)
+	}
+	c, s := memDial(t, n, a, b)
+	start := time.Now()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	want := maxMemRetransmits * time.Millisecond
+	if elapsed := time.Since(start); elapsed < want || elapsed > 5*time.Second {
+		t.Errorf("write delivered after %v, want about %v", elapsed, want)
+	}
+}
+
+// equalInts returns whether a and b hold the same values.
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
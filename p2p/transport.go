@@ -0,0 +1,33 @@
+package p2p
+
+import (
+	"net"
+	"time"
+)
+
+// Transport creates the connections of a node.  It listens for the inbound
+// connections and dials the outbound ones.  The addresses of the connections
+// and listeners it creates are *net.TCPAddr, except for the remote address
+// of the connections to peers dialed by name through a proxy.
+type Transport interface {
+	// Listen announces on the local address laddr of the form
+	// "host:port".
+	Listen(laddr string) (net.Listener, error)
+
+	// Dial connects to addr, giving up after timeout.
+	Dial(addr *NetAddress, timeout time.Duration) (net.Conn, error)
+}
+
+// tcpTransport is the Transport of TCP sockets used unless the configuration
+// says otherwise.
+type tcpTransport struct{}
+
+// Listen announces on the TCP address laddr.
+func (tcpTransport) Listen(laddr string) (net.Listener, error) {
+	return net.Listen("tcp", laddr)
+}
+
+// Dial connects to the TCP address addr.
+func (tcpTransport) Dial(addr *NetAddress, timeout time.Duration) (net.Conn, error) {
+	return addr.DialTimeout(timeout)
+}
@@ -1 +1,933 @@
 package p2p
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blockchainservice/address"
+	"github.com/blockchainservice/common"
+	"github.com/blockchainservice/crypto"
+)
+
+// discoveryVersion is the version of the discovery protocol sent in pings.
+const discoveryVersion = 1
+
+// Discovery packet types.
+const (
+	pingPacket = iota + 1
+	pongPacket
+	findnodePacket
+	neighborsPacket
+)
+
+const (
+	// maxPacketSize is the maximum size of a discovery packet.  It is
+	// below the minimum IPv6 MTU so packets are never fragmented.
+	maxPacketSize = 1280
+
+	// maxNeighbors is the maximum number of nodes in a neighbors packet.
+	maxNeighbors = 12
+
+	// maxSignatureLen and maxEncodedPubKeyLen bound the signature and the
+	// type prefixed public key of a packet.
+	maxSignatureLen     = 72
+	maxEncodedPubKeyLen = 34
+
+	// endpointSize is the serialized size of an endpoint.
+	endpointSize = 16 + 2 + 2
+
+	respTimeout    = 500 * time.Millisecond
+	expiration     = 20 * time.Second
+	bondExpiration = 24 * time.Hour
+)
+
+// Errors returned by the discovery protocol.
+var (
+	errPacketTooSmall   = errors.New("too small")
+	errBadSignature     = errors.New("invalid signature")
+	errExpired          = errors.New("expired")
+	errUnsolicitedReply = errors.New("unsolicited reply")
+	errUnknownNode      = errors.New("unknown node")
+	errTimeout          = errors.New("RPC timeout")
+	errClosed           = errors.New("socket closed")
+)
+
+// endpoint is the address a node is reachable at.
+type endpoint struct {
+	IP  net.IP
+	UDP uint16
+	TCP uint16
+}
+
+func makeEndpoint(addr *net.UDPAddr, tcpPort uint16) endpoint {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+	return endpoint{IP: ip, UDP: uint16(addr.Port), TCP: tcpPort}
+}
+
+// packet is implemented by the payloads of the discovery packets.
+type packet interface {
+	// name returns the name of the packet for logging.
+	name() string
+
+	// encode writes the payload to w.
+	encode(w io.Writer) error
+
+	// decode reads the payload from r.
+	decode(r io.Reader) error
+
+	// handle processes the packet received from the node with the given
+	// ID at the given address.  mac is the hash of the whole packet.
+	handle(t *udp, from *net.UDPAddr, fromID NodeID, mac []byte) error
+}
+
+type ping struct {
+	Version    uint32
+	From, To   endpoint
+	Expiration uint64
+}
+
+type pong struct {
+	// To mirrors the UDP envelope address of the ping packet, which
+	// provides a way to discover the external address (after NAT).
+	To endpoint
+
+	// ReplyTok is the hash of the ping packet.
+	ReplyTok   []byte
+	Expiration uint64
+}
+
+type findnode struct {
+	Target     NodeID
+	Expiration uint64
+}
+
+type neighbors struct {
+	Nodes      []nodeRecord
+	Expiration uint64
+}
+
+// nodeRecord is a node as sent in a neighbors packet.
+type nodeRecord struct {
+	endpoint
+	ID NodeID
+}
+
+// pending represents a pending reply.
+//
+// Some implementations of the protocol wish to send more than one reply
+// packet to findnode.  In general, any neighbors packet cannot be matched up
+// with a specific findnode packet.
+//
+// Our implementation handles this by storing a callback function for each
+// pending reply.  Incoming packets from a node are dispatched to all the
+// callback functions for that node.
+type pending struct {
+	// these fields must match in the reply.
+	from  NodeID
+	ptype byte
+
+	// time when the request must complete
+	deadline time.Time
+
+	// callback is called when a matching reply arrives.  If it returns
+	// true, the callback is removed from the pending reply queue.  If it
+	// returns false, the reply is considered incomplete and the callback
+	// will be invoked again for the next matching reply.
+	callback func(resp interface{}) (done bool)
+
+	// errc receives nil when the callback indicates completion or an
+	// error if no further reply is received within the timeout.
+	errc chan<- error
+}
+
+type reply struct {
+	from  NodeID
+	ptype byte
+	data  interface{}
+
+	// loop indicates whether there was a matching request by sending on
+	// this channel.
+	matched chan<- bool
+}
+
+// udp implements the discovery protocol over a UDP socket.
+type udp struct {
+	conn  *net.UDPConn
+	priv  crypto.PrivateKey
+	magic uint32
+	tab   *Table
+
+	// ourEndpoint and selfNode describe the local node, they change when
+	// the external IP address does.
+	selfMtx     sync.Mutex
+	ourEndpoint endpoint
+	selfNode    *Node
+
+	// lastPing and lastPong hold the times a ping was last received from
+	// and a pong last received from each node.  A node that answered a
+	// ping proved its endpoint and may query the table, a node that pinged
+	// us may be queried.
+	bondMtx  sync.Mutex
+	lastPing map[NodeID]time.Time
+	lastPong map[NodeID]time.Time
+
+	addpending chan *pending
+	gotreply   chan reply
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// ListenUDP starts the discovery protocol on the UDP address laddr.  The
+// node is identified by the ID of priv and advertises tcpPort as the port
+// peer connections are accepted on.  Packets are tagged with the magic of the
+// network so nodes of different networks never find each other.  The
+// returned table is bootstrapped from bootnodes.
+func ListenUDP(priv crypto.PrivateKey, magic uint32, laddr string,
+	tcpPort uint16, bootnodes []*Node) (*Table, error) {
+
+	addr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tab := newUDP(conn, priv, magic, tcpPort, bootnodes)
+	log.Infof("UDP discovery listening on %s, self %s", conn.LocalAddr(),
+		tab.self)
+	return tab, nil
+}
+
+func newUDP(conn *net.UDPConn, priv crypto.PrivateKey, magic uint32,
+	tcpPort uint16, bootnodes []*Node) *Table {
+
+	var id NodeID
+	copy(id[:], address.PubKeyHash(priv.PubKey()))
+	realaddr := conn.LocalAddr().(*net.UDPAddr)
+	ourEndpoint := makeEndpoint(realaddr, tcpPort)
+	t := &udp{
+		conn:        conn,
+		priv:        priv,
+		magic:       magic,
+		ourEndpoint: ourEndpoint,
+		selfNode: &Node{
+			ID:  id,
+			IP:  ourEndpoint.IP,
+			UDP: ourEndpoint.UDP,
+			TCP: ourEndpoint.TCP,
+		},
+		lastPing:   make(map[NodeID]time.Time),
+		lastPong:   make(map[NodeID]time.Time),
+		addpending: make(chan *pending),
+		gotreply:   make(chan reply),
+		closing:    make(chan struct{}),
+	}
+	t.tab = newTable(t, bootnodes)
+
+	t.wg.Add(2)
+	go t.loop()
+	go t.readLoop()
+	go t.tab.loop()
+	return t.tab
+}
+
+func (t *udp) self() *Node {
+	t.selfMtx.Lock()
+	defer t.selfMtx.Unlock()
+	return t.selfNode
+}
+
+// setExternalIP advertises ip as the address of the local node.
+func (t *udp) setExternalIP(ip net.IP) {
+	t.selfMtx.Lock()
+	defer t.selfMtx.Unlock()
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	t.ourEndpoint.IP = ip
+	self := *t.selfNode
+	self.IP = ip
+	t.selfNode = &self
+}
+
+// endpoint returns the endpoint of the local node.
+func (t *udp) endpoint() endpoint {
+	t.selfMtx.Lock()
+	defer t.selfMtx.Unlock()
+	return t.ourEndpoint
+}
+
+func (t *udp) close() {
+	close(t.closing)
+	t.conn.Close()
+	t.wg.Wait()
+}
+
+// ping sends a ping message to the given node and waits for a reply.
+func (t *udp) ping(n *Node) error {
+	return <-t.sendPing(n, nil)
+}
+
+// sendPing sends a ping message to the given node and invokes the callback
+// when the reply arrives.
+func (t *udp) sendPing(n *Node, callback func()) <-chan error {
+	req := &ping{
+		Version:    discoveryVersion,
+		From:       t.endpoint(),
+		To:         makeEndpoint(n.addr(), n.TCP),
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	}
+	packet, hash, err := t.encodePacket(pingPacket, req)
+	if err != nil {
+		errc := make(chan error, 1)
+		errc <- err
+		return errc
+	}
+	// Add a matcher for the reply to the pending reply queue.  Pongs are
+	// matched if they reference the ping we're about to send.
+	errc := t.pending(n.ID, pongPacket, func(p interface{}) bool {
+		ok := bytes.Equal(p.(*pong).ReplyTok, hash)
+		if ok && callback != nil {
+			callback()
+		}
+		return ok
+	})
+	// Send the packet.
+	t.write(n.addr(), n.ID, req.name(), packet)
+	return errc
+}
+
+// findnode sends a findnode request to the given node and waits until the
+// node has sent up to bucketSize neighbors or a respTimeout has passed.
+func (t *udp) findnode(n *Node, target NodeID) ([]*Node, error) {
+	// If we haven't seen a ping from the destination node for a while,
+	// it won't remember our endpoint proof and reject findnode.  Solicit
+	// a ping first.
+	if time.Since(t.lastPingReceived(n.ID)) > bondExpiration {
+		t.ping(n)
+		// Wait for them to ping back and process our pong.
+		time.Sleep(respTimeout)
+	}
+
+	// Add a matcher for 'neighbors' replies to the pending reply queue.
+	// The matcher waits for bucketSize nodes to be returned.
+	nodes := make([]*Node, 0, bucketSize)
+	nreceived := 0
+	errc := t.pending(n.ID, neighborsPacket, func(r interface{}) bool {
+		reply := r.(*neighbors)
+		for _, rn := range reply.Nodes {
+			nreceived++
+			node, err := t.nodeFromRecord(n.addr(), rn)
+			if err != nil {
+				log.Tracef("Invalid neighbor node received "+
+					"from %s: %v", n, err)
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+		// A packet that is not full is the last one of the reply.
+		return nreceived >= bucketSize || len(reply.Nodes) < maxNeighbors
+	})
+	t.send(n.addr(), n.ID, findnodePacket, &findnode{
+		Target:     target,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	return nodes, <-errc
+}
+
+// pending adds a reply matcher to the pending reply queue.
+func (t *udp) pending(id NodeID, ptype byte,
+	callback func(interface{}) bool) <-chan error {
+
+	ch := make(chan error, 1)
+	p := &pending{from: id, ptype: ptype, callback: callback, errc: ch}
+	select {
+	case t.addpending <- p:
+		// loop will handle it
+	case <-t.closing:
+		ch <- errClosed
+	}
+	return ch
+}
+
+// handleReply dispatches a reply packet, invoking reply matchers.  It
+// returns whether any matcher considered the packet acceptable.
+func (t *udp) handleReply(from NodeID, ptype byte, req packet) bool {
+	matched := make(chan bool, 1)
+	select {
+	case t.gotreply <- reply{from, ptype, req, matched}:
+		// loop will handle it
+		return <-matched
+	case <-t.closing:
+		return false
+	}
+}
+
+// loop runs in its own goroutine.  It keeps track of the refresh timer and
+// the pending reply queue.
+func (t *udp) loop() {
+	defer t.wg.Done()
+
+	var (
+		plist        = list.New()
+		timeout      = time.NewTimer(0)
+		nextTimeout  *pending // head of plist when timeout was last reset
+		contTimeouts = 0      // number of continuous timeouts
+	)
+	<-timeout.C // ignore first timeout
+	defer timeout.Stop()
+
+	resetTimeout := func() {
+		if plist.Front() == nil || nextTimeout == plist.Front().Value {
+			return
+		}
+		// Start the timer so it fires when the next pending reply has
+		// expired.
+		now := time.Now()
+		for el := plist.Front(); el != nil; el = el.Next() {
+			nextTimeout = el.Value.(*pending)
+			if dist := nextTimeout.deadline.Sub(now); dist < 2*respTimeout {
+				timeout.Reset(dist)
+				return
+			}
+			// Remove pending replies whose deadline is too far in
+			// the future.  These can occur if the system clock
+			// jumped backwards after the deadline was assigned.
+			nextTimeout.errc <- errClockWarp
+			plist.Remove(el)
+		}
+		nextTimeout = nil
+		timeout.Stop()
+	}
+
+	for {
+		resetTimeout()
+
+		select {
+		case <-t.closing:
+			for el := plist.Front(); el != nil; el = el.Next() {
+				el.Value.(*pending).errc <- errClosed
+			}
+			return
+
+		case p := <-t.addpending:
+			p.deadline = time.Now().Add(respTimeout)
+			plist.PushBack(p)
+
+		case r := <-t.gotreply:
+			var matched bool
+			for el := plist.Front(); el != nil; el = el.Next() {
+				p := el.Value.(*pending)
+				if p.from == r.from && p.ptype == r.ptype {
+					matched = true
+					// Remove the matcher if its callback
+					// indicates that all replies have been
+					// received.
+					if p.callback(r.data) {
+						p.errc <- nil
+						plist.Remove(el)
+					}
+					// Reset the continuous timeout counter.
+					contTimeouts = 0
+				}
+			}
+			r.matched <- matched
+
+		case now := <-timeout.C:
+			nextTimeout = nil
+
+			// Notify and remove callbacks whose deadline is in the
+			// past.
+			for el := plist.Front(); el != nil; el = el.Next() {
+				p := el.Value.(*pending)
+				if now.After(p.deadline) || now.Equal(p.deadline) {
+					p.errc <- errTimeout
+					plist.Remove(el)
+					contTimeouts++
+				}
+			}
+			if contTimeouts > 32 {
+				log.Warnf("%d discovery requests timed out in a "+
+					"row, check the clock and the network",
+					contTimeouts)
+				contTimeouts = 0
+			}
+		}
+	}
+}
+
+// errClockWarp is returned for pending replies whose deadline moved too far
+// into the future because the system clock jumped backwards.
+var errClockWarp = errors.New("reply deadline too far in the future")
+
+// send encodes and sends a packet to the node with the given ID at toaddr.
+func (t *udp) send(toaddr *net.UDPAddr, toid NodeID, ptype byte,
+	req packet) ([]byte, error) {
+
+	packet, hash, err := t.encodePacket(ptype, req)
+	if err != nil {
+		return hash, err
+	}
+	return hash, t.write(toaddr, toid, req.name(), packet)
+}
+
+func (t *udp) write(toaddr *net.UDPAddr, toid NodeID, what string,
+	packet []byte) error {
+
+	_, err := t.conn.WriteToUDP(packet, toaddr)
+	log.Tracef(">> %s %s@%s: %v", what, toid, toaddr, err)
+	return err
+}
+
+// sigHash returns the hash signed by the sender of a packet.  It commits to
+// the magic of the network so packets are not accepted by the nodes of other
+// networks.
+func (t *udp) sigHash(ptype byte, payload []byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	binary.LittleEndian.PutUint32(buf, t.magic)
+	buf[4] = ptype
+	buf = append(buf, payload...)
+	return common.DoubleHashB(buf)
+}
+
+// encodePacket serializes and signs a packet.  A packet is made of the type
+// prefixed public key and the signature of the sender, both variable length,
+// followed by the packet type and the payload.  The hash of the whole packet
+// is returned along with it.
+func (t *udp) encodePacket(ptype byte, req packet) (packet, hash []byte,
+	err error) {
+
+	var payload bytes.Buffer
+	if err := req.encode(&payload); err != nil {
+		return nil, nil, err
+	}
+	sig, err := t.priv.Sign(t.sigHash(ptype, payload.Bytes()))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var b bytes.Buffer
+	common.WriteVarBytes(&b, crypto.EncodePublicKey(t.priv.PubKey()))
+	common.WriteVarBytes(&b, sig)
+	b.WriteByte(ptype)
+	b.Write(payload.Bytes())
+	if b.Len() > maxPacketSize {
+		return nil, nil, fmt.Errorf("%s packet of %d bytes exceeds the "+
+			"maximum packet size", req.name(), b.Len())
+	}
+	return b.Bytes(), common.DoubleHashB(b.Bytes()), nil
+}
+
+// decodePacket parses and authenticates a packet, returning the payload and
+// the ID of the node that signed it.
+func (t *udp) decodePacket(buf []byte) (packet, NodeID, []byte, error) {
+	var fromID NodeID
+	r := bytes.NewReader(buf)
+	encodedPubKey, err := common.ReadVarBytes(r, maxEncodedPubKeyLen,
+		"public key")
+	if err != nil {
+		return nil, fromID, nil, err
+	}
+	sig, err := common.ReadVarBytes(r, maxSignatureLen, "signature")
+	if err != nil {
+		return nil, fromID, nil, err
+	}
+	ptype, err := r.ReadByte()
+	if err != nil {
+		return nil, fromID, nil, errPacketTooSmall
+	}
+	payload := buf[len(buf)-r.Len():]
+
+	pubKey, err := crypto.DecodePublicKey(encodedPubKey)
+	if err != nil {
+		return nil, fromID, nil, err
+	}
+	if !pubKey.Verify(t.sigHash(ptype, payload), sig) {
+		return nil, fromID, nil, errBadSignature
+	}
+	copy(fromID[:], address.Hash160(encodedPubKey))
+
+	var req packet
+	switch ptype {
+	case pingPacket:
+		req = new(ping)
+	case pongPacket:
+		req = new(pong)
+	case findnodePacket:
+		req = new(findnode)
+	case neighborsPacket:
+		req = new(neighbors)
+	default:
+		return nil, fromID, nil, fmt.Errorf("unknown type: %d", ptype)
+	}
+	if err := req.decode(r); err != nil {
+		return nil, fromID, nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fromID, nil, fmt.Errorf("%d trailing bytes", r.Len())
+	}
+	return req, fromID, common.DoubleHashB(buf), nil
+}
+
+// readLoop runs in its own goroutine.  It handles incoming UDP packets.
+func (t *udp) readLoop() {
+	defer t.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		nbytes, from, err := t.conn.ReadFromUDP(buf)
+		if isTemporary(err) {
+			// Ignore temporary read errors.
+			log.Debugf("Temporary UDP read error: %v", err)
+			continue
+		} else if err != nil {
+			// Shut down the loop for permanent errors.
+			select {
+			case <-t.closing:
+			default:
+				log.Debugf("UDP read error: %v", err)
+			}
+			return
+		}
+		t.handlePacket(from, buf[:nbytes])
+	}
+}
+
+func (t *udp) handlePacket(from *net.UDPAddr, buf []byte) error {
+	req, fromID, hash, err := t.decodePacket(buf)
+	if err != nil {
+		log.Tracef("Bad discovery packet from %s: %v", from, err)
+		return err
+	}
+	err = req.handle(t, from, fromID, hash)
+	log.Tracef("<< %s %s@%s: %v", req.name(), fromID, from, err)
+	return err
+}
+
+func (t *udp) lastPingReceived(id NodeID) time.Time {
+	t.bondMtx.Lock()
+	defer t.bondMtx.Unlock()
+	return t.lastPing[id]
+}
+
+func (t *udp) lastPongReceived(id NodeID) time.Time {
+	t.bondMtx.Lock()
+	defer t.bondMtx.Unlock()
+	return t.lastPong[id]
+}
+
+func (t *udp) updateLastPingReceived(id NodeID, at time.Time) {
+	t.bondMtx.Lock()
+	t.lastPing[id] = at
+	t.bondMtx.Unlock()
+}
+
+func (t *udp) updateLastPongReceived(id NodeID, at time.Time) {
+	t.bondMtx.Lock()
+	t.lastPong[id] = at
+	t.bondMtx.Unlock()
+}
+
+// nodeFromRecord returns the node described by a record of a neighbors
+// packet received from sender.
+func (t *udp) nodeFromRecord(sender *net.UDPAddr, rn nodeRecord) (*Node, error) {
+	if rn.UDP <= 1024 {
+		return nil, errors.New("low port")
+	}
+	if rn.IP.IsUnspecified() || rn.IP.IsMulticast() {
+		return nil, fmt.Errorf("invalid IP %s", rn.IP)
+	}
+	// Loopback addresses are only accepted from nodes on the loopback
+	// network themselves.
+	if rn.IP.IsLoopback() && !sender.IP.IsLoopback() {
+		return nil, fmt.Errorf("loopback IP %s from %s", rn.IP, sender)
+	}
+	if rn.ID == t.selfNode.ID {
+		return nil, errors.New("local node")
+	}
+	return &Node{ID: rn.ID, IP: rn.IP, UDP: rn.UDP, TCP: rn.TCP}, nil
+}
+
+func expired(ts uint64) bool {
+	return time.Unix(int64(ts), 0).Before(time.Now())
+}
+
+func (req *ping) name() string {
+	return "PING"
+}
+
+func (req *ping) handle(t *udp, from *net.UDPAddr, fromID NodeID,
+	mac []byte) error {
+
+	if expired(req.Expiration) {
+		return errExpired
+	}
+	t.send(from, fromID, pongPacket, &pong{
+		To:         makeEndpoint(from, req.From.TCP),
+		ReplyTok:   mac,
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+
+	// Ping back if our last pong on file is too far in the past.
+	n := &Node{ID: fromID, IP: from.IP, UDP: uint16(from.Port),
+		TCP: req.From.TCP}
+	if time.Since(t.lastPongReceived(fromID)) > bondExpiration {
+		t.sendPing(n, func() {
+			t.tab.addVerifiedNode(n)
+		})
+	} else {
+		t.tab.addVerifiedNode(n)
+	}
+
+	t.updateLastPingReceived(fromID, time.Now())
+	t.handleReply(fromID, pingPacket, req)
+	return nil
+}
+
+func (req *pong) name() string {
+	return "PONG"
+}
+
+func (req *pong) handle(t *udp, from *net.UDPAddr, fromID NodeID,
+	mac []byte) error {
+
+	if expired(req.Expiration) {
+		return errExpired
+	}
+	if !t.handleReply(fromID, pongPacket, req) {
+		return errUnsolicitedReply
+	}
+	t.updateLastPongReceived(fromID, time.Now())
+	return nil
+}
+
+func (req *findnode) name() string {
+	return "FINDNODE"
+}
+
+func (req *findnode) handle(t *udp, from *net.UDPAddr, fromID NodeID,
+	mac []byte) error {
+
+	if expired(req.Expiration) {
+		return errExpired
+	}
+	if time.Since(t.lastPongReceived(fromID)) > bondExpiration {
+		// No endpoint proof pong exists, we don't process the packet.
+		// This prevents an attack vector where the discovery protocol
+		// could be used to amplify traffic in a DDOS attack.  A
+		// malicious actor would send a findnode request with the IP
+		// address and UDP port of the target as the source address.
+		// The recipient of the findnode packet would then send a
+		// neighbors packet (which is a much bigger packet than
+		// findnode) to the victim.
+		return errUnknownNode
+	}
+	t.tab.mutex.Lock()
+	closest := t.tab.closest(req.Target, bucketSize).entries
+	t.tab.mutex.Unlock()
+
+	// Send neighbors in chunks with at most maxNeighbors per packet to
+	// stay below the packet size limit.  The requester takes a packet that
+	// is not full as the end of the reply, so an empty one is sent when
+	// fewer than bucketSize nodes fill the last packet.
+	p := neighbors{Expiration: uint64(time.Now().Add(expiration).Unix())}
+	var count int
+	for _, n := range closest {
+		// Don't advertise loopback addresses to nodes that could not
+		// reach them.
+		if n.IP.IsLoopback() && !from.IP.IsLoopback() {
+			continue
+		}
+		p.Nodes = append(p.Nodes, nodeRecord{
+			endpoint: makeEndpoint(n.addr(), n.TCP),
+			ID:       n.ID,
+		})
+		count++
+		if len(p.Nodes) == maxNeighbors {
+			t.send(from, fromID, neighborsPacket, &p)
+			p.Nodes = p.Nodes[:0]
+		}
+	}
+	if len(p.Nodes) > 0 || count < bucketSize {
+		t.send(from, fromID, neighborsPacket, &p)
+	}
+	return nil
+}
+
+func (req *neighbors) name() string {
+	return "NEIGHBORS"
+}
+
+func (req *neighbors) handle(t *udp, from *net.UDPAddr, fromID NodeID,
+	mac []byte) error {
+
+	if expired(req.Expiration) {
+		return errExpired
+	}
+	if !t.handleReply(fromID, neighborsPacket, req) {
+		return errUnsolicitedReply
+	}
+	return nil
+}
+
+// writeEndpoint serializes an endpoint as the 16 byte IP followed by the
+// big endian UDP and TCP ports.
+func writeEndpoint(w io.Writer, e *endpoint) error {
+	var buf [endpointSize]byte
+	copy(buf[:16], e.IP.To16())
+	binary.BigEndian.PutUint16(buf[16:], e.UDP)
+	binary.BigEndian.PutUint16(buf[18:], e.TCP)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readEndpoint(r io.Reader, e *endpoint) error {
+	var buf [endpointSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	ip := net.IP(buf[:16])
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	e.IP = ip
+	e.UDP = binary.BigEndian.Uint16(buf[16:])
+	e.TCP = binary.BigEndian.Uint16(buf[18:])
+	return nil
+}
+
+func writeUint64(w io.Writer, v uint64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readUint64(r io.Reader) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func (req *ping) encode(w io.Writer) error {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], req.Version)
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	if err := writeEndpoint(w, &req.From); err != nil {
+		return err
+	}
+	if err := writeEndpoint(w, &req.To); err != nil {
+		return err
+	}
+	return writeUint64(w, req.Expiration)
+}
+
+func (req *ping) decode(r io.Reader) error {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	req.Version = binary.LittleEndian.Uint32(buf[:])
+	if err := readEndpoint(r, &req.From); err != nil {
+		return err
+	}
+	if err := readEndpoint(r, &req.To); err != nil {
+		return err
+	}
+	var err error
+	req.Expiration, err = readUint64(r)
+	return err
+}
+
+func (req *pong) encode(w io.Writer) error {
+	if err := writeEndpoint(w, &req.To); err != nil {
+		return err
+	}
+	if _, err := w.Write(req.ReplyTok); err != nil {
+		return err
+	}
+	return writeUint64(w, req.Expiration)
+}
+
+func (req *pong) decode(r io.Reader) error {
+	if err := readEndpoint(r, &req.To); err != nil {
+		return err
+	}
+	req.ReplyTok = make([]byte, common.HashSize)
+	if _, err := io.ReadFull(r, req.ReplyTok); err != nil {
+		return err
+	}
+	var err error
+	req.Expiration, err = readUint64(r)
+	return err
+}
+
+func (req *findnode) encode(w io.Writer) error {
+	if _, err := w.Write(req.Target[:]); err != nil {
+		return err
+	}
+	return writeUint64(w, req.Expiration)
+}
+
+func (req *findnode) decode(r io.Reader) error {
+	if _, err := io.ReadFull(r, req.Target[:]); err != nil {
+		return err
+	}
+	var err error
+	req.Expiration, err = readUint64(r)
+	return err
+}
+
+func (req *neighbors) encode(w io.Writer) error {
+	if _, err := w.Write([]byte{byte(len(req.Nodes))}); err != nil {
+		return err
+	}
+	for i := range req.Nodes {
+		if err := writeEndpoint(w, &req.Nodes[i].endpoint); err != nil {
+			return err
+		}
+		if _, err := w.Write(req.Nodes[i].ID[:]); err != nil {
+			return err
+		}
+	}
+	return writeUint64(w, req.Expiration)
+}
+
+func (req *neighbors) decode(r io.Reader) error {
+	var count [1]byte
+	if _, err := io.ReadFull(r, count[:]); err != nil {
+		return err
+	}
+	if count[0] > maxNeighbors {
+		return fmt.Errorf("too many neighbors [count %d, max %d]",
+			count[0], maxNeighbors)
+	}
+	req.Nodes = make([]nodeRecord, count[0])
+	for i := range req.Nodes {
+		if err := readEndpoint(r, &req.Nodes[i].endpoint); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, req.Nodes[i].ID[:]); err != nil {
+			return err
+		}
+	}
+	var err error
+	req.Expiration, err = readUint64(r)
+	return err
+}
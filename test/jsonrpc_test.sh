@@ -4,4 +4,7 @@ curl -s -X POST -d '{"jsonrpc":"1.0","method":"hello_world","params":[],"id":1}'
 curl -s -X POST -d '{"jsonrpc":"1.0","method":"echo","params":["123456"],"id":1}' http://127.0.0.1:8080
 curl -s -X POST -d '{"jsonrpc":"1.0","method":"get_data","params":[[{"content": "987654321"}], {"a":1}, 87978],"id":1}' http://127.0.0.1:8080
 
-curl -s -X POST -d '{"jsonrpc":"1.0","method":"get_data","params":[[{"content": "987654321"}], {"a":1}, 87978, 7654321],"id":1}' http://127.0.0.1:8080
\ No newline at end of file
+curl -s -X POST -d '{"jsonrpc":"1.0","method":"get_data","params":[[{"content": "987654321"}], {"a":1}, 87978, 7654321],"id":1}' http://127.0.0.1:8080
+curl -s -X POST -d '{"jsonrpc":"1.0","method":"getnetworkinfo","params":[],"id":1}' http://127.0.0.1:8080
+curl -s -X POST -d '{"jsonrpc":"1.0","method":"getpeerinfo","params":[],"id":1}' http://127.0.0.1:8080
+curl -s -X POST -d '{"jsonrpc":"1.0","method":"getsyncinfo","params":[],"id":1}' http://127.0.0.1:8080
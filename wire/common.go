@@ -0,0 +1,263 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/blockchainservice/common"
+)
+
+// Variable length integers and byte arrays use the encoding of the common
+// package, which the chain data model shares with the wire.
+
+// littleEndian is a convenience variable since binary.LittleEndian is quite
+// long.
+var littleEndian = binary.LittleEndian
+
+// bigEndian is a convenience variable since binary.BigEndian is quite long.
+var bigEndian = binary.BigEndian
+
+// readElement reads the next sequence of bytes from r using little endian
+// depending on the concrete type of element pointed to.
+func readElement(r io.Reader, element interface{}) error {
+	var scratch [8]byte
+
+	switch e := element.(type) {
+	case *int32:
+		if _, err := io.ReadFull(r, scratch[:4]); err != nil {
+			return err
+		}
+		*e = int32(littleEndian.Uint32(scratch[:4]))
+		return nil
+
+	case *uint32:
+		if _, err := io.ReadFull(r, scratch[:4]); err != nil {
+			return err
+		}
+		*e = littleEndian.Uint32(scratch[:4])
+		return nil
+
+	case *int64:
+		if _, err := io.ReadFull(r, scratch[:8]); err != nil {
+			return err
+		}
+		*e = int64(littleEndian.Uint64(scratch[:8]))
+		return nil
+
+	case *uint64:
+		if _, err := io.ReadFull(r, scratch[:8]); err != nil {
+			return err
+		}
+		*e = littleEndian.Uint64(scratch[:8])
+		return nil
+
+	case *bool:
+		if _, err := io.ReadFull(r, scratch[:1]); err != nil {
+			return err
+		}
+		*e = scratch[0] != 0x00
+		return nil
+
+	case *uint8:
+		if _, err := io.ReadFull(r, scratch[:1]); err != nil {
+			return err
+		}
+		*e = scratch[0]
+		return nil
+
+	// Unix timestamp encoded as an int64 number of seconds.
+	case *time.Time:
+		if _, err := io.ReadFull(r, scratch[:8]); err != nil {
+			return err
+		}
+		*e = time.Unix(int64(littleEndian.Uint64(scratch[:8])), 0)
+		return nil
+
+	// Message header checksum.
+	case *[4]byte:
+		_, err := io.ReadFull(r, e[:])
+		return err
+
+	// Message header command.
+	case *[CommandSize]uint8:
+		_, err := io.ReadFull(r, e[:])
+		return err
+
+	// IP address.
+	case *[16]byte:
+		_, err := io.ReadFull(r, e[:])
+		return err
+
+	case *common.Hash:
+		_, err := io.ReadFull(r, e[:])
+		return err
+
+	case *ServiceFlag:
+		if _, err := io.ReadFull(r, scratch[:8]); err != nil {
+			return err
+		}
+		*e = ServiceFlag(littleEndian.Uint64(scratch[:8]))
+		return nil
+
+	case *InvType:
+		if _, err := io.ReadFull(r, scratch[:4]); err != nil {
+			return err
+		}
+		*e = InvType(littleEndian.Uint32(scratch[:4]))
+		return nil
+
+	case *RejectCode:
+		if _, err := io.ReadFull(r, scratch[:1]); err != nil {
+			return err
+		}
+		*e = RejectCode(scratch[0])
+		return nil
+	}
+
+	return fmt.Errorf("readElement: unsupported type %T", element)
+}
+
+// readElements reads multiple items from r.  It is equivalent to multiple
+// calls to readElement.
+func readElements(r io.Reader, elements ...interface{}) error {
+	for _, element := range elements {
+		err := readElement(r, element)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeElement writes the little endian representation of element to w.
+func writeElement(w io.Writer, element interface{}) error {
+	var scratch [8]byte
+
+	switch e := element.(type) {
+	case int32:
+		littleEndian.PutUint32(scratch[:4], uint32(e))
+		_, err := w.Write(scratch[:4])
+		return err
+
+	case uint32:
+		littleEndian.PutUint32(scratch[:4], e)
+		_, err := w.Write(scratch[:4])
+		return err
+
+	case int64:
+		littleEndian.PutUint64(scratch[:8], uint64(e))
+		_, err := w.Write(scratch[:8])
+		return err
+
+	case uint64:
+		littleEndian.PutUint64(scratch[:8], e)
+		_, err := w.Write(scratch[:8])
+		return err
+
+	case bool:
+		if e {
+			scratch[0] = 0x01
+		} else {
+			scratch[0] = 0x00
+		}
+		_, err := w.Write(scratch[:1])
+		return err
+
+	case uint8:
+		scratch[0] = e
+		_, err := w.Write(scratch[:1])
+		return err
+
+	// Unix timestamp encoded as an int64 number of seconds.
+	case time.Time:
+		littleEndian.PutUint64(scratch[:8], uint64(e.Unix()))
+		_, err := w.Write(scratch[:8])
+		return err
+
+	// Message header checksum.
+	case [4]byte:
+		_, err := w.Write(e[:])
+		return err
+
+	// Message header command.
+	case [CommandSize]uint8:
+		_, err := w.Write(e[:])
+		return err
+
+	// IP address.
+	case [16]byte:
+		_, err := w.Write(e[:])
+		return err
+
+	case *common.Hash:
+		_, err := w.Write(e[:])
+		return err
+
+	case ServiceFlag:
+		littleEndian.PutUint64(scratch[:8], uint64(e))
+		_, err := w.Write(scratch[:8])
+		return err
+
+	case InvType:
+		littleEndian.PutUint32(scratch[:4], uint32(e))
+		_, err := w.Write(scratch[:4])
+		return err
+
+	case RejectCode:
+		scratch[0] = uint8(e)
+		_, err := w.Write(scratch[:1])
+		return err
+	}
+
+	return fmt.Errorf("writeElement: unsupported type %T", element)
+}
+
+// writeElements writes multiple items to w.  It is equivalent to multiple
+// calls to writeElement.
+func writeElements(w io.Writer, elements ...interface{}) error {
+	for _, element := range elements {
+		err := writeElement(w, element)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadVarString reads a variable length string from r and returns it as a Go
+// string.  A variable length string is encoded as a variable length integer
+// containing the length of the string followed by the bytes that represent
+// the string itself.  An error is returned if the length is greater than the
+// maximum block payload size since it helps protect against memory exhaustion
+// attacks and forced panics through malformed messages.
+func ReadVarString(r io.Reader, maxAllowed uint32, fieldName string) (string, error) {
+	buf, err := common.ReadVarBytes(r, maxAllowed, fieldName)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// WriteVarString serializes str to w as a variable length integer containing
+// the length of the string followed by the bytes that represent the string
+// itself.
+func WriteVarString(w io.Writer, str string) error {
+	err := common.WriteVarInt(w, uint64(len(str)))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, str)
+	return err
+}
+
+// VarStringSerializeSize returns the number of bytes it would take to
+// serialize str as a variable length string.
+func VarStringSerializeSize(str string) int {
+	return common.VarIntSerializeSize(uint64(len(str))) + len(str)
+}
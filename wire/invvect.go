@@ -0,0 +1,132 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/blockchainservice/common"
+)
+
+const (
+	// MaxInvPerMsg is the maximum number of inventory vectors that can be
+	// in a single inv or getdata message.
+	MaxInvPerMsg = 50000
+
+	// defaultInvListAlloc is the default size used for the backing array
+	// for an inventory list.  The array will dynamically grow as needed,
+	// but this figure is intended to provide enough space for the max
+	// number of inventory vectors in a *typical* inventory message without
+	// needing to grow the backing array multiple times.
+	defaultInvListAlloc = 1000
+
+	// Maximum payload size for an inventory vector.
+	maxInvVectPayload = 4 + common.HashSize
+)
+
+// InvType represents the allowed types of inventory vectors.  See InvVect.
+type InvType uint32
+
+// These constants define the various supported inventory vector types.
+const (
+	InvTypeError InvType = 0
+	InvTypeTx    InvType = 1
+	InvTypeBlock InvType = 2
+)
+
+// Map of inventory vector types back to their constant names for pretty
+// printing.
+var ivStrings = map[InvType]string{
+	InvTypeError: "ERROR",
+	InvTypeTx:    "MSG_TX",
+	InvTypeBlock: "MSG_BLOCK",
+}
+
+// String returns the InvType in human-readable form.
+func (invtype InvType) String() string {
+	if s, ok := ivStrings[invtype]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("Unknown InvType (%d)", uint32(invtype))
+}
+
+// InvVect defines an inventory vector which is used to describe data,
+// as specified by the Type field, that a peer wants, has, or does not have to
+// another peer.
+type InvVect struct {
+	Type InvType     // Type of data
+	Hash common.Hash // Hash of the data
+}
+
+// NewInvVect returns a new InvVect using the provided type and hash.
+func NewInvVect(typ InvType, hash *common.Hash) *InvVect {
+	return &InvVect{
+		Type: typ,
+		Hash: *hash,
+	}
+}
+
+// readInvVect reads an encoded InvVect from r depending on the protocol
+// version.
+func readInvVect(r io.Reader, pver uint32, iv *InvVect) error {
+	return readElements(r, &iv.Type, &iv.Hash)
+}
+
+// writeInvVect serializes an InvVect to w depending on the protocol version.
+func writeInvVect(w io.Writer, pver uint32, iv *InvVect) error {
+	return writeElements(w, iv.Type, &iv.Hash)
+}
+
+// readInvList reads a count prefixed list of inventory vectors from r.
+func readInvList(r io.Reader, pver uint32, cmd string) ([]*InvVect, error) {
+	count, err := common.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Limit to max inventory vectors per message.
+	if count > MaxInvPerMsg {
+		str := fmt.Sprintf("too many invvect in message [%v]", count)
+		return nil, messageError(cmd, str)
+	}
+
+	// Create a contiguous slice of inventory vectors to decode into in
+	// order to reduce the number of allocations.
+	invList := make([]*InvVect, 0, count)
+	invVects := make([]InvVect, count)
+	for i := uint64(0); i < count; i++ {
+		iv := &invVects[i]
+		err := readInvVect(r, pver, iv)
+		if err != nil {
+			return nil, err
+		}
+		invList = append(invList, iv)
+	}
+	return invList, nil
+}
+
+// writeInvList writes a count prefixed list of inventory vectors to w.
+func writeInvList(w io.Writer, pver uint32, cmd string, invList []*InvVect) error {
+	// Limit to max inventory vectors per message.
+	count := len(invList)
+	if count > MaxInvPerMsg {
+		str := fmt.Sprintf("too many invvect in message [%v]", count)
+		return messageError(cmd, str)
+	}
+
+	err := common.WriteVarInt(w, uint64(count))
+	if err != nil {
+		return err
+	}
+	for _, iv := range invList {
+		err := writeInvVect(w, pver, iv)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/blockchainservice/common"
+)
+
+// MessageHeaderSize is the number of bytes in a message header.
+// Network magic 4 bytes + command 12 bytes + payload length 4 bytes +
+// checksum 4 bytes.
+const MessageHeaderSize = 24
+
+// CommandSize is the fixed size of all commands in the common message
+// header.  Shorter commands must be zero padded.
+const CommandSize = 12
+
+// MaxMessagePayload is the maximum bytes a message can be regardless of other
+// individual limits imposed by messages themselves.
+const MaxMessagePayload = 1024 * 1024 * 32 // 32MB
+
+// Commands used in message headers which describe the type of message.
+const (
+	CmdVersion    = "version"
+	CmdVerAck     = "verack"
+	CmdPing       = "ping"
+	CmdPong       = "pong"
+	CmdInv        = "inv"
+	CmdGetData    = "getdata"
+	CmdNotFound   = "notfound"
+	CmdBlock      = "block"
+	CmdTx         = "tx"
+	CmdHeaders    = "headers"
+	CmdGetHeaders = "getheaders"
+	CmdAddr       = "addr"
+	CmdGetAddr    = "getaddr"
+	CmdReject     = "reject"
+)
+
+// Message is an interface that describes a message.  This interface provides
+// the ability to create and use messages in a generic fashion, allowing
+// peers to read and write any message without knowing its concrete type.
+type Message interface {
+	Decode(io.Reader, uint32) error
+	Encode(io.Writer, uint32) error
+	Command() string
+	MaxPayloadLength(uint32) uint32
+}
+
+// makeEmptyMessage creates a message of the appropriate concrete type based
+// on the command.
+func makeEmptyMessage(command string) (Message, error) {
+	var msg Message
+	switch command {
+	case CmdVersion:
+		msg = &MsgVersion{}
+
+	case CmdVerAck:
+		msg = &MsgVerAck{}
+
+	case CmdPing:
+		msg = &MsgPing{}
+
+	case CmdPong:
+		msg = &MsgPong{}
+
+	case CmdInv:
+		msg = &MsgInv{}
+
+	case CmdGetData:
+		msg = &MsgGetData{}
+
+	case CmdNotFound:
+		msg = &MsgNotFound{}
+
+	case CmdBlock:
+		msg = &MsgBlock{}
+
+	case CmdTx:
+		msg = &MsgTx{}
+
+	case CmdHeaders:
+		msg = &MsgHeaders{}
+
+	case CmdGetHeaders:
+		msg = &MsgGetHeaders{}
+
+	case CmdAddr:
+		msg = &MsgAddr{}
+
+	case CmdGetAddr:
+		msg = &MsgGetAddr{}
+
+	case CmdReject:
+		msg = &MsgReject{}
+
+	default:
+		return nil, fmt.Errorf("unhandled command [%s]", command)
+	}
+	return msg, nil
+}
+
+// messageHeader defines the header structure for all protocol messages.
+type messageHeader struct {
+	magic    uint32  // 4 bytes
+	command  string  // 12 bytes
+	length   uint32  // 4 bytes
+	checksum [4]byte // 4 bytes
+}
+
+// readMessageHeader reads a message header from r.
+func readMessageHeader(r io.Reader) (int, *messageHeader, error) {
+	// Since readElements doesn't return the amount of bytes read, attempt
+	// to read the entire header into a buffer first in case there is a
+	// short read so the proper amount of read bytes are known.  This works
+	// since the header is a fixed size.
+	var headerBytes [MessageHeaderSize]byte
+	n, err := io.ReadFull(r, headerBytes[:])
+	if err != nil {
+		return n, nil, err
+	}
+	hr := bytes.NewReader(headerBytes[:])
+
+	// Create and populate a messageHeader struct from the raw header bytes.
+	hdr := messageHeader{}
+	var command [CommandSize]byte
+	readElements(hr, &hdr.magic, &command, &hdr.length, &hdr.checksum)
+
+	// Strip trailing zeros from command string.
+	hdr.command = string(bytes.TrimRight(command[:], "\x00"))
+
+	return n, &hdr, nil
+}
+
+// discardInput reads n bytes from reader r in chunks and discards the read
+// bytes.  This is used to skip payloads when various errors occur and helps
+// prevent rogue nodes from causing massive memory allocation through forging
+// header length.
+func discardInput(r io.Reader, n uint32) {
+	maxSize := uint32(10 * 1024) // 10k at a time
+	numReads := n / maxSize
+	bytesRemaining := n % maxSize
+	if n > 0 {
+		buf := make([]byte, maxSize)
+		for i := uint32(0); i < numReads; i++ {
+			io.ReadFull(r, buf)
+		}
+	}
+	if bytesRemaining > 0 {
+		buf := make([]byte, bytesRemaining)
+		io.ReadFull(r, buf)
+	}
+}
+
+// checksum returns the first four bytes of the double sha256 of payload.  The
+// envelope always uses double sha256 regardless of the hash algorithm of the
+// chain so messages can be checked before the network is known.
+func checksum(payload []byte) [4]byte {
+	var sum [4]byte
+	copy(sum[:], common.DoubleHashB(payload)[0:4])
+	return sum
+}
+
+// WriteMessageN writes a message to w including the necessary header
+// information and returns the number of bytes written.  This function is the
+// same as WriteMessage except it also returns the number of bytes written.
+func WriteMessageN(w io.Writer, msg Message, pver uint32, magic uint32) (int, error) {
+	totalBytes := 0
+
+	// Enforce max command size.
+	var command [CommandSize]byte
+	cmd := msg.Command()
+	if len(cmd) > CommandSize {
+		str := fmt.Sprintf("command [%s] is too long [max %v]",
+			cmd, CommandSize)
+		return totalBytes, messageError("WriteMessage", str)
+	}
+	copy(command[:], []byte(cmd))
+
+	// Encode the message payload.
+	var bw bytes.Buffer
+	err := msg.Encode(&bw, pver)
+	if err != nil {
+		return totalBytes, err
+	}
+	payload := bw.Bytes()
+	lenp := len(payload)
+
+	// Enforce maximum overall message payload.
+	if lenp > MaxMessagePayload {
+		str := fmt.Sprintf("message payload is too large - encoded "+
+			"%d bytes, but maximum message payload is %d bytes",
+			lenp, MaxMessagePayload)
+		return totalBytes, messageError("WriteMessage", str)
+	}
+
+	// Enforce maximum message payload based on the message type.
+	mpl := msg.MaxPayloadLength(pver)
+	if uint32(lenp) > mpl {
+		str := fmt.Sprintf("message payload is too large - encoded "+
+			"%d bytes, but maximum message payload size for "+
+			"messages of type [%s] is %d.", lenp, cmd, mpl)
+		return totalBytes, messageError("WriteMessage", str)
+	}
+
+	// Create header for the message.
+	hdr := messageHeader{}
+	hdr.magic = magic
+	hdr.command = cmd
+	hdr.length = uint32(lenp)
+	hdr.checksum = checksum(payload)
+
+	// Encode the header for the message.  This is done to a buffer
+	// rather than directly to the writer since writeElements doesn't
+	// return the number of bytes written.
+	hw := bytes.NewBuffer(make([]byte, 0, MessageHeaderSize+lenp))
+	writeElements(hw, hdr.magic, command, hdr.length, hdr.checksum)
+
+	// Write the header and payload in a single write so the message is
+	// never interleaved with another one written to the same connection.
+	hw.Write(payload)
+	n, err := w.Write(hw.Bytes())
+	totalBytes += n
+	return totalBytes, err
+}
+
+// WriteMessage writes a message to w including the necessary header
+// information.  This function is the same as WriteMessageN except it doesn't
+// return the number of bytes written.
+func WriteMessage(w io.Writer, msg Message, pver uint32, magic uint32) error {
+	_, err := WriteMessageN(w, msg, pver, magic)
+	return err
+}
+
+// ReadMessageN reads, validates, and parses the next message from r for the
+// provided protocol version and network magic.  It returns the number of
+// bytes read in addition to the parsed Message and raw bytes which comprise
+// the message.  This function is the same as ReadMessage except it also
+// returns the number of bytes read.
+func ReadMessageN(r io.Reader, pver uint32, magic uint32) (int, Message, []byte, error) {
+	totalBytes := 0
+	n, hdr, err := readMessageHeader(r)
+	totalBytes += n
+	if err != nil {
+		return totalBytes, nil, nil, err
+	}
+
+	// Enforce maximum message payload.
+	if hdr.length > MaxMessagePayload {
+		str := fmt.Sprintf("message payload is too large - header "+
+			"indicates %d bytes, but max message payload is %d "+
+			"bytes.", hdr.length, MaxMessagePayload)
+		return totalBytes, nil, nil, messageError("ReadMessage", str)
+	}
+
+	// Check for messages from the wrong network.
+	if hdr.magic != magic {
+		discardInput(r, hdr.length)
+		str := fmt.Sprintf("message from other network [0x%08x]", hdr.magic)
+		return totalBytes, nil, nil, messageError("ReadMessage", str)
+	}
+
+	// Check for malformed commands.
+	command := hdr.command
+	if !utf8.ValidString(command) {
+		discardInput(r, hdr.length)
+		str := fmt.Sprintf("invalid command %v", []byte(command))
+		return totalBytes, nil, nil, messageError("ReadMessage", str)
+	}
+
+	// Create struct of appropriate message type based on the command.
+	msg, err := makeEmptyMessage(command)
+	if err != nil {
+		discardInput(r, hdr.length)
+		return totalBytes, nil, nil, messageError("ReadMessage",
+			err.Error())
+	}
+
+	// Check for maximum length based on the message type as a malicious
+	// client could otherwise create a well-formed header and set the
+	// length to max numbers in order to exhaust the machine's memory.
+	mpl := msg.MaxPayloadLength(pver)
+	if hdr.length > mpl {
+		discardInput(r, hdr.length)
+		str := fmt.Sprintf("payload exceeds max length - header "+
+			"indicates %v bytes, but max payload size for "+
+			"messages of type [%v] is %v.", hdr.length, command, mpl)
+		return totalBytes, nil, nil, messageError("ReadMessage", str)
+	}
+
+	// Read payload.
+	payload := make([]byte, hdr.length)
+	n, err = io.ReadFull(r, payload)
+	totalBytes += n
+	if err != nil {
+		return totalBytes, nil, nil, err
+	}
+
+	// Test checksum.
+	if sum := checksum(payload); sum != hdr.checksum {
+		str := fmt.Sprintf("payload checksum failed - header "+
+			"indicates %v, but actual checksum is %v.",
+			hdr.checksum, sum)
+		return totalBytes, nil, nil, messageError("ReadMessage", str)
+	}
+
+	// Unmarshal message.  The payload must be consumed exactly, trailing
+	// bytes would otherwise be a second encoding of the same message.
+	pr := bytes.NewBuffer(payload)
+	err = msg.Decode(pr, pver)
+	if err != nil {
+		return totalBytes, nil, nil, err
+	}
+	if pr.Len() != 0 {
+		str := fmt.Sprintf("message [%s] has %d trailing bytes",
+			command, pr.Len())
+		return totalBytes, nil, nil, messageError("ReadMessage", str)
+	}
+
+	return totalBytes, msg, payload, nil
+}
+
+// ReadMessage reads, validates, and parses the next message from r for the
+// provided protocol version and network magic.  It returns the parsed
+// Message and raw bytes which comprise the message.  This function only
+// differs from ReadMessageN in that it doesn't return the number of bytes
+// read.
+func ReadMessage(r io.Reader, pver uint32, magic uint32) (Message, []byte, error) {
+	_, msg, buf, err := ReadMessageN(r, pver, magic)
+	return msg, buf, err
+}
@@ -0,0 +1,254 @@
+package wire
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blockchainservice/common"
+)
+
+// testMagic is the network magic the test messages are framed with.
+const testMagic = 0xd9b4bef9
+
+// makeFrame returns a message framed with the given header fields.
+func makeFrame(magic uint32, command string, length uint32, sum [4]byte, payload []byte) []byte {
+	var buf bytes.Buffer
+	var cmd [CommandSize]byte
+	copy(cmd[:], command)
+	writeElements(&buf, magic, cmd, length, sum)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// validFrame returns payload framed as a command message with a correct
+// header.
+func validFrame(command string, payload []byte) []byte {
+	return makeFrame(testMagic, command, uint32(len(payload)),
+		checksum(payload), payload)
+}
+
+// testBlock returns a block holding a single transaction.
+func testBlock() *common.Block {
+	block := common.NewBlock(common.NewBlockHeader(1, &common.Hash{1},
+		&common.Hash{2}, 7, 0x207fffff, 42))
+	block.Header.Timestamp = time.Unix(1600000000, 0)
+	block.AddTransaction(&common.Tx{
+		Version: 1,
+		TxIn: []*common.TxIn{{
+			PreviousOutPoint: common.OutPoint{Hash: common.Hash{3}},
+			SignatureScript:  []byte{1, 2, 3},
+			Sequence:         common.MaxTxInSequenceNum,
+		}},
+		TxOut: []*common.TxOut{{Value: 5, PkScript: []byte{4}}},
+	})
+	return block
+}
+
+// TestMessageRoundTrip ensures every message is written and read back to an
+// identical message.
+func TestMessageRoundTrip(t *testing.T) {
+	block := testBlock()
+	hash := block.BlockHash()
+	txHash := block.Transactions[0].TxHash()
+
+	inv := NewMsgInv()
+	inv.AddInvVect(NewInvVect(InvTypeBlock, &hash))
+	inv.AddInvVect(NewInvVect(InvTypeTx, &txHash))
+	getData := NewMsgGetData()
+	getData.AddInvVect(NewInvVect(InvTypeTx, &hash))
+	headers := NewMsgHeaders()
+	headers.AddBlockHeader(&block.Header)
+	addr := NewMsgAddr()
+	addr.AddAddress(NewNetAddressTimestamp(time.Unix(1600000000, 0),
+		SFNodeNetwork, net.ParseIP("10.0.0.1"), 9090))
+	addr.AddAddress(NewNetAddressTimestamp(time.Unix(1600000001, 0), 0,
+		net.ParseIP("2001:db8::1"), 9091))
+	version := NewMsgVersion(1, &hash, "node", 99, 7)
+	version.ListenAddr = "10.0.0.1:9090"
+	version.AddService(SFNodeNetwork)
+	reject := NewMsgReject(CmdBlock, RejectInvalid, "bad block")
+	reject.Hash = hash
+
+	tests := []Message{
+		version,
+		NewMsgVerAck(),
+		NewMsgPing(1),
+		NewMsgPong(2),
+		inv,
+		getData,
+		NewMsgBlock(block),
+		NewMsgTx(block.Transactions[0]),
+		headers,
+		addr,
+		reject,
+	}
+
+	for _, msg := range tests {
+		var buf bytes.Buffer
+		n, err := WriteMessageN(&buf, msg, ProtocolVersion, testMagic)
+		if err != nil {
+			t.Errorf("%s: WriteMessageN: %v", msg.Command(), err)
+			continue
+		}
+		if n != buf.Len() {
+			t.Errorf("%s: %d bytes written, reported %d",
+				msg.Command(), buf.Len(), n)
+		}
+		frame := append([]byte{}, buf.Bytes()...)
+
+		n, got, payload, err := ReadMessageN(&buf, ProtocolVersion,
+			testMagic)
+		if err != nil {
+			t.Errorf("%s: ReadMessageN: %v", msg.Command(), err)
+			continue
+		}
+		if n != len(frame) {
+			t.Errorf("%s: %d bytes read, want %d", msg.Command(), n,
+				len(frame))
+		}
+		if !bytes.Equal(payload, frame[MessageHeaderSize:]) {
+			t.Errorf("%s: payload %x, want %x", msg.Command(), payload,
+				frame[MessageHeaderSize:])
+		}
+		if reflect.TypeOf(got) != reflect.TypeOf(msg) {
+			t.Errorf("%s: read a %T", msg.Command(), got)
+			continue
+		}
+
+		// The message read encodes to the same payload.
+		var encoded bytes.Buffer
+		if err := got.Encode(&encoded, ProtocolVersion); err != nil {
+			t.Errorf("%s: Encode: %v", msg.Command(), err)
+		} else if !bytes.Equal(encoded.Bytes(), payload) {
+			t.Errorf("%s: read message encodes to %x, want %x",
+				msg.Command(), encoded.Bytes(), payload)
+		}
+	}
+}
+
+// TestReadMessageErrors ensures malformed frames are rejected, the framing
+// errors with a MessageError, and that the stream stays usable after the
+// frames whose payload was read or discarded.
+func TestReadMessageErrors(t *testing.T) {
+	ping := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	badSum := checksum(ping)
+	badSum[0] ^= 0xff
+
+	tests := []struct {
+		name      string
+		frame     []byte
+		msgError  bool // the error is a MessageError
+		discarded bool // the payload is skipped and the stream usable
+	}{
+		{"wrong network", makeFrame(testMagic+1, CmdPing, 8,
+			checksum(ping), ping), true, true},
+		{"unknown command", validFrame("bogus", ping), true, true},
+		{"invalid command",
+			validFrame(string([]byte{0xff, 0xfe}), ping), true, true},
+		{"checksum mismatch",
+			makeFrame(testMagic, CmdPing, 8, badSum, ping), true, true},
+		{"trailing bytes", validFrame(CmdPing, append(ping, 0)), true,
+			true},
+		{"payload over the message limit",
+			validFrame(CmdPing, make([]byte, 9)), true, true},
+		{"payload over the maximum",
+			makeFrame(testMagic, CmdBlock, MaxMessagePayload+1,
+				[4]byte{}, nil), true, false},
+		{"too many inventory vectors",
+			validFrame(CmdInv, []byte{0xfd, 0x51, 0xc3}), true, true},
+		{"too many addresses",
+			validFrame(CmdAddr, []byte{0xfd, 0xe9, 0x03}), true, true},
+		{"too many headers",
+			validFrame(CmdHeaders, []byte{0xfd, 0xd1, 0x07}), true, true},
+		{"user agent too long",
+			validFrame(CmdVersion, func() []byte {
+				msg := NewMsgVersion(1, &common.Hash{}, "node", 0, 0)
+				msg.UserAgent = ""
+				var buf bytes.Buffer
+				msg.Encode(&buf, ProtocolVersion)
+				b := buf.Bytes()
+				// Replace the empty user agent by a longer one.
+				b = append(b[:len(b)-9], 0xfd, 0x01, 0x01)
+				b = append(b, strings.Repeat("a", 257)...)
+				return append(b, make([]byte, 8)...)
+			}()), false, true},
+	}
+
+	next := validFrame(CmdVerAck, nil)
+	for _, test := range tests {
+		r := bytes.NewReader(append(append([]byte{}, test.frame...),
+			next...))
+		msg, _, err := ReadMessage(r, ProtocolVersion, testMagic)
+		if err == nil {
+			t.Errorf("%s: read %v", test.name, msg)
+			continue
+		}
+		if _, ok := err.(*MessageError); ok != test.msgError {
+			t.Errorf("%s: got a %T error %v", test.name, err, err)
+		}
+		if !test.discarded {
+			continue
+		}
+		msg, _, err = ReadMessage(r, ProtocolVersion, testMagic)
+		if err != nil {
+			t.Errorf("%s: next message: %v", test.name, err)
+		} else if _, ok := msg.(*MsgVerAck); !ok {
+			t.Errorf("%s: next message is a %T", test.name, msg)
+		}
+	}
+
+	// A frame cut short is an io error.
+	frame := validFrame(CmdPing, ping)
+	_, _, err := ReadMessage(bytes.NewReader(frame[:len(frame)-1]),
+		ProtocolVersion, testMagic)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("short payload: got error %v, want %v", err,
+			io.ErrUnexpectedEOF)
+	}
+}
+
+// TestWriteMessageErrors ensures messages over their limits are not written.
+func TestWriteMessageErrors(t *testing.T) {
+	inv := NewMsgInv()
+	inv.InvList = make([]*InvVect, MaxInvPerMsg+1)
+	for i := range inv.InvList {
+		inv.InvList[i] = &InvVect{Type: InvTypeTx}
+	}
+	version := NewMsgVersion(1, &common.Hash{}, "node", 0, 0)
+	version.UserAgent = strings.Repeat("a", MaxUserAgentLen+1)
+	addr := NewMsgAddr()
+	addr.AddrList = make([]*NetAddress, MaxAddrPerMsg+1)
+
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"too many inventory vectors", inv},
+		{"user agent too long", version},
+		{"too many addresses", addr},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := WriteMessage(&buf, test.msg, ProtocolVersion, testMagic)
+		if _, ok := err.(*MessageError); !ok {
+			t.Errorf("%s: got error %v, want a MessageError", test.name,
+				err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes written", test.name, buf.Len())
+		}
+	}
+
+	// AddInvVect and AddAddress refuse to exceed the limits.
+	if err := inv.AddInvVect(&InvVect{}); err == nil {
+		t.Error("AddInvVect exceeded the limit")
+	}
+	if err := addr.AddAddress(&NetAddress{}); err == nil {
+		t.Error("AddAddress exceeded the limit")
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"io"
+
+	"github.com/blockchainservice/common"
+)
+
+// MsgBlock implements the Message interface and represents a block message.
+// It is used to deliver block and transaction information in response to a
+// getdata message (MsgGetData) for a given block hash.
+type MsgBlock struct {
+	common.Block
+}
+
+// Decode decodes r using the protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgBlock) Decode(r io.Reader, pver uint32) error {
+	return msg.Block.Deserialize(r)
+}
+
+// Encode encodes the receiver to w using the protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgBlock) Encode(w io.Writer, pver uint32) error {
+	return msg.Block.Serialize(w)
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgBlock) Command() string {
+	return CmdBlock
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgBlock) MaxPayloadLength(pver uint32) uint32 {
+	return common.MaxBlockPayload
+}
+
+// NewMsgBlock returns a new block message that conforms to the Message
+// interface and carries the passed block.
+func NewMsgBlock(block *common.Block) *MsgBlock {
+	return &MsgBlock{Block: *block}
+}
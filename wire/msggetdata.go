@@ -0,0 +1,72 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/blockchainservice/common"
+)
+
+// MsgGetData implements the Message interface and represents a getdata
+// message.  It is used to request data such as blocks and transactions from
+// another peer, usually in response to an inv message (MsgInv).
+//
+// Use the AddInvVect function to build up the list of inventory vectors when
+// sending a getdata message to another peer.
+type MsgGetData struct {
+	InvList []*InvVect
+}
+
+// AddInvVect adds an inventory vector to the message.
+func (msg *MsgGetData) AddInvVect(iv *InvVect) error {
+	if len(msg.InvList)+1 > MaxInvPerMsg {
+		str := fmt.Sprintf("too many invvect in message [max %v]",
+			MaxInvPerMsg)
+		return messageError("MsgGetData.AddInvVect", str)
+	}
+
+	msg.InvList = append(msg.InvList, iv)
+	return nil
+}
+
+// Decode decodes r using the protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgGetData) Decode(r io.Reader, pver uint32) error {
+	invList, err := readInvList(r, pver, "MsgGetData.Decode")
+	if err != nil {
+		return err
+	}
+	msg.InvList = invList
+	return nil
+}
+
+// Encode encodes the receiver to w using the protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgGetData) Encode(w io.Writer, pver uint32) error {
+	return writeInvList(w, pver, "MsgGetData.Encode", msg.InvList)
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgGetData) Command() string {
+	return CmdGetData
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgGetData) MaxPayloadLength(pver uint32) uint32 {
+	// Num inventory vectors (varInt) + max allowed inventory vectors.
+	return uint32(common.MaxVarIntPayload + (MaxInvPerMsg * maxInvVectPayload))
+}
+
+// NewMsgGetData returns a new getdata message that conforms to the Message
+// interface.  See MsgGetData for details.
+func NewMsgGetData() *MsgGetData {
+	return &MsgGetData{
+		InvList: make([]*InvVect, 0, defaultInvListAlloc),
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/blockchainservice/common"
+)
+
+// MaxBlockHeadersPerMsg is the maximum number of block headers that can be in
+// a single headers message.
+const MaxBlockHeadersPerMsg = 2000
+
+// MsgHeaders implements the Message interface and represents a headers
+// message.  It is used to deliver block header information to a peer that is
+// syncing the chain.
+type MsgHeaders struct {
+	Headers []*common.BlockHeader
+}
+
+// AddBlockHeader adds a new block header to the message.
+func (msg *MsgHeaders) AddBlockHeader(bh *common.BlockHeader) error {
+	if len(msg.Headers)+1 > MaxBlockHeadersPerMsg {
+		str := fmt.Sprintf("too many block headers in message [max %v]",
+			MaxBlockHeadersPerMsg)
+		return messageError("MsgHeaders.AddBlockHeader", str)
+	}
+
+	msg.Headers = append(msg.Headers, bh)
+	return nil
+}
+
+// Decode decodes r using the protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgHeaders) Decode(r io.Reader, pver uint32) error {
+	count, err := common.ReadVarInt(r)
+	if err != nil {
+		return err
+	}
+
+	// Limit to max block headers per message.
+	if count > MaxBlockHeadersPerMsg {
+		str := fmt.Sprintf("too many block headers for message "+
+			"[count %v, max %v]", count, MaxBlockHeadersPerMsg)
+		return messageError("MsgHeaders.Decode", str)
+	}
+
+	// Create a contiguous slice of headers to deserialize into in order to
+	// reduce the number of allocations.
+	headers := make([]common.BlockHeader, count)
+	msg.Headers = make([]*common.BlockHeader, 0, count)
+	for i := uint64(0); i < count; i++ {
+		bh := &headers[i]
+		err := bh.Deserialize(r)
+		if err != nil {
+			return err
+		}
+		msg.AddBlockHeader(bh)
+	}
+
+	return nil
+}
+
+// Encode encodes the receiver to w using the protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgHeaders) Encode(w io.Writer, pver uint32) error {
+	// Limit to max block headers per message.
+	count := len(msg.Headers)
+	if count > MaxBlockHeadersPerMsg {
+		str := fmt.Sprintf("too many block headers for message "+
+			"[count %v, max %v]", count, MaxBlockHeadersPerMsg)
+		return messageError("MsgHeaders.Encode", str)
+	}
+
+	err := common.WriteVarInt(w, uint64(count))
+	if err != nil {
+		return err
+	}
+
+	for _, bh := range msg.Headers {
+		err := bh.Serialize(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgHeaders) Command() string {
+	return CmdHeaders
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgHeaders) MaxPayloadLength(pver uint32) uint32 {
+	// Num headers (varInt) + max allowed headers.
+	return common.MaxVarIntPayload + (MaxBlockHeadersPerMsg *
+		common.MaxBlockHeaderPayload)
+}
+
+// NewMsgHeaders returns a new headers message that conforms to the Message
+// interface.  See MsgHeaders for details.
+func NewMsgHeaders() *MsgHeaders {
+	return &MsgHeaders{
+		Headers: make([]*common.BlockHeader, 0, MaxBlockHeadersPerMsg),
+	}
+}
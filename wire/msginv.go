@@ -0,0 +1,73 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/blockchainservice/common"
+)
+
+// MsgInv implements the Message interface and represents an inv message.
+// It is used to advertise a peer's known data such as blocks and
+// transactions through inventory vectors.  The peer receiving it requests the
+// data it does not have with a getdata message (MsgGetData).
+//
+// Use the AddInvVect function to build up the list of inventory vectors when
+// sending a inv message to another peer.
+type MsgInv struct {
+	InvList []*InvVect
+}
+
+// AddInvVect adds an inventory vector to the message.
+func (msg *MsgInv) AddInvVect(iv *InvVect) error {
+	if len(msg.InvList)+1 > MaxInvPerMsg {
+		str := fmt.Sprintf("too many invvect in message [max %v]",
+			MaxInvPerMsg)
+		return messageError("MsgInv.AddInvVect", str)
+	}
+
+	msg.InvList = append(msg.InvList, iv)
+	return nil
+}
+
+// Decode decodes r using the protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgInv) Decode(r io.Reader, pver uint32) error {
+	invList, err := readInvList(r, pver, "MsgInv.Decode")
+	if err != nil {
+		return err
+	}
+	msg.InvList = invList
+	return nil
+}
+
+// Encode encodes the receiver to w using the protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgInv) Encode(w io.Writer, pver uint32) error {
+	return writeInvList(w, pver, "MsgInv.Encode", msg.InvList)
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgInv) Command() string {
+	return CmdInv
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgInv) MaxPayloadLength(pver uint32) uint32 {
+	// Num inventory vectors (varInt) + max allowed inventory vectors.
+	return uint32(common.MaxVarIntPayload + (MaxInvPerMsg * maxInvVectPayload))
+}
+
+// NewMsgInv returns a new inv message that conforms to the Message
+// interface.  See MsgInv for details.
+func NewMsgInv() *MsgInv {
+	return &MsgInv{
+		InvList: make([]*InvVect, 0, defaultInvListAlloc),
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"io"
+)
+
+// MsgPing implements the Message interface and represents a ping message.
+// It is sent periodically to check that the remote peer is still alive and
+// to measure the round trip time.  The nonce is echoed back in the pong
+// (MsgPong) answering it.
+type MsgPing struct {
+	// Unique value associated with message that is used to identify
+	// specific ping message.
+	Nonce uint64
+}
+
+// Decode decodes r using the protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgPing) Decode(r io.Reader, pver uint32) error {
+	return readElement(r, &msg.Nonce)
+}
+
+// Encode encodes the receiver to w using the protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgPing) Encode(w io.Writer, pver uint32) error {
+	return writeElement(w, msg.Nonce)
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgPing) Command() string {
+	return CmdPing
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgPing) MaxPayloadLength(pver uint32) uint32 {
+	// Nonce 8 bytes.
+	return 8
+}
+
+// NewMsgPing returns a new ping message that conforms to the Message
+// interface.  See MsgPing for details.
+func NewMsgPing(nonce uint64) *MsgPing {
+	return &MsgPing{
+		Nonce: nonce,
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"io"
+
+	"github.com/blockchainservice/common"
+)
+
+// MsgTx implements the Message interface and represents a tx message.  It is
+// used to deliver transaction information in response to a getdata message
+// (MsgGetData) for a given transaction hash.
+type MsgTx struct {
+	common.Tx
+}
+
+// Decode decodes r using the protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgTx) Decode(r io.Reader, pver uint32) error {
+	return msg.Tx.Deserialize(r)
+}
+
+// Encode encodes the receiver to w using the protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgTx) Encode(w io.Writer, pver uint32) error {
+	return msg.Tx.Serialize(w)
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgTx) Command() string {
+	return CmdTx
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgTx) MaxPayloadLength(pver uint32) uint32 {
+	// A transaction can be as large as the block carrying it.
+	return common.MaxBlockPayload
+}
+
+// NewMsgTx returns a new tx message that conforms to the Message interface
+// and carries the passed transaction.
+func NewMsgTx(tx *common.Tx) *MsgTx {
+	return &MsgTx{Tx: *tx}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/blockchainservice/common"
+)
+
+const (
+	// MaxUserAgentLen is the maximum allowed length for the user agent
+	// field in a version message (MsgVersion).
+	MaxUserAgentLen = 256
+
+	// MaxNodeIDLen is the maximum allowed length for the node ID field in
+	// a version message.
+	MaxNodeIDLen = 64
+
+	// MaxListenAddrLen is the maximum allowed length for the listen
+	// address field in a version message.
+	MaxListenAddrLen = 256
+)
+
+// DefaultUserAgent is the user agent advertised by version messages created
+// with NewMsgVersion.
+const DefaultUserAgent = "/blockchainservice:0.1.0/"
+
+// MsgVersion implements the Message interface and represents a version
+// message.  It is used for a peer to advertise itself as soon as an outbound
+// connection is made.  The remote peer then uses this information along with
+// its own to negotiate.  The remote peer must then respond with a version
+// message of its own containing the negotiated values followed by a verack
+// message (MsgVerAck).  This exchange must take place before any further
+// communication is allowed to proceed.
+type MsgVersion struct {
+	// Version of the protocol the node is using.
+	ProtocolVersion uint32
+
+	// Bitfield which identifies the enabled services.
+	Services ServiceFlag
+
+	// Time the message was generated.  This is encoded as an int64 on the
+	// wire.
+	Timestamp time.Time
+
+	// ChainID and GenesisHash identify the network the node is on.
+	ChainID     uint32
+	GenesisHash common.Hash
+
+	// NodeID is the identity of the node derived from its node key.
+	NodeID string
+
+	// ListenAddr is the host:port the node accepts connections on, empty
+	// when it does not accept inbound connections.
+	ListenAddr string
+
+	// Unique value associated with message that is used to detect self
+	// connections.
+	Nonce uint64
+
+	// The user agent that generated message.  This is encoded as a varString
+	// on the wire.
+	UserAgent string
+
+	// Height of the best block of the chain known to the generator of the
+	// version message.
+	BestHeight uint64
+}
+
+// HasService returns whether the specified service is supported by the peer
+// that generated the message.
+func (msg *MsgVersion) HasService(service ServiceFlag) bool {
+	return msg.Services&service == service
+}
+
+// AddService adds service as a supported service by the peer generating the
+// message.
+func (msg *MsgVersion) AddService(service ServiceFlag) {
+	msg.Services |= service
+}
+
+// Decode decodes r using the protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgVersion) Decode(r io.Reader, pver uint32) error {
+	err := readElements(r, &msg.ProtocolVersion, &msg.Services,
+		&msg.Timestamp, &msg.ChainID, &msg.GenesisHash)
+	if err != nil {
+		return err
+	}
+
+	msg.NodeID, err = ReadVarString(r, MaxNodeIDLen, "node id")
+	if err != nil {
+		return err
+	}
+
+	msg.ListenAddr, err = ReadVarString(r, MaxListenAddrLen, "listen address")
+	if err != nil {
+		return err
+	}
+
+	err = readElement(r, &msg.Nonce)
+	if err != nil {
+		return err
+	}
+
+	msg.UserAgent, err = ReadVarString(r, MaxUserAgentLen, "user agent")
+	if err != nil {
+		return err
+	}
+
+	return readElement(r, &msg.BestHeight)
+}
+
+// Encode encodes the receiver to w using the protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgVersion) Encode(w io.Writer, pver uint32) error {
+	err := validateVersionStrings(msg)
+	if err != nil {
+		return err
+	}
+
+	err = writeElements(w, msg.ProtocolVersion, msg.Services,
+		msg.Timestamp, msg.ChainID, &msg.GenesisHash)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarString(w, msg.NodeID)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarString(w, msg.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	err = writeElement(w, msg.Nonce)
+	if err != nil {
+		return err
+	}
+
+	err = WriteVarString(w, msg.UserAgent)
+	if err != nil {
+		return err
+	}
+
+	return writeElement(w, msg.BestHeight)
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgVersion) Command() string {
+	return CmdVersion
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgVersion) MaxPayloadLength(pver uint32) uint32 {
+	// Protocol version 4 bytes + services 8 bytes + timestamp 8 bytes +
+	// chain id 4 bytes + genesis hash 32 bytes + nonce 8 bytes +
+	// best height 8 bytes + three strings with their length prefix.
+	return 72 + 3*common.MaxVarIntPayload + MaxNodeIDLen +
+		MaxListenAddrLen + MaxUserAgentLen
+}
+
+// NewMsgVersion returns a new version message that conforms to the Message
+// interface using the passed parameters and defaults for the remaining
+// fields.
+func NewMsgVersion(chainID uint32, genesisHash *common.Hash, nodeID string,
+	nonce uint64, bestHeight uint64) *MsgVersion {
+
+	// Limit the timestamp to one second precision since the protocol
+	// doesn't support better.
+	return &MsgVersion{
+		ProtocolVersion: ProtocolVersion,
+		Services:        0,
+		Timestamp:       time.Unix(time.Now().Unix(), 0),
+		ChainID:         chainID,
+		GenesisHash:     *genesisHash,
+		NodeID:          nodeID,
+		Nonce:           nonce,
+		UserAgent:       DefaultUserAgent,
+		BestHeight:      bestHeight,
+	}
+}
+
+// validateVersionStrings checks the variable length fields of the message
+// against their maximum lengths.
+func validateVersionStrings(msg *MsgVersion) error {
+	if len(msg.NodeID) > MaxNodeIDLen {
+		str := fmt.Sprintf("node id too long [len %v, max %v]",
+			len(msg.NodeID), MaxNodeIDLen)
+		return messageError("MsgVersion", str)
+	}
+	if len(msg.ListenAddr) > MaxListenAddrLen {
+		str := fmt.Sprintf("listen address too long [len %v, max %v]",
+			len(msg.ListenAddr), MaxListenAddrLen)
+		return messageError("MsgVersion", str)
+	}
+	if len(msg.UserAgent) > MaxUserAgentLen {
+		str := fmt.Sprintf("user agent too long [len %v, max %v]",
+			len(msg.UserAgent), MaxUserAgentLen)
+		return messageError("MsgVersion", str)
+	}
+	return nil
+}
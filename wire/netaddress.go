@@ -0,0 +1,122 @@
+// Copyright (c) 2013-2015 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+package wire
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxNetAddressPayload returns the max payload size for a network address.
+// Timestamp 8 bytes + services 8 bytes + ip 16 bytes + port 2 bytes.
+const maxNetAddressPayload = 34
+
+// NetAddress defines information about a peer on the network including the
+// time it was last seen, the services it supports, its IP address, and port.
+type NetAddress struct {
+	// Last time the address was seen.
+	Timestamp time.Time
+
+	// Bitfield which identifies the services supported by the address.
+	Services ServiceFlag
+
+	// IP address of the peer.
+	IP net.IP
+
+	// Port the peer is using.  This is encoded in big endian on the wire
+	// which differs from most everything else.
+	Port uint16
+}
+
+// HasService returns whether the specified service is supported by the
+// address.
+func (na *NetAddress) HasService(service ServiceFlag) bool {
+	return na.Services&service == service
+}
+
+// AddService adds service as a supported service by the peer generating the
+// message.
+func (na *NetAddress) AddService(service ServiceFlag) {
+	na.Services |= service
+}
+
+// String returns the address in host:port form.
+func (na *NetAddress) String() string {
+	return net.JoinHostPort(na.IP.String(), strconv.FormatUint(uint64(na.Port), 10))
+}
+
+// NewNetAddressIPPort returns a new NetAddress using the provided IP, port, and
+// supported services with defaults for the remaining fields.
+func NewNetAddressIPPort(ip net.IP, port uint16, services ServiceFlag) *NetAddress {
+	return NewNetAddressTimestamp(time.Now(), services, ip, port)
+}
+
+// NewNetAddressTimestamp returns a new NetAddress using the provided
+// timestamp, IP, port, and supported services.  The timestamp is rounded to
+// single second precision.
+func NewNetAddressTimestamp(
+	timestamp time.Time, services ServiceFlag, ip net.IP, port uint16) *NetAddress {
+	// Limit the timestamp to one second precision since the protocol
+	// doesn't support better.
+	na := NetAddress{
+		Timestamp: time.Unix(timestamp.Unix(), 0),
+		Services:  services,
+		IP:        ip,
+		Port:      port,
+	}
+	return &na
+}
+
+// NewNetAddress returns a new NetAddress using the provided TCP address and
+// supported services with defaults for the remaining fields.
+func NewNetAddress(addr *net.TCPAddr, services ServiceFlag) *NetAddress {
+	return NewNetAddressIPPort(addr.IP, uint16(addr.Port), services)
+}
+
+// readNetAddress reads an encoded NetAddress from r depending on the protocol
+// version.
+func readNetAddress(r io.Reader, pver uint32, na *NetAddress) error {
+	var ip [16]byte
+
+	err := readElements(r, &na.Timestamp, &na.Services, &ip)
+	if err != nil {
+		return err
+	}
+	// Sigh.  Protocol mixes little and big endian.
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return err
+	}
+
+	*na = NetAddress{
+		Timestamp: na.Timestamp,
+		Services:  na.Services,
+		IP:        net.IP(ip[:]),
+		Port:      bigEndian.Uint16(port[:]),
+	}
+	return nil
+}
+
+// writeNetAddress serializes a NetAddress to w depending on the protocol
+// version.
+func writeNetAddress(w io.Writer, pver uint32, na *NetAddress) error {
+	// Ensure to always write 16 bytes even if the ip is nil.
+	var ip [16]byte
+	if na.IP != nil {
+		copy(ip[:], na.IP.To16())
+	}
+	err := writeElements(w, na.Timestamp, na.Services, ip)
+	if err != nil {
+		return err
+	}
+
+	// Sigh.  Protocol mixes little and big endian.
+	var port [2]byte
+	bigEndian.PutUint16(port[:], na.Port)
+	_, err = w.Write(port[:])
+	return err
+}
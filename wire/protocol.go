@@ -0,0 +1,109 @@
+// Copyright (c) 2013-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE.btcd file.
+
+// Package wire implements the peer-to-peer protocol of the network.
+//
+// Every message travels in an envelope made of the network magic, the command
+// name zero padded to 12 bytes, the payload length and the first four bytes
+// of the double sha256 of the payload, followed by the payload itself.
+// ReadMessage and WriteMessage frame messages over any io.Reader or io.Writer,
+// typically a net.Conn, and reject messages for another network, with a bad
+// checksum or larger than the limit of their type.
+package wire
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the latest protocol version this package supports.
+	ProtocolVersion uint32 = 1
+
+	// MinProtocolVersion is the oldest protocol version a peer may run to
+	// be accepted.
+	MinProtocolVersion uint32 = 1
+)
+
+// ServiceFlag identifies services supported by a peer.
+type ServiceFlag uint64
+
+const (
+	// SFNodeNetwork is a flag used to indicate a peer is a full node that
+	// can serve blocks.
+	SFNodeNetwork ServiceFlag = 1 << iota
+
+	// SFNodeValidator is a flag used to indicate a peer takes part in the
+	// consensus rounds of the chain.
+	SFNodeValidator
+
+	// SFNodeRelay is a flag used to indicate a peer relays transactions.
+	SFNodeRelay
+)
+
+// Map of service flags back to their constant names for pretty printing.
+var sfStrings = map[ServiceFlag]string{
+	SFNodeNetwork:   "SFNodeNetwork",
+	SFNodeValidator: "SFNodeValidator",
+	SFNodeRelay:     "SFNodeRelay",
+}
+
+// orderedSFStrings is an ordered list of service flags from highest to
+// lowest.
+var orderedSFStrings = []ServiceFlag{
+	SFNodeNetwork,
+	SFNodeValidator,
+	SFNodeRelay,
+}
+
+// String returns the ServiceFlag in human-readable form.
+func (f ServiceFlag) String() string {
+	// No flags are set.
+	if f == 0 {
+		return "0x0"
+	}
+
+	// Add individual bit flags.
+	s := ""
+	for _, flag := range orderedSFStrings {
+		if f&flag == flag {
+			s += sfStrings[flag] + "|"
+			f -= flag
+		}
+	}
+
+	// Add any remaining flags which aren't accounted for as hex.
+	s = strings.TrimRight(s, "|")
+	if f != 0 {
+		s += "|0x" + strconv.FormatUint(uint64(f), 16)
+	}
+	s = strings.TrimLeft(s, "|")
+	return s
+}
+
+// MessageError describes an issue with a message.  An example of some
+// potential issues are messages from the wrong network, invalid commands,
+// mismatched checksums, and exceeding max payloads.
+//
+// This provides a mechanism for the caller to type assert the error to
+// differentiate between general io errors such as io.EOF and issues that
+// resulted from malformed messages.
+type MessageError struct {
+	Func        string // Function name
+	Description string // Human readable description of the issue
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e *MessageError) Error() string {
+	if e.Func != "" {
+		return fmt.Sprintf("%v: %v", e.Func, e.Description)
+	}
+	return e.Description
+}
+
+// messageError creates an error for the given function and description.
+func messageError(f string, desc string) *MessageError {
+	return &MessageError{Func: f, Description: desc}
+}